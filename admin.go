@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/subtle"
+	"embed"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed admin
+var adminFiles embed.FS
+
+// Number of receipts the dashboard lists.
+const recentReceiptLimit = 50
+
+// Lower bounds of the point ranges receipts are grouped into on the dashboard.
+var pointBuckets = []int{0, 25, 50, 100, 200}
+
+type pointBucket struct {
+	Label    string `json:"label"`
+	Receipts int    `json:"receipts"`
+}
+
+/*
+Middleware admitting operators who sign in with the admin credentials, or
+who present a bearer token with the admin role when OIDC is configured.
+*/
+func requireAdmin(username string, password string, verifier *oidcVerifier) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if token, found := strings.CutPrefix(context.GetHeader("Authorization"), "Bearer "); found && verifier != nil {
+			claims, err := verifier.verify(token)
+			if err == nil {
+				for _, role := range verifier.roles(claims) {
+					if role == roleAdmin {
+						context.Next()
+						return
+					}
+				}
+			}
+		}
+
+		givenUsername, givenPassword, hasCredentials := context.Request.BasicAuth()
+		if hasCredentials && username != "" &&
+			subtle.ConstantTimeCompare([]byte(givenUsername), []byte(username)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(givenPassword), []byte(password)) == 1 {
+			context.Next()
+			return
+		}
+
+		context.Header("WWW-Authenticate", `Basic realm="admin"`)
+		abortWithMessage(context, http.StatusUnauthorized, "admin.credentials_required")
+	}
+}
+
+// Serves the dashboard page.
+func getAdminDashboard(context *gin.Context) {
+	page, err := adminFiles.ReadFile("admin/index.html")
+	if err != nil {
+		abortWithMessage(context, http.StatusInternalServerError, "admin.dashboard_failed")
+		return
+	}
+	context.Data(http.StatusOK, "text/html; charset=utf-8", page)
+}
+
+// Everything the dashboard displays, in one response.
+func getAdminOverview(context *gin.Context) {
+	recentReceipts, recentError := receipts.RecentReceipts(recentReceiptLimit)
+	distribution, distributionError := pointDistribution()
+	if recentError != nil || distributionError != nil {
+		abortWithMessage(context, http.StatusInternalServerError, "admin.overview_failed")
+		return
+	}
+
+	rules := activeRules()
+	context.IndentedJSON(
+		http.StatusOK,
+		gin.H{
+			"recentReceipts":    recentReceipts,
+			"pointDistribution": distribution,
+			"rules":             rules.Rules,
+			"rulesVersion":      rules.Version,
+		},
+	)
+}
+
+// Counts how many receipts fall into each of the point buckets.
+func pointDistribution() ([]pointBucket, error) {
+	counts, err := receipts.CountByPoints(pointBuckets)
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := make([]pointBucket, len(pointBuckets))
+	for index, lower := range pointBuckets {
+		if index+1 < len(pointBuckets) {
+			buckets[index].Label = strconv.Itoa(lower) + "-" + strconv.Itoa(pointBuckets[index+1]-1)
+		} else {
+			buckets[index].Label = strconv.Itoa(lower) + "+"
+		}
+		buckets[index].Receipts = counts[index]
+	}
+	return buckets, nil
+}
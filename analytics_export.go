@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/parquet-go/parquet-go"
+)
+
+/*
+The anonymized analytics export, which is off without a SaltSecret. Retailer
+names are hashed with a salt derived from the secret for each SaltRotation
+period, so retailers can be grouped within an export but not followed
+across periods, and the salts can't be recomputed without the secret.
+*/
+type AnalyticsExportConfig struct {
+	SaltSecret   string
+	SaltRotation time.Duration
+}
+
+// Receipts the analytics export reads from the store at a time.
+const analyticsPageSize = 500
+
+// Lower bounds in dollars of the buckets receipt totals are exported in.
+var analyticsTotalBuckets = []int{0, 5, 10, 25, 50, 100, 250}
+
+// Audit action for an operator exporting the analytics.
+const auditAnalyticsExported = "analytics.exported"
+
+/*
+A receipt as the analytics export has it, with the same fields in NDJSON
+and Parquet. Nothing in it points at a user: user and receipt ids, API
+keys, coordinates, store ids, tags, extras and item descriptions are left
+out, totals are bucketed and purchases are only timed to the hour.
+*/
+type analyticsRow struct {
+	// the retailer hashed with the period's salt
+	Retailer         string `json:"retailer" parquet:"retailer,dict"`
+	Category         string `json:"category,omitempty" parquet:"category,optional,dict"`
+	State            string `json:"state,omitempty" parquet:"state,optional,dict"`
+	PurchaseDate     string `json:"purchaseDate" parquet:"purchaseDate"`
+	PurchaseHour     int    `json:"purchaseHour" parquet:"purchaseHour"`
+	ProcessedDate    string `json:"processedDate" parquet:"processedDate"`
+	TotalBucket      string `json:"totalBucket" parquet:"totalBucket,dict"`
+	ItemCount        int    `json:"itemCount" parquet:"itemCount"`
+	Points           int    `json:"points" parquet:"points"`
+	Status           string `json:"status,omitempty" parquet:"status,optional,dict"`
+	Channel          string `json:"channel,omitempty" parquet:"channel,optional,dict"`
+	MerchantVerified bool   `json:"merchantVerified" parquet:"merchantVerified"`
+	RulesVersion     string `json:"rulesVersion" parquet:"rulesVersion,dict"`
+	Variant          string `json:"variant,omitempty" parquet:"variant,optional,dict"`
+	// start of the salt's period; only retailers hashed in the same period compare
+	SaltPeriod string `json:"saltPeriod" parquet:"saltPeriod,dict"`
+}
+
+// Hashes retailers with the salt of the period an export is made in.
+type retailerHasher struct {
+	salt   []byte
+	period time.Time
+}
+
+func newRetailerHasher(config AnalyticsExportConfig, now time.Time) retailerHasher {
+	period := now.UTC().Truncate(config.SaltRotation)
+	mac := hmac.New(sha256.New, []byte(config.SaltSecret))
+	mac.Write([]byte("analytics-salt:" + period.Format(time.RFC3339)))
+	return retailerHasher{salt: mac.Sum(nil), period: period}
+}
+
+// The merchant's canonical id when enrichment found one, otherwise the retailer, hashed.
+func (hasher retailerHasher) hash(record storedReceipt) string {
+	retailer := record.Receipt.Retailer
+	if record.Merchant != nil && record.Merchant.CanonicalID != "" {
+		retailer = record.Merchant.CanonicalID
+	}
+	mac := hmac.New(sha256.New, hasher.salt)
+	mac.Write([]byte(merchantKey(retailer)))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// The bucket of the total, like "10-25" for totals from $10 up to but not including $25.
+func totalBucket(total string) string {
+	cents, valid := totalCents(total)
+	if !valid {
+		return ""
+	}
+	index := len(analyticsTotalBuckets) - 1
+	for index > 0 && cents < int64(analyticsTotalBuckets[index])*100 {
+		index--
+	}
+	if index == len(analyticsTotalBuckets)-1 {
+		return strconv.Itoa(analyticsTotalBuckets[index]) + "+"
+	}
+	return strconv.Itoa(analyticsTotalBuckets[index]) + "-" + strconv.Itoa(analyticsTotalBuckets[index+1])
+}
+
+func (hasher retailerHasher) row(record storedReceipt) analyticsRow {
+	row := analyticsRow{
+		Retailer:         hasher.hash(record),
+		PurchaseDate:     record.Receipt.Date,
+		ProcessedDate:    record.ProcessedAt.UTC().Format("2006-01-02"),
+		TotalBucket:      totalBucket(record.Receipt.Total),
+		ItemCount:        len(record.Receipt.Items),
+		Points:           record.Points,
+		Status:           record.Status,
+		Channel:          record.Channel,
+		MerchantVerified: record.Verification != nil,
+		RulesVersion:     record.RulesVersion,
+		Variant:          record.Variant,
+		SaltPeriod:       hasher.period.Format(time.RFC3339),
+	}
+	if clock, err := time.Parse("15:04", record.Receipt.Time); err == nil {
+		row.PurchaseHour = clock.Hour()
+	}
+	if record.Merchant != nil {
+		row.Category = record.Merchant.Category
+	}
+	if record.Receipt.Location != nil {
+		row.State = record.Receipt.Location.State
+	}
+	return row
+}
+
+/*
+Streams every receipt anonymized for the data-science team, as NDJSON or,
+with ?format=parquet, a Parquet file. The rows leave out everything that
+identifies a user, so the export can be handed over without a privacy
+review each time; the audit trail records who exported it.
+*/
+func getAnalyticsExport(config AnalyticsExportConfig) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		format := context.DefaultQuery("format", "ndjson")
+		if format != "ndjson" && format != "parquet" {
+			respondWithMessage(context, http.StatusBadRequest, "export.format_invalid")
+			return
+		}
+		// the first page is read before responding, so a store that's down gets a 500
+		page, err := receipts.ListReceipts("", "", analyticsPageSize)
+		if err != nil {
+			log.Printf("Analytics export failed: %v", err)
+			respondWithMessage(context, http.StatusInternalServerError, "export.failed")
+			return
+		}
+
+		now := wallClock.Now()
+		hasher := newRetailerHasher(config, now)
+		filename := "receipts-analytics-" + now.UTC().Format("20060102T150405Z") + "." + format
+		context.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+		var write func([]analyticsRow) error
+		var finish func() error
+		if format == "parquet" {
+			context.Header("Content-Type", "application/vnd.apache.parquet")
+			writer := parquet.NewGenericWriter[analyticsRow](
+				context.Writer,
+				parquet.Compression(&parquet.Snappy),
+				parquet.KeyValueMetadata("saltPeriod", hasher.period.Format(time.RFC3339)),
+			)
+			write = func(rows []analyticsRow) error {
+				_, err := writer.Write(rows)
+				return err
+			}
+			finish = writer.Close
+		} else {
+			context.Header("Content-Type", "application/x-ndjson")
+			encoder := json.NewEncoder(context.Writer)
+			write = func(rows []analyticsRow) error {
+				for _, row := range rows {
+					if err := encoder.Encode(row); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			finish = func() error { return nil }
+		}
+		context.Status(http.StatusOK)
+
+		count := 0
+		for len(page) > 0 && err == nil {
+			rows := make([]analyticsRow, len(page))
+			for index, record := range page {
+				rows[index] = hasher.row(record)
+			}
+			if err = write(rows); err == nil {
+				count += len(rows)
+				page, err = receipts.ListReceipts("", page[len(page)-1].ID, analyticsPageSize)
+			}
+		}
+		if err == nil {
+			err = finish()
+		}
+		if err != nil {
+			// the status was already sent, so the client gets a truncated file
+			log.Printf("Analytics export failed part way through: %v", err)
+			return
+		}
+		recordAudit(context, auditEntry{
+			Action: auditAnalyticsExported,
+			Reason: strconv.Itoa(count) + " receipts as " + format,
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+/*
+A change someone made to a receipt or balance. Updates keep both versions
+of the receipt, so a mistaken correction can be traced and undone.
+*/
+type auditEntry struct {
+	ID        string         `json:"id"`
+	At        time.Time      `json:"at"`
+	Action    string         `json:"action"`
+	Actor     string         `json:"actor,omitempty"`
+	ReceiptID string         `json:"receiptId,omitempty"`
+	UserID    string         `json:"userId,omitempty"`
+	Before    *storedReceipt `json:"before,omitempty"`
+	After     *storedReceipt `json:"after,omitempty"`
+	Points    int            `json:"points,omitempty"`
+	Reason    string         `json:"reason,omitempty"`
+}
+
+// Audit actions.
+const (
+	auditReceiptUpdated   = "receipt.updated"
+	auditReceiptDeleted   = "receipt.deleted"
+	auditReceiptRestored  = "receipt.restored"
+	auditReceiptTagged    = "receipt.tagged"
+	auditReceiptBackdated = "receipt.backdated"
+	auditReceiptPurged    = "receipt.purged"
+	auditStoreBackfilled  = "store.backfilled"
+)
+
+// Default and largest number of entries GET /admin/audit returns.
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+/*
+Who is making a request, for the audit trail: the token subject, the admin
+username, or the X-User-ID header when authentication is off.
+*/
+func auditActor(context *gin.Context) string {
+	if subject := context.GetString("subject"); subject != "" {
+		return subject
+	}
+	if username, _, hasCredentials := context.Request.BasicAuth(); hasCredentials {
+		return "admin:" + username
+	}
+	return context.GetHeader("X-User-ID")
+}
+
+/*
+Adds an entry to the audit trail. The change it describes has already
+happened, so a failure is logged rather than failing the request.
+*/
+func recordAudit(context *gin.Context, entry auditEntry) {
+	saveAudit(receiptStore(context), auditActor(context), entry)
+}
+
+// Adds an entry the actor made to the store's audit trail, for work done after the request.
+func saveAudit(store Store, actor string, entry auditEntry) {
+	entry.ID = uuid.New().String()
+	entry.At = wallClock.Now()
+	entry.Actor = actor
+	if err := store.RecordAudit(entry); err != nil {
+		log.Printf("Failed to record %s audit entry for %s: %v", entry.Action, entry.ReceiptID, err)
+	}
+}
+
+// Lists audit entries, newest first, optionally only those for ?receipt= or ?user=.
+func getAuditTrail(context *gin.Context) {
+	limit, err := strconv.Atoi(context.DefaultQuery("limit", strconv.Itoa(defaultAuditLimit)))
+	if err != nil || limit < 1 || limit > maxAuditLimit {
+		respondWithMessage(context, http.StatusBadRequest, "audit.limit_invalid", maxAuditLimit)
+		return
+	}
+
+	entries, err := receipts.AuditTrail(context.Query("receipt"), context.Query("user"), limit)
+	if err != nil {
+		respondWithMessage(context, http.StatusInternalServerError, "audit.lookup_failed")
+		return
+	}
+	if entries == nil {
+		entries = []auditEntry{}
+	}
+	context.IndentedJSON(http.StatusOK, gin.H{"entries": entries})
+}
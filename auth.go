@@ -0,0 +1,351 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Roles a caller can be granted through their token's claims.
+const (
+	roleSubmitter = "submitter"
+	roleReader    = "reader"
+	roleAdmin     = "admin"
+)
+
+// Key the caller's roles are stored under in the gin context.
+const rolesContextKey = "roles"
+
+/*
+Validates bearer tokens issued by an OIDC provider. Signing keys are read
+from the issuer's JWKS endpoint and refreshed when a token references a key
+we haven't seen, so provider key rotation doesn't need a restart.
+*/
+type oidcVerifier struct {
+	issuer     string
+	audience   string
+	rolesClaim string
+	roleMap    map[string]string
+	jwksURL    string
+	client     *http.Client
+
+	mutex       sync.Mutex
+	keys        map[string]crypto.PublicKey
+	lastRefresh time.Time
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+type jsonWebKey struct {
+	KeyID string `json:"kid"`
+	Type  string `json:"kty"`
+	Curve string `json:"crv"`
+	N     string `json:"n"`
+	E     string `json:"e"`
+	X     string `json:"x"`
+	Y     string `json:"y"`
+}
+
+/*
+Looks up the issuer's discovery document to find its JWKS endpoint. The
+role map translates claim values into our roles; values missing from the
+map are used as role names directly.
+*/
+func newOIDCVerifier(issuer string, audience string, rolesClaim string, roleMap map[string]string) (*oidcVerifier, error) {
+	verifier := &oidcVerifier{
+		issuer:     strings.TrimSuffix(issuer, "/"),
+		audience:   audience,
+		rolesClaim: rolesClaim,
+		roleMap:    roleMap,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		keys:       make(map[string]crypto.PublicKey),
+	}
+
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURL string `json:"jwks_uri"`
+	}
+	if err := verifier.getJSON(verifier.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, fmt.Errorf("failed to load OIDC discovery document: %w", err)
+	}
+	if discovery.JWKSURL == "" {
+		return nil, errors.New("OIDC discovery document has no jwks_uri")
+	}
+	verifier.jwksURL = discovery.JWKSURL
+	return verifier, nil
+}
+
+func (verifier *oidcVerifier) getJSON(url string, target any) error {
+	response, err := verifier.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", url, response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(target)
+}
+
+/*
+Returns the signing key for a key id, refreshing the key set at most once
+a minute when the id isn't known.
+*/
+func (verifier *oidcVerifier) key(keyID string) (crypto.PublicKey, error) {
+	verifier.mutex.Lock()
+	defer verifier.mutex.Unlock()
+
+	if key, exists := verifier.keys[keyID]; exists {
+		return key, nil
+	}
+	if time.Since(verifier.lastRefresh) < time.Minute {
+		return nil, errors.New("unknown signing key")
+	}
+	verifier.lastRefresh = time.Now()
+
+	var keySet struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := verifier.getJSON(verifier.jwksURL, &keySet); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, webKey := range keySet.Keys {
+		if key, err := webKey.publicKey(); err == nil {
+			keys[webKey.KeyID] = key
+		}
+	}
+	verifier.keys = keys
+
+	if key, exists := keys[keyID]; exists {
+		return key, nil
+	}
+	return nil, errors.New("unknown signing key")
+}
+
+func (webKey jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch webKey.Type {
+	case "RSA":
+		modulus, modulusError := base64.RawURLEncoding.DecodeString(webKey.N)
+		exponent, exponentError := base64.RawURLEncoding.DecodeString(webKey.E)
+		if modulusError != nil || exponentError != nil {
+			return nil, errors.New("malformed RSA key")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(modulus),
+			E: int(new(big.Int).SetBytes(exponent).Int64()),
+		}, nil
+	case "EC":
+		if webKey.Curve != "P-256" {
+			return nil, errors.New("unsupported curve " + webKey.Curve)
+		}
+		x, xError := base64.RawURLEncoding.DecodeString(webKey.X)
+		y, yError := base64.RawURLEncoding.DecodeString(webKey.Y)
+		if xError != nil || yError != nil {
+			return nil, errors.New("malformed EC key")
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	}
+	return nil, errors.New("unsupported key type " + webKey.Type)
+}
+
+/*
+Checks a compact JWT's signature, issuer, audience and validity window,
+returning its claims. Only RS256 and ES256 tokens are accepted.
+*/
+func (verifier *oidcVerifier) verify(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header jwtHeader
+	if err := decodeTokenSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	key, err := verifier.key(header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch publicKey := key.(type) {
+	case *rsa.PublicKey:
+		if header.Algorithm != "RS256" {
+			return nil, errors.New("unexpected token algorithm " + header.Algorithm)
+		}
+		if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature); err != nil {
+			return nil, errors.New("invalid token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Algorithm != "ES256" || len(signature) != 64 {
+			return nil, errors.New("unexpected token algorithm " + header.Algorithm)
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(publicKey, digest[:], r, s) {
+			return nil, errors.New("invalid token signature")
+		}
+	}
+
+	var claims map[string]any
+	if err := decodeTokenSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if issuer, _ := claims["iss"].(string); strings.TrimSuffix(issuer, "/") != verifier.issuer {
+		return nil, errors.New("unexpected token issuer")
+	}
+	if verifier.audience != "" && !claimContains(claims["aud"], verifier.audience) {
+		return nil, errors.New("unexpected token audience")
+	}
+	now := float64(time.Now().Unix())
+	if expiry, ok := claims["exp"].(float64); !ok || now >= expiry {
+		return nil, errors.New("token has expired")
+	}
+	if notBefore, ok := claims["nbf"].(float64); ok && now < notBefore {
+		return nil, errors.New("token is not valid yet")
+	}
+	return claims, nil
+}
+
+func decodeTokenSegment(segment string, target any) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(decoded, target); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+// Reports whether a string or string-array claim holds the given value.
+func claimContains(claim any, value string) bool {
+	for _, entry := range claimStrings(claim) {
+		if entry == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Flattens a claim that is either a list or a space separated string.
+func claimStrings(claim any) []string {
+	switch typed := claim.(type) {
+	case string:
+		return strings.Fields(typed)
+	case []any:
+		var values []string
+		for _, entry := range typed {
+			if text, ok := entry.(string); ok {
+				values = append(values, text)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+/*
+Maps the configured roles claim onto our roles. The claim may be nested,
+e.g. "realm_access.roles" for Keycloak.
+*/
+func (verifier *oidcVerifier) roles(claims map[string]any) []string {
+	var claim any = claims
+	for _, name := range strings.Split(verifier.rolesClaim, ".") {
+		object, ok := claim.(map[string]any)
+		if !ok {
+			return nil
+		}
+		claim = object[name]
+	}
+
+	var roles []string
+	for _, value := range claimStrings(claim) {
+		if role, mapped := verifier.roleMap[value]; mapped {
+			value = role
+		}
+		roles = append(roles, value)
+	}
+	return roles
+}
+
+/*
+Middleware that requires a valid bearer token and records the caller's
+roles for requireRole to check.
+*/
+func authenticate(verifier *oidcVerifier) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		token, found := strings.CutPrefix(context.GetHeader("Authorization"), "Bearer ")
+		if !found || token == "" {
+			context.Header("WWW-Authenticate", "Bearer")
+			abortWithMessage(context, http.StatusUnauthorized, "auth.bearer_missing")
+			return
+		}
+
+		claims, err := verifier.verify(token)
+		if err != nil {
+			context.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			abortWithMessage(context, http.StatusUnauthorized, "auth.bearer_invalid", err.Error())
+			return
+		}
+
+		context.Set(rolesContextKey, verifier.roles(claims))
+		if subject, ok := claims["sub"].(string); ok {
+			context.Set("subject", subject)
+		}
+		context.Next()
+	}
+}
+
+// Middleware that lets the request through if the caller has the role. Admins can do everything.
+func requireRole(role string) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		for _, granted := range context.GetStringSlice(rolesContextKey) {
+			if granted == role || granted == roleAdmin {
+				context.Next()
+				return
+			}
+		}
+		abortWithMessage(context, http.StatusForbidden, "auth.role_required", role)
+	}
+}
+
+/*
+Middleware that only lets through callers a bearer token names, for
+endpoints that spend a user's points: X-User-ID is whatever the client
+sends, so it can't show who's asking. Without an OIDC issuer nobody is
+named and they're all refused.
+*/
+func requireSubject(context *gin.Context) {
+	if context.GetString("subject") == "" {
+		context.Header("WWW-Authenticate", "Bearer")
+		abortWithMessage(context, http.StatusUnauthorized, "auth.subject_required")
+		return
+	}
+	context.Next()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Version of the backup format, bumped whenever lines change incompatibly.
+const backupFormatVersion = 1
+
+type backupManifest struct {
+	FormatVersion int       `json:"formatVersion"`
+	CreatedAt     time.Time `json:"createdAt"`
+	RulesVersion  string    `json:"rulesVersion"`
+}
+
+/*
+One line of a backup archive. Archives are gzipped NDJSON: a manifest line,
+then the scoring rules, then the store's snapshot entries. Lines can be
+written and read one at a time, so neither side buffers the whole backup.
+*/
+type backupLine struct {
+	Manifest *backupManifest `json:"manifest,omitempty"`
+	Rule     *scoringRule    `json:"rule,omitempty"`
+	snapshotEntry
+}
+
+/*
+Streams a consistent snapshot of every receipt, balance and scoring rule as
+a single gzipped archive.
+*/
+func getBackup(context *gin.Context) {
+	filename := "receipts-backup-" + time.Now().UTC().Format("20060102T150405Z") + ".ndjson.gz"
+	context.Header("Content-Type", "application/gzip")
+	context.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	context.Status(http.StatusOK)
+
+	archive := gzip.NewWriter(context.Writer)
+	encoder := json.NewEncoder(archive)
+
+	rules := activeRules()
+	err := encoder.Encode(backupLine{
+		Manifest: &backupManifest{
+			FormatVersion: backupFormatVersion,
+			CreatedAt:     time.Now(),
+			RulesVersion:  rules.Version,
+		},
+	})
+	for index := 0; err == nil && index < len(rules.Rules); index++ {
+		err = encoder.Encode(backupLine{Rule: &rules.Rules[index]})
+	}
+	if err == nil {
+		err = receipts.Export(func(entry snapshotEntry) error {
+			return encoder.Encode(backupLine{snapshotEntry: entry})
+		})
+	}
+	if err != nil {
+		// the status is already sent, so the truncated archive is the only signal
+		log.Printf("Backup failed part way through: %v", err)
+		return
+	}
+	archive.Close()
+}
+
+/*
+Replaces everything in the store with the contents of a backup archive.
+Nothing is replaced if the archive can't be read to the end.
+*/
+func postRestore(context *gin.Context) {
+	archive, err := gzip.NewReader(context.Request.Body)
+	if err != nil {
+		abortWithMessage(context, http.StatusBadRequest, "backup.read_failed")
+		return
+	}
+	decoder := json.NewDecoder(bufio.NewReader(archive))
+
+	var first backupLine
+	if err := decoder.Decode(&first); err != nil || first.Manifest == nil {
+		abortWithMessage(context, http.StatusBadRequest, "backup.manifest_missing")
+		return
+	}
+	if first.Manifest.FormatVersion != backupFormatVersion {
+		abortWithMessage(context, http.StatusBadRequest, "backup.version_unsupported")
+		return
+	}
+
+	restoredReceipts, restoredBalances := 0, 0
+	next := func() (snapshotEntry, error) {
+		for {
+			var line backupLine
+			if err := decoder.Decode(&line); err != nil {
+				return snapshotEntry{}, err
+			}
+			// the rules are informational, scoring always uses the running rules
+			if line.Receipt == nil && line.Balance == nil {
+				continue
+			}
+			if line.Receipt != nil {
+				restoredReceipts++
+			}
+			if line.Balance != nil {
+				restoredBalances++
+			}
+			return line.snapshotEntry, nil
+		}
+	}
+
+	if err := receipts.Import(next); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			abortWithMessage(context, http.StatusBadRequest, "backup.truncated")
+			return
+		}
+		log.Printf("Restore failed: %v", err)
+		abortWithMessage(context, http.StatusBadRequest, "backup.restore_failed")
+		return
+	}
+	invalidateAllPoints()
+
+	context.IndentedJSON(
+		http.StatusOK,
+		gin.H{"receipts": restoredReceipts, "balances": restoredBalances},
+	)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// One line of the batch response, for the receipt at Index in the request.
+type batchResult struct {
+	Index   int          `json:"index"`
+	ID      string       `json:"id,omitempty"`
+	Points  int          `json:"points"`
+	Status  string       `json:"status,omitempty"`
+	Capped  []ruleResult `json:"capped,omitempty"`
+	Message string       `json:"message,omitempty"`
+	Code    string       `json:"code,omitempty"`
+	Errors  []fieldError `json:"errors,omitempty"`
+}
+
+/*
+Processes a batch of receipts sent either as a JSON array or as newline
+delimited JSON. Receipts are decoded and scored one at a time and each
+result is written as an NDJSON line as soon as it's ready, so memory use
+doesn't grow with the size of the batch. Each receipt counts against the
+caller's API key quotas, and is refused once they're used up; the ones that
+fail aren't counted. With Prefer: respond-async the batch is queued
+instead, see queueBatch.
+*/
+func processBatch(quotas *quotaMeter) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		reader := bufio.NewReader(context.Request.Body)
+		decoder := json.NewDecoder(reader)
+
+		// a leading bracket means a JSON array, anything else is NDJSON
+		isArray := false
+		if first, err := peekNonSpace(reader); err == nil && first == '[' {
+			if _, err := decoder.Token(); err != nil {
+				respondWithMessage(context, http.StatusBadRequest, "batch.read_failed")
+				return
+			}
+			isArray = true
+		}
+		if queuesBatch(context) {
+			queueBatch(context, decoder, isArray)
+			return
+		}
+
+		context.Header("Content-Type", "application/x-ndjson")
+		context.Status(http.StatusOK)
+		encoder := json.NewEncoder(context.Writer)
+		language := requestLanguage(context)
+
+		for index := 0; decoder.More(); index++ {
+			var receipt Receipt
+			err := decoder.Decode(&receipt)
+			var invalid *validationError
+			if errors.As(err, &invalid) {
+				// the receipt was read whole, only its fields were refused
+				message, code := localizeError(language, err)
+				encoder.Encode(batchResult{Index: index, Message: message, Code: code, Errors: invalid.localize(language)})
+				context.Writer.Flush()
+				continue
+			}
+			if err != nil {
+				// the decoder can't find the next receipt after bad JSON, so stop here
+				encoder.Encode(batchResult{
+					Index:   index,
+					Message: translate(language, "receipt.bind_failed"),
+					Code:    "receipt.bind_failed",
+				})
+				return
+			}
+
+			refund, err := quotas.chargeReceipt(context)
+			var record storedReceipt
+			if err == nil {
+				if record, err = processReceipt(processingFor(context), receipt, submittingUser(context), channelBatch); err != nil {
+					refund()
+				}
+			}
+			if err != nil {
+				message, code := localizeError(language, err)
+				encoder.Encode(batchResult{
+					Index: index, Message: message, Code: code, Errors: localizeFieldErrors(language, err),
+				})
+			} else {
+				encoder.Encode(batchResult{
+					Index: index, ID: record.ID, Points: record.Points, Status: record.Status, Capped: record.capsApplied(),
+				})
+			}
+			context.Writer.Flush()
+		}
+
+		if isArray {
+			decoder.Token()
+		}
+	}
+}
+
+// Returns the next non-whitespace byte without consuming it.
+func peekNonSpace(reader *bufio.Reader) (byte, error) {
+	for {
+		next, err := reader.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		switch next[0] {
+		case ' ', '\t', '\r', '\n':
+			reader.ReadByte()
+		default:
+			return next[0], nil
+		}
+	}
+}
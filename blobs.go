@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Where the original images and PDFs of receipts are kept, so support can pull
+them up for audits and disputes.
+*/
+type BlobConfig struct {
+	// "disk", or "s3" for any S3-compatible object store
+	Backend string
+	// directory blobs are written to on disk
+	Dir string
+	// the object store's endpoint, e.g. https://s3.us-east-1.amazonaws.com,
+	// and the bucket, region and credentials to use
+	S3Endpoint  string
+	S3Bucket    string
+	S3Region    string
+	S3AccessKey string
+	S3SecretKey string
+	// largest upload accepted, in bytes
+	MaxSize int64
+}
+
+// The original file a receipt was scanned from.
+type receiptBlob struct {
+	ContentType string
+	Data        []byte
+}
+
+// Keeps one original per receipt, keyed by receipt id.
+type blobStore interface {
+	put(receiptID string, blob receiptBlob) error
+	// Returns errBlobNotFound if the receipt has no original.
+	get(receiptID string) (receiptBlob, error)
+	// Removes the receipt's original, if it has one.
+	remove(receiptID string) error
+}
+
+var errBlobNotFound = errors.New("blob not found")
+
+// Global store of receipt originals
+var receiptBlobs blobStore
+
+func newBlobStore(config BlobConfig, resilience ResilienceConfig) (blobStore, error) {
+	switch config.Backend {
+	case "disk":
+		if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+			return nil, err
+		}
+		return diskBlobs{dir: config.Dir}, nil
+	case "s3":
+		if config.S3Endpoint == "" || config.S3Bucket == "" {
+			return nil, errors.New("BLOB_BACKEND=s3 needs BLOB_S3_ENDPOINT and BLOB_S3_BUCKET")
+		}
+		return s3Blobs{
+			config: config,
+			client: &http.Client{Timeout: time.Minute},
+			guard:  newDependencyGuard("blobs", resilience, retryUnlessPermanent),
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown BLOB_BACKEND: %s", config.Backend)
+}
+
+// Whether a file sniffed as this content type can be a receipt's original.
+func acceptedBlobType(contentType string) bool {
+	return strings.HasPrefix(contentType, "image/") || contentType == "application/pdf"
+}
+
+/*
+Attaches the image or PDF a receipt was scanned from, replacing any earlier
+one. The type is sniffed from the contents rather than trusted from the
+request.
+*/
+func putReceiptImage(maxSize int64) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		record, found := receiptForBlob(context)
+		if !found {
+			return
+		}
+
+		data, err := io.ReadAll(http.MaxBytesReader(context.Writer, context.Request.Body, maxSize))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondWithMessage(context, http.StatusRequestEntityTooLarge, "image.too_large", maxSize)
+			return
+		}
+		if err != nil || len(data) == 0 {
+			respondWithMessage(context, http.StatusBadRequest, "image.missing")
+			return
+		}
+		contentType := http.DetectContentType(data)
+		if !acceptedBlobType(contentType) {
+			respondWithMessage(context, http.StatusUnsupportedMediaType, "image.unsupported_type", contentType)
+			return
+		}
+
+		if err := receiptBlobs.put(record.ID, receiptBlob{ContentType: contentType, Data: data}); err != nil {
+			log.Printf("Failed to store the image of receipt %s: %v", record.ID, err)
+			respondWithMessage(context, http.StatusInternalServerError, "image.save_failed")
+			return
+		}
+		context.IndentedJSON(
+			http.StatusCreated,
+			gin.H{"id": record.ID, "contentType": contentType, "size": len(data), "links": receiptLinks(record.ID)},
+		)
+	}
+}
+
+// Retrieves the image or PDF a receipt was scanned from.
+func getReceiptImage(context *gin.Context) {
+	record, found := receiptForBlob(context)
+	if !found {
+		return
+	}
+	blob, err := receiptBlobs.get(record.ID)
+	if errors.Is(err, errBlobNotFound) {
+		respondWithMessage(context, http.StatusNotFound, "image.not_found")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load the image of receipt %s: %v", record.ID, err)
+		respondWithMessage(context, http.StatusInternalServerError, "image.lookup_failed")
+		return
+	}
+	respondCacheable(context, blob.ContentType, blob.Data, time.Time{}, cacheImage)
+}
+
+/*
+Looks up the receipt an image belongs to, responding with 404 when it
+doesn't exist or belongs to someone other than an authenticated caller.
+*/
+func receiptForBlob(context *gin.Context) (storedReceipt, bool) {
+	record, err := receiptStore(context).GetReceipt(context.Param("id"))
+	owner := ownerScope(context)
+	if errors.Is(err, errReceiptNotFound) || (err == nil && owner != "" && record.UserID != owner) {
+		respondWithMessage(context, http.StatusNotFound, "receipt.not_found")
+		return storedReceipt{}, false
+	}
+	if err != nil {
+		respondWithMessage(context, http.StatusInternalServerError, "points.lookup_failed")
+		return storedReceipt{}, false
+	}
+	return record, true
+}
+
+// Keeps each original as a file named by the receipt id, its type alongside.
+type diskBlobs struct {
+	dir string
+}
+
+func (blobs diskBlobs) put(receiptID string, blob receiptBlob) error {
+	path := filepath.Join(blobs.dir, receiptID)
+	// write the type first, so a reader never finds data without one
+	if err := os.WriteFile(path+".type", []byte(blob.ContentType), 0o644); err != nil {
+		return err
+	}
+	temporary := path + ".tmp"
+	if err := os.WriteFile(temporary, blob.Data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(temporary, path)
+}
+
+func (blobs diskBlobs) get(receiptID string) (receiptBlob, error) {
+	path := filepath.Join(blobs.dir, receiptID)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return receiptBlob{}, errBlobNotFound
+	}
+	if err != nil {
+		return receiptBlob{}, err
+	}
+	contentType, err := os.ReadFile(path + ".type")
+	if err != nil {
+		return receiptBlob{}, err
+	}
+	return receiptBlob{ContentType: string(contentType), Data: data}, nil
+}
+
+func (blobs diskBlobs) remove(receiptID string) error {
+	path := filepath.Join(blobs.dir, receiptID)
+	for _, file := range []string{path, path + ".type"} {
+		if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Keeps originals in an S3-compatible bucket as receipts/<id>, addressing the
+bucket by path so MinIO and other stores work too. Requests are signed with
+AWS Signature Version 4.
+*/
+type s3Blobs struct {
+	config BlobConfig
+	client *http.Client
+	guard  *dependencyGuard
+}
+
+func (blobs s3Blobs) put(receiptID string, blob receiptBlob) error {
+	return blobs.guard.do(context.Background(), func() error {
+		response, err := blobs.do(http.MethodPut, receiptID, blob)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		return objectStoreError(response)
+	})
+}
+
+func (blobs s3Blobs) get(receiptID string) (receiptBlob, error) {
+	return guarded(blobs.guard, func() (receiptBlob, error) {
+		response, err := blobs.do(http.MethodGet, receiptID, receiptBlob{})
+		if err != nil {
+			return receiptBlob{}, err
+		}
+		defer response.Body.Close()
+		if response.StatusCode == http.StatusNotFound {
+			return receiptBlob{}, permanentError{errBlobNotFound}
+		}
+		if err := objectStoreError(response); err != nil {
+			return receiptBlob{}, err
+		}
+		data, err := io.ReadAll(response.Body)
+		if err != nil {
+			return receiptBlob{}, err
+		}
+		return receiptBlob{ContentType: response.Header.Get("Content-Type"), Data: data}, nil
+	})
+}
+
+func (blobs s3Blobs) remove(receiptID string) error {
+	return blobs.guard.do(context.Background(), func() error {
+		response, err := blobs.do(http.MethodDelete, receiptID, receiptBlob{})
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		// deleting a missing object succeeds too
+		if response.StatusCode == http.StatusNoContent {
+			return nil
+		}
+		return objectStoreError(response)
+	})
+}
+
+// Describes an unsuccessful response, which is only worth retrying for server errors and throttling.
+func objectStoreError(response *http.Response) error {
+	if response.StatusCode == http.StatusOK {
+		return nil
+	}
+	err := fmt.Errorf("the object store answered %s", response.Status)
+	if response.StatusCode < 500 && response.StatusCode != http.StatusTooManyRequests {
+		return permanentError{err}
+	}
+	return err
+}
+
+func (blobs s3Blobs) do(method string, receiptID string, blob receiptBlob) (*http.Response, error) {
+	endpoint := strings.TrimSuffix(blobs.config.S3Endpoint, "/") + "/" + blobs.config.S3Bucket + "/receipts/" + receiptID
+	request, err := http.NewRequest(method, endpoint, bytes.NewReader(blob.Data))
+	if err != nil {
+		return nil, err
+	}
+	if blob.ContentType != "" {
+		request.Header.Set("Content-Type", blob.ContentType)
+	}
+	blobs.sign(request, blob.Data, time.Now().UTC())
+	return blobs.client.Do(request)
+}
+
+// Adds an AWS Signature Version 4 authorization header to the request.
+func (blobs s3Blobs) sign(request *http.Request, payload []byte, now time.Time) {
+	region := blobs.config.S3Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256.Sum256(payload)
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		request.URL.RawQuery,
+		"host:" + request.URL.Host + "\n" +
+			"x-amz-content-sha256:" + hex.EncodeToString(payloadHash[:]) + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + blobs.config.S3SecretKey)
+	for _, part := range []string{date, region, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	request.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		blobs.config.S3AccessKey, scope, signedHeaders, hex.EncodeToString(key),
+	))
+}
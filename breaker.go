@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+/*
+Stops calling a failing dependency for a while, so requests fail fast instead
+of piling up behind timeouts. After threshold consecutive failures the
+breaker opens for cooldown; then a single trial call is let through, which
+closes it again on success.
+*/
+type circuitBreaker struct {
+	mutex     sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	// whether a trial call is in flight while half open
+	trying bool
+	// how many times the breaker has opened
+	opened int64
+}
+
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: max(threshold, 1), cooldown: cooldown}
+}
+
+// Whether a call may go ahead; each call allowed must be recorded.
+func (breaker *circuitBreaker) allow() bool {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	if breaker.failures < breaker.threshold {
+		return true
+	}
+	if time.Now().Before(breaker.openUntil) || breaker.trying {
+		return false
+	}
+	breaker.trying = true
+	return true
+}
+
+// Records the outcome of an allowed call.
+func (breaker *circuitBreaker) record(failed bool) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	trial := breaker.trying
+	breaker.trying = false
+	if !failed {
+		breaker.failures = 0
+		return
+	}
+	breaker.failures++
+	if breaker.failures >= breaker.threshold {
+		if trial || breaker.failures == breaker.threshold {
+			breaker.opened++
+		}
+		breaker.openUntil = time.Now().Add(breaker.cooldown)
+	}
+}
+
+// "closed", "open", or "half-open" once the cooldown has passed.
+func (breaker *circuitBreaker) state() string {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	switch {
+	case breaker.failures < breaker.threshold:
+		return "closed"
+	case time.Now().Before(breaker.openUntil):
+		return "open"
+	}
+	return "half-open"
+}
+
+// How many times the breaker has opened since the service started.
+func (breaker *circuitBreaker) timesOpened() int64 {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	return breaker.opened
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	// Receipts a bulk delete reads from the store at a time.
+	bulkDeletePageSize = 500
+	// Finished bulk deletes kept for GET /admin/bulk-deletes.
+	bulkDeleteHistory = 100
+	// Matching receipt ids a bulk delete reports, so a dry run can be spot checked.
+	bulkDeleteSampleSize = 10
+)
+
+// States of a bulk delete.
+const (
+	jobRunning   = "running"
+	jobCompleted = "completed"
+	jobFailed    = "failed"
+)
+
+/*
+Which receipts a bulk delete applies to; a receipt must match every
+criterion given. Retailers match ignoring case and surrounding spaces,
+processing times are [ProcessedFrom, ProcessedTo), and purchase dates are
+inclusive "2006-01-02" days.
+*/
+type receiptFilter struct {
+	Retailer      string     `json:"retailer,omitempty"`
+	APIKey        string     `json:"apiKey,omitempty"`
+	ProcessedFrom *time.Time `json:"processedFrom,omitempty"`
+	ProcessedTo   *time.Time `json:"processedTo,omitempty"`
+	PurchasedFrom string     `json:"purchasedFrom,omitempty"`
+	PurchasedTo   string     `json:"purchasedTo,omitempty"`
+}
+
+// The filter without the spaces around its text, which would otherwise read as criteria.
+func (filter receiptFilter) trimmed() receiptFilter {
+	filter.Retailer = strings.TrimSpace(filter.Retailer)
+	filter.APIKey = strings.TrimSpace(filter.APIKey)
+	filter.PurchasedFrom = strings.TrimSpace(filter.PurchasedFrom)
+	filter.PurchasedTo = strings.TrimSpace(filter.PurchasedTo)
+	return filter
+}
+
+/*
+Adds what's wrong with the trimmed filter to invalid. An empty filter would
+match everything, so it's refused.
+*/
+func (filter receiptFilter) validate(invalid *validationError) {
+	if filter == (receiptFilter{}) {
+		invalid.add("filter", "bulk_delete.filter_empty")
+		return
+	}
+	dates := []struct{ field, date string }{
+		{"purchasedFrom", filter.PurchasedFrom},
+		{"purchasedTo", filter.PurchasedTo},
+	}
+	for _, date := range dates {
+		if _, err := time.Parse("2006-01-02", date.date); date.date != "" && err != nil {
+			invalid.add("filter."+date.field, "bulk_delete.date_invalid", date.date)
+		}
+	}
+}
+
+// Whether the receipt meets every criterion of the trimmed filter.
+func (filter receiptFilter) matches(record storedReceipt) bool {
+	switch {
+	case filter.Retailer != "" && !strings.EqualFold(strings.TrimSpace(record.Receipt.Retailer), filter.Retailer):
+		return false
+	case filter.APIKey != "" && record.APIKey != filter.APIKey:
+		return false
+	case filter.ProcessedFrom != nil && record.ProcessedAt.Before(*filter.ProcessedFrom):
+		return false
+	case filter.ProcessedTo != nil && !record.ProcessedAt.Before(*filter.ProcessedTo):
+		return false
+	case filter.PurchasedFrom != "" && record.Receipt.Date < filter.PurchasedFrom:
+		return false
+	case filter.PurchasedTo != "" && record.Receipt.Date > filter.PurchasedTo:
+		return false
+	}
+	return true
+}
+
+/*
+A bulk delete and how far it's got. A dry run only counts the receipts it
+would delete. Otherwise matching receipts go to the trash, their points
+taken back, or with Purge are removed for good along with their images.
+*/
+type bulkDeleteJob struct {
+	ID         string        `json:"id"`
+	Filter     receiptFilter `json:"filter"`
+	DryRun     bool          `json:"dryRun"`
+	Purge      bool          `json:"purge"`
+	Status     string        `json:"status"`
+	Scanned    int           `json:"scanned"`
+	Matched    int           `json:"matched"`
+	Deleted    int           `json:"deleted"`
+	Sample     []string      `json:"sample"`
+	Actor      string        `json:"actor,omitempty"`
+	StartedAt  time.Time     `json:"startedAt"`
+	FinishedAt *time.Time    `json:"finishedAt,omitempty"`
+	Error      string        `json:"error,omitempty"`
+}
+
+/*
+The bulk deletes this instance has run, newest last. Jobs run in the
+background and are kept in memory, so a restart forgets them; one cut
+short can be started again, since it only finds what's left.
+*/
+type bulkDeleteRegistry struct {
+	mutex sync.Mutex
+	jobs  []*bulkDeleteJob
+}
+
+// Global record of bulk deletes
+var bulkDeletes = &bulkDeleteRegistry{}
+
+// Changes the job while holding the registry's lock.
+func (registry *bulkDeleteRegistry) update(job *bulkDeleteJob, change func(job *bulkDeleteJob)) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	change(job)
+}
+
+// Copies of the jobs, newest first.
+func (registry *bulkDeleteRegistry) list() []bulkDeleteJob {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	jobs := make([]bulkDeleteJob, 0, len(registry.jobs))
+	for index := len(registry.jobs) - 1; index >= 0; index-- {
+		job := *registry.jobs[index]
+		job.Sample = slices.Clone(job.Sample)
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+// Adds the job, forgetting the oldest finished ones past bulkDeleteHistory.
+func (registry *bulkDeleteRegistry) add(job *bulkDeleteJob) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	registry.jobs = append(registry.jobs, job)
+	for excess := len(registry.jobs) - bulkDeleteHistory; excess > 0; excess-- {
+		oldest := slices.IndexFunc(registry.jobs, func(job *bulkDeleteJob) bool { return job.Status != jobRunning })
+		if oldest < 0 {
+			break
+		}
+		registry.jobs = slices.Delete(registry.jobs, oldest, oldest+1)
+	}
+}
+
+/*
+Walks every receipt in id order, deleting those the job's filter matches,
+and with Purge then the trash, since receipts deleted before are in it.
+*/
+func (registry *bulkDeleteRegistry) run(job *bulkDeleteJob) {
+	err := registry.walk(job, func(after string) ([]storedReceipt, error) {
+		return receipts.ListReceipts("", after, bulkDeletePageSize)
+	})
+	if err == nil && job.Purge {
+		err = registry.walk(job, func(after string) ([]storedReceipt, error) {
+			return receipts.ListTrashedReceipts(after, bulkDeletePageSize)
+		})
+	}
+	finished := wallClock.Now()
+	deleted := 0
+	registry.update(job, func(job *bulkDeleteJob) {
+		job.FinishedAt = &finished
+		job.Status = jobCompleted
+		if err != nil {
+			job.Status, job.Error = jobFailed, err.Error()
+		}
+		deleted = job.Deleted
+	})
+	if err != nil {
+		log.Printf("Bulk delete %s failed after deleting %d receipts: %v", job.ID, deleted, err)
+	}
+}
+
+// Deletes the matching receipts of the pages list returns after each id.
+func (registry *bulkDeleteRegistry) walk(job *bulkDeleteJob, list func(after string) ([]storedReceipt, error)) error {
+	after := ""
+	for {
+		page, err := list(after)
+		if err != nil || len(page) == 0 {
+			return err
+		}
+		after = page[len(page)-1].ID
+
+		for _, record := range page {
+			matched := job.Filter.matches(record)
+			registry.update(job, func(job *bulkDeleteJob) {
+				job.Scanned++
+				if matched {
+					job.Matched++
+					if len(job.Sample) < bulkDeleteSampleSize {
+						job.Sample = append(job.Sample, record.ID)
+					}
+				}
+			})
+			if !matched || job.DryRun {
+				continue
+			}
+			if err := job.remove(record); err != nil {
+				return err
+			}
+			registry.update(job, func(job *bulkDeleteJob) { job.Deleted++ })
+		}
+	}
+}
+
+/*
+Deletes or purges one matching receipt, recording it in the audit trail.
+A receipt already in the trash has had its points taken back, so purging
+it takes none.
+*/
+func (job *bulkDeleteJob) remove(record storedReceipt) error {
+	deleted, points := record, 0
+	if record.DeletedAt == nil {
+		var err error
+		deleted, err = receipts.DeleteReceipt(record.ID, "")
+		// deleted by someone else meanwhile
+		if errors.Is(err, errReceiptNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		invalidatePoints(record.ID)
+		points = -deleted.Points
+	}
+	action := auditReceiptDeleted
+	if job.Purge {
+		// it's in the trash now, so removing it takes no more points
+		err := receipts.RemoveReceipt(record.ID)
+		if errors.Is(err, errReceiptNotFound) && record.DeletedAt != nil {
+			return nil
+		}
+		if err != nil && !errors.Is(err, errReceiptNotFound) {
+			return err
+		}
+		if err := receiptBlobs.remove(record.ID); err != nil {
+			log.Printf("Failed to remove the image of purged receipt %s: %v", record.ID, err)
+		}
+		action = auditReceiptPurged
+	}
+	saveAudit(receipts, job.Actor, auditEntry{
+		Action:    action,
+		ReceiptID: deleted.ID,
+		UserID:    deleted.UserID,
+		Before:    &deleted,
+		Points:    points,
+		Reason:    "bulk delete " + job.ID,
+	})
+	return nil
+}
+
+/*
+Starts deleting the receipts matching a filter in the background, from a
+body like {"filter": {"apiKey": "acme", "processedFrom": "2024-05-01T00:00:00Z"},
+"dryRun": false}. Runs are dry unless dryRun is false, so a mistyped filter
+only reports what it would have deleted. Responds 202 with the job, whose
+progress GET /admin/bulk-deletes/{id} reports.
+*/
+func postBulkDelete(context *gin.Context) {
+	var request struct {
+		Filter receiptFilter `json:"filter"`
+		DryRun *bool         `json:"dryRun"`
+		Purge  bool          `json:"purge"`
+	}
+	if err := decodeJSON(context.Request.Body, &request, "bulk_delete.bind_failed"); err != nil {
+		respondWithError(context, http.StatusBadRequest, err)
+		return
+	}
+	request.Filter = request.Filter.trimmed()
+	invalid := &validationError{}
+	request.Filter.validate(invalid)
+	if err := invalid.orNil(); err != nil {
+		respondWithError(context, http.StatusBadRequest, err)
+		return
+	}
+
+	job := &bulkDeleteJob{
+		ID:        uuid.New().String(),
+		Filter:    request.Filter,
+		DryRun:    request.DryRun == nil || *request.DryRun,
+		Purge:     request.Purge,
+		Status:    jobRunning,
+		Sample:    []string{},
+		Actor:     auditActor(context),
+		StartedAt: wallClock.Now(),
+	}
+	bulkDeletes.add(job)
+	go bulkDeletes.run(job)
+
+	context.Header("Location", "/admin/bulk-deletes/"+job.ID)
+	context.IndentedJSON(http.StatusAccepted, bulkDeletes.find(job.ID))
+}
+
+// A copy of the job with the id, or nil.
+func (registry *bulkDeleteRegistry) find(id string) *bulkDeleteJob {
+	for _, job := range registry.list() {
+		if job.ID == id {
+			return &job
+		}
+	}
+	return nil
+}
+
+// Lists bulk deletes, newest first.
+func getBulkDeletes(context *gin.Context) {
+	context.IndentedJSON(http.StatusOK, gin.H{"jobs": bulkDeletes.list()})
+}
+
+// Reports how far a bulk delete has got.
+func getBulkDelete(context *gin.Context) {
+	job := bulkDeletes.find(context.Param("id"))
+	if job == nil {
+		respondWithMessage(context, http.StatusNotFound, "bulk_delete.not_found")
+		return
+	}
+	context.IndentedJSON(http.StatusOK, job)
+}
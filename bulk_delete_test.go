@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestReceiptFilterMatches(t *testing.T) {
+	at := func(value string) *time.Time {
+		parsed, _ := time.Parse(time.RFC3339, value)
+		return &parsed
+	}
+	record := storedReceipt{
+		Receipt:     Receipt{Retailer: " Target ", Date: "2024-05-10"},
+		APIKey:      "acme",
+		ProcessedAt: *at("2024-05-12T10:00:00Z"),
+	}
+	tests := []struct {
+		name   string
+		filter receiptFilter
+		want   bool
+	}{
+		{"retailer ignoring case and spaces", receiptFilter{Retailer: "target "}, true},
+		{"other retailer", receiptFilter{Retailer: "Walmart"}, false},
+		{"api key", receiptFilter{APIKey: "acme"}, true},
+		{"other api key", receiptFilter{APIKey: "globex"}, false},
+		{"processed from, included", receiptFilter{ProcessedFrom: at("2024-05-12T10:00:00Z")}, true},
+		{"processed from, later", receiptFilter{ProcessedFrom: at("2024-05-12T10:00:01Z")}, false},
+		{"processed to, excluded", receiptFilter{ProcessedTo: at("2024-05-12T10:00:00Z")}, false},
+		{"processed to, later", receiptFilter{ProcessedTo: at("2024-05-12T10:00:01Z")}, true},
+		{"purchased from, included", receiptFilter{PurchasedFrom: " 2024-05-10"}, true},
+		{"purchased from, later", receiptFilter{PurchasedFrom: "2024-05-11"}, false},
+		{"purchased to, included", receiptFilter{PurchasedTo: "2024-05-10"}, true},
+		{"purchased to, earlier", receiptFilter{PurchasedTo: "2024-05-09"}, false},
+		{"every criterion", receiptFilter{Retailer: "target", APIKey: "acme", PurchasedFrom: "2024-05-01", PurchasedTo: "2024-05-31"}, true},
+		{"one criterion off", receiptFilter{Retailer: "target", APIKey: "globex"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.filter.trimmed().matches(record); got != test.want {
+				t.Errorf("matches() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReceiptFilterValidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		filter     receiptFilter
+		wantFields []string
+	}{
+		{"empty", receiptFilter{}, []string{"filter"}},
+		// blank criteria would match every receipt
+		{"blank retailer", receiptFilter{Retailer: "  "}, []string{"filter"}},
+		{"blank everything", receiptFilter{Retailer: " ", APIKey: "\t", PurchasedFrom: " ", PurchasedTo: " "}, []string{"filter"}},
+		{"retailer", receiptFilter{Retailer: "Target"}, nil},
+		{"dates", receiptFilter{PurchasedFrom: "2024-05-01", PurchasedTo: "2024-05-31"}, nil},
+		{"bad from date", receiptFilter{PurchasedFrom: "05/01/2024"}, []string{"filter.purchasedFrom"}},
+		{"bad to date", receiptFilter{PurchasedTo: "2024-13-01"}, []string{"filter.purchasedTo"}},
+		{"bad dates", receiptFilter{PurchasedFrom: "May 1", PurchasedTo: "2024-13-01"}, []string{"filter.purchasedFrom", "filter.purchasedTo"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			invalid := &validationError{}
+			test.filter.trimmed().validate(invalid)
+			var fields []string
+			for _, field := range invalid.fields {
+				fields = append(fields, field.Field)
+			}
+			if !slices.Equal(fields, test.wantFields) {
+				t.Errorf("validate() found %v, want %v", fields, test.wantFields)
+			}
+		})
+	}
+}
+
+// A bulk delete with purge removes matching receipts whether they're live or already trashed.
+func TestBulkDeletePurgesTheTrash(t *testing.T) {
+	useTestGlobals(t)
+
+	for _, record := range []storedReceipt{
+		{ID: "a", UserID: "user", Receipt: Receipt{Retailer: "Target"}, Points: 10},
+		{ID: "b", UserID: "user", Receipt: Receipt{Retailer: "Target"}, Points: 20},
+		{ID: "c", UserID: "user", Receipt: Receipt{Retailer: "Walmart"}, Points: 30},
+	} {
+		if _, err := receipts.SaveReceipt(record); err != nil {
+			t.Fatalf("SaveReceipt(%s) failed: %v", record.ID, err)
+		}
+	}
+	if _, err := receipts.DeleteReceipt("a", ""); err != nil {
+		t.Fatalf("DeleteReceipt() failed: %v", err)
+	}
+
+	registry := &bulkDeleteRegistry{}
+	job := &bulkDeleteJob{ID: "job", Filter: receiptFilter{Retailer: "target"}, Purge: true, Status: jobRunning}
+	registry.add(job)
+	registry.run(job)
+
+	if job.Status != jobCompleted || job.Matched != 2 || job.Deleted != 2 {
+		t.Fatalf("job finished %s with %d matched and %d deleted, want completed with 2 of each", job.Status, job.Matched, job.Deleted)
+	}
+	for _, id := range []string{"a", "b"} {
+		if _, err := receipts.GetReceipt(id); !errors.Is(err, errReceiptNotFound) {
+			t.Errorf("GetReceipt(%s) = %v after the purge, want errReceiptNotFound", id, err)
+		}
+	}
+	trashed, _ := receipts.TrashedReceipts(10)
+	if len(trashed) != 0 {
+		t.Errorf("%d receipts left in the trash, want none", len(trashed))
+	}
+	if balance, _ := receipts.Balance("user"); balance != 30 {
+		t.Errorf("balance is %d after the purge, want the 30 of the receipt left", balance)
+	}
+}
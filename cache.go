@@ -0,0 +1,108 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+/*
+A fixed size cache that evicts the least recently used entry once full.
+Safe for use by concurrent requests.
+*/
+type lruCache[K comparable, V any] struct {
+	mutex    sync.Mutex
+	capacity int
+	// most recently used entries are at the front
+	entries  *list.List
+	elements map[K]*list.Element
+	// counts removals and clears, see putUnlessRemoved
+	removals uint64
+}
+
+type lruEntry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+func newLRUCache[K comparable, V any](capacity int) *lruCache[K, V] {
+	return &lruCache[K, V]{
+		capacity: max(capacity, 1),
+		entries:  list.New(),
+		elements: make(map[K]*list.Element),
+	}
+}
+
+func (cache *lruCache[K, V]) get(key K) (V, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	element, exists := cache.elements[key]
+	if !exists {
+		var zero V
+		return zero, false
+	}
+	cache.entries.MoveToFront(element)
+	return element.Value.(lruEntry[K, V]).value, true
+}
+
+func (cache *lruCache[K, V]) put(key K, value V) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.insert(key, value)
+}
+
+// Where the cache is in its removals, for putUnlessRemoved.
+func (cache *lruCache[K, V]) generation() uint64 {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.removals
+}
+
+/*
+Puts a value read from elsewhere unless an entry was removed or the cache
+was cleared since generation, when the value may be one the removal was
+invalidating.
+*/
+func (cache *lruCache[K, V]) putUnlessRemoved(key K, value V, generation uint64) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cache.removals == generation {
+		cache.insert(key, value)
+	}
+}
+
+// Puts the value with the mutex held.
+func (cache *lruCache[K, V]) insert(key K, value V) {
+	if element, exists := cache.elements[key]; exists {
+		element.Value = lruEntry[K, V]{key: key, value: value}
+		cache.entries.MoveToFront(element)
+		return
+	}
+
+	cache.elements[key] = cache.entries.PushFront(lruEntry[K, V]{key: key, value: value})
+	if cache.entries.Len() > cache.capacity {
+		oldest := cache.entries.Back()
+		cache.entries.Remove(oldest)
+		delete(cache.elements, oldest.Value.(lruEntry[K, V]).key)
+	}
+}
+
+func (cache *lruCache[K, V]) remove(key K) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.removals++
+	if element, exists := cache.elements[key]; exists {
+		cache.entries.Remove(element)
+		delete(cache.elements, key)
+	}
+}
+
+func (cache *lruCache[K, V]) clear() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.removals++
+	cache.entries.Init()
+	cache.elements = make(map[K]*list.Element)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Cache-Control policies for the read endpoints, by how often what they
+serve changes. Everything is private, since responses depend on who's
+asking, and carries an ETag, so revalidating an unchanged response costs a
+304 rather than the body.
+*/
+const (
+	// points and listings change with any receipt, so clients check every time
+	cacheRevalidate = "private, no-cache"
+	// a receipt's breakdown and rendering only change when it's corrected
+	cacheReceipt = "private, max-age=60"
+	// images only change when they're uploaded again
+	cacheImage = "private, max-age=3600"
+)
+
+// A strong ETag for a response body, which changes whenever any byte of it does.
+func strongETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+/*
+Responds with the body unless the request's conditions say the client
+already has it, in which case it gets a 304. Sends the body's ETag, the
+Cache-Control policy and, unless it's zero, lastModified, which must be
+the latest time the response could have changed.
+*/
+func respondCacheable(
+	context *gin.Context, contentType string, body []byte, lastModified time.Time, cacheControl string,
+) {
+	etag := strongETag(body)
+	context.Header("ETag", etag)
+	context.Header("Cache-Control", cacheControl)
+	if !lastModified.IsZero() {
+		context.Header("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	if notModified(context.Request, etag, lastModified) {
+		context.Status(http.StatusNotModified)
+		return
+	}
+	context.Data(http.StatusOK, contentType, body)
+}
+
+// Responds with the value as indented JSON, like IndentedJSON, unless the client already has it.
+func respondCacheableJSON(context *gin.Context, value any, lastModified time.Time, cacheControl string) {
+	body, err := json.MarshalIndent(value, "", "    ")
+	if err != nil {
+		context.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	respondCacheable(context, "application/json; charset=utf-8", body, lastModified, cacheControl)
+}
+
+/*
+Whether the request's If-None-Match lists the ETag or, without one, its
+If-Modified-Since is no earlier than lastModified, to the second.
+*/
+func notModified(request *http.Request, etag string, lastModified time.Time) bool {
+	if ifNoneMatch := request.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return etagMatches(ifNoneMatch, etag)
+	}
+	if lastModified.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(request.Header.Get("If-Modified-Since"))
+	return err == nil && !lastModified.Truncate(time.Second).After(since)
+}
+
+// Reports whether an If-None-Match header lists the ETag (or is "*").
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+When the receipt last changed, for Last-Modified, which the store bumps
+with every write: retagging, reviews and trashing included. Sandboxes'
+clocks stand still, so their receipts have no usable time, and neither do
+receipts saved before the store kept it; both are only validated by ETag.
+*/
+func receiptModified(context *gin.Context, record storedReceipt) time.Time {
+	if sandboxOf(context) != nil {
+		return time.Time{}
+	}
+	return record.ModifiedAt
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Stops the wall clock at the time for the rest of the test.
+func stopWallClock(t *testing.T, at time.Time) {
+	previous := wallClock
+	t.Cleanup(func() { wallClock = previous })
+	wallClock = fixedClock(at)
+}
+
+func TestReceiptModifiedFollowsEveryWrite(t *testing.T) {
+	store := newMemoryStore()
+	start := time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC)
+	writes := []struct {
+		name  string
+		write func() error
+	}{
+		{"saved for review", func() error {
+			_, err := store.SaveReceipt(storedReceipt{ID: "r", UserID: "user", Points: 10, Status: reviewPending, ProcessedAt: start})
+			return err
+		}},
+		{"approved", func() error {
+			_, _, err := store.ResolveReview("r", true)
+			return err
+		}},
+		// backdating saves it again as processed earlier
+		{"backdated", func() error {
+			record, _ := store.GetReceipt("r")
+			record.ProcessedAt = start.Add(-24 * time.Hour)
+			_, err := store.SaveReceipt(record)
+			return err
+		}},
+		{"trashed", func() error {
+			_, err := store.DeleteReceipt("r", "")
+			return err
+		}},
+		{"restored", func() error {
+			_, err := store.RestoreReceipt("r", "")
+			return err
+		}},
+	}
+	for index, write := range writes {
+		at := start.Add(time.Duration(index+1) * time.Hour)
+		stopWallClock(t, at)
+		if err := write.write(); err != nil {
+			t.Fatalf("%s: write failed: %v", write.name, err)
+		}
+		if modified := store.receipts["r"].ModifiedAt; !modified.Equal(at) {
+			t.Errorf("%s: modified at %s, want %s", write.name, modified, at)
+		}
+	}
+}
+
+// A receipt rejected since the client last asked isn't reported unchanged.
+func TestGetPointsAfterReview(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useTestGlobals(t)
+	router := gin.New()
+	router.GET("/receipts/:id/points", getPoints)
+	get := func(since time.Time) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, "/receipts/r/points", nil)
+		request.Header.Set("If-Modified-Since", since.Format(http.TimeFormat))
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	scored := time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC)
+	stopWallClock(t, scored)
+	if _, err := receipts.SaveReceipt(storedReceipt{ID: "r", UserID: "user", Points: 10, Status: reviewPending, ProcessedAt: scored}); err != nil {
+		t.Fatalf("SaveReceipt() failed: %v", err)
+	}
+	if response := get(scored); response.Code != http.StatusNotModified {
+		t.Fatalf("unchanged receipt got %d, want 304", response.Code)
+	}
+
+	rejected := scored.Add(time.Hour)
+	stopWallClock(t, rejected)
+	if _, _, err := receipts.ResolveReview("r", false); err != nil {
+		t.Fatalf("ResolveReview() failed: %v", err)
+	}
+	response := get(scored)
+	if response.Code != http.StatusOK {
+		t.Errorf("rejected receipt got %d, want 200", response.Code)
+	}
+	if modified := response.Header().Get("Last-Modified"); modified != rejected.Format(http.TimeFormat) {
+		t.Errorf("Last-Modified is %q, want the rejection's %q", modified, rejected.Format(http.TimeFormat))
+	}
+}
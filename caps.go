@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Caps on what receipts can earn, so a generous promotion can't be farmed by
+submitting receipts in bulk. A receipt over a points cap is still saved,
+with what it's allowed; one over the receipts cap is refused. Zero turns a
+cap off.
+*/
+type CapsConfig struct {
+	// most points one receipt can earn
+	ReceiptPoints int
+	// most points a user's receipts can earn in any 24 hours
+	DailyPoints int
+	// most receipts a user can submit in any 24 hours
+	DailyReceipts int
+}
+
+// Window the daily caps are counted over, like the transfer limits.
+const capWindow = 24 * time.Hour
+
+// Breakdown entries taking back the points over a cap.
+const (
+	capReceiptRule = "cap.receipt"
+	capDailyRule   = "cap.daily"
+)
+
+// Caps in force, see CapsConfig
+var pointsCaps CapsConfig
+
+/*
+Held from counting a user's recent receipts until the receipt is saved, so
+concurrent submissions to this instance can't both fit under a daily cap.
+Users are spread over the stripes by their id's hash, so one user's
+submissions only wait for others' that share a stripe. Replicas don't
+share them: each can let one of a user's concurrent submissions through,
+so with N replicas a cap can be overshot by N-1.
+*/
+var capsLocks [capsLockStripes]sync.Mutex
+
+const capsLockStripes = 256
+
+// The lock the user's receipts are counted against the daily caps under.
+func capsLock(userID string) *sync.Mutex {
+	stripe := fnv.New32a()
+	stripe.Write([]byte(userID))
+	return &capsLocks[stripe.Sum32()%capsLockStripes]
+}
+
+// Wrapped by the error refusing a receipt over the daily receipts cap.
+var errReceiptCapReached = errors.New("daily receipt cap reached")
+
+// Whether the user's receipts are counted against a daily cap. Receipts without a user aren't.
+func (caps CapsConfig) daily(userID string) bool {
+	return userID != "" && (caps.DailyPoints > 0 || caps.DailyReceipts > 0)
+}
+
+/*
+Caps the receipt's points, adding a breakdown entry for what each cap took
+back, or refuses the receipt with an error wrapping errReceiptCapReached.
+The receipt's own earlier saves don't count against the daily caps, so
+correcting a receipt isn't refused as another one.
+*/
+func (caps CapsConfig) apply(store Store, record *storedReceipt) error {
+	if caps.ReceiptPoints > 0 && record.Points > caps.ReceiptPoints {
+		record.capAt(capReceiptRule, caps.ReceiptPoints, fmt.Sprintf("%d points per receipt", caps.ReceiptPoints))
+	}
+	if !caps.daily(record.UserID) {
+		return nil
+	}
+
+	earned, receiptCount, err := recentReceipts(store, record.UserID, record.ID)
+	if err != nil {
+		return err
+	}
+	if caps.DailyReceipts > 0 && receiptCount >= caps.DailyReceipts {
+		return fmt.Errorf("%w: %w", errReceiptCapReached, newClientError("receipt.daily_cap", caps.DailyReceipts))
+	}
+	if remaining := max(caps.DailyPoints-earned, 0); caps.DailyPoints > 0 && record.Points > remaining {
+		record.capAt(capDailyRule, remaining, fmt.Sprintf("%d points a day", caps.DailyPoints))
+	}
+	return nil
+}
+
+/*
+The points the user's other receipts earned in the last capWindow, net of
+replacements, from the ledger, and how many of them there were, counting
+the ones still waiting for review as well.
+*/
+func recentReceipts(store Store, userID string, receiptID string) (int, int, error) {
+	since := wallClock.Now().Add(-capWindow)
+	earned := 0
+	counted := make(map[string]bool)
+	for _, kind := range []string{ledgerReceipt, ledgerReceiptApproved, ledgerReceiptReplaced} {
+		entries, err := store.LedgerSince(userID, kind, since)
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, entry := range entries {
+			if entry.ReceiptID == receiptID {
+				continue
+			}
+			earned += entry.Points
+			if kind != ledgerReceiptReplaced {
+				counted[entry.ReceiptID] = true
+			}
+		}
+	}
+	// held receipts have no ledger entries until they're approved
+	pending, err := store.PendingReviewSince(userID, since)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, id := range pending {
+		if id != receiptID {
+			counted[id] = true
+		}
+	}
+	return earned, len(counted), nil
+}
+
+// Lowers the receipt's points to the cap's, recording what was taken back in its breakdown.
+func (record *storedReceipt) capAt(rule string, points int, detail string) {
+	record.Breakdown = append(record.Breakdown, ruleResult{
+		Rule:          rule,
+		Points:        points - record.Points,
+		PrecisePoints: (wholePoints(points) - record.precisePoints()).precise(),
+		Detail:        detail,
+	})
+	record.Points = points
+}
+
+// The breakdown entries of the caps that lowered the receipt's points.
+func (record storedReceipt) capsApplied() []ruleResult {
+	var applied []ruleResult
+	for _, result := range record.Breakdown {
+		if result.Rule == capReceiptRule || result.Rule == capDailyRule {
+			applied = append(applied, result)
+		}
+	}
+	return applied
+}
+
+// A ledger entry crediting the receipt's points, noting any caps that lowered them.
+func receiptLedgerEntry(record storedReceipt, kind string) ledgerEntry {
+	entry := newLedgerEntry(record.UserID, kind, record.Points, record.ID)
+	var reasons []string
+	for _, result := range record.capsApplied() {
+		reasons = append(reasons, fmt.Sprintf("capped at %s (%d)", result.Detail, result.Points))
+	}
+	entry.Reason = strings.Join(reasons, ", ")
+	return entry
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCapsConfigApply(t *testing.T) {
+	// receipts the user already submitted today
+	earlier := []storedReceipt{
+		{ID: "earlier-1", UserID: "user", Points: 60},
+		{ID: "earlier-2", UserID: "user", Points: 30, Status: reviewPending},
+	}
+	tests := []struct {
+		name       string
+		caps       CapsConfig
+		record     storedReceipt
+		wantPoints int
+		wantRules  []string
+		wantCapped bool
+	}{
+		{"no caps", CapsConfig{}, storedReceipt{ID: "new", UserID: "user", Points: 500}, 500, nil, false},
+		{"under the receipt cap", CapsConfig{ReceiptPoints: 100}, storedReceipt{ID: "new", UserID: "user", Points: 80}, 80, nil, false},
+		{"over the receipt cap", CapsConfig{ReceiptPoints: 100}, storedReceipt{ID: "new", UserID: "user", Points: 150}, 100, []string{capReceiptRule}, false},
+		{"over the daily points cap", CapsConfig{DailyPoints: 100}, storedReceipt{ID: "new", UserID: "user", Points: 50}, 40, []string{capDailyRule}, false},
+		{"over both points caps", CapsConfig{ReceiptPoints: 45, DailyPoints: 100}, storedReceipt{ID: "new", UserID: "user", Points: 50}, 40, []string{capReceiptRule, capDailyRule}, false},
+		// the held receipt counts as one of today's
+		{"at the daily receipts cap", CapsConfig{DailyReceipts: 2}, storedReceipt{ID: "new", UserID: "user", Points: 10}, 10, nil, true},
+		{"under the daily receipts cap", CapsConfig{DailyReceipts: 3}, storedReceipt{ID: "new", UserID: "user", Points: 10}, 10, nil, false},
+		// saving a receipt again doesn't count it twice
+		{"resaving a receipt", CapsConfig{DailyReceipts: 2, DailyPoints: 100}, storedReceipt{ID: "earlier-1", UserID: "user", Points: 70}, 70, nil, false},
+		{"no user", CapsConfig{DailyReceipts: 1, DailyPoints: 1}, storedReceipt{ID: "new", Points: 50}, 50, nil, false},
+		{"another user", CapsConfig{DailyReceipts: 1, DailyPoints: 100}, storedReceipt{ID: "new", UserID: "other", Points: 50}, 50, nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newMemoryStore()
+			for _, record := range earlier {
+				record.ProcessedAt = time.Now().Add(-time.Hour)
+				if _, err := store.SaveReceipt(record); err != nil {
+					t.Fatalf("SaveReceipt() failed: %v", err)
+				}
+			}
+
+			record := test.record
+			record.ProcessedAt = time.Now()
+			err := test.caps.apply(store, &record)
+			if capped := errors.Is(err, errReceiptCapReached); capped != test.wantCapped {
+				t.Fatalf("apply() = %v, want refused %v", err, test.wantCapped)
+			}
+			if err != nil && !test.wantCapped {
+				t.Fatalf("apply() failed: %v", err)
+			}
+			if record.Points != test.wantPoints {
+				t.Errorf("apply() left %d points, want %d", record.Points, test.wantPoints)
+			}
+			applied := record.capsApplied()
+			if len(applied) != len(test.wantRules) {
+				t.Fatalf("apply() added %d cap entries, want %v", len(applied), test.wantRules)
+			}
+			for index, result := range applied {
+				if result.Rule != test.wantRules[index] {
+					t.Errorf("cap entry %d is %s, want %s", index, result.Rule, test.wantRules[index])
+				}
+			}
+		})
+	}
+}
+
+// A store slow to read the ledger, so submissions counting it overlap.
+type slowLedgerStore struct {
+	Store
+}
+
+func (store slowLedgerStore) LedgerSince(userID string, kind string, since time.Time) ([]ledgerEntry, error) {
+	time.Sleep(5 * time.Millisecond)
+	return store.Store.LedgerSince(userID, kind, since)
+}
+
+// Concurrent submissions from one user fit under the daily receipts cap together, not each.
+func TestDailyReceiptCapWithConcurrentSubmissions(t *testing.T) {
+	receipts = slowLedgerStore{useTestGlobals(t)}
+	pointsCaps = CapsConfig{DailyReceipts: 3}
+	const submissions = 20
+	scoringPool = newWorkerPool(submissions+1, 0)
+	var wait sync.WaitGroup
+	results := make(chan error, submissions)
+	for submission := 0; submission < submissions; submission++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			_, err := processReceipt(processing{}, targetReceipt(), "alice", channelAPI)
+			results <- err
+		}()
+	}
+	// another user isn't held back by alice's cap
+	if _, err := processReceipt(processing{}, targetReceipt(), "bob", channelAPI); err != nil {
+		t.Errorf("bob's receipt failed: %v", err)
+	}
+	wait.Wait()
+	close(results)
+
+	accepted := 0
+	for err := range results {
+		switch {
+		case err == nil:
+			accepted++
+		case !errors.Is(err, errReceiptCapReached):
+			t.Errorf("a submission failed with %v, want it accepted or capped", err)
+		}
+	}
+	if accepted != 3 {
+		t.Errorf("%d of alice's receipts were accepted, want the cap's 3", accepted)
+	}
+	if balance, _ := receipts.Balance("alice"); balance != 3*28 {
+		t.Errorf("alice has %d points, want %d", balance, 3*28)
+	}
+}
+
+func TestCapsLockStripes(t *testing.T) {
+	if capsLock("alice") != capsLock("alice") {
+		t.Error("one user's receipts are counted under different locks")
+	}
+	stripes := make(map[*sync.Mutex]bool)
+	for _, user := range []string{"alice", "bob", "carol", "dave", "erin", "frank", "grace", "heidi"} {
+		stripes[capsLock(user)] = true
+	}
+	if len(stripes) < 2 {
+		t.Error("every user is counted under the same lock")
+	}
+}
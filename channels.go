@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How a receipt reached the service, stored with it and seen by the rules.
+const (
+	// POST /receipts/process with JSON, or the websocket
+	channelAPI = "api"
+	// POST /receipts/process with a multipart form, often with a scan attached
+	channelUpload = "upload"
+	// POST /receipts/qr
+	channelQR = "qr"
+	// POST /receipts/wallet
+	channelWallet = "wallet"
+	// POST /receipts/batch
+	channelBatch = "batch"
+	// NATS or SQS messages
+	channelQueue = "queue"
+
+	// how a client says it captured a receipt it submits, see submissionChannel
+	channelManual = "manual"
+	channelOCR    = "ocr"
+	channelEmail  = "email"
+)
+
+// Every channel, in the order they're listed in errors.
+var receiptChannels = []string{
+	channelAPI, channelUpload, channelQR, channelWallet, channelBatch, channelQueue, channelManual, channelOCR, channelEmail,
+}
+
+// The channels clients may claim for what they submit to POST /receipts/process.
+var declaredChannels = []string{channelManual, channelOCR, channelEmail}
+
+/*
+The channel of a receipt submitted to POST /receipts/process: the
+X-Receipt-Channel header when the client says how it captured the receipt,
+e.g. "manual" for one typed in by hand, otherwise the fallback. Errors are
+clientErrors.
+*/
+func submissionChannel(context *gin.Context, fallback string) (string, error) {
+	declared := strings.ToLower(strings.TrimSpace(context.GetHeader("X-Receipt-Channel")))
+	if declared == "" {
+		return fallback, nil
+	}
+	if !slices.Contains(declaredChannels, declared) {
+		return "", newClientError("receipt.channel_invalid", declared, strings.Join(declaredChannels, ", "))
+	}
+	return declared, nil
+}
+
+/*
+Adjusts the points of receipts that came in through any of the channels:
+the other rules' points are multiplied by Multiplier when it's set (0.5
+halves them), then Points are added, which may be negative, e.g. to award
+less for manually entered receipts than for scanned ones.
+*/
+type channelRule struct {
+	Name       string   `json:"name"`
+	Channels   []string `json:"channels"`
+	Points     int      `json:"points"`
+	Multiplier float64  `json:"multiplier"`
+	Flag       string   `json:"flag"`
+}
+
+func (rule channelRule) validate() error {
+	if len(rule.Channels) == 0 {
+		return fmt.Errorf("channel rule %s needs channels", rule.Name)
+	}
+	for _, channel := range rule.Channels {
+		if !slices.Contains(receiptChannels, channel) {
+			return fmt.Errorf(
+				"channel rule %s has an unknown channel %q, not one of %s",
+				rule.Name, channel, strings.Join(receiptChannels, ", "),
+			)
+		}
+	}
+	if rule.Multiplier < 0 {
+		return fmt.Errorf("channel rule %s has a negative multiplier", rule.Name)
+	}
+	return nil
+}
+
+func (rule channelRule) rule() scoringRule {
+	description := fmt.Sprintf("%d points", rule.Points)
+	if rule.Multiplier > 0 {
+		description = fmt.Sprintf("The other rules' points times %g and %d points", rule.Multiplier, rule.Points)
+	}
+	return scoringRule{
+		Name:        rule.Name,
+		Flag:        rule.Flag,
+		Description: description + " for receipts submitted by " + strings.Join(rule.Channels, " or "),
+		bonus: func(receipt parsedReceipt, subtotal centipoints) (centipoints, string) {
+			if !slices.Contains(rule.Channels, receipt.channel) {
+				return 0, ""
+			}
+			points := wholePoints(rule.Points)
+			if rule.Multiplier > 0 {
+				points += centipoints(math.Round(float64(subtotal) * (rule.Multiplier - 1)))
+			}
+			return points, receipt.channel
+		},
+	}
+}
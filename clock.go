@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Tells the time. What depends on the date, like the scoring rules, purchase
+date checks, retention and report periods, asks a Clock rather than the
+system, so sandboxes can stop time and admins can process historical
+receipts as of when they were bought.
+*/
+type Clock interface {
+	Now() time.Time
+}
+
+// The system's clock.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// A clock stopped at one time.
+type fixedClock time.Time
+
+func (clock fixedClock) Now() time.Time {
+	return time.Time(clock)
+}
+
+// Global clock of everything that isn't in a sandbox or backdated
+var wallClock Clock = systemClock{}
+
+// Key a backdated request's processing is stored under in the gin context, see backdate.
+const asOfContextKey = "asOf"
+
+// Value of asOf processing each receipt at its own purchase time.
+const asOfPurchase = "purchase"
+
+/*
+Where and when a receipt is processed: production's store at the wall
+clock's time unless it's in a sandbox or backdated. The zero value is
+production now.
+*/
+type processing struct {
+	// the sandbox the receipt is processed in, or nil for production
+	sandbox *sandbox
+	// the time it's processed at, or nil for the sandbox's or the wall clock
+	clock Clock
+	// whether each receipt is processed as of its purchase time instead
+	atPurchase bool
+	// name of the API key submitting it, if any, see apiKey
+	apiKey string
+}
+
+// How the request's receipts are processed.
+func processingFor(context *gin.Context) processing {
+	var target processing
+	if box := sandboxOf(context); box != nil {
+		target.sandbox, target.clock = box, box
+	}
+	if value, exists := context.Get(asOfContextKey); exists {
+		asOf := value.(processing)
+		target.clock, target.atPurchase = asOf.clock, asOf.atPurchase
+	}
+	if value, exists := context.Get(apiKeyContextKey); exists {
+		target.apiKey = value.(apiKey).Name
+	}
+	return target
+}
+
+// The store receipts are saved in.
+func (target processing) store() Store {
+	if target.sandbox != nil {
+		return target.sandbox.store
+	}
+	return receipts
+}
+
+/*
+The time the receipt is processed at. Backdated to its purchase, a receipt
+whose date or time doesn't parse is processed now, and refused for them.
+*/
+func (target processing) now(receipt Receipt) time.Time {
+	if target.atPurchase {
+		if purchase, err := time.Parse("2006-01-02 15:04", receipt.Date+" "+receipt.Time); err == nil {
+			return purchase
+		}
+	}
+	if target.clock != nil {
+		return target.clock.Now()
+	}
+	return wallClock.Now()
+}
+
+/*
+Admin middleware processing the request's receipts as of ?asOf=, either an
+RFC 3339 time or "purchase" for each receipt's own purchase time (taken
+as UTC), e.g. to award a promotion that ran back then to receipts imported
+since.
+*/
+func backdate(context *gin.Context) {
+	asOf := context.Query("asOf")
+	if asOf == asOfPurchase {
+		context.Set(asOfContextKey, processing{atPurchase: true})
+		context.Next()
+		return
+	}
+	at, err := time.Parse(time.RFC3339, asOf)
+	if err != nil {
+		abortWithMessage(context, http.StatusBadRequest, "backdate.as_of_invalid", asOfPurchase)
+		return
+	}
+	context.Set(asOfContextKey, processing{clock: fixedClock(at.UTC())})
+	context.Next()
+}
+
+/*
+Processes a historical receipt as of the time backdate chose, for the
+user in X-User-ID, and records who did it in the audit trail.
+*/
+func postBackdatedReceipt(context *gin.Context) {
+	channel, err := submissionChannel(context, channelAPI)
+	if err != nil {
+		respondWithError(context, http.StatusBadRequest, err)
+		return
+	}
+	record, err := processReceipt(processingFor(context), boundReceipt(context), submittingUser(context), channel)
+	if err != nil {
+		respondWithProcessError(context, err)
+		return
+	}
+	recordAudit(context, auditEntry{
+		Action:    auditReceiptBackdated,
+		ReceiptID: record.ID,
+		UserID:    record.UserID,
+		After:     &record,
+		Points:    record.Points,
+		Reason:    "as of " + record.ProcessedAt.Format(time.RFC3339),
+	})
+
+	response := gin.H{
+		"id":           record.ID,
+		"points":       record.Points,
+		"processedAt":  record.ProcessedAt,
+		"rulesVersion": record.RulesVersion,
+		"links":        receiptLinks(record.ID),
+	}
+	if record.Status != "" {
+		response["status"] = record.Status
+	}
+	if capped := record.capsApplied(); capped != nil {
+		response["capped"] = capped
+	}
+	context.IndentedJSON(http.StatusCreated, response)
+}
+
+// Whole calendar days from the date to the time's day, both in UTC.
+func daysBetween(date time.Time, at time.Time) int {
+	day := time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, time.UTC)
+	return int(day.Sub(date).Hours() / 24)
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Runtime configuration for the service, read from the environment.
+type Config struct {
+	Address string
+
+	// JSON file configuring the rules engine, see RulesConfig.
+	RulesFile string
+	// "lenient" or "strict", see receiptSchema.
+	ReceiptSchema string
+	// Directory of WebAssembly scoring plugins, and how long each call may take.
+	PluginDir     string
+	PluginTimeout time.Duration
+	// Directory whose receipt.html replaces the built-in template for rendered receipts.
+	RenderTemplateDir string
+	// JSON file of issuers' wallet pass adapters, see walletAdapter.
+	WalletAdaptersFile string
+
+	// How many receipts are scored at once, and how many more may wait
+	// before submissions are rejected with 503.
+	WorkerConcurrency int
+	WorkerQueueDepth  int
+
+	// Where receipts and balances are kept: "memory", "postgres" or
+	// "sharded" across StoreShards (name=url pairs, the first the primary,
+	// see shardedStore). Cluster mode is for running several replicas behind a load balancer;
+	// it requires a shared store and relays receipt events between replicas.
+	StoreBackend string
+	DatabaseURL  string
+	ClusterMode  bool
+	StoreShards  []string
+	// Shards being drained by the rebalance command.
+	RetiredShards []string
+	// Names of the shards receipts were placed on before the shards changed.
+	PreviousShards []string
+	// The stores STORE_BACKEND=dual moves between.
+	DualWrite DualWriteConfig
+	// Apply pending SQL migrations at startup instead of with `migrate up`.
+	MigrateOnStartup bool
+
+	// How many receipts' points are kept in the lookup cache.
+	PointsCacheSize int
+	// How replicas invalidate each other's caches, see InvalidationConfig.
+	Invalidation InvalidationConfig
+
+	// The anonymized export for the data-science team, see AnalyticsExportConfig.
+	Analytics AnalyticsExportConfig
+
+	// How often finished days and weeks are checked for missing reports, 0 to never.
+	ReportInterval time.Duration
+
+	// How long deleted receipts can be restored before they're purged.
+	TrashRetention time.Duration
+
+	// Which receipts are held for review before their points are awarded.
+	Review ReviewConfig
+
+	// How calls to the store and integrations are retried, see ResilienceConfig.
+	Resilience ResilienceConfig
+
+	// How retailers are matched to merchants, see EnrichmentConfig.
+	Enrichment EnrichmentConfig
+
+	// Where receipts' original images and PDFs are kept, see BlobConfig.
+	Blobs BlobConfig
+
+	// Charities users can donate points to, see DonationConfig.
+	Donations DonationConfig
+
+	// Limits on moving points between users, see TransferConfig.
+	Transfers TransferConfig
+
+	// Caps on the points and receipts users can earn and submit, see CapsConfig.
+	Caps CapsConfig
+
+	// Receipts consumed from NATS JetStream, see NATSConfig.
+	NATS NATSConfig
+
+	// How users are told about points, see NotificationConfig.
+	Notifications NotificationConfig
+
+	// Shared secret partners use to sign receipt submissions. Signature
+	// verification is disabled when empty.
+	SignatureSecret  string
+	SignatureMaxSkew time.Duration
+	// Largest signed batch, in bytes, held on disk while its signature is checked.
+	MaxSignedBatch int64
+	// How signed submissions are checked for replays, see ReplayConfig.
+	Replay ReplayConfig
+	// Partners' API keys and their submission quotas, see QuotaConfig.
+	Quotas QuotaConfig
+	// Where async batches are queued, see JobQueueConfig.
+	Jobs JobQueueConfig
+	// Isolated namespaces for partners' integration tests, see SandboxConfig.
+	Sandbox SandboxConfig
+	// Redis shared by replicas, for the features configured to use it.
+	RedisURL string
+
+	// HTTPS is served from a cert/key pair, or from certificates obtained
+	// automatically for AutocertDomains. HTTPRedirectAddress optionally
+	// listens for plain HTTP and redirects it to HTTPS.
+	TLSCertFile         string
+	TLSKeyFile          string
+	AutocertDomains     []string
+	AutocertCacheDir    string
+	AutocertEmail       string
+	HTTPRedirectAddress string
+
+	// Bearer tokens are required and checked against this issuer when set.
+	// OIDCRoleMap translates values of the roles claim into our role names.
+	OIDCIssuer     string
+	OIDCAudience   string
+	OIDCRolesClaim string
+	OIDCRoleMap    map[string]string
+
+	// Where feature flags come from: env, file or ofrep, with the file or
+	// flag service for the latter two.
+	FlagProvider   string
+	FlagsFile      string
+	FlagServiceURL string
+	FlagCacheTTL   time.Duration
+
+	// Credentials operators use to sign in to the admin dashboard.
+	AdminUsername string
+	AdminPassword string
+
+	// CORS headers are only sent when at least one origin is allowed.
+	CORS CORSConfig
+}
+
+/*
+Builds the service configuration from environment variables, falling back
+to defaults that match running the app locally.
+*/
+func loadConfig() Config {
+	return Config{
+		Address:            envString("LISTEN_ADDRESS", "localhost:9090"),
+		RulesFile:          envString("RULES_FILE", ""),
+		ReceiptSchema:      envString("RECEIPT_SCHEMA", schemaLenient),
+		PluginDir:          envString("PLUGIN_DIR", ""),
+		WalletAdaptersFile: envString("WALLET_ADAPTERS_FILE", ""),
+		RenderTemplateDir:  envString("RENDER_TEMPLATE_DIR", ""),
+		PluginTimeout:      envDuration("PLUGIN_TIMEOUT", 100*time.Millisecond),
+		WorkerConcurrency:  envInt("WORKER_CONCURRENCY", runtime.NumCPU()),
+		WorkerQueueDepth:   envInt("WORKER_QUEUE_DEPTH", 100),
+		StoreBackend:       envString("STORE_BACKEND", "memory"),
+		DatabaseURL:        envString("DATABASE_URL", ""),
+		ClusterMode:        envBool("CLUSTER_MODE", false),
+		StoreShards:        envList("STORE_SHARDS"),
+		RetiredShards:      envList("STORE_RETIRED_SHARDS"),
+		PreviousShards:     envList("STORE_PREVIOUS_SHARDS"),
+		MigrateOnStartup:   envBool("MIGRATE_ON_STARTUP", true),
+		PointsCacheSize:    envInt("POINTS_CACHE_SIZE", 10000),
+		ReportInterval:     envDuration("REPORT_INTERVAL", time.Hour),
+		TrashRetention:     envDuration("TRASH_RETENTION", 30*24*time.Hour),
+		SignatureSecret:    envString("SIGNATURE_SECRET", ""),
+		SignatureMaxSkew:   envDuration("SIGNATURE_MAX_SKEW", 5*time.Minute),
+		MaxSignedBatch:     int64(envInt("SIGNATURE_BATCH_MAX_SIZE", 1<<30)),
+		RedisURL:           envString("REDIS_URL", ""),
+
+		TLSCertFile:         envString("TLS_CERT_FILE", ""),
+		TLSKeyFile:          envString("TLS_KEY_FILE", ""),
+		AutocertDomains:     envList("AUTOCERT_DOMAINS"),
+		AutocertCacheDir:    envString("AUTOCERT_CACHE_DIR", "certs"),
+		AutocertEmail:       envString("AUTOCERT_EMAIL", ""),
+		HTTPRedirectAddress: envString("HTTP_REDIRECT_ADDRESS", ""),
+
+		OIDCIssuer:     envString("OIDC_ISSUER", ""),
+		OIDCAudience:   envString("OIDC_AUDIENCE", ""),
+		OIDCRolesClaim: envString("OIDC_ROLES_CLAIM", "roles"),
+		OIDCRoleMap:    envMap("OIDC_ROLE_MAP"),
+
+		FlagProvider:   envString("FLAG_PROVIDER", "env"),
+		FlagsFile:      envString("FLAGS_FILE", "flags.json"),
+		FlagServiceURL: envString("FLAG_SERVICE_URL", ""),
+		FlagCacheTTL:   envDuration("FLAG_CACHE_TTL", 30*time.Second),
+
+		AdminUsername: envString("ADMIN_USERNAME", ""),
+		AdminPassword: envString("ADMIN_PASSWORD", ""),
+
+		Review: ReviewConfig{
+			MinPoints:      envInt("REVIEW_MIN_POINTS", 0),
+			MaxTotal:       envFloat("REVIEW_MAX_TOTAL", 0),
+			CheckItemTotal: envBool("REVIEW_CHECK_ITEM_TOTAL", false),
+		},
+
+		Resilience: ResilienceConfig{
+			Attempts:        envInt("RETRY_ATTEMPTS", 3),
+			Backoff:         envDuration("RETRY_BACKOFF", 100*time.Millisecond),
+			MaxBackoff:      envDuration("RETRY_MAX_BACKOFF", 2*time.Second),
+			BreakerFailures: envInt("BREAKER_FAILURES", 5),
+			BreakerCooldown: envDuration("BREAKER_COOLDOWN", 30*time.Second),
+		},
+
+		Enrichment: EnrichmentConfig{
+			Provider:        envString("MERCHANT_PROVIDER", ""),
+			URL:             envString("MERCHANT_API_URL", ""),
+			APIKey:          envString("MERCHANT_API_KEY", ""),
+			File:            envString("MERCHANT_FILE", "merchants.json"),
+			Timeout:         envDuration("MERCHANT_TIMEOUT", 500*time.Millisecond),
+			CacheSize:       envInt("MERCHANT_CACHE_SIZE", 1000),
+			CacheTTL:        envDuration("MERCHANT_CACHE_TTL", 24*time.Hour),
+			BreakerFailures: envInt("MERCHANT_BREAKER_FAILURES", 5),
+			BreakerCooldown: envDuration("MERCHANT_BREAKER_COOLDOWN", 30*time.Second),
+		},
+
+		Blobs: BlobConfig{
+			Backend:     envString("BLOB_BACKEND", "disk"),
+			Dir:         envString("BLOB_DIR", "blobs"),
+			S3Endpoint:  envString("BLOB_S3_ENDPOINT", ""),
+			S3Bucket:    envString("BLOB_S3_BUCKET", ""),
+			S3Region:    envString("BLOB_S3_REGION", "us-east-1"),
+			S3AccessKey: envString("BLOB_S3_ACCESS_KEY", ""),
+			S3SecretKey: envString("BLOB_S3_SECRET_KEY", ""),
+			MaxSize:     int64(envInt("BLOB_MAX_SIZE", 10<<20)),
+		},
+
+		Donations: DonationConfig{
+			Charities: envMap("CHARITY_PARTNERS"),
+			MinPoints: envInt("DONATION_MIN_POINTS", 1),
+		},
+
+		Transfers: TransferConfig{
+			MaxPoints:     envInt("TRANSFER_MAX_POINTS", 5000),
+			DailyLimit:    envInt("TRANSFER_DAILY_LIMIT", 10000),
+			MaxRecipients: envInt("TRANSFER_MAX_RECIPIENTS", 5),
+		},
+
+		Caps: CapsConfig{
+			ReceiptPoints: envInt("CAP_RECEIPT_POINTS", 0),
+			DailyPoints:   envInt("CAP_DAILY_POINTS", 0),
+			DailyReceipts: envInt("CAP_DAILY_RECEIPTS", 0),
+		},
+
+		DualWrite: DualWriteConfig{
+			From:       envString("STORE_DUAL_FROM", ""),
+			To:         envString("STORE_DUAL_TO", ""),
+			Read:       envString("STORE_DUAL_READ", "from"),
+			VerifyRate: envFloat("STORE_DUAL_VERIFY_RATE", 1),
+			Migrated:   envBool("STORE_DUAL_MIGRATED", false),
+		},
+
+		Replay: ReplayConfig{
+			Window:     envDuration("SIGNATURE_REPLAY_WINDOW", 10*time.Minute),
+			NonceCache: envString("SIGNATURE_NONCE_CACHE", "memory"),
+		},
+
+		Quotas: QuotaConfig{
+			KeysFile: envString("API_KEYS_FILE", ""),
+			Counter:  envString("QUOTA_COUNTER", "memory"),
+		},
+
+		Jobs: JobQueueConfig{
+			Backend:     envString("JOB_QUEUE", ""),
+			Workers:     envInt("JOB_WORKERS", 2),
+			MaxAttempts: envInt("JOB_MAX_ATTEMPTS", 5),
+			Backoff:     envDuration("JOB_RETRY_BACKOFF", time.Second),
+			MaxBackoff:  envDuration("JOB_MAX_BACKOFF", 5*time.Minute),
+		},
+
+		Invalidation: InvalidationConfig{
+			Backend: envString("CACHE_INVALIDATION", ""),
+			Channel: envString("CACHE_INVALIDATION_CHANNEL", "receipt-scanner.invalidations"),
+			NATSURL: envString("CACHE_INVALIDATION_NATS_URL", os.Getenv("NATS_URL")),
+		},
+
+		Analytics: AnalyticsExportConfig{
+			SaltSecret:   envString("ANALYTICS_SALT_SECRET", ""),
+			SaltRotation: envPositiveDuration("ANALYTICS_SALT_ROTATION", 30*24*time.Hour),
+		},
+
+		Sandbox: SandboxConfig{
+			Mode:          envString("SANDBOX_MODE", sandboxOff),
+			Time:          envString("SANDBOX_TIME", "2024-01-01T12:00:00Z"),
+			MaxNamespaces: envInt("SANDBOX_MAX_NAMESPACES", 100),
+		},
+
+		NATS: NATSConfig{
+			URL:           envString("NATS_URL", ""),
+			Stream:        envString("NATS_STREAM", ""),
+			Subject:       envString("NATS_SUBJECT", "receipts.submitted"),
+			Consumer:      envString("NATS_CONSUMER", "receipt-scanner"),
+			ResultSubject: envString("NATS_RESULT_SUBJECT", "receipts.scored"),
+			BatchSize:     envInt("NATS_BATCH_SIZE", 10),
+		},
+
+		Notifications: NotificationConfig{
+			SMTPAddress:        envString("NOTIFY_SMTP_ADDRESS", ""),
+			SMTPUsername:       envString("NOTIFY_SMTP_USERNAME", ""),
+			SMTPPassword:       envString("NOTIFY_SMTP_PASSWORD", ""),
+			SMTPFrom:           envString("NOTIFY_SMTP_FROM", ""),
+			FCMCredentialsFile: envString("NOTIFY_FCM_CREDENTIALS_FILE", ""),
+			WebhookURL:         envString("NOTIFY_WEBHOOK_URL", ""),
+			WebhookSecret:      envString("NOTIFY_WEBHOOK_SECRET", ""),
+		},
+
+		CORS: CORSConfig{
+			AllowedOrigins:   envList("CORS_ALLOWED_ORIGINS"),
+			AllowedMethods:   envListOr("CORS_ALLOWED_METHODS", "GET", "POST", "PUT", "DELETE", "OPTIONS"),
+			AllowedHeaders:   envListOr("CORS_ALLOWED_HEADERS", "Authorization", "Content-Type", signatureHeader, signatureTimestampHeader, signatureNonceHeader, apiKeyHeader),
+			AllowCredentials: envBool("CORS_ALLOW_CREDENTIALS", false),
+			MaxAge:           envDuration("CORS_MAX_AGE", 10*time.Minute),
+		},
+	}
+}
+
+func envString(key string, fallback string) string {
+	if value, exists := os.LookupEnv(key); exists {
+		return value
+	}
+	return fallback
+}
+
+// Reads a comma separated list, ignoring blank entries.
+func envList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if trimmed := strings.TrimSpace(value); trimmed != "" {
+			values = append(values, trimmed)
+		}
+	}
+	return values
+}
+
+// Like envList, but uses the fallback values when the variable is empty.
+func envListOr(key string, fallback ...string) []string {
+	if values := envList(key); len(values) > 0 {
+		return values
+	}
+	return fallback
+}
+
+// Reads a comma separated list of key=value pairs.
+func envMap(key string) map[string]string {
+	values := make(map[string]string)
+	for _, pair := range envList(key) {
+		if name, value, found := strings.Cut(pair, "="); found {
+			values[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+	return values
+}
+
+func envInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func envFloat(key string, fallback float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func envBool(key string, fallback bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// Like envDuration, but falls back for a duration that isn't positive too.
+func envPositiveDuration(key string, fallback time.Duration) time.Duration {
+	if value := envDuration(key, fallback); value > 0 {
+		return value
+	}
+	return fallback
+}
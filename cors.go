@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type CORSConfig struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+// Response headers browsers let scripts read besides the safelisted ones, for caching, async batches and quotas.
+var corsExposedHeaders = strings.Join([]string{
+	"ETag", "Last-Modified", "Location", "Retry-After", "Preference-Applied",
+	"X-Quota-Limit-Day", "X-Quota-Remaining-Day", "X-Quota-Reset-Day",
+	"X-Quota-Limit-Month", "X-Quota-Remaining-Month", "X-Quota-Reset-Month",
+}, ", ")
+
+/*
+Refuses credentials with the "*" origin: any site could then call the API
+as the user, with their cookies.
+*/
+func (config CORSConfig) validate() error {
+	if config.AllowCredentials && allowsAnyOrigin(config.AllowedOrigins) {
+		return errors.New("CORS_ALLOW_CREDENTIALS needs CORS_ALLOWED_ORIGINS to list origins, not *")
+	}
+	return nil
+}
+
+/*
+Middleware adding CORS headers for allowed origins and answering preflight
+requests itself, so they never reach authentication. An origin of "*"
+allows any origin, without credentials; see validate.
+*/
+func cors(config CORSConfig) gin.HandlerFunc {
+	allowedMethods := strings.Join(config.AllowedMethods, ", ")
+	allowedHeaders := strings.Join(config.AllowedHeaders, ", ")
+	maxAge := strconv.Itoa(int(config.MaxAge.Seconds()))
+
+	return func(context *gin.Context) {
+		origin := context.GetHeader("Origin")
+		context.Header("Vary", "Origin")
+		if origin == "" || !originAllowed(config.AllowedOrigins, origin) {
+			context.Next()
+			return
+		}
+
+		if allowsAnyOrigin(config.AllowedOrigins) {
+			context.Header("Access-Control-Allow-Origin", "*")
+		} else {
+			context.Header("Access-Control-Allow-Origin", origin)
+		}
+		if config.AllowCredentials {
+			context.Header("Access-Control-Allow-Credentials", "true")
+		}
+		context.Header("Access-Control-Expose-Headers", corsExposedHeaders)
+
+		preflight := context.Request.Method == http.MethodOptions &&
+			context.GetHeader("Access-Control-Request-Method") != ""
+		if !preflight {
+			context.Next()
+			return
+		}
+
+		context.Header("Access-Control-Allow-Methods", allowedMethods)
+		context.Header("Access-Control-Allow-Headers", allowedHeaders)
+		if config.MaxAge > 0 {
+			context.Header("Access-Control-Max-Age", maxAge)
+		}
+		context.AbortWithStatus(http.StatusNoContent)
+	}
+}
+
+func originAllowed(allowedOrigins []string, origin string) bool {
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func allowsAnyOrigin(allowedOrigins []string) bool {
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCORSConfigValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		origins     []string
+		credentials bool
+		wantErr     bool
+	}{
+		{"any origin", []string{"*"}, false, false},
+		{"listed origins with credentials", []string{"https://app.example.com"}, true, false},
+		{"any origin with credentials", []string{"https://app.example.com", "*"}, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := CORSConfig{AllowedOrigins: test.origins, AllowCredentials: test.credentials}.validate()
+			if (err != nil) != test.wantErr {
+				t.Errorf("validate() = %v, want an error %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+// Scripts on an allowed origin can read the headers clients cache and page with.
+func TestCORSExposesHeaders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(cors(CORSConfig{AllowedOrigins: []string{"https://app.example.com"}, AllowCredentials: true}))
+	router.GET("/receipts/:id/points", func(context *gin.Context) { context.Status(http.StatusOK) })
+
+	request := httptest.NewRequest(http.MethodGet, "/receipts/r/points", nil)
+	request.Header.Set("Origin", "https://app.example.com")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	if origin := recorder.Header().Get("Access-Control-Allow-Origin"); origin != "https://app.example.com" {
+		t.Errorf("Access-Control-Allow-Origin is %q, want the request's origin", origin)
+	}
+	exposed := recorder.Header().Get("Access-Control-Expose-Headers")
+	for _, header := range []string{"ETag", "Last-Modified", "Location", "X-Quota-Remaining-Day"} {
+		if !strings.Contains(exposed, header) {
+			t.Errorf("Access-Control-Expose-Headers is %q, want it to list %s", exposed, header)
+		}
+	}
+}
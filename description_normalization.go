@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/text/cases"
+)
+
+/*
+A step item descriptions go through before rules measure them, so the same
+item formatted differently by different partners scores the same.
+*/
+type normalizationStep string
+
+const (
+	// removes leading and trailing whitespace
+	normalizeTrim normalizationStep = "trim"
+	// turns every run of whitespace into a single space
+	normalizeCollapseWhitespace normalizationStep = "collapse-whitespace"
+	// removes product codes, see skuPattern
+	normalizeStripSKUs normalizationStep = "strip-skus"
+	// folds case, so "DORITOS" and "Doritos" are the same
+	normalizeCaseFold normalizationStep = "casefold"
+)
+
+/*
+The steps item descriptions go through, in order. Without any in the rules
+config descriptions are only trimmed, as the description length rule
+always did; an empty list measures them as given.
+*/
+type descriptionNormalization []normalizationStep
+
+// Product codes partners print in descriptions: labelled SKUs, UPCs and PLUs
+// like "SKU: A-1234", numbers like "#0042", and bare codes of 6 or more digits.
+var skuPattern = regexp.MustCompile(`(?i)\b(?:sku|upc|plu)\s*[:#]?\s*[a-z0-9-]*\d[a-z0-9-]*|#\d+\b|\b\d{6,}\b`)
+
+var whitespacePattern = regexp.MustCompile(`\s+`)
+
+func (steps descriptionNormalization) validate() error {
+	for _, step := range steps {
+		switch step {
+		case normalizeTrim, normalizeCollapseWhitespace, normalizeStripSKUs, normalizeCaseFold:
+		default:
+			return fmt.Errorf(
+				"descriptionNormalization steps must be %s, %s, %s or %s, not %q",
+				normalizeTrim, normalizeCollapseWhitespace, normalizeStripSKUs, normalizeCaseFold, step,
+			)
+		}
+	}
+	return nil
+}
+
+// The description after every step.
+func (steps descriptionNormalization) apply(description string) string {
+	for _, step := range steps {
+		switch step {
+		case normalizeTrim:
+			description = strings.TrimSpace(description)
+		case normalizeCollapseWhitespace:
+			description = whitespacePattern.ReplaceAllString(description, " ")
+		case normalizeStripSKUs:
+			description = skuPattern.ReplaceAllString(description, "")
+		case normalizeCaseFold:
+			// a Caser keeps state, so each description gets its own
+			description = cases.Fold().String(description)
+		}
+	}
+	return description
+}
+
+// The receipt's items with their descriptions normalized, leaving the receipt's own untouched.
+func (steps descriptionNormalization) items(items []Item) []Item {
+	normalized := make([]Item, len(items))
+	for index, item := range items {
+		normalized[index] = item
+		normalized[index].Description = steps.apply(item.Description)
+	}
+	return normalized
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// One field that differs between two receipts, by its JSON path, e.g. "receipt.items[1].price".
+type fieldChange struct {
+	Field string `json:"field"`
+	From  any    `json:"from"`
+	To    any    `json:"to"`
+}
+
+// How one rule's points differ between two receipts; rules missing from one scored nothing there.
+type ruleDelta struct {
+	Rule  string  `json:"rule"`
+	From  float64 `json:"from"`
+	To    float64 `json:"to"`
+	Delta float64 `json:"delta"`
+}
+
+// Which receipt, at which version, one side of a diff is.
+type diffSide struct {
+	ID           string  `json:"id"`
+	Version      int64   `json:"version"`
+	Points       int     `json:"points"`
+	PreciseTotal float64 `json:"precisePoints"`
+	RulesVersion string  `json:"rulesVersion"`
+}
+
+func sideOf(record storedReceipt) diffSide {
+	return diffSide{
+		ID:           record.ID,
+		Version:      record.Version,
+		Points:       record.Points,
+		PreciseTotal: record.precisePoints().precise(),
+		RulesVersion: record.RulesVersion,
+	}
+}
+
+/*
+Compares two receipts for support agents handling rescoring disputes:
+either the receipt with ?against=, another receipt, or two versions of the
+receipt with ?from= and ?to=. Versions default to the current one and the
+one before it; earlier versions come from the audit trail, which keeps
+each update's before and after. Responds with the fields that changed, each
+rule's points on both sides, and the difference in points.
+*/
+func getReceiptDiff(context *gin.Context) {
+	against := context.Query("against")
+	_, hasFrom := context.GetQuery("from")
+	_, hasTo := context.GetQuery("to")
+	if against != "" && (hasFrom || hasTo) {
+		respondWithMessage(context, http.StatusBadRequest, "diff.against_with_versions")
+		return
+	}
+
+	current, err := receipts.GetReceipt(context.Param("id"))
+	if errors.Is(err, errReceiptNotFound) {
+		respondWithMessage(context, http.StatusNotFound, "receipt.not_found")
+		return
+	}
+	if err != nil {
+		respondWithMessage(context, http.StatusInternalServerError, "points.lookup_failed")
+		return
+	}
+
+	var from, to storedReceipt
+	if against != "" {
+		other, err := receipts.GetReceipt(against)
+		if errors.Is(err, errReceiptNotFound) {
+			respondWithMessage(context, http.StatusNotFound, "receipt.not_found")
+			return
+		}
+		if err != nil {
+			respondWithMessage(context, http.StatusInternalServerError, "points.lookup_failed")
+			return
+		}
+		from, to = current, other
+	} else {
+		versions, err := receiptVersions(current)
+		if err != nil {
+			respondWithMessage(context, http.StatusInternalServerError, "audit.lookup_failed")
+			return
+		}
+		var found bool
+		if to, found = pickVersion(context, versions, "to", current.Version); !found {
+			return
+		}
+		if from, found = pickVersion(context, versions, "from", versions.before(to.Version)); !found {
+			return
+		}
+	}
+
+	changes, err := diffFields(from, to)
+	if err != nil {
+		respondWithMessage(context, http.StatusInternalServerError, "diff.failed")
+		return
+	}
+	context.IndentedJSON(http.StatusOK, gin.H{
+		"from":               sideOf(from),
+		"to":                 sideOf(to),
+		"pointsDelta":        to.Points - from.Points,
+		"precisePointsDelta": (to.precisePoints() - from.precisePoints()).precise(),
+		"changes":            changes,
+		"rules":              diffRules(from.Breakdown, to.Breakdown),
+	})
+}
+
+// The versions of a receipt known to the audit trail and the store, by version.
+type receiptVersionSet map[int64]storedReceipt
+
+func receiptVersions(current storedReceipt) (receiptVersionSet, error) {
+	entries, err := receipts.AuditTrail(current.ID, "", maxAuditLimit)
+	if err != nil {
+		return nil, err
+	}
+	versions := receiptVersionSet{current.Version: current}
+	for _, entry := range entries {
+		for _, snapshot := range []*storedReceipt{entry.Before, entry.After} {
+			if snapshot == nil {
+				continue
+			}
+			if _, known := versions[snapshot.Version]; !known {
+				versions[snapshot.Version] = *snapshot
+			}
+		}
+	}
+	return versions, nil
+}
+
+// The latest version known before the version, or the version itself when there's none.
+func (versions receiptVersionSet) before(version int64) int64 {
+	earlier := version
+	for known := range versions {
+		if known < version && (earlier == version || known > earlier) {
+			earlier = known
+		}
+	}
+	return earlier
+}
+
+// The version named by the query parameter, or the fallback, responding when it's not known.
+func pickVersion(context *gin.Context, versions receiptVersionSet, parameter string, fallback int64) (storedReceipt, bool) {
+	version := fallback
+	if value, given := context.GetQuery(parameter); given {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			respondWithMessage(context, http.StatusBadRequest, "diff.version_invalid", parameter)
+			return storedReceipt{}, false
+		}
+		version = parsed
+	}
+	record, known := versions[version]
+	if !known {
+		respondWithMessage(context, http.StatusNotFound, "diff.version_not_found", version, versions.list())
+		return storedReceipt{}, false
+	}
+	return record, true
+}
+
+// The known versions, for errors, e.g. "1, 2, 4".
+func (versions receiptVersionSet) list() string {
+	known := make([]int64, 0, len(versions))
+	for version := range versions {
+		known = append(known, version)
+	}
+	slices.Sort(known)
+	list := make([]string, len(known))
+	for index, version := range known {
+		list[index] = strconv.FormatInt(version, 10)
+	}
+	return strings.Join(list, ", ")
+}
+
+/*
+The fields that differ between the receipts, as they appear in JSON. The
+breakdown is left to diffRules and the version to the sides of the diff.
+*/
+func diffFields(from storedReceipt, to storedReceipt) ([]fieldChange, error) {
+	fromFields, err := jsonFields(from)
+	if err != nil {
+		return nil, err
+	}
+	toFields, err := jsonFields(to)
+	if err != nil {
+		return nil, err
+	}
+	changes := []fieldChange{}
+	diffValues("", fromFields, toFields, &changes)
+	return changes, nil
+}
+
+// The receipt as generic JSON, without what diffFields leaves out.
+func jsonFields(record storedReceipt) (map[string]any, error) {
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		return nil, err
+	}
+	delete(fields, "breakdown")
+	delete(fields, "version")
+	return fields, nil
+}
+
+// Adds the differences between two JSON values at the path, descending into objects and arrays.
+func diffValues(path string, from any, to any, changes *[]fieldChange) {
+	fromObject, fromIsObject := from.(map[string]any)
+	toObject, toIsObject := to.(map[string]any)
+	if fromIsObject && toIsObject {
+		keys := make([]string, 0, len(fromObject)+len(toObject))
+		for key := range fromObject {
+			keys = append(keys, key)
+		}
+		for key := range toObject {
+			if _, shared := fromObject[key]; !shared {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			field := key
+			if path != "" {
+				field = path + "." + key
+			}
+			diffValues(field, fromObject[key], toObject[key], changes)
+		}
+		return
+	}
+
+	fromArray, fromIsArray := from.([]any)
+	toArray, toIsArray := to.([]any)
+	if fromIsArray && toIsArray {
+		for index := 0; index < max(len(fromArray), len(toArray)); index++ {
+			var fromElement, toElement any
+			if index < len(fromArray) {
+				fromElement = fromArray[index]
+			}
+			if index < len(toArray) {
+				toElement = toArray[index]
+			}
+			diffValues(fmt.Sprintf("%s[%d]", path, index), fromElement, toElement, changes)
+		}
+		return
+	}
+
+	if fmt.Sprint(from) != fmt.Sprint(to) {
+		*changes = append(*changes, fieldChange{Field: path, From: from, To: to})
+	}
+}
+
+// Each rule's points on both sides, in the order the first receipt's breakdown, then the second's, lists them.
+func diffRules(from []ruleResult, to []ruleResult) []ruleDelta {
+	var order []string
+	points := make(map[string]*[2]centipoints)
+	add := func(side int, breakdown []ruleResult) {
+		for _, result := range breakdown {
+			if points[result.Rule] == nil {
+				points[result.Rule] = &[2]centipoints{}
+				order = append(order, result.Rule)
+			}
+			precise := fractionalPoints(result.PrecisePoints)
+			if result.PrecisePoints == 0 {
+				precise = wholePoints(result.Points)
+			}
+			points[result.Rule][side] += precise
+		}
+	}
+	add(0, from)
+	add(1, to)
+
+	deltas := make([]ruleDelta, 0, len(order))
+	for _, rule := range order {
+		sides := points[rule]
+		deltas = append(deltas, ruleDelta{
+			Rule:  rule,
+			From:  sides[0].precise(),
+			To:    sides[1].precise(),
+			Delta: (sides[1] - sides[0]).precise(),
+		})
+	}
+	return deltas
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Charity partners users can donate points to, and the smallest donation accepted.
+type DonationConfig struct {
+	// charity ids mapped to display names
+	Charities map[string]string
+	MinPoints int
+}
+
+// All the points donated to one charity.
+type charityTotal struct {
+	Charity   string `json:"charity"`
+	Name      string `json:"name"`
+	Donations int    `json:"donations"`
+	Donors    int    `json:"donors"`
+	Points    int    `json:"points"`
+}
+
+const auditPointsDonated = "points.donated"
+
+/*
+Converts some of a user's points into a donation to a charity partner.
+Users can only donate their own points, as their token names them, and
+never more than their balance.
+*/
+func postDonation(config DonationConfig) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		userID := context.Param("id")
+		if context.GetString("subject") != userID {
+			respondWithMessage(context, http.StatusForbidden, "donation.forbidden")
+			return
+		}
+		var request struct {
+			Charity string `json:"charity"`
+			Points  int    `json:"points"`
+		}
+		if err := context.BindJSON(&request); err != nil {
+			respondWithMessage(context, http.StatusBadRequest, "donation.bind_failed")
+			return
+		}
+		name, known := config.Charities[request.Charity]
+		if !known {
+			respondWithMessage(context, http.StatusBadRequest, "donation.charity_unknown", request.Charity)
+			return
+		}
+		if request.Points < max(config.MinPoints, 1) {
+			respondWithMessage(context, http.StatusBadRequest, "donation.points_invalid", max(config.MinPoints, 1))
+			return
+		}
+
+		entry := newLedgerEntry(userID, ledgerDonation, -request.Points, "")
+		entry.Counterparty = request.Charity
+		applied, err := receiptStore(context).MovePoints(entry)
+		if errors.Is(err, errInsufficientPoints) {
+			respondWithMessage(context, http.StatusConflict, "donation.insufficient_points")
+			return
+		}
+		if updateConflict(err) {
+			respondWithConflict(context, err)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to record %s's donation: %v", userID, err)
+			respondWithMessage(context, http.StatusInternalServerError, "donation.failed")
+			return
+		}
+		entry = applied[0]
+		recordAudit(context, auditEntry{
+			Action: auditPointsDonated, UserID: userID, Points: entry.Points, Reason: name,
+		})
+		if sandboxOf(context) == nil {
+			notifyUser(notification{
+				Kind: notifyRedemption, UserID: userID, Points: request.Points, Balance: entry.Balance,
+				Args: []any{request.Points, name},
+			})
+		}
+
+		context.IndentedJSON(http.StatusCreated, gin.H{
+			"id":      entry.ID,
+			"charity": request.Charity,
+			"name":    name,
+			"points":  request.Points,
+			"balance": entry.Balance,
+		})
+	}
+}
+
+// Reports how many points each charity partner has received, and from how many users.
+func getDonationTotals(charities map[string]string) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		totals, err := receipts.DonationTotals()
+		if err != nil {
+			respondWithMessage(context, http.StatusInternalServerError, "donation.totals_failed")
+			return
+		}
+		points := 0
+		for index := range totals {
+			totals[index].Name = charities[totals[index].Charity]
+			points += totals[index].Points
+		}
+		context.IndentedJSON(http.StatusOK, gin.H{"charities": totals, "totalPoints": points})
+	}
+}
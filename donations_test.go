@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Donations made in a sandbox stay in it: nobody is notified and production's audit trail doesn't hear of them.
+func TestDonationNotifies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	config := DonationConfig{Charities: map[string]string{"redcross": "Red Cross"}, MinPoints: 10}
+	tests := []struct {
+		name        string
+		sandboxed   bool
+		wantNotices int
+	}{
+		{"in production", false, 1},
+		{"in a sandbox", true, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			production := useTestGlobals(t)
+			previous := notificationQueue
+			t.Cleanup(func() { notificationQueue = previous })
+			notificationQueue = make(chan notification, 10)
+
+			store := Store(production)
+			var box *sandbox
+			if test.sandboxed {
+				box = &sandbox{name: "test", store: newMemoryStore()}
+				store = box.store
+			}
+			store.SaveReceipt(storedReceipt{ID: "r1", UserID: "alice", Points: 100})
+
+			router := gin.New()
+			router.POST("/users/:id/donate", func(context *gin.Context) {
+				context.Set("subject", "alice")
+				if box != nil {
+					context.Set(sandboxContextKey, box)
+				}
+			}, postDonation(config))
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodPost, "/users/alice/donate", strings.NewReader(`{"charity": "redcross", "points": 40}`))
+			router.ServeHTTP(recorder, request)
+			if recorder.Code != http.StatusCreated {
+				t.Fatalf("donation got %d: %s, want 201", recorder.Code, recorder.Body)
+			}
+
+			if balance, _ := store.Balance("alice"); balance != 60 {
+				t.Errorf("alice has %d points left, want 60", balance)
+			}
+			if notices := len(notificationQueue); notices != test.wantNotices {
+				t.Errorf("%d notifications were sent, want %d", notices, test.wantNotices)
+			}
+			trail, _ := production.AuditTrail("", "alice", 10)
+			if wantAudited := !test.sandboxed; (len(trail) == 1) != wantAudited {
+				t.Errorf("production's audit trail has %d entries for alice, want audited %v", len(trail), wantAudited)
+			}
+		})
+	}
+}
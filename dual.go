@@ -0,0 +1,604 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+STORE_BACKEND=dual moves between stores without downtime. From and To are
+"memory" or PostgreSQL urls; Read names the one that's authoritative,
+"from" until the new store has caught up and "to" once it's trusted, and
+VerifyRate is the share of reads checked against the other store.
+Migrated confirms that what backfill doesn't copy, the ledger history,
+audit trail, profiles, merchant transactions and reports, has been moved
+to To some other way; Read can't be "to" before then.
+*/
+type DualWriteConfig struct {
+	From       string
+	To         string
+	Read       string
+	VerifyRate float64
+	Migrated   bool
+}
+
+// Most recent differences the drift report keeps.
+const maxDriftSamples = 100
+
+/*
+Writes to two stores and checks reads against both while moving from one
+to the other. The authoritative store answers every call; the shadow gets
+the same writes afterwards, and its failures are reported as drift rather
+than failing the request. Receipts and balances already in the
+authoritative store are copied over by backfill.
+*/
+type dualStore struct {
+	// answers reads and takes writes first
+	Store
+	shadow     Store
+	verifyRate float64
+	drift      *driftReport
+
+	// writes share it, so a backfill can pause them while it copies
+	writes sync.RWMutex
+}
+
+func openDualStore(config Config) (*dualStore, error) {
+	dual := config.DualWrite
+	if dual.From == "" || dual.To == "" {
+		return nil, errors.New("STORE_BACKEND=dual needs STORE_DUAL_FROM and STORE_DUAL_TO")
+	}
+	if dual.Read != "from" && dual.Read != "to" {
+		return nil, errors.New("STORE_DUAL_READ must be from or to, not " + dual.Read)
+	}
+	if dual.Read == "to" && !dual.Migrated {
+		return nil, errors.New(
+			"STORE_DUAL_READ=to needs STORE_DUAL_MIGRATED=true once the ledger, audit trail, profiles, " +
+				"merchant transactions and reports are in STORE_DUAL_TO, as backfill doesn't copy them",
+		)
+	}
+	authoritative, shadow := "from", "to"
+	authoritativeURL, shadowURL := dual.From, dual.To
+	if dual.Read == "to" {
+		authoritative, shadow = shadow, authoritative
+		authoritativeURL, shadowURL = shadowURL, authoritativeURL
+	}
+	// only one store relays events, or replicas would hear each one twice
+	primary, err := openNamedStore(authoritative, authoritativeURL, config, config.ClusterMode)
+	if err != nil {
+		return nil, err
+	}
+	secondary, err := openNamedStore(shadow, shadowURL, config, false)
+	if err != nil {
+		return nil, err
+	}
+	return &dualStore{Store: primary, shadow: secondary, verifyRate: dual.VerifyRate, drift: newDriftReport()}, nil
+}
+
+/*
+How the shadow store differs from the authoritative one since the app
+started or the last backfill: how many reads were compared and differed,
+how many writes the shadow failed, and the latest examples of each.
+*/
+type driftReport struct {
+	mutex sync.Mutex
+	driftCounts
+}
+
+type driftCounts struct {
+	Since         time.Time      `json:"since"`
+	Compared      map[string]int `json:"compared"`
+	Mismatched    map[string]int `json:"mismatched"`
+	WriteFailures map[string]int `json:"writeFailures"`
+	Samples       []driftSample  `json:"samples"`
+}
+
+// One difference between the stores, by the call that found it.
+type driftSample struct {
+	At     time.Time `json:"at"`
+	Method string    `json:"method"`
+	Key    string    `json:"key"`
+	// the fields that differ, or why the shadow failed
+	Detail string `json:"detail"`
+}
+
+func newDriftReport() *driftReport {
+	report := &driftReport{}
+	report.reset()
+	return report
+}
+
+// Starts the report over from now.
+func (report *driftReport) reset() {
+	report.Since = time.Now()
+	report.Compared = make(map[string]int)
+	report.Mismatched = make(map[string]int)
+	report.WriteFailures = make(map[string]int)
+	report.Samples = nil
+}
+
+func (report *driftReport) sample(method string, key string, detail string) {
+	report.Samples = append(report.Samples, driftSample{At: time.Now(), Method: method, Key: key, Detail: detail})
+	if len(report.Samples) > maxDriftSamples {
+		report.Samples = report.Samples[1:]
+	}
+}
+
+func (report *driftReport) compared(method string, key string, differences []string) {
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+
+	report.Compared[method]++
+	if len(differences) > 0 {
+		report.Mismatched[method]++
+		report.sample(method, key, "differs in "+strings.Join(differences, ", "))
+	}
+}
+
+func (report *driftReport) writeFailed(method string, key string, err error) {
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+
+	report.WriteFailures[method]++
+	report.sample(method, key, err.Error())
+	log.Printf("Shadow store failed %s for %s: %v", method, key, err)
+}
+
+// A copy of the report that's safe to serialize while it's still being added to.
+func (report *driftReport) snapshot() driftCounts {
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+
+	copied := driftCounts{
+		Since:         report.Since,
+		Compared:      make(map[string]int),
+		Mismatched:    make(map[string]int),
+		WriteFailures: make(map[string]int),
+		Samples:       append([]driftSample{}, report.Samples...),
+	}
+	for method, count := range report.Compared {
+		copied.Compared[method] = count
+	}
+	for method, count := range report.Mismatched {
+		copied.Mismatched[method] = count
+	}
+	for method, count := range report.WriteFailures {
+		copied.WriteFailures[method] = count
+	}
+	return copied
+}
+
+/*
+The top level JSON fields in which the values differ. Times are compared in
+UTC to the microsecond, as PostgreSQL keeps them.
+*/
+func driftFields(authoritative any, shadow any) []string {
+	decode := func(value any) map[string]json.RawMessage {
+		var fields map[string]json.RawMessage
+		encoded, _ := json.Marshal(value)
+		json.Unmarshal(encoded, &fields)
+		return fields
+	}
+	expected, actual := decode(authoritative), decode(shadow)
+	var differences []string
+	for name, value := range expected {
+		if string(value) != string(actual[name]) {
+			differences = append(differences, name)
+		}
+	}
+	for name := range actual {
+		if _, exists := expected[name]; !exists {
+			differences = append(differences, name)
+		}
+	}
+	sort.Strings(differences)
+	return differences
+}
+
+/*
+The record as both stores should hold it, with its times as PostgreSQL
+keeps them. Each store stamps its own modification times, so they're left
+out.
+*/
+func comparableRecord(record storedReceipt) storedReceipt {
+	record.ModifiedAt = time.Time{}
+	record.ProcessedAt = record.ProcessedAt.UTC().Truncate(time.Microsecond)
+	if record.DeletedAt != nil {
+		deletedAt := record.DeletedAt.UTC().Truncate(time.Microsecond)
+		record.DeletedAt = &deletedAt
+	}
+	return record
+}
+
+// Whether this read should be checked against the shadow.
+func (store *dualStore) verifying() bool {
+	return store.verifyRate >= 1 || rand.Float64() < store.verifyRate
+}
+
+// Sends a write the authoritative store took to the shadow too, reporting its failures.
+func (store *dualStore) mirror(method string, key string, write func(shadow Store) error) {
+	if err := write(store.shadow); err != nil {
+		store.drift.writeFailed(method, key, err)
+	}
+}
+
+func (store *dualStore) SaveReceipt(record storedReceipt) (int, error) {
+	store.writes.RLock()
+	defer store.writes.RUnlock()
+
+	balance, err := store.Store.SaveReceipt(record)
+	if err == nil {
+		// the authoritative store already checked the version
+		record.Version = 0
+		store.mirror("SaveReceipt", record.ID, func(shadow Store) error {
+			_, err := shadow.SaveReceipt(record)
+			return err
+		})
+	}
+	return balance, err
+}
+
+func (store *dualStore) GetReceipt(id string) (storedReceipt, error) {
+	record, err := store.Store.GetReceipt(id)
+	if (err == nil || errors.Is(err, errReceiptNotFound)) && store.verifying() {
+		shadowRecord, shadowError := store.shadow.GetReceipt(id)
+		switch {
+		case err != nil && errors.Is(shadowError, errReceiptNotFound):
+			store.drift.compared("GetReceipt", id, nil)
+		case err != nil || shadowError != nil:
+			store.drift.compared("GetReceipt", id, []string{"existence"})
+		default:
+			store.drift.compared("GetReceipt", id, driftFields(comparableRecord(record), comparableRecord(shadowRecord)))
+		}
+	}
+	return record, err
+}
+
+func (store *dualStore) DeleteReceipt(id string, owner string) (storedReceipt, error) {
+	store.writes.RLock()
+	defer store.writes.RUnlock()
+
+	record, err := store.Store.DeleteReceipt(id, owner)
+	if err == nil {
+		store.mirror("DeleteReceipt", id, func(shadow Store) error {
+			_, err := shadow.DeleteReceipt(id, owner)
+			return err
+		})
+	}
+	return record, err
+}
+
+func (store *dualStore) RestoreReceipt(id string, owner string) (storedReceipt, error) {
+	store.writes.RLock()
+	defer store.writes.RUnlock()
+
+	record, err := store.Store.RestoreReceipt(id, owner)
+	if err == nil {
+		store.mirror("RestoreReceipt", id, func(shadow Store) error {
+			_, err := shadow.RestoreReceipt(id, owner)
+			return err
+		})
+	}
+	return record, err
+}
+
+func (store *dualStore) ResolveReview(id string, approve bool) (storedReceipt, int, error) {
+	store.writes.RLock()
+	defer store.writes.RUnlock()
+
+	record, balance, err := store.Store.ResolveReview(id, approve)
+	if err == nil {
+		store.mirror("ResolveReview", id, func(shadow Store) error {
+			_, _, err := shadow.ResolveReview(id, approve)
+			return err
+		})
+	}
+	return record, balance, err
+}
+
+func (store *dualStore) PurgeTrash(before time.Time) (int, error) {
+	store.writes.RLock()
+	defer store.writes.RUnlock()
+
+	purged, err := store.Store.PurgeTrash(before)
+	if err == nil {
+		store.mirror("PurgeTrash", before.Format(time.RFC3339), func(shadow Store) error {
+			_, err := shadow.PurgeTrash(before)
+			return err
+		})
+	}
+	return purged, err
+}
+
+func (store *dualStore) RemoveReceipt(id string) error {
+	store.writes.RLock()
+	defer store.writes.RUnlock()
+
+	err := store.Store.RemoveReceipt(id)
+	if err == nil {
+		store.mirror("RemoveReceipt", id, func(shadow Store) error { return shadow.RemoveReceipt(id) })
+	}
+	return err
+}
+
+func (store *dualStore) Balance(userID string) (int, error) {
+	balance, err := store.Store.Balance(userID)
+	if err == nil && store.verifying() {
+		shadowBalance, shadowError := store.shadow.Balance(userID)
+		if shadowError != nil || shadowBalance != balance {
+			store.drift.compared("Balance", userID, []string{"points"})
+		} else {
+			store.drift.compared("Balance", userID, nil)
+		}
+	}
+	return balance, err
+}
+
+func (store *dualStore) AdjustBalance(entry ledgerEntry) (ledgerEntry, error) {
+	store.writes.RLock()
+	defer store.writes.RUnlock()
+
+	applied, err := store.Store.AdjustBalance(entry)
+	if err == nil {
+		store.mirror("AdjustBalance", entry.UserID, func(shadow Store) error {
+			_, err := shadow.AdjustBalance(entry)
+			return err
+		})
+	}
+	return applied, err
+}
+
+func (store *dualStore) MovePoints(entries ...ledgerEntry) ([]ledgerEntry, error) {
+	store.writes.RLock()
+	defer store.writes.RUnlock()
+
+	applied, err := store.Store.MovePoints(entries...)
+	if err == nil && len(entries) > 0 {
+		store.mirror("MovePoints", entries[0].UserID, func(shadow Store) error {
+			_, err := shadow.MovePoints(entries...)
+			return err
+		})
+	}
+	return applied, err
+}
+
+func (store *dualStore) RecordAudit(entry auditEntry) error {
+	store.writes.RLock()
+	defer store.writes.RUnlock()
+
+	err := store.Store.RecordAudit(entry)
+	if err == nil {
+		store.mirror("RecordAudit", entry.ID, func(shadow Store) error { return shadow.RecordAudit(entry) })
+	}
+	return err
+}
+
+func (store *dualStore) Profile(userID string) (userProfile, error) {
+	profile, err := store.Store.Profile(userID)
+	if err == nil && store.verifying() {
+		shadowProfile, shadowError := store.shadow.Profile(userID)
+		if shadowError != nil {
+			store.drift.compared("Profile", userID, []string{"existence"})
+		} else {
+			store.drift.compared("Profile", userID, driftFields(profile, shadowProfile))
+		}
+	}
+	return profile, err
+}
+
+func (store *dualStore) SaveProfile(profile userProfile) error {
+	store.writes.RLock()
+	defer store.writes.RUnlock()
+
+	err := store.Store.SaveProfile(profile)
+	if err == nil {
+		store.mirror("SaveProfile", profile.UserID, func(shadow Store) error { return shadow.SaveProfile(profile) })
+	}
+	return err
+}
+
+func (store *dualStore) RegisterTransaction(transaction merchantTransaction) error {
+	store.writes.RLock()
+	defer store.writes.RUnlock()
+
+	err := store.Store.RegisterTransaction(transaction)
+	if err == nil {
+		store.mirror("RegisterTransaction", transaction.TransactionID, func(shadow Store) error {
+			return shadow.RegisterTransaction(transaction)
+		})
+	}
+	return err
+}
+
+func (store *dualStore) ClaimTransaction(match transactionMatch) (merchantTransaction, error) {
+	store.writes.RLock()
+	defer store.writes.RUnlock()
+
+	transaction, err := store.Store.ClaimTransaction(match)
+	if err == nil || errors.Is(err, errTransactionNotFound) {
+		store.mirror("ClaimTransaction", match.ReceiptID, func(shadow Store) error {
+			_, err := shadow.ClaimTransaction(match)
+			if errors.Is(err, errTransactionNotFound) {
+				return nil
+			}
+			return err
+		})
+	}
+	return transaction, err
+}
+
+func (store *dualStore) ReleaseTransaction(receiptID string) error {
+	store.writes.RLock()
+	defer store.writes.RUnlock()
+
+	err := store.Store.ReleaseTransaction(receiptID)
+	if err == nil {
+		store.mirror("ReleaseTransaction", receiptID, func(shadow Store) error { return shadow.ReleaseTransaction(receiptID) })
+	}
+	return err
+}
+
+func (store *dualStore) SaveReport(saved report) error {
+	store.writes.RLock()
+	defer store.writes.RUnlock()
+
+	err := store.Store.SaveReport(saved)
+	if err == nil {
+		key := saved.Period + " " + saved.Start.Format(time.RFC3339)
+		store.mirror("SaveReport", key, func(shadow Store) error { return shadow.SaveReport(saved) })
+	}
+	return err
+}
+
+// Restores both stores from the snapshot, keeping its entries to replay to the shadow.
+func (store *dualStore) Import(next func() (snapshotEntry, error)) error {
+	store.writes.Lock()
+	defer store.writes.Unlock()
+
+	var entries []snapshotEntry
+	err := store.Store.Import(func() (snapshotEntry, error) {
+		entry, err := next()
+		if err == nil {
+			entries = append(entries, entry)
+		}
+		return entry, err
+	})
+	if err == nil {
+		store.mirror("Import", "snapshot", func(shadow Store) error { return shadow.Import(replaySnapshot(entries)) })
+	}
+	return err
+}
+
+func (store *dualStore) Merge(entries []snapshotEntry) error {
+	store.writes.RLock()
+	defer store.writes.RUnlock()
+
+	err := store.Store.Merge(entries)
+	if err == nil {
+		store.mirror("Merge", "snapshot", func(shadow Store) error { return shadow.Merge(entries) })
+	}
+	return err
+}
+
+func replaySnapshot(entries []snapshotEntry) func() (snapshotEntry, error) {
+	return func() (snapshotEntry, error) {
+		if len(entries) == 0 {
+			return snapshotEntry{}, io.EOF
+		}
+		entry := entries[0]
+		entries = entries[1:]
+		return entry, nil
+	}
+}
+
+// Most receipts or balances backfill copies at once while writes wait.
+const backfillBatchSize = 500
+
+/*
+Copies the authoritative store's receipts, then its balances, to the
+shadow a batch at a time. Writes wait while each batch is read and copied,
+so none land in between, and are mirrored as usual between batches;
+balances come last so that every receipt counted in them is there first.
+The drift report starts over, as it only makes sense from a common
+starting point.
+*/
+func (store *dualStore) backfill() (int, error) {
+	copied := 0
+	for after := ""; ; {
+		count, err := store.copyBatch(func() ([]snapshotEntry, error) {
+			records, err := store.receiptBatch(after)
+			entries := make([]snapshotEntry, len(records))
+			for index := range records {
+				entries[index] = snapshotEntry{Receipt: &records[index]}
+				after = records[index].ID
+			}
+			return entries, err
+		})
+		copied += count
+		if err != nil {
+			return copied, err
+		}
+		if count == 0 {
+			break
+		}
+	}
+	for after := ""; ; {
+		count, err := store.copyBatch(func() ([]snapshotEntry, error) {
+			balances, err := store.Store.ListBalances(after, backfillBatchSize)
+			entries := make([]snapshotEntry, len(balances))
+			for index := range balances {
+				entries[index] = snapshotEntry{Balance: &balances[index]}
+				after = balances[index].UserID
+			}
+			return entries, err
+		})
+		if err != nil {
+			return copied, err
+		}
+		if count == 0 {
+			break
+		}
+	}
+	store.drift.mutex.Lock()
+	store.drift.reset()
+	store.drift.mutex.Unlock()
+	return copied, nil
+}
+
+/*
+The next batch of receipts with ids after the given one, whether they're
+in the trash or not, so a receipt moving in or out of it between batches
+isn't missed.
+*/
+func (store *dualStore) receiptBatch(after string) ([]storedReceipt, error) {
+	records, err := store.Store.ListReceipts("", after, backfillBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	trashed, err := store.Store.ListTrashedReceipts(after, backfillBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	records = append(records, trashed...)
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+	return records[:min(backfillBatchSize, len(records))], nil
+}
+
+// Reads a batch and merges it into the shadow while writes wait, returning its size.
+func (store *dualStore) copyBatch(read func() ([]snapshotEntry, error)) (int, error) {
+	store.writes.Lock()
+	defer store.writes.Unlock()
+
+	entries, err := read()
+	if err != nil || len(entries) == 0 {
+		return 0, err
+	}
+	return len(entries), store.shadow.Merge(entries)
+}
+
+// Reports how the stores have drifted apart.
+func (store *dualStore) getDrift(context *gin.Context) {
+	context.IndentedJSON(http.StatusOK, store.drift.snapshot())
+}
+
+// Copies the authoritative store's receipts and balances to the shadow.
+func (store *dualStore) postBackfill(context *gin.Context) {
+	copied, err := store.backfill()
+	if err != nil {
+		log.Printf("Backfilling the shadow store failed: %v", err)
+		respondWithMessage(context, http.StatusInternalServerError, "migration.backfill_failed")
+		return
+	}
+	recordAudit(context, auditEntry{Action: auditStoreBackfilled, Reason: "copied receipts and balances to the shadow store"})
+	context.IndentedJSON(http.StatusOK, gin.H{"receipts": copied})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOpenDualStoreCutover(t *testing.T) {
+	tests := []struct {
+		name     string
+		read     string
+		migrated bool
+		wantErr  string
+	}{
+		{"reading from the old store", "from", false, ""},
+		{"reading from the new store before migrating", "to", false, "STORE_DUAL_MIGRATED"},
+		{"reading from the new store once migrated", "to", true, ""},
+		{"unknown store", "both", true, "STORE_DUAL_READ"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := Config{DualWrite: DualWriteConfig{From: "memory", To: "memory", Read: test.read, Migrated: test.migrated}}
+			_, err := openDualStore(config)
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Errorf("openDualStore() failed: %v", err)
+			case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+				t.Errorf("openDualStore() = %v, want an error naming %s", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func newTestDualStore() (*dualStore, *memoryStore, *memoryStore) {
+	authoritative, shadow := newMemoryStore(), newMemoryStore()
+	return &dualStore{Store: authoritative, shadow: shadow, verifyRate: 1, drift: newDriftReport()}, authoritative, shadow
+}
+
+// Backfill copies every receipt and balance, in more than one batch, and keeps what the shadow already had.
+func TestDualBackfill(t *testing.T) {
+	store, authoritative, shadow := newTestDualStore()
+	for index := 0; index < backfillBatchSize+10; index++ {
+		record := storedReceipt{ID: fmt.Sprintf("receipt-%04d", index), UserID: "alice", Points: 1, ProcessedAt: time.Now()}
+		if _, err := authoritative.SaveReceipt(record); err != nil {
+			t.Fatalf("SaveReceipt() failed: %v", err)
+		}
+	}
+	if _, err := authoritative.DeleteReceipt("receipt-0003", ""); err != nil {
+		t.Fatalf("DeleteReceipt() failed: %v", err)
+	}
+	// bob only has points he was granted
+	if _, err := authoritative.AdjustBalance(newLedgerEntry("bob", ledgerAdjustment, 40, "")); err != nil {
+		t.Fatalf("AdjustBalance() failed: %v", err)
+	}
+	// what the shadow heard before the backfill stays
+	if err := shadow.SaveProfile(userProfile{UserID: "alice", Language: "es"}); err != nil {
+		t.Fatalf("SaveProfile() failed: %v", err)
+	}
+	store.drift.compared("Balance", "alice", []string{"points"})
+
+	copied, err := store.backfill()
+	if err != nil {
+		t.Fatalf("backfill() failed: %v", err)
+	}
+	if copied != backfillBatchSize+10 {
+		t.Errorf("backfill() copied %d receipts, want %d", copied, backfillBatchSize+10)
+	}
+	for _, userID := range []string{"alice", "bob"} {
+		want, _ := authoritative.Balance(userID)
+		if got, _ := shadow.Balance(userID); got != want {
+			t.Errorf("shadow balance of %s is %d, want %d", userID, got, want)
+		}
+	}
+	if trashed, _ := shadow.TrashedReceipts(10); len(trashed) != 1 || trashed[0].ID != "receipt-0003" {
+		t.Errorf("shadow trash holds %v, want receipt-0003", trashed)
+	}
+	if profile, _ := shadow.Profile("alice"); profile.Language != "es" {
+		t.Errorf("backfill replaced the shadow's profile with %+v", profile)
+	}
+	if stats, _ := shadow.Stats(time.Time{}); stats.Receipts != backfillBatchSize+9 {
+		t.Errorf("shadow stats count %d receipts, want %d", stats.Receipts, backfillBatchSize+9)
+	}
+	if drift := store.drift.snapshot(); len(drift.Mismatched) != 0 {
+		t.Errorf("drift report kept %v from before the backfill", drift.Mismatched)
+	}
+
+	// backfilling again changes nothing
+	entries, _ := shadow.Ledger("alice", 1000)
+	if _, err := store.backfill(); err != nil {
+		t.Fatalf("second backfill() failed: %v", err)
+	}
+	if again, _ := shadow.Ledger("alice", 1000); len(again) != len(entries) {
+		t.Errorf("second backfill() added %d ledger entries, want none", len(again)-len(entries))
+	}
+}
+
+// A shadow slow to take a batch, so writes made during the backfill overlap it.
+type slowMergeStore struct {
+	Store
+}
+
+func (store slowMergeStore) Merge(entries []snapshotEntry) error {
+	time.Sleep(2 * time.Millisecond)
+	return store.Store.Merge(entries)
+}
+
+// Writes during a backfill land in both stores, whichever batch they fall between.
+func TestDualBackfillWithConcurrentWrites(t *testing.T) {
+	store, authoritative, shadow := newTestDualStore()
+	store.shadow = slowMergeStore{shadow}
+	for index := 0; index < 2*backfillBatchSize; index++ {
+		record := storedReceipt{ID: fmt.Sprintf("old-%04d", index), UserID: "alice", Points: 2}
+		if _, err := authoritative.SaveReceipt(record); err != nil {
+			t.Fatalf("SaveReceipt() failed: %v", err)
+		}
+	}
+
+	var wait sync.WaitGroup
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		for index := 0; index < 200; index++ {
+			store.SaveReceipt(storedReceipt{ID: fmt.Sprintf("new-%04d", index), UserID: "alice", Points: 3})
+			store.DeleteReceipt(fmt.Sprintf("old-%04d", index*5), "")
+		}
+	}()
+	if _, err := store.backfill(); err != nil {
+		t.Fatalf("backfill() failed: %v", err)
+	}
+	wait.Wait()
+
+	want, _ := authoritative.Balance("alice")
+	if got, _ := shadow.Balance("alice"); got != want {
+		t.Errorf("shadow balance is %d, want %d", got, want)
+	}
+	for index := 0; index < 2*backfillBatchSize; index++ {
+		id := fmt.Sprintf("old-%04d", index)
+		_, err := authoritative.GetReceipt(id)
+		if _, shadowError := shadow.GetReceipt(id); (err == nil) != (shadowError == nil) {
+			t.Fatalf("%s is trashed in one store only", id)
+		}
+	}
+}
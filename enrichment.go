@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// What the merchant directory knows about a receipt's retailer.
+type merchantInfo struct {
+	// the directory's id for the merchant, the same however the name is spelled
+	CanonicalID string `json:"canonicalId"`
+	Name        string `json:"name"`
+	Category    string `json:"category,omitempty"`
+}
+
+/*
+Resolves retailer names as printed on receipts to merchants. Lookup reports
+false when the directory doesn't know the retailer.
+*/
+type merchantProvider interface {
+	lookup(ctx context.Context, retailer string) (merchantInfo, bool, error)
+}
+
+/*
+How retailers are enriched with merchant details. Enrichment is best effort:
+a slow or failing directory never fails or holds up scoring for longer than
+Timeout.
+*/
+type EnrichmentConfig struct {
+	// "http" for a merchant API, "file" for a JSON directory, or "" to turn enrichment off
+	Provider string
+	// the merchant API, queried as GET <URL>?name=<retailer>, and its bearer token
+	URL    string
+	APIKey string
+	// JSON file of merchants, see loadFileMerchants
+	File string
+
+	Timeout   time.Duration
+	CacheSize int
+	CacheTTL  time.Duration
+	// consecutive failures that open the circuit breaker, and for how long
+	BreakerFailures int
+	BreakerCooldown time.Duration
+}
+
+// A cached lookup; merchant is nil when the directory didn't know the retailer.
+type cachedMerchant struct {
+	merchant *merchantInfo
+	expires  time.Time
+}
+
+// Looks merchants up through the provider, caching answers and guarding against failures.
+type retailerEnricher struct {
+	provider merchantProvider
+	timeout  time.Duration
+	ttl      time.Duration
+	cache    *lruCache[string, cachedMerchant]
+	guard    *dependencyGuard
+}
+
+// Global enricher, nil when enrichment is off
+var merchants *retailerEnricher
+
+/*
+Sets up enrichment with the given provider, retrying lookups like other
+integrations but with the directory's own breaker settings.
+*/
+func newRetailerEnricher(config EnrichmentConfig, resilience ResilienceConfig) (*retailerEnricher, error) {
+	var provider merchantProvider
+	switch config.Provider {
+	case "":
+		return nil, nil
+	case "http":
+		if config.URL == "" {
+			return nil, errors.New("MERCHANT_PROVIDER=http needs MERCHANT_API_URL")
+		}
+		provider = httpMerchants{url: config.URL, apiKey: config.APIKey, client: &http.Client{}}
+	case "file":
+		fileProvider, err := loadFileMerchants(config.File)
+		if err != nil {
+			return nil, err
+		}
+		provider = fileProvider
+	default:
+		return nil, fmt.Errorf("unknown MERCHANT_PROVIDER: %s", config.Provider)
+	}
+
+	enricher := &retailerEnricher{
+		provider: provider,
+		timeout:  config.Timeout,
+		ttl:      config.CacheTTL,
+		cache:    newLRUCache[string, cachedMerchant](config.CacheSize),
+	}
+	resilience.BreakerFailures = config.BreakerFailures
+	resilience.BreakerCooldown = config.BreakerCooldown
+	enricher.guard = newDependencyGuard("merchants", resilience, retryUnlessPermanent)
+	return enricher, nil
+}
+
+// Names that differ only in case and spacing are the same retailer.
+func merchantKey(retailer string) string {
+	return strings.ToLower(strings.Join(strings.Fields(retailer), " "))
+}
+
+/*
+Returns the retailer's merchant, or nil when it's unknown or the directory
+couldn't be reached in time; retries all happen within the timeout. Only
+definite answers are cached, so failures are tried again on the next receipt
+unless the breaker is open.
+*/
+func (enricher *retailerEnricher) enrich(retailer string) *merchantInfo {
+	key := merchantKey(retailer)
+	if enricher == nil || key == "" {
+		return nil
+	}
+	if cached, exists := enricher.cache.get(key); exists && time.Now().Before(cached.expires) {
+		return cached.merchant
+	}
+
+	var merchant *merchantInfo
+	ctx, cancel := context.WithTimeout(context.Background(), enricher.timeout)
+	defer cancel()
+	err := enricher.guard.do(ctx, func() error {
+		info, found, err := enricher.provider.lookup(ctx, retailer)
+		if found {
+			merchant = &info
+		}
+		return err
+	})
+	if err != nil {
+		if !errors.Is(err, errCircuitOpen) {
+			log.Printf("Failed to look up merchant %q: %v", retailer, err)
+		}
+		return nil
+	}
+	enricher.cache.put(key, cachedMerchant{merchant: merchant, expires: time.Now().Add(enricher.ttl)})
+	return merchant
+}
+
+// Queries a merchant API that answers 404 for retailers it doesn't know.
+type httpMerchants struct {
+	url    string
+	apiKey string
+	client *http.Client
+}
+
+func (provider httpMerchants) lookup(ctx context.Context, retailer string) (merchantInfo, bool, error) {
+	request, err := http.NewRequestWithContext(
+		ctx, http.MethodGet, provider.url+"?"+url.Values{"name": {retailer}}.Encode(), nil,
+	)
+	if err != nil {
+		return merchantInfo{}, false, err
+	}
+	if provider.apiKey != "" {
+		request.Header.Set("Authorization", "Bearer "+provider.apiKey)
+	}
+	response, err := provider.client.Do(request)
+	if err != nil {
+		return merchantInfo{}, false, err
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusNotFound:
+		return merchantInfo{}, false, nil
+	case response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500:
+		return merchantInfo{}, false, fmt.Errorf("the merchant API answered %s", response.Status)
+	case response.StatusCode != http.StatusOK:
+		// the API won't answer differently if asked again
+		return merchantInfo{}, false, permanentError{fmt.Errorf("the merchant API answered %s", response.Status)}
+	}
+	var merchant merchantInfo
+	if err := json.NewDecoder(response.Body).Decode(&merchant); err != nil {
+		return merchantInfo{}, false, err
+	}
+	return merchant, merchant.CanonicalID != "", nil
+}
+
+// Merchants from a JSON file, matched by name or any of their aliases.
+type fileMerchants map[string]merchantInfo
+
+/*
+Reads a JSON array of merchants, each with "canonicalId", "name",
+"category" and optional "aliases".
+*/
+func loadFileMerchants(path string) (fileMerchants, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []struct {
+		merchantInfo
+		Aliases []string `json:"aliases"`
+	}
+	if err := json.Unmarshal(contents, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse merchant file %s: %w", path, err)
+	}
+	directory := make(fileMerchants)
+	for _, entry := range entries {
+		for _, name := range append(entry.Aliases, entry.Name) {
+			directory[merchantKey(name)] = entry.merchantInfo
+		}
+	}
+	return directory, nil
+}
+
+func (directory fileMerchants) lookup(ctx context.Context, retailer string) (merchantInfo, bool, error) {
+	merchant, found := directory[merchantKey(retailer)]
+	return merchant, found, nil
+}
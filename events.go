@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Sent to subscribers whenever a receipt has been processed or reviewed.
+type receiptEvent struct {
+	ID       string `json:"id"`
+	UserID   string `json:"userId,omitempty"`
+	Retailer string `json:"retailer"`
+	Points   int    `json:"points"`
+	// the user's points after this receipt, when the receipt has a user
+	Balance int `json:"balance,omitempty"`
+	// "approved" or "rejected" when the event resolves a review
+	Review string `json:"review,omitempty"`
+}
+
+/*
+Fans receipt events out to every subscriber. Each subscriber has a small
+buffer; a subscriber that falls behind misses events rather than slowing
+down receipt processing.
+*/
+type eventBroker struct {
+	mutex       sync.Mutex
+	subscribers map[chan receiptEvent]struct{}
+	// when set, events are handed to forward instead of delivered directly,
+	// so another process (e.g. the shared store) can deliver them to every replica
+	forward func(event receiptEvent) error
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{subscribers: make(map[chan receiptEvent]struct{})}
+}
+
+func (broker *eventBroker) subscribe() chan receiptEvent {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+
+	events := make(chan receiptEvent, 64)
+	broker.subscribers[events] = struct{}{}
+	return events
+}
+
+func (broker *eventBroker) unsubscribe(events chan receiptEvent) {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+
+	delete(broker.subscribers, events)
+}
+
+func (broker *eventBroker) publish(event receiptEvent) {
+	if broker.forward != nil {
+		err := broker.forward(event)
+		if err == nil {
+			return
+		}
+		log.Printf("Failed to forward receipt event, delivering locally: %v", err)
+	}
+	broker.deliver(event)
+}
+
+// Sends the event to this process's subscribers.
+func (broker *eventBroker) deliver(event receiptEvent) {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+
+	for events := range broker.subscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// Global broker for processed receipt events
+var receiptEvents *eventBroker
+
+// How often an idle stream sends a comment so proxies don't close it.
+const streamHeartbeatInterval = 15 * time.Second
+
+/*
+Streams an event for every newly processed receipt using server-sent
+events. The optional retailer and minPoints query parameters filter which
+receipts are sent.
+*/
+func streamReceipts(context *gin.Context) {
+	retailer := context.Query("retailer")
+	minPoints := 0
+	if value := context.Query("minPoints"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			respondWithMessage(context, http.StatusBadRequest, "stream.min_points_invalid")
+			return
+		}
+		minPoints = parsed
+	}
+
+	events := receiptEvents.subscribe()
+	defer receiptEvents.unsubscribe(events)
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	context.Header("Cache-Control", "no-cache")
+	context.Header("X-Accel-Buffering", "no")
+	context.Stream(func(writer io.Writer) bool {
+		select {
+		case <-context.Request.Context().Done():
+			return false
+		case <-heartbeat.C:
+			io.WriteString(writer, ": heartbeat\n\n")
+		case event := <-events:
+			if retailer != "" && !strings.EqualFold(retailer, event.Retailer) {
+				return true
+			}
+			if event.Points < minPoints {
+				return true
+			}
+			context.SSEvent("receipt", event)
+		}
+		return true
+	})
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Scores a share of receipts with experimental rule variants so their effect
+can be measured before rolling them out. Receipts not assigned to a variant
+are the control group and use the main rules.
+*/
+type experimentConfig struct {
+	Name string `json:"name"`
+	// "user" keeps each user in one variant; "receipt" assigns every
+	// receipt independently. Receipts without a user are always assigned
+	// by receipt.
+	AssignBy string              `json:"assignBy"`
+	Variants []experimentVariant `json:"variants"`
+}
+
+/*
+A variant gets Percent of receipts (or users), plus any users listed by
+id. Its rules are a complete rules config with their own version.
+*/
+type experimentVariant struct {
+	Name    string      `json:"name"`
+	Percent float64     `json:"percent"`
+	Users   []string    `json:"users"`
+	Rules   RulesConfig `json:"rules"`
+}
+
+type experiment struct {
+	name     string
+	assignBy string
+	variants []experimentArm
+}
+
+type experimentArm struct {
+	name    string
+	percent float64
+	users   map[string]bool
+	rules   ruleSet
+}
+
+// Global experiment currently running, if any
+func activeExperiment() *experiment {
+	return rulesInUse().experiment
+}
+
+// Aggregate results for one experiment variant.
+type variantStats struct {
+	Variant       string  `json:"variant"`
+	Receipts      int     `json:"receipts"`
+	Users         int     `json:"users"`
+	TotalPoints   int     `json:"totalPoints"`
+	AveragePoints float64 `json:"averagePoints"`
+}
+
+// Name the control group is reported under.
+const controlVariant = "control"
+
+func (config *experimentConfig) validate() error {
+	if config.Name == "" {
+		return errors.New("the experiment needs a name")
+	}
+	if config.AssignBy != "user" && config.AssignBy != "receipt" {
+		return fmt.Errorf("experiment %s must assignBy user or receipt", config.Name)
+	}
+
+	totalPercent := 0.0
+	names := map[string]bool{controlVariant: true}
+	for index := range config.Variants {
+		variant := &config.Variants[index]
+		if variant.Name == "" || names[variant.Name] {
+			return fmt.Errorf("experiment variant %d needs a unique name other than %s", index, controlVariant)
+		}
+		names[variant.Name] = true
+		if variant.Percent < 0 {
+			return fmt.Errorf("experiment variant %s has a negative percent", variant.Name)
+		}
+		totalPercent += variant.Percent
+
+		if variant.Rules.Experiment != nil {
+			return fmt.Errorf("experiment variant %s can't run its own experiment", variant.Name)
+		}
+		if err := variant.Rules.validate(); err != nil {
+			return fmt.Errorf("experiment variant %s: %w", variant.Name, err)
+		}
+	}
+	if totalPercent > 100 {
+		return fmt.Errorf("experiment %s assigns more than 100 percent", config.Name)
+	}
+	return nil
+}
+
+func newExperiment(config *experimentConfig, plugins []*wasmPlugin) *experiment {
+	running := &experiment{name: config.Name, assignBy: config.AssignBy}
+	for _, variant := range config.Variants {
+		users := make(map[string]bool)
+		for _, userID := range variant.Users {
+			users[userID] = true
+		}
+		running.variants = append(running.variants, experimentArm{
+			name:    variant.Name,
+			percent: variant.Percent,
+			users:   users,
+			rules:   newRuleSet(variant.Rules, plugins),
+		})
+	}
+	return running
+}
+
+/*
+Picks the rules a receipt is scored with, and the variant they belong to
+("" for the main rules). Assignment hashes the experiment name with the
+user or receipt id, so it's stable without being stored anywhere.
+*/
+func rulesFor(userID string, receiptID string) (ruleSet, string) {
+	loaded := rulesInUse()
+	running := loaded.experiment
+	if running == nil {
+		return loaded.rules, ""
+	}
+
+	for _, variant := range running.variants {
+		if userID != "" && variant.users[userID] {
+			return variant.rules, variant.name
+		}
+	}
+
+	key := receiptID
+	if running.assignBy == "user" && userID != "" {
+		key = userID
+	}
+	bucket := rolloutBucket(running.name, key)
+
+	threshold := 0.0
+	for _, variant := range running.variants {
+		threshold += variant.percent
+		if bucket < threshold {
+			return variant.rules, variant.name
+		}
+	}
+	return loaded.rules, ""
+}
+
+// Compares how receipts scored in each variant of the running experiment.
+func getExperimentStats(context *gin.Context) {
+	running := activeExperiment()
+	if running == nil {
+		respondWithMessage(context, http.StatusNotFound, "experiment.not_running")
+		return
+	}
+
+	stats, err := receipts.VariantStats()
+	if err != nil {
+		respondWithMessage(context, http.StatusInternalServerError, "experiment.stats_failed")
+		return
+	}
+
+	// list every variant, including ones that haven't scored anything yet
+	byVariant := make(map[string]variantStats)
+	for _, variant := range stats {
+		byVariant[variant.Variant] = variant
+	}
+	names := []string{controlVariant}
+	percents := map[string]float64{controlVariant: 100}
+	for _, variant := range running.variants {
+		names = append(names, variant.name)
+		percents[variant.name] = variant.percent
+		percents[controlVariant] -= variant.percent
+	}
+
+	variants := make([]gin.H, 0, len(names))
+	for _, name := range names {
+		lookup := name
+		if name == controlVariant {
+			lookup = ""
+		}
+		variant := byVariant[lookup]
+		variants = append(variants, gin.H{
+			"variant":       name,
+			"percent":       percents[name],
+			"receipts":      variant.Receipts,
+			"users":         variant.Users,
+			"totalPoints":   variant.TotalPoints,
+			"averagePoints": variant.AveragePoints,
+		})
+	}
+
+	context.IndentedJSON(
+		http.StatusOK,
+		gin.H{"experiment": running.name, "variants": variants},
+	)
+}
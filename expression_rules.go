@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/vm"
+)
+
+// Default limits for running an expression rule against one receipt.
+const (
+	defaultExpressionTimeout      = 50 * time.Millisecond
+	defaultExpressionMemoryBudget = 100000
+)
+
+/*
+How many expression rules may run at once. expr can't stop a program part
+way, so one past its timeout keeps running, and its slot, until it's done;
+this bounds how many of those can pile up.
+*/
+const maxExpressionRuns = 64
+
+var expressionRuns = make(chan struct{}, maxExpressionRuns)
+
+/*
+A rule written in the expr language (https://expr-lang.org) and evaluated
+against the receipt, so new scoring ideas can be tried without rebuilding
+the service. The expression returns the points to award, e.g.
+
+	len(items) >= 10 ? 20 : 0
+	retailer startsWith "Target" && weekday == "Friday" ? total * 0.5 : 0
+
+Fractional results are kept to the hundredth of a point, see centipoints.
+*/
+type expressionRule struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Expression  string `json:"expression"`
+	Flag        string `json:"flag"`
+
+	program *vm.Program
+}
+
+/*
+Sets the memory budget expression runs have. expr only has a global one,
+which every run reads as it starts, so it's set before any expression runs
+and then left alone: replacing it while receipts are scored would race
+with them.
+*/
+func useExpressionMemoryBudget(budget uint) {
+	vm.MemoryBudget = budget
+}
+
+// What expressions can see; they have no access to anything else.
+type expressionEnv struct {
+	Retailer     string           `expr:"retailer"`
+	Total        float64          `expr:"total"`
+	PurchaseDate string           `expr:"purchaseDate"`
+	PurchaseTime string           `expr:"purchaseTime"`
+	Weekday      string           `expr:"weekday"`
+	Day          int              `expr:"day"`
+	Month        int              `expr:"month"`
+	Hour         int              `expr:"hour"`
+	Minute       int              `expr:"minute"`
+	Items        []expressionItem `expr:"items"`
+	StoreID      string           `expr:"storeId"`
+	State        string           `expr:"state"`
+	Category     string           `expr:"category"`
+	MerchantID   string           `expr:"merchantId"`
+	Tags         []string         `expr:"tags"`
+	Channel      string           `expr:"channel"`
+	// whether the receipt matched a transaction its retailer registered
+	MerchantVerified bool `expr:"merchantVerified"`
+	// when the receipt is processed, e.g. for promotions that end, and how
+	// long after its purchase that is
+	ProcessedDate     string `expr:"processedDate"`
+	DaysSincePurchase int    `expr:"daysSincePurchase"`
+}
+
+type expressionItem struct {
+	Description string `expr:"description"`
+	// the description the item rules see, see descriptionNormalization
+	NormalizedDescription string  `expr:"normalizedDescription"`
+	Price                 float64 `expr:"price"`
+}
+
+// Compiles the expression, checking it against the environment it'll run in.
+func (rule *expressionRule) compile() error {
+	program, err := expr.Compile(rule.Expression, expr.Env(expressionEnv{}), expr.AsFloat64())
+	if err != nil {
+		return fmt.Errorf("expression rule %s doesn't compile: %w", rule.Name, err)
+	}
+	rule.program = program
+	return nil
+}
+
+// Looks for the tags identifier in an expression.
+type tagsVisitor struct {
+	found bool
+}
+
+func (visitor *tagsVisitor) Visit(node *ast.Node) {
+	if identifier, ok := (*node).(*ast.IdentifierNode); ok && identifier.Value == "tags" {
+		visitor.found = true
+	}
+}
+
+// Whether the compiled expression reads the receipt's tags.
+func (rule expressionRule) readsTags() bool {
+	visitor := &tagsVisitor{}
+	node := rule.program.Node()
+	ast.Walk(&node, visitor)
+	return visitor.found
+}
+
+func newExpressionEnv(receipt parsedReceipt) expressionEnv {
+	items := make([]expressionItem, len(receipt.receipt.Items))
+	for index, item := range receipt.receipt.Items {
+		// unparseable prices are reported by the item description rule
+		price, _ := strconv.ParseFloat(item.Price, 64)
+		items[index] = expressionItem{
+			Description:           item.Description,
+			NormalizedDescription: receipt.items[index].Description,
+			Price:                 price,
+		}
+	}
+	env := expressionEnv{
+		Retailer:     receipt.receipt.Retailer,
+		Total:        receipt.total,
+		PurchaseDate: receipt.receipt.Date,
+		PurchaseTime: receipt.receipt.Time,
+		Weekday:      receipt.purchaseDate.Weekday().String(),
+		Day:          receipt.purchaseDate.Day(),
+		Month:        int(receipt.purchaseDate.Month()),
+		Hour:         receipt.purchaseTime.Hour(),
+		Minute:       receipt.purchaseTime.Minute(),
+		Items:        items,
+		Tags:         receipt.receipt.Tags,
+		Channel:      receipt.channel,
+		// purchase dates are local, so compared as calendar days in UTC
+		ProcessedDate:     receipt.processedAt.UTC().Format("2006-01-02"),
+		DaysSincePurchase: daysBetween(receipt.purchaseDate, receipt.processedAt.UTC()),
+		MerchantVerified:  receipt.verification != nil,
+	}
+	if location := receipt.receipt.Location; location != nil {
+		env.StoreID = location.StoreID
+		env.State = location.State
+	}
+	if receipt.merchant != nil {
+		env.Category = receipt.merchant.Category
+		env.MerchantID = receipt.merchant.CanonicalID
+	}
+	return env
+}
+
+/*
+Turns the expression into a scoring rule that gives up after timeout,
+waiting for a free run included. Expressions are prototypes, so one that
+fails or runs too long awards no points rather than failing the receipt.
+*/
+func (rule expressionRule) rule(timeout time.Duration) scoringRule {
+	description := rule.Description
+	if description == "" {
+		description = rule.Expression
+	}
+
+	return scoringRule{
+		Name:        rule.Name,
+		Description: description,
+		Flag:        rule.Flag,
+		readsTags:   rule.readsTags(),
+		score: func(receipt parsedReceipt) (centipoints, error) {
+			type outcome struct {
+				result any
+				err    error
+			}
+			deadline := time.NewTimer(timeout)
+			defer deadline.Stop()
+			select {
+			case expressionRuns <- struct{}{}:
+			case <-deadline.C:
+				log.Printf("Expression rule %s waited longer than %s to run", rule.Name, timeout)
+				return 0, nil
+			}
+			finished := make(chan outcome, 1)
+			go func() {
+				defer func() { <-expressionRuns }()
+				result, err := expr.Run(rule.program, newExpressionEnv(receipt))
+				finished <- outcome{result: result, err: err}
+			}()
+
+			select {
+			case done := <-finished:
+				if done.err != nil {
+					log.Printf("Expression rule %s failed: %v", rule.Name, done.err)
+					return 0, nil
+				}
+				points, _ := done.result.(float64)
+				if math.IsNaN(points) || math.IsInf(points, 0) {
+					return 0, nil
+				}
+				return fractionalPoints(points), nil
+			case <-deadline.C:
+				log.Printf("Expression rule %s took longer than %s", rule.Name, timeout)
+				return 0, nil
+			}
+		},
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/expr-lang/expr/vm"
+)
+
+func compiledRule(t *testing.T, expression string) expressionRule {
+	t.Helper()
+	rule := expressionRule{Name: "test", Expression: expression}
+	if err := rule.compile(); err != nil {
+		t.Fatal(err)
+	}
+	return rule
+}
+
+// A run past its timeout awards nothing but keeps its slot until it's done, and runs wait for a free one.
+func TestExpressionRuleTimeout(t *testing.T) {
+	previous := vm.MemoryBudget
+	t.Cleanup(func() { useExpressionMemoryBudget(previous) })
+	useExpressionMemoryBudget(1 << 40)
+	slow := compiledRule(t, "len(filter(1..2000, len(filter(1..2000, # > 0)) > 0))").rule(time.Millisecond)
+	fast := compiledRule(t, "12.5").rule(20 * time.Millisecond)
+
+	if points, err := slow.score(parsedReceipt{}); err != nil || points != 0 {
+		t.Fatalf("slow rule scored %d, %v, want nothing", points, err)
+	}
+	if running := len(expressionRuns); running != 1 {
+		t.Fatalf("%d runs hold a slot after the timeout, want the slow one", running)
+	}
+	for len(expressionRuns) < maxExpressionRuns {
+		expressionRuns <- struct{}{}
+	}
+	if points, _ := fast.score(parsedReceipt{}); points != 0 {
+		t.Errorf("rule scored %d with no free slot, want nothing", points)
+	}
+	for index := 1; index < maxExpressionRuns; index++ {
+		<-expressionRuns
+	}
+
+	for started := time.Now(); len(expressionRuns) > 0; time.Sleep(time.Millisecond) {
+		if time.Since(started) > 10*time.Second {
+			t.Fatal("the slow run never gave its slot back")
+		}
+	}
+	if points, _ := fast.score(parsedReceipt{}); points != 1250 {
+		t.Errorf("rule scored %d once slots were free, want 1250", points)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Decides whether a feature flag is on for a user, so endpoints and rules can
+be dark-launched per environment. Providers return fallback for flags they
+don't know about.
+*/
+type flagProvider interface {
+	enabled(flag string, userID string, fallback bool) bool
+}
+
+// Global source of feature flags, consulted by handlers and the rules engine
+var featureFlags flagProvider = envFlags{}
+
+/*
+Reads flags from FLAG_<NAME> environment variables, where the name is
+upper cased with dashes as underscores: FLAG_BATCH_PROCESSING=false.
+*/
+type envFlags struct{}
+
+func (envFlags) enabled(flag string, userID string, fallback bool) bool {
+	name := "FLAG_" + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+	return envBool(name, fallback)
+}
+
+/*
+A flag in the flags file. It's on for everyone when Enabled is set, and
+otherwise for the listed users plus Percent of the rest.
+*/
+type fileFlag struct {
+	Enabled bool     `json:"enabled"`
+	Users   []string `json:"users"`
+	Percent float64  `json:"percent"`
+}
+
+// Flags read once from a JSON file of flag names to fileFlags.
+type fileFlags map[string]fileFlag
+
+func loadFileFlags(path string) (fileFlags, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var flags fileFlags
+	if err := json.Unmarshal(contents, &flags); err != nil {
+		return nil, fmt.Errorf("failed to parse flags file %s: %w", path, err)
+	}
+	return flags, nil
+}
+
+func (flags fileFlags) enabled(flag string, userID string, fallback bool) bool {
+	settings, exists := flags[flag]
+	if !exists {
+		return fallback
+	}
+	if settings.Enabled {
+		return true
+	}
+	for _, user := range settings.Users {
+		if user == userID {
+			return true
+		}
+	}
+	return userID != "" && rolloutBucket(flag, userID) < settings.Percent
+}
+
+/*
+Evaluates flags with a service implementing the OpenFeature remote
+evaluation protocol (OFREP). Answers are cached for a while since rules
+check flags for every receipt; when the service can't be reached the
+fallback is used.
+*/
+type remoteFlags struct {
+	baseURL  string
+	client   *http.Client
+	cacheTTL time.Duration
+
+	mutex sync.Mutex
+	cache map[string]cachedFlag
+}
+
+type cachedFlag struct {
+	value   bool
+	expires time.Time
+}
+
+func newRemoteFlags(baseURL string, cacheTTL time.Duration) *remoteFlags {
+	return &remoteFlags{
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		client:   &http.Client{Timeout: time.Second},
+		cacheTTL: cacheTTL,
+		cache:    make(map[string]cachedFlag),
+	}
+}
+
+func (flags *remoteFlags) enabled(flag string, userID string, fallback bool) bool {
+	key := flag + "\x00" + userID
+	flags.mutex.Lock()
+	cached, exists := flags.cache[key]
+	flags.mutex.Unlock()
+	if exists && time.Now().Before(cached.expires) {
+		return cached.value
+	}
+
+	value, err := flags.evaluate(flag, userID)
+	if err != nil {
+		return fallback
+	}
+	flags.mutex.Lock()
+	flags.cache[key] = cachedFlag{value: value, expires: time.Now().Add(flags.cacheTTL)}
+	flags.mutex.Unlock()
+	return value
+}
+
+func (flags *remoteFlags) evaluate(flag string, userID string) (bool, error) {
+	request, err := json.Marshal(gin.H{"context": gin.H{"targetingKey": userID}})
+	if err != nil {
+		return false, err
+	}
+	response, err := flags.client.Post(
+		flags.baseURL+"/ofrep/v1/evaluate/flags/"+url.PathEscape(flag), "application/json", bytes.NewReader(request),
+	)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("flag service returned %s for %s", response.Status, flag)
+	}
+
+	var evaluation struct {
+		Value any `json:"value"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&evaluation); err != nil {
+		return false, err
+	}
+	switch value := evaluation.Value.(type) {
+	case bool:
+		return value, nil
+	case string:
+		return strconv.ParseBool(value)
+	}
+	return false, fmt.Errorf("flag %s isn't a boolean", flag)
+}
+
+// Sets up the provider named by FLAG_PROVIDER.
+func newFlagProvider(config Config) (flagProvider, error) {
+	switch config.FlagProvider {
+	case "env":
+		return envFlags{}, nil
+	case "file":
+		return loadFileFlags(config.FlagsFile)
+	case "ofrep":
+		if config.FlagServiceURL == "" {
+			return nil, fmt.Errorf("FLAG_PROVIDER=ofrep needs FLAG_SERVICE_URL")
+		}
+		return newRemoteFlags(config.FlagServiceURL, config.FlagCacheTTL), nil
+	}
+	return nil, fmt.Errorf("unknown FLAG_PROVIDER: %s", config.FlagProvider)
+}
+
+/*
+Places a key in [0, 100) that stays the same for the same name and key, for
+percentage rollouts.
+*/
+func rolloutBucket(name string, key string) float64 {
+	hash := fnv.New32a()
+	hash.Write([]byte(name + ":" + key))
+	return float64(hash.Sum32()%10000) / 100
+}
+
+// Responds as if the endpoint doesn't exist while its flag is off.
+func requireFlag(flag string, fallback bool) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if !featureFlags.enabled(flag, submittingUser(context), fallback) {
+			abortWithMessage(context, http.StatusNotFound, "feature.disabled")
+			return
+		}
+		context.Next()
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+/*
+Wraps a store whose backend can fail transiently, retrying calls the
+database didn't get to finish and failing fast while it's down. Writes are
+safe to retry: saves replace what they saved before, and ledger and audit
+entries carry ids the database keeps unique. Backups aren't retried, since
+they stream as they go.
+*/
+type guardedStore struct {
+	Store
+	guard *dependencyGuard
+}
+
+func newGuardedStore(store Store, config ResilienceConfig) guardedStore {
+	return guardedStore{Store: store, guard: newDependencyGuard("store", config, transientStoreError)}
+}
+
+/*
+Whether retrying might help: the connection failed, the server is
+restarting or short of resources, or the transaction lost a serialization
+race. Anything about the query or the data itself is permanent.
+*/
+func transientStoreError(err error) bool {
+	var pgError *pgconn.PgError
+	if errors.As(err, &pgError) {
+		for _, class := range []string{"08", "40", "53", "57P"} {
+			if strings.HasPrefix(pgError.Code, class) {
+				return true
+			}
+		}
+		return false
+	}
+	var netError net.Error
+	return errors.As(err, &netError) || errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		pgconn.SafeToRetry(err)
+}
+
+func (store guardedStore) SaveReceipt(record storedReceipt) (int, error) {
+	return guarded(store.guard, func() (int, error) { return store.Store.SaveReceipt(record) })
+}
+
+func (store guardedStore) GetReceipt(id string) (storedReceipt, error) {
+	return guarded(store.guard, func() (storedReceipt, error) { return store.Store.GetReceipt(id) })
+}
+
+func (store guardedStore) DeleteReceipt(id string, owner string) (storedReceipt, error) {
+	return guarded(store.guard, func() (storedReceipt, error) { return store.Store.DeleteReceipt(id, owner) })
+}
+
+func (store guardedStore) RestoreReceipt(id string, owner string) (storedReceipt, error) {
+	return guarded(store.guard, func() (storedReceipt, error) { return store.Store.RestoreReceipt(id, owner) })
+}
+
+func (store guardedStore) ResolveReview(id string, approve bool) (storedReceipt, int, error) {
+	var balance int
+	record, err := guarded(store.guard, func() (storedReceipt, error) {
+		record, newBalance, err := store.Store.ResolveReview(id, approve)
+		balance = newBalance
+		return record, err
+	})
+	return record, balance, err
+}
+
+func (store guardedStore) PendingReview(limit int) ([]storedReceipt, error) {
+	return guarded(store.guard, func() ([]storedReceipt, error) { return store.Store.PendingReview(limit) })
+}
+
+func (store guardedStore) PendingReviewSince(userID string, since time.Time) ([]string, error) {
+	return guarded(store.guard, func() ([]string, error) { return store.Store.PendingReviewSince(userID, since) })
+}
+
+func (store guardedStore) TrashedReceipts(limit int) ([]storedReceipt, error) {
+	return guarded(store.guard, func() ([]storedReceipt, error) { return store.Store.TrashedReceipts(limit) })
+}
+
+func (store guardedStore) ListTrashedReceipts(after string, limit int) ([]storedReceipt, error) {
+	return guarded(store.guard, func() ([]storedReceipt, error) { return store.Store.ListTrashedReceipts(after, limit) })
+}
+
+func (store guardedStore) PurgeTrash(before time.Time) (int, error) {
+	return guarded(store.guard, func() (int, error) { return store.Store.PurgeTrash(before) })
+}
+
+func (store guardedStore) RemoveReceipt(id string) error {
+	return store.guard.do(context.Background(), func() error { return store.Store.RemoveReceipt(id) })
+}
+
+func (store guardedStore) RecentReceipts(limit int) ([]storedReceipt, error) {
+	return guarded(store.guard, func() ([]storedReceipt, error) { return store.Store.RecentReceipts(limit) })
+}
+
+func (store guardedStore) ListReceipts(userID string, after string, limit int) ([]storedReceipt, error) {
+	return guarded(store.guard, func() ([]storedReceipt, error) { return store.Store.ListReceipts(userID, after, limit) })
+}
+
+func (store guardedStore) CountReceipts(userID string) (int, bool, error) {
+	var exact bool
+	count, err := guarded(store.guard, func() (int, error) {
+		count, isExact, err := store.Store.CountReceipts(userID)
+		exact = isExact
+		return count, err
+	})
+	return count, exact, err
+}
+
+func (store guardedStore) CountByPoints(lowerBounds []int) ([]int, error) {
+	return guarded(store.guard, func() ([]int, error) { return store.Store.CountByPoints(lowerBounds) })
+}
+
+func (store guardedStore) Balance(userID string) (int, error) {
+	return guarded(store.guard, func() (int, error) { return store.Store.Balance(userID) })
+}
+
+func (store guardedStore) ListBalances(after string, limit int) ([]userBalance, error) {
+	return guarded(store.guard, func() ([]userBalance, error) { return store.Store.ListBalances(after, limit) })
+}
+
+func (store guardedStore) AdjustBalance(entry ledgerEntry) (ledgerEntry, error) {
+	return guarded(store.guard, func() (ledgerEntry, error) { return store.Store.AdjustBalance(entry) })
+}
+
+func (store guardedStore) MovePoints(entries ...ledgerEntry) ([]ledgerEntry, error) {
+	return guarded(store.guard, func() ([]ledgerEntry, error) { return store.Store.MovePoints(entries...) })
+}
+
+func (store guardedStore) LedgerSince(userID string, kind string, since time.Time) ([]ledgerEntry, error) {
+	return guarded(store.guard, func() ([]ledgerEntry, error) { return store.Store.LedgerSince(userID, kind, since) })
+}
+
+func (store guardedStore) DonationTotals() ([]charityTotal, error) {
+	return guarded(store.guard, store.Store.DonationTotals)
+}
+
+func (store guardedStore) Ledger(userID string, limit int) ([]ledgerEntry, error) {
+	return guarded(store.guard, func() ([]ledgerEntry, error) { return store.Store.Ledger(userID, limit) })
+}
+
+func (store guardedStore) RecordAudit(entry auditEntry) error {
+	return store.guard.do(context.Background(), func() error { return store.Store.RecordAudit(entry) })
+}
+
+func (store guardedStore) AuditTrail(receiptID string, userID string, limit int) ([]auditEntry, error) {
+	return guarded(store.guard, func() ([]auditEntry, error) {
+		return store.Store.AuditTrail(receiptID, userID, limit)
+	})
+}
+
+func (store guardedStore) Profile(userID string) (userProfile, error) {
+	return guarded(store.guard, func() (userProfile, error) { return store.Store.Profile(userID) })
+}
+
+func (store guardedStore) SaveProfile(profile userProfile) error {
+	return store.guard.do(context.Background(), func() error { return store.Store.SaveProfile(profile) })
+}
+
+func (store guardedStore) RegisterTransaction(transaction merchantTransaction) error {
+	return store.guard.do(context.Background(), func() error { return store.Store.RegisterTransaction(transaction) })
+}
+
+func (store guardedStore) Transaction(merchant string, transactionID string) (merchantTransaction, error) {
+	return guarded(store.guard, func() (merchantTransaction, error) {
+		return store.Store.Transaction(merchant, transactionID)
+	})
+}
+
+func (store guardedStore) ClaimTransaction(match transactionMatch) (merchantTransaction, error) {
+	return guarded(store.guard, func() (merchantTransaction, error) { return store.Store.ClaimTransaction(match) })
+}
+
+func (store guardedStore) ReleaseTransaction(receiptID string) error {
+	return store.guard.do(context.Background(), func() error { return store.Store.ReleaseTransaction(receiptID) })
+}
+
+func (store guardedStore) Search(query string, tags []string, channel string, offset int, limit int) ([]searchHit, int, error) {
+	var total int
+	hits, err := guarded(store.guard, func() ([]searchHit, error) {
+		hits, count, err := store.Store.Search(query, tags, channel, offset, limit)
+		total = count
+		return hits, err
+	})
+	return hits, total, err
+}
+
+func (store guardedStore) Stats(since time.Time) (receiptStats, error) {
+	return guarded(store.guard, func() (receiptStats, error) { return store.Store.Stats(since) })
+}
+
+func (store guardedStore) Rollup(start time.Time, end time.Time) (report, error) {
+	return guarded(store.guard, func() (report, error) { return store.Store.Rollup(start, end) })
+}
+
+func (store guardedStore) SaveReport(saved report) error {
+	return store.guard.do(context.Background(), func() error { return store.Store.SaveReport(saved) })
+}
+
+func (store guardedStore) Reports(period string, from time.Time, to time.Time) ([]report, error) {
+	return guarded(store.guard, func() ([]report, error) { return store.Store.Reports(period, from, to) })
+}
+
+func (store guardedStore) VariantStats() ([]variantStats, error) {
+	return guarded(store.guard, store.Store.VariantStats)
+}
+
+// Safe to retry too, as balances are set rather than added to.
+func (store guardedStore) Merge(entries []snapshotEntry) error {
+	return store.guard.do(context.Background(), func() error { return store.Store.Merge(entries) })
+}
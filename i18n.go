@@ -0,0 +1,151 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Message catalogs, one per language, keyed by message code.
+//
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// Messages in this language are used whenever a translation is missing.
+const defaultLanguage = "en"
+
+// Global message catalogs by language
+var catalogs = mustLoadCatalogs()
+
+func mustLoadCatalogs() map[string]map[string]string {
+	paths, err := fs.Glob(localeFiles, "locales/*.json")
+	if err != nil {
+		panic(err)
+	}
+
+	loaded := make(map[string]map[string]string)
+	for _, path := range paths {
+		contents, err := localeFiles.ReadFile(path)
+		if err != nil {
+			panic(err)
+		}
+		var catalog map[string]string
+		if err := json.Unmarshal(contents, &catalog); err != nil {
+			panic(fmt.Sprintf("failed to parse message catalog %s: %v", path, err))
+		}
+		language := strings.TrimSuffix(strings.TrimPrefix(path, "locales/"), ".json")
+		loaded[language] = catalog
+	}
+	return loaded
+}
+
+/*
+An error whose message can be shown to clients in their own language. The
+code identifies the message so clients can also show their own copy.
+*/
+type clientError struct {
+	code string
+	args []any
+}
+
+func newClientError(code string, args ...any) *clientError {
+	return &clientError{code: code, args: args}
+}
+
+func (err *clientError) Error() string {
+	return translate(defaultLanguage, err.code, err.args...)
+}
+
+// Looks up a message, falling back to English and then to the code itself.
+func translate(language string, code string, args ...any) string {
+	message, exists := catalogs[language][code]
+	if !exists {
+		message, exists = catalogs[defaultLanguage][code]
+	}
+	if !exists {
+		return code
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(message, args...)
+	}
+	return message
+}
+
+/*
+Picks the best supported language from an Accept-Language header, matching
+on the primary subtag so "es-MX" gets Spanish.
+*/
+func preferredLanguage(acceptLanguage string) string {
+	type weightedLanguage struct {
+		language string
+		quality  float64
+	}
+
+	var candidates []weightedLanguage
+	for _, entry := range strings.Split(acceptLanguage, ",") {
+		tag, parameters, _ := strings.Cut(strings.TrimSpace(entry), ";")
+		quality := 1.0
+		if value, found := strings.CutPrefix(strings.TrimSpace(parameters), "q="); found {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				quality = parsed
+			}
+		}
+		primary, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		if _, supported := catalogs[primary]; supported && quality > 0 {
+			candidates = append(candidates, weightedLanguage{language: primary, quality: quality})
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].quality > candidates[j].quality })
+	if len(candidates) == 0 {
+		return defaultLanguage
+	}
+	return candidates[0].language
+}
+
+func requestLanguage(context *gin.Context) string {
+	return preferredLanguage(context.GetHeader("Accept-Language"))
+}
+
+// Responds with a message in the caller's language along with its code.
+func respondWithMessage(context *gin.Context, status int, code string, args ...any) {
+	context.Header("Content-Language", requestLanguage(context))
+	context.IndentedJSON(
+		status,
+		gin.H{"message": translate(requestLanguage(context), code, args...), "code": code},
+	)
+}
+
+/*
+Responds with the error's message, translated when it's a clientError,
+along with each field's problem when it's a validationError.
+*/
+func respondWithError(context *gin.Context, status int, err error) {
+	if fields := localizeFieldErrors(requestLanguage(context), err); fields != nil {
+		context.Header("Content-Language", requestLanguage(context))
+		context.IndentedJSON(status, gin.H{"message": fields[0].Message, "code": fields[0].Code, "errors": fields})
+		return
+	}
+	var translatable *clientError
+	if errors.As(err, &translatable) {
+		respondWithMessage(context, status, translatable.code, translatable.args...)
+		return
+	}
+	context.IndentedJSON(status, gin.H{"message": err.Error()})
+}
+
+// Returns the error's message in the language along with its code, if it has one.
+func localizeError(language string, err error) (string, string) {
+	var translatable *clientError
+	if errors.As(err, &translatable) {
+		return translate(language, translatable.code, translatable.args...), translatable.code
+	}
+	return err.Error(), ""
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+How replicas tell each other to drop what they cache when a receipt changes
+or the rules are reloaded on one of them. Backend is "" to leave each
+replica's caches to itself, "redis" at REDIS_URL or "nats" at NATSURL, and
+Channel the Redis channel or NATS subject they share.
+*/
+type InvalidationConfig struct {
+	Backend string
+	Channel string
+	NATSURL string
+}
+
+/*
+What a replica tells the others to drop: the cached points of Receipts,
+every receipt's after a restore, or the rules, which they reload from their
+RULES_FILE.
+*/
+type invalidation struct {
+	// the replica that published it, which has already dropped its own
+	Origin      string   `json:"origin"`
+	Receipts    []string `json:"receipts,omitempty"`
+	AllReceipts bool     `json:"allReceipts,omitempty"`
+	Rules       bool     `json:"rules,omitempty"`
+}
+
+// Where invalidations are published for the other replicas.
+type invalidationBus interface {
+	publish(payload []byte) error
+}
+
+// Global invalidation bus, nil when caches are only invalidated locally
+var invalidations invalidationBus
+
+// Tells this replica's invalidations apart from the ones it hears from the others.
+var instanceID = uuid.New().String()
+
+// Drops the receipt's cached points here and on the other replicas.
+func invalidatePoints(receiptID string) {
+	pointsCache.remove(receiptID)
+	broadcastInvalidation(invalidation{Receipts: []string{receiptID}})
+}
+
+// Drops every cached receipt's points here and on the other replicas.
+func invalidateAllPoints() {
+	pointsCache.clear()
+	broadcastInvalidation(invalidation{AllReceipts: true})
+}
+
+/*
+Tells the other replicas what to drop. A failed publish is only logged:
+their entries stay until they're evicted, as they did before replicas
+shared invalidations.
+*/
+func broadcastInvalidation(message invalidation) {
+	if invalidations == nil {
+		return
+	}
+	message.Origin = instanceID
+	payload, err := json.Marshal(message)
+	if err == nil {
+		err = invalidations.publish(payload)
+	}
+	if err != nil {
+		log.Printf("Failed to publish a cache invalidation: %v", err)
+	}
+}
+
+// Drops what another replica's invalidation names.
+func applyInvalidation(payload []byte) {
+	var message invalidation
+	if err := json.Unmarshal(payload, &message); err != nil {
+		log.Printf("Ignoring a malformed cache invalidation: %v", err)
+		return
+	}
+	if message.Origin == instanceID {
+		return
+	}
+	if message.AllReceipts {
+		pointsCache.clear()
+	}
+	for _, receiptID := range message.Receipts {
+		pointsCache.remove(receiptID)
+	}
+	if message.Rules {
+		reloadRules()
+	}
+}
+
+/*
+Invalidations published while the connection was down are lost, so after
+reconnecting everything they could have named is dropped.
+*/
+func catchUpInvalidations() {
+	log.Print("Reconnected to the cache invalidation channel, dropping cached points and reloading the rules")
+	pointsCache.clear()
+	reloadRules()
+}
+
+/*
+Subscribes to the invalidations CACHE_INVALIDATION names before returning,
+so none published once the replica serves requests are missed.
+*/
+func startCacheInvalidation(config Config) error {
+	switch config.Invalidation.Backend {
+	case "":
+		if config.ClusterMode {
+			log.Print("Replicas don't invalidate each other's caches; set CACHE_INVALIDATION=redis or nats " +
+				"for changed receipts and reloaded rules to reach every replica")
+		}
+		return nil
+	case "redis":
+		client, err := openRedis(config.RedisURL, "CACHE_INVALIDATION=redis")
+		if err != nil {
+			return err
+		}
+		bus := redisInvalidations{client: client, channel: config.Invalidation.Channel}
+		if err := bus.subscribe(); err != nil {
+			return fmt.Errorf("failed to subscribe to Redis channel %s: %w", bus.channel, err)
+		}
+		invalidations = bus
+	case "nats":
+		bus, err := subscribeNATSInvalidations(config.Invalidation)
+		if err != nil {
+			return err
+		}
+		invalidations = bus
+	default:
+		return errors.New("unknown CACHE_INVALIDATION: " + config.Invalidation.Backend)
+	}
+	log.Printf("Sharing cache invalidations over %s %s", config.Invalidation.Backend, config.Invalidation.Channel)
+	return nil
+}
+
+// Shares invalidations over a Redis pub/sub channel.
+type redisInvalidations struct {
+	client  *redis.Client
+	channel string
+}
+
+func (bus redisInvalidations) publish(payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	return bus.client.Publish(ctx, bus.channel, payload).Err()
+}
+
+/*
+Subscribes and hands invalidations to applyInvalidation in the background.
+The client resubscribes by itself after losing the connection, confirming
+the subscription again, which is when invalidations may have been missed.
+*/
+func (bus redisInvalidations) subscribe() error {
+	subscription := bus.client.Subscribe(context.Background(), bus.channel)
+	if _, err := subscription.ReceiveTimeout(context.Background(), redisTimeout); err != nil {
+		subscription.Close()
+		return err
+	}
+	go func() {
+		for message := range subscription.ChannelWithSubscriptions() {
+			switch message := message.(type) {
+			case *redis.Subscription:
+				catchUpInvalidations()
+			case *redis.Message:
+				applyInvalidation([]byte(message.Payload))
+			}
+		}
+	}()
+	return nil
+}
+
+/*
+Shares invalidations over a core NATS subject: they only matter to replicas
+running when they're published, so JetStream would keep them for nothing.
+*/
+type natsInvalidations struct {
+	connection *nats.Conn
+	subject    string
+}
+
+func (bus natsInvalidations) publish(payload []byte) error {
+	return bus.connection.Publish(bus.subject, payload)
+}
+
+func subscribeNATSInvalidations(config InvalidationConfig) (natsInvalidations, error) {
+	if config.NATSURL == "" {
+		return natsInvalidations{}, errors.New("CACHE_INVALIDATION=nats needs CACHE_INVALIDATION_NATS_URL or NATS_URL")
+	}
+	connection, err := nats.Connect(config.NATSURL,
+		nats.Name("receipt-scanner"),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Printf("Disconnected from the cache invalidation subject: %v", err)
+		}),
+		nats.ReconnectHandler(func(*nats.Conn) { catchUpInvalidations() }),
+	)
+	if err != nil {
+		return natsInvalidations{}, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	_, err = connection.Subscribe(config.Channel, func(message *nats.Msg) {
+		applyInvalidation(message.Data)
+	})
+	// the server has the subscription once the flush returns
+	if err == nil {
+		err = connection.Flush()
+	}
+	if err != nil {
+		connection.Close()
+		return natsInvalidations{}, fmt.Errorf("failed to subscribe to %s: %w", config.Channel, err)
+	}
+	return natsInvalidations{connection: connection, subject: config.Channel}, nil
+}
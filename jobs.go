@@ -0,0 +1,714 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+How receipts submitted to POST /receipts/batch with Prefer: respond-async
+are queued. The "memory" queue loses its jobs when the process stops;
+"redis" at REDIS_URL keeps them, so a batch survives restarts mid-run, and
+replicas share it. Jobs failing for a reason on our side are retried
+MaxAttempts times in all, waiting Backoff before the first retry and twice
+as long before each one after, up to MaxBackoff, then dead-lettered.
+*/
+type JobQueueConfig struct {
+	Backend     string
+	Workers     int
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+}
+
+const (
+	// How long a worker has a job before another may take it, in case the first stopped.
+	jobLease = 2 * time.Minute
+	// How often idle workers look for jobs that came due.
+	jobPollInterval = time.Second
+	// How long finished jobs are kept for GET /receipts/batch/:id; dead ones stay until requeued.
+	jobRetention = 7 * 24 * time.Hour
+	// Most receipts one async batch may have, since they're all read before any is queued.
+	maxAsyncBatch = 10000
+	// Dead jobs GET /admin/jobs/dead lists by default, and at most.
+	defaultDeadJobsLimit = 50
+	maxDeadJobsLimit     = 500
+)
+
+// Audit action for an operator requeueing a dead job.
+const auditJobRequeued = "job.requeued"
+
+// States of a queued receipt, besides jobRunning, jobCompleted and jobFailed (refused for good).
+const (
+	jobQueued = "queued"
+	// out of attempts, waiting for an operator to requeue it
+	jobDead = "dead"
+)
+
+/*
+One receipt of an async batch. It's saved as ReceiptID on every attempt, so
+a job retried after its receipt was saved replaces the receipt rather than
+awarding its points twice.
+*/
+type receiptJob struct {
+	ID         string    `json:"id"`
+	BatchID    string    `json:"batchId"`
+	Index      int       `json:"index"`
+	Receipt    Receipt   `json:"receipt"`
+	UserID     string    `json:"userId,omitempty"`
+	APIKey     string    `json:"apiKey,omitempty"`
+	ReceiptID  string    `json:"receiptId"`
+	State      string    `json:"state"`
+	Attempts   int       `json:"attempts"`
+	EnqueuedAt time.Time `json:"enqueuedAt"`
+	// when a queued job is next tried, or a running one's lease runs out
+	RunAt      time.Time  `json:"runAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	// the outcome once it's finished, or the last attempt's error
+	Points  int          `json:"points"`
+	Status  string       `json:"status,omitempty"`
+	Message string       `json:"message,omitempty"`
+	Code    string       `json:"code,omitempty"`
+	Errors  []fieldError `json:"errors,omitempty"`
+}
+
+var errJobNotFound = errors.New("job not found")
+
+var errJobNotDead = errors.New("job isn't dead")
+
+// Where jobs wait for the workers, see JobQueueConfig.
+type jobQueue interface {
+	// Adds the jobs, all or none of them.
+	enqueue(jobs []receiptJob) error
+	// Takes the next queued job due by now, running it for jobLease and
+	// counting the attempt, or reports false when none is due.
+	take(now time.Time) (receiptJob, bool, error)
+	// Saves a taken job's new state: queued again until RunAt, or finished.
+	finish(job receiptJob) error
+	// Returns the job, or errJobNotFound.
+	job(id string) (receiptJob, error)
+	// Returns the jobs of the batch that are still kept, by index.
+	batch(batchID string) ([]receiptJob, error)
+	// Returns a page of dead jobs, most recently dead first, and how many there are.
+	dead(offset int, limit int) ([]receiptJob, int, error)
+	// Queues a dead job again with its attempts reset, or returns errJobNotDead.
+	requeue(id string, now time.Time) (receiptJob, error)
+}
+
+// Global job queue, nil when async batches are off
+var receiptJobs jobQueue
+
+// Opens the queue JOB_QUEUE names, or none when it's empty.
+func openJobQueue(config Config) (jobQueue, error) {
+	switch config.Jobs.Backend {
+	case "":
+		return nil, nil
+	case "memory":
+		if config.ClusterMode {
+			log.Print("Replicas don't share the memory job queue; set JOB_QUEUE=redis for batches to survive restarts")
+		}
+		return newMemoryJobQueue(), nil
+	case "redis":
+		client, err := openRedis(config.RedisURL, "JOB_QUEUE=redis")
+		if err != nil {
+			return nil, err
+		}
+		return redisJobQueue{client: client}, nil
+	}
+	return nil, errors.New("unknown JOB_QUEUE: " + config.Jobs.Backend)
+}
+
+// Starts the workers scoring queued receipts in the background.
+func startJobWorkers(queue jobQueue, config JobQueueConfig, quotas *quotaMeter) {
+	for worker := 0; worker < max(config.Workers, 1); worker++ {
+		go func() {
+			for {
+				job, found, err := queue.take(wallClock.Now())
+				if err != nil {
+					log.Printf("Failed to take a job from the queue: %v", err)
+				}
+				if !found {
+					time.Sleep(jobPollInterval)
+					continue
+				}
+				runJob(queue, config, quotas, job)
+			}
+		}()
+	}
+}
+
+/*
+Scores the job's receipt. Receipts that fail for a reason on our side, like
+NATS deliveries, are retried; invalid ones fail for good. Each attempt is
+counted against the API key the batch was sent with, and uncounted if it
+fails, so receipts beyond the key's quotas fail when they're run.
+*/
+func runJob(queue jobQueue, config JobQueueConfig, quotas *quotaMeter, job receiptJob) {
+	refund := func() {}
+	var err error
+	if key, known := quotas.named(job.APIKey); known {
+		refund, err = quotas.chargeKey(key, defaultLanguage)
+	}
+	var record storedReceipt
+	if err == nil {
+		if record, _, err = scoreAndSave(
+			processing{apiKey: job.APIKey}, job.ReceiptID, job.Receipt, job.UserID, channelBatch,
+		); err != nil {
+			refund()
+		}
+	}
+	now := wallClock.Now()
+	job.Message, job.Code, job.Errors = "", "", nil
+	if err != nil {
+		job.Message, job.Code = localizeError(defaultLanguage, err)
+		job.Errors = localizeFieldErrors(defaultLanguage, err)
+	}
+	switch {
+	case retriesJob(err) && job.Attempts < config.MaxAttempts:
+		job.State = jobQueued
+		job.RunAt = now.Add(retryBackoff(config, job.Attempts))
+	case retriesJob(err):
+		job.State, job.FinishedAt = jobDead, &now
+		log.Printf("Job %s is dead after %d attempts: %s", job.ID, job.Attempts, job.Message)
+	case err != nil:
+		job.State, job.FinishedAt = jobFailed, &now
+	default:
+		job.State, job.FinishedAt = jobCompleted, &now
+		job.Points, job.Status = record.Points, record.Status
+	}
+	if err := queue.finish(job); err != nil {
+		// the job runs again once its lease runs out
+		log.Printf("Failed to save job %s: %v", job.ID, err)
+	}
+}
+
+// Whether the job failed for a reason on our side, and may succeed if it's tried again.
+func retriesJob(err error) bool {
+	return errors.Is(err, errSaveFailed) || errors.Is(err, errSaveConflict) || errors.Is(err, errPoolSaturated) ||
+		errors.Is(err, errQuotaCheckFailed)
+}
+
+// How long a job waits before its next attempt, after the given number of attempts.
+func retryBackoff(config JobQueueConfig, attempts int) time.Duration {
+	backoff := config.Backoff
+	for attempt := 1; attempt < attempts && backoff < config.MaxBackoff; attempt++ {
+		backoff *= 2
+	}
+	return min(backoff, config.MaxBackoff)
+}
+
+/*
+Whether the batch is queued rather than scored as it's read: the client
+asked for that (RFC 7240) and there's a queue. Sandboxed and backdated
+receipts depend on the request, so they're always scored right away.
+*/
+func queuesBatch(context *gin.Context) bool {
+	target := processingFor(context)
+	if receiptJobs == nil || target.sandbox != nil || target.clock != nil || target.atPurchase {
+		return false
+	}
+	for _, preference := range context.Request.Header.Values("Prefer") {
+		if strings.Contains(strings.ToLower(preference), "respond-async") {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Queues a batch sent with Prefer: respond-async, responding 202 with the
+batch's id once every receipt is queued. Receipts whose fields are refused
+are recorded as failed jobs, so the batch's status covers every index; bad
+JSON refuses the whole batch, since nothing after it can be read.
+*/
+func queueBatch(context *gin.Context, decoder *json.Decoder, isArray bool) {
+	batchID := uuid.New().String()
+	now := wallClock.Now()
+	var jobs []receiptJob
+	for index := 0; decoder.More(); index++ {
+		if index == maxAsyncBatch {
+			respondWithMessage(context, http.StatusRequestEntityTooLarge, "batch.too_large", maxAsyncBatch)
+			return
+		}
+		job := receiptJob{
+			ID:         uuid.New().String(),
+			BatchID:    batchID,
+			Index:      index,
+			UserID:     submittingUser(context),
+			APIKey:     processingFor(context).apiKey,
+			ReceiptID:  uuid.New().String(),
+			State:      jobQueued,
+			EnqueuedAt: now,
+			RunAt:      now,
+		}
+		err := decoder.Decode(&job.Receipt)
+		var invalid *validationError
+		if errors.As(err, &invalid) {
+			job.State, job.FinishedAt = jobFailed, &now
+			job.Message, job.Code = localizeError(defaultLanguage, err)
+			job.Errors = invalid.localize(defaultLanguage)
+		} else if err != nil {
+			respondWithMessage(context, http.StatusBadRequest, "batch.read_failed")
+			return
+		}
+		jobs = append(jobs, job)
+	}
+	if isArray {
+		decoder.Token()
+	}
+
+	if err := receiptJobs.enqueue(jobs); err != nil {
+		log.Printf("Failed to queue batch %s: %v", batchID, err)
+		respondWithMessage(context, http.StatusServiceUnavailable, "batch.queue_failed")
+		return
+	}
+	status := "/receipts/batch/" + batchID
+	context.Header("Preference-Applied", "respond-async")
+	context.Header("Location", status)
+	context.IndentedJSON(http.StatusAccepted, gin.H{
+		"batchId": batchID,
+		"jobs":    len(jobs),
+		"links":   gin.H{"status": gin.H{"href": status}},
+	})
+}
+
+/*
+Reports how far an async batch has got: how many of its jobs are in each
+state, and each job. Other users' batches look missing to authenticated
+callers.
+*/
+func getBatchStatus(context *gin.Context) {
+	if receiptJobs == nil {
+		respondWithMessage(context, http.StatusNotFound, "batch.not_found")
+		return
+	}
+	jobs, err := receiptJobs.batch(context.Param("id"))
+	if err != nil {
+		respondWithMessage(context, http.StatusInternalServerError, "batch.lookup_failed")
+		return
+	}
+	// a batch's jobs all belong to the user who sent it
+	if scope := ownerScope(context); len(jobs) == 0 || scope != "" && jobs[0].UserID != scope {
+		respondWithMessage(context, http.StatusNotFound, "batch.not_found")
+		return
+	}
+	counts := make(map[string]int)
+	for _, job := range jobs {
+		counts[job.State]++
+	}
+	context.IndentedJSON(http.StatusOK, gin.H{"batchId": context.Param("id"), "counts": counts, "jobs": jobs})
+}
+
+// Lists dead jobs for operators, most recently dead first, with ?limit= and ?offset=.
+func getDeadJobs(context *gin.Context) {
+	limit, limitError := strconv.Atoi(context.DefaultQuery("limit", strconv.Itoa(defaultDeadJobsLimit)))
+	offset, offsetError := strconv.Atoi(context.DefaultQuery("offset", "0"))
+	if limitError != nil || offsetError != nil || limit < 1 || limit > maxDeadJobsLimit || offset < 0 {
+		respondWithMessage(context, http.StatusBadRequest, "jobs.page_invalid", maxDeadJobsLimit)
+		return
+	}
+	if receiptJobs == nil {
+		context.IndentedJSON(http.StatusOK, gin.H{"jobs": []receiptJob{}, "total": 0})
+		return
+	}
+	jobs, total, err := receiptJobs.dead(offset, limit)
+	if err != nil {
+		respondWithMessage(context, http.StatusInternalServerError, "jobs.lookup_failed")
+		return
+	}
+	if jobs == nil {
+		jobs = []receiptJob{}
+	}
+	context.IndentedJSON(http.StatusOK, gin.H{"jobs": jobs, "total": total})
+}
+
+// Shows one job, whatever its state.
+func getJob(context *gin.Context) {
+	if receiptJobs == nil {
+		respondWithMessage(context, http.StatusNotFound, "jobs.not_found")
+		return
+	}
+	job, err := receiptJobs.job(context.Param("id"))
+	if errors.Is(err, errJobNotFound) {
+		respondWithMessage(context, http.StatusNotFound, "jobs.not_found")
+		return
+	}
+	if err != nil {
+		respondWithMessage(context, http.StatusInternalServerError, "jobs.lookup_failed")
+		return
+	}
+	context.IndentedJSON(http.StatusOK, job)
+}
+
+// Queues a dead job again, for when whatever it failed on is fixed.
+func requeueJob(context *gin.Context) {
+	if receiptJobs == nil {
+		respondWithMessage(context, http.StatusNotFound, "jobs.not_found")
+		return
+	}
+	job, err := receiptJobs.requeue(context.Param("id"), wallClock.Now())
+	switch {
+	case errors.Is(err, errJobNotFound):
+		respondWithMessage(context, http.StatusNotFound, "jobs.not_found")
+	case errors.Is(err, errJobNotDead):
+		respondWithMessage(context, http.StatusConflict, "jobs.not_dead", job.State)
+	case err != nil:
+		log.Printf("Failed to requeue job %s: %v", context.Param("id"), err)
+		respondWithMessage(context, http.StatusInternalServerError, "jobs.requeue_failed")
+	default:
+		recordAudit(context, auditEntry{
+			Action:    auditJobRequeued,
+			ReceiptID: job.ReceiptID,
+			UserID:    job.UserID,
+			Reason:    "job " + job.ID,
+		})
+		context.IndentedJSON(http.StatusOK, job)
+	}
+}
+
+// Keeps jobs in memory, for a single instance that can lose them.
+type memoryJobQueue struct {
+	mutex sync.Mutex
+	jobs  map[string]receiptJob
+	// job ids by batch, in the order they were queued
+	batches map[string][]string
+}
+
+func newMemoryJobQueue() *memoryJobQueue {
+	return &memoryJobQueue{jobs: make(map[string]receiptJob), batches: make(map[string][]string)}
+}
+
+func (queue *memoryJobQueue) enqueue(jobs []receiptJob) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	queue.expire(wallClock.Now())
+	for _, job := range jobs {
+		queue.jobs[job.ID] = job
+		queue.batches[job.BatchID] = append(queue.batches[job.BatchID], job.ID)
+	}
+	return nil
+}
+
+// Forgets batches whose jobs all finished more than jobRetention ago, except dead ones.
+func (queue *memoryJobQueue) expire(now time.Time) {
+	for batchID, ids := range queue.batches {
+		expired := true
+		for _, id := range ids {
+			job := queue.jobs[id]
+			if job.FinishedAt == nil || job.State == jobDead || now.Sub(*job.FinishedAt) < jobRetention {
+				expired = false
+				break
+			}
+		}
+		if expired {
+			for _, id := range ids {
+				delete(queue.jobs, id)
+			}
+			delete(queue.batches, batchID)
+		}
+	}
+}
+
+func (queue *memoryJobQueue) take(now time.Time) (receiptJob, bool, error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	var next *receiptJob
+	for _, job := range queue.jobs {
+		// a running job whose lease ran out lost its worker
+		due := (job.State == jobQueued || job.State == jobRunning) && !job.RunAt.After(now)
+		if due && (next == nil || job.RunAt.Before(next.RunAt)) {
+			candidate := job
+			next = &candidate
+		}
+	}
+	if next == nil {
+		return receiptJob{}, false, nil
+	}
+	next.State, next.RunAt = jobRunning, now.Add(jobLease)
+	next.Attempts++
+	queue.jobs[next.ID] = *next
+	return *next, true, nil
+}
+
+func (queue *memoryJobQueue) finish(job receiptJob) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	queue.jobs[job.ID] = job
+	return nil
+}
+
+func (queue *memoryJobQueue) job(id string) (receiptJob, error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	job, exists := queue.jobs[id]
+	if !exists {
+		return receiptJob{}, errJobNotFound
+	}
+	return job, nil
+}
+
+func (queue *memoryJobQueue) batch(batchID string) ([]receiptJob, error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	jobs := make([]receiptJob, 0, len(queue.batches[batchID]))
+	for _, id := range queue.batches[batchID] {
+		jobs = append(jobs, queue.jobs[id])
+	}
+	return jobs, nil
+}
+
+func (queue *memoryJobQueue) dead(offset int, limit int) ([]receiptJob, int, error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	var dead []receiptJob
+	for _, job := range queue.jobs {
+		if job.State == jobDead {
+			dead = append(dead, job)
+		}
+	}
+	sort.Slice(dead, func(i, j int) bool { return dead[i].FinishedAt.After(*dead[j].FinishedAt) })
+	total := len(dead)
+	dead = dead[min(offset, total):]
+	return dead[:min(limit, len(dead))], total, nil
+}
+
+func (queue *memoryJobQueue) requeue(id string, now time.Time) (receiptJob, error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	job, exists := queue.jobs[id]
+	if !exists {
+		return receiptJob{}, errJobNotFound
+	}
+	if job.State != jobDead {
+		return job, errJobNotDead
+	}
+	job = job.requeued(now)
+	queue.jobs[id] = job
+	return job, nil
+}
+
+// The dead job queued to run now with its attempts reset.
+func (job receiptJob) requeued(now time.Time) receiptJob {
+	job.State, job.Attempts, job.RunAt, job.FinishedAt = jobQueued, 0, now, nil
+	return job
+}
+
+/*
+Keeps jobs in Redis: each job as JSON, the ids of queued and running jobs
+in a sorted set by when they're due (a running job is due again when its
+lease runs out), dead ones in another by when they died, and each batch's
+ids in a list.
+*/
+type redisJobQueue struct {
+	client *redis.Client
+}
+
+const (
+	redisJobsReady = "receipt-jobs:ready"
+	redisJobsDead  = "receipt-jobs:dead"
+)
+
+func redisJobKey(id string) string { return "receipt-jobs:job:" + id }
+
+func redisBatchKey(batchID string) string { return "receipt-jobs:batch:" + batchID }
+
+/*
+Takes the first job due by ARGV[1] off KEYS[1] by making it due again at
+ARGV[2], so replicas taking jobs at the same time get different ones.
+*/
+var takeJobScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, 1)
+if #ids == 0 then
+	return false
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ids[1])
+return ids[1]
+`)
+
+func (queue redisJobQueue) enqueue(jobs []receiptJob) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	_, err := queue.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, job := range jobs {
+			encoded, err := json.Marshal(job)
+			if err != nil {
+				return err
+			}
+			if job.State == jobQueued {
+				pipe.Set(ctx, redisJobKey(job.ID), encoded, 0)
+				pipe.ZAdd(ctx, redisJobsReady, redis.Z{Score: float64(job.RunAt.UnixMilli()), Member: job.ID})
+			} else {
+				pipe.Set(ctx, redisJobKey(job.ID), encoded, jobRetention)
+			}
+			pipe.RPush(ctx, redisBatchKey(job.BatchID), job.ID)
+		}
+		if len(jobs) > 0 {
+			pipe.Expire(ctx, redisBatchKey(jobs[0].BatchID), jobRetention)
+		}
+		return nil
+	})
+	return err
+}
+
+func (queue redisJobQueue) take(now time.Time) (receiptJob, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	id, err := takeJobScript.Run(
+		ctx, queue.client, []string{redisJobsReady}, now.UnixMilli(), now.Add(jobLease).UnixMilli(),
+	).Text()
+	if errors.Is(err, redis.Nil) {
+		return receiptJob{}, false, nil
+	}
+	if err != nil {
+		return receiptJob{}, false, err
+	}
+	job, err := queue.job(id)
+	if errors.Is(err, errJobNotFound) {
+		// nothing left to run
+		queue.client.ZRem(ctx, redisJobsReady, id)
+		return receiptJob{}, false, nil
+	}
+	if err != nil {
+		return receiptJob{}, false, err
+	}
+	job.State, job.RunAt = jobRunning, now.Add(jobLease)
+	job.Attempts++
+	encoded, err := json.Marshal(job)
+	if err != nil {
+		return receiptJob{}, false, err
+	}
+	if err := queue.client.Set(ctx, redisJobKey(id), encoded, 0).Err(); err != nil {
+		return receiptJob{}, false, err
+	}
+	return job, true, nil
+}
+
+func (queue redisJobQueue) finish(job receiptJob) error {
+	encoded, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	_, err = queue.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		switch job.State {
+		case jobQueued:
+			pipe.Set(ctx, redisJobKey(job.ID), encoded, 0)
+			pipe.ZAdd(ctx, redisJobsReady, redis.Z{Score: float64(job.RunAt.UnixMilli()), Member: job.ID})
+		case jobDead:
+			pipe.Set(ctx, redisJobKey(job.ID), encoded, 0)
+			pipe.ZRem(ctx, redisJobsReady, job.ID)
+			pipe.ZAdd(ctx, redisJobsDead, redis.Z{Score: float64(job.FinishedAt.UnixMilli()), Member: job.ID})
+		default:
+			pipe.Set(ctx, redisJobKey(job.ID), encoded, jobRetention)
+			pipe.ZRem(ctx, redisJobsReady, job.ID)
+		}
+		return nil
+	})
+	return err
+}
+
+func (queue redisJobQueue) job(id string) (receiptJob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	encoded, err := queue.client.Get(ctx, redisJobKey(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return receiptJob{}, errJobNotFound
+	}
+	if err != nil {
+		return receiptJob{}, err
+	}
+	var job receiptJob
+	return job, json.Unmarshal(encoded, &job)
+}
+
+// The jobs with the ids that are still kept, in order.
+func (queue redisJobQueue) jobs(ctx context.Context, ids []string) ([]receiptJob, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, len(ids))
+	for index, id := range ids {
+		keys[index] = redisJobKey(id)
+	}
+	values, err := queue.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]receiptJob, 0, len(values))
+	for _, value := range values {
+		encoded, kept := value.(string)
+		if !kept {
+			continue
+		}
+		var job receiptJob
+		if err := json.Unmarshal([]byte(encoded), &job); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+func (queue redisJobQueue) batch(batchID string) ([]receiptJob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	ids, err := queue.client.LRange(ctx, redisBatchKey(batchID), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return queue.jobs(ctx, ids)
+}
+
+func (queue redisJobQueue) dead(offset int, limit int) ([]receiptJob, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	total, err := queue.client.ZCard(ctx, redisJobsDead).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	ids, err := queue.client.ZRevRange(ctx, redisJobsDead, int64(offset), int64(offset+limit-1)).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	jobs, err := queue.jobs(ctx, ids)
+	return jobs, int(total), err
+}
+
+func (queue redisJobQueue) requeue(id string, now time.Time) (receiptJob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	// only the first of two operators requeueing the job at once gets to
+	removed, err := queue.client.ZRem(ctx, redisJobsDead, id).Result()
+	if err != nil {
+		return receiptJob{}, err
+	}
+	job, err := queue.job(id)
+	if err != nil {
+		return receiptJob{}, err
+	}
+	if removed == 0 || job.State != jobDead {
+		return job, errJobNotDead
+	}
+	job = job.requeued(now)
+	return job, queue.finish(job)
+}
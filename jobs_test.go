@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	config := JobQueueConfig{Backoff: time.Second, MaxBackoff: 10 * time.Second}
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{50, 10 * time.Second},
+	}
+	for _, test := range tests {
+		if got := retryBackoff(config, test.attempts); got != test.want {
+			t.Errorf("retryBackoff() after %d attempts = %s, want %s", test.attempts, got, test.want)
+		}
+	}
+}
+
+// A store that can't save receipts while it's down.
+type downStore struct {
+	Store
+	down *bool
+}
+
+func (store downStore) SaveReceipt(record storedReceipt) (int, error) {
+	if *store.down {
+		return 0, errors.New("connection refused")
+	}
+	return store.Store.SaveReceipt(record)
+}
+
+// Sets the global job queue to a memory one for the test.
+func useTestJobQueue(t *testing.T) *memoryJobQueue {
+	previous := receiptJobs
+	t.Cleanup(func() { receiptJobs = previous })
+	queue := newMemoryJobQueue()
+	receiptJobs = queue
+	return queue
+}
+
+// A job failing on our side is retried after each backoff, then dead until it's requeued.
+func TestRunJobRetriesUntilDead(t *testing.T) {
+	down := true
+	store := useTestGlobals(t)
+	receipts = downStore{store, &down}
+	queue := useTestJobQueue(t)
+	config := JobQueueConfig{MaxAttempts: 3, Backoff: time.Minute, MaxBackoff: time.Hour}
+	now := time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC)
+	stopWallClock(t, now)
+	queued := receiptJob{ID: "job", BatchID: "batch", Receipt: targetReceipt(), UserID: "alice", ReceiptID: "receipt", State: jobQueued, RunAt: now}
+	if err := queue.enqueue([]receiptJob{queued}); err != nil {
+		t.Fatalf("enqueue() failed: %v", err)
+	}
+
+	for _, wait := range []time.Duration{time.Minute, 2 * time.Minute, 0} {
+		job, found, _ := queue.take(now)
+		if !found {
+			t.Fatalf("take() found nothing at %s", now)
+		}
+		runJob(queue, config, nil, job)
+		job, _ = queue.job("job")
+		if wait == 0 {
+			if job.State != jobDead || job.Attempts != config.MaxAttempts {
+				t.Fatalf("after the last attempt the job is %s after %d attempts, want dead after %d", job.State, job.Attempts, config.MaxAttempts)
+			}
+			break
+		}
+		if job.State != jobQueued || !job.RunAt.Equal(now.Add(wait)) {
+			t.Fatalf("after attempt %d the job is %s until %s, want queued until %s", job.Attempts, job.State, job.RunAt, now.Add(wait))
+		}
+		if job.Code != "receipt.save_failed" {
+			t.Errorf("after attempt %d the job's code is %q, want receipt.save_failed", job.Attempts, job.Code)
+		}
+		if _, found, _ := queue.take(now.Add(wait - time.Second)); found {
+			t.Fatalf("take() found the job before its backoff ran out")
+		}
+		now = now.Add(wait)
+		stopWallClock(t, now)
+	}
+	if _, found, _ := queue.take(now.Add(24 * time.Hour)); found {
+		t.Fatalf("take() found a dead job")
+	}
+
+	down = false
+	if _, err := queue.requeue("job", now); err != nil {
+		t.Fatalf("requeue() failed: %v", err)
+	}
+	job, found, _ := queue.take(now)
+	if !found || job.Attempts != 1 {
+		t.Fatalf("take() after requeueing = %v with %d attempts, want the job with its attempts reset", found, job.Attempts)
+	}
+	runJob(queue, config, nil, job)
+	if job, _ = queue.job("job"); job.State != jobCompleted || job.Points != 28 || job.Code != "" {
+		t.Errorf("requeued job is %s with %d points and code %q, want completed with 28 and no error", job.State, job.Points, job.Code)
+	}
+	if balance, _ := store.Balance("alice"); balance != 28 {
+		t.Errorf("alice has %d points, want 28", balance)
+	}
+}
+
+// A job whose receipt is refused fails right away, without retrying.
+func TestRunJobFailures(t *testing.T) {
+	tests := []struct {
+		name      string
+		receipt   Receipt
+		wantState string
+	}{
+		{"invalid receipt", Receipt{Retailer: "Target"}, jobFailed},
+		{"valid receipt", targetReceipt(), jobCompleted},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestGlobals(t)
+			queue := useTestJobQueue(t)
+			queue.enqueue([]receiptJob{{ID: "job", BatchID: "batch", Receipt: test.receipt, ReceiptID: "receipt", State: jobQueued}})
+			job, _, _ := queue.take(wallClock.Now())
+			runJob(queue, JobQueueConfig{MaxAttempts: 3, Backoff: time.Minute}, nil, job)
+			if job, _ = queue.job("job"); job.State != test.wantState {
+				t.Errorf("job is %s: %s, want %s", job.State, job.Message, test.wantState)
+			}
+		})
+	}
+}
+
+func TestJobAdminRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useTestGlobals(t)
+	queue := useTestJobQueue(t)
+	died := time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC)
+	var jobs []receiptJob
+	for index, id := range []string{"first-dead", "second-dead", "third-dead"} {
+		finished := died.Add(time.Duration(index) * time.Minute)
+		jobs = append(jobs, receiptJob{ID: id, BatchID: "batch", Index: index, ReceiptID: id, State: jobDead, Attempts: 5, FinishedAt: &finished})
+	}
+	jobs = append(jobs, receiptJob{ID: "queued", BatchID: "batch", Index: 3, State: jobQueued, RunAt: died})
+	queue.enqueue(jobs)
+	router := gin.New()
+	router.GET("/admin/jobs/dead", getDeadJobs)
+	router.GET("/admin/jobs/:id", getJob)
+	router.POST("/admin/jobs/:id/requeue", requeueJob)
+	send := func(method string, path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+		return recorder
+	}
+
+	response := send(http.MethodGet, "/admin/jobs/dead?limit=2&offset=0")
+	var page struct {
+		Jobs  []receiptJob `json:"jobs"`
+		Total int          `json:"total"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &page)
+	if response.Code != http.StatusOK || page.Total != 3 || len(page.Jobs) != 2 || page.Jobs[0].ID != "third-dead" {
+		t.Fatalf("dead jobs page is %d: %s, want the two most recently dead of 3", response.Code, response.Body)
+	}
+	if response := send(http.MethodGet, "/admin/jobs/dead?limit=0"); response.Code != http.StatusBadRequest {
+		t.Errorf("a limit of 0 got %d, want 400", response.Code)
+	}
+
+	requeues := []struct {
+		id         string
+		wantStatus int
+	}{
+		{"second-dead", http.StatusOK},
+		// only the first of two requeues gets to
+		{"second-dead", http.StatusConflict},
+		{"queued", http.StatusConflict},
+		{"missing", http.StatusNotFound},
+	}
+	for _, requeue := range requeues {
+		if response := send(http.MethodPost, "/admin/jobs/"+requeue.id+"/requeue"); response.Code != requeue.wantStatus {
+			t.Errorf("requeueing %s got %d: %s, want %d", requeue.id, response.Code, response.Body, requeue.wantStatus)
+		}
+	}
+	var job receiptJob
+	response = send(http.MethodGet, "/admin/jobs/second-dead")
+	json.Unmarshal(response.Body.Bytes(), &job)
+	if job.State != jobQueued || job.Attempts != 0 || job.FinishedAt != nil {
+		t.Errorf("requeued job is %+v, want queued with its attempts reset", job)
+	}
+	if trail, _ := receipts.AuditTrail("second-dead", "", 10); len(trail) != 1 || trail[0].Action != auditJobRequeued {
+		t.Errorf("audit trail of the requeued job's receipt is %+v, want the requeue", trail)
+	}
+	if _, total, _ := queue.dead(0, 10); total != 2 {
+		t.Errorf("%d jobs are dead after requeueing one, want 2", total)
+	}
+}
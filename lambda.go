@@ -0,0 +1,147 @@
+//go:build lambda
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/google/uuid"
+)
+
+// Message attribute naming the user an SQS receipt is submitted for.
+const sqsUserAttribute = "userId"
+
+/*
+In Lambda builds (go build -tags lambda) requests come from AWS Lambda
+rather than a listener. One function serves both API Gateway proxy events,
+which go through the router like any HTTP request, and batches of receipts
+from SQS, which are scored like NATS deliveries.
+*/
+func runServer(config Config, handler http.Handler) error {
+	log.Printf("Handling AWS Lambda invocations")
+	lambda.Start(func(ctx context.Context, event json.RawMessage) (any, error) {
+		var probe struct {
+			Records []struct {
+				EventSource string `json:"eventSource"`
+			} `json:"Records"`
+		}
+		json.Unmarshal(event, &probe)
+		if len(probe.Records) > 0 && probe.Records[0].EventSource == "aws:sqs" {
+			var batch events.SQSEvent
+			if err := json.Unmarshal(event, &batch); err != nil {
+				return nil, err
+			}
+			return consumeSQSReceipts(batch), nil
+		}
+
+		var request events.APIGatewayProxyRequest
+		if err := json.Unmarshal(event, &request); err != nil {
+			return nil, err
+		}
+		return serveAPIGatewayRequest(ctx, handler, request)
+	})
+	return nil
+}
+
+// Runs an API Gateway proxy event through the router and returns its response.
+func serveAPIGatewayRequest(
+	ctx context.Context, handler http.Handler, event events.APIGatewayProxyRequest,
+) (events.APIGatewayProxyResponse, error) {
+	body := []byte(event.Body)
+	if event.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(event.Body)
+		if err != nil {
+			return events.APIGatewayProxyResponse{}, fmt.Errorf("failed to decode the request body: %w", err)
+		}
+		body = decoded
+	}
+
+	query := url.Values(event.MultiValueQueryStringParameters)
+	if len(query) == 0 {
+		query = url.Values{}
+		for name, value := range event.QueryStringParameters {
+			query.Set(name, value)
+		}
+	}
+	request, err := http.NewRequestWithContext(
+		ctx, event.HTTPMethod, (&url.URL{Path: event.Path, RawQuery: query.Encode()}).RequestURI(), bytes.NewReader(body),
+	)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+	for name, value := range event.Headers {
+		request.Header.Set(name, value)
+	}
+	for name, values := range event.MultiValueHeaders {
+		request.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	request.Host = request.Header.Get("Host")
+	request.RemoteAddr = event.RequestContext.Identity.SourceIP + ":0"
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	response := events.APIGatewayProxyResponse{
+		StatusCode:        recorder.Code,
+		MultiValueHeaders: recorder.Header(),
+	}
+	// API Gateway only passes text through, so images and PDFs go base64 encoded
+	contentType := recorder.Header().Get("Content-Type")
+	if utf8.Valid(recorder.Body.Bytes()) && (strings.HasPrefix(contentType, "text/") ||
+		strings.Contains(contentType, "json") || contentType == "") {
+		response.Body = recorder.Body.String()
+	} else {
+		response.Body = base64.StdEncoding.EncodeToString(recorder.Body.Bytes())
+		response.IsBase64Encoded = true
+	}
+	return response, nil
+}
+
+/*
+Scores a batch of receipts from SQS. Like NATS deliveries, a redelivered
+message keeps its receipt id so its points aren't awarded twice. Receipts
+that fail on our side are reported back for redelivery, which needs the
+event source mapping's ReportBatchItemFailures; invalid ones are dropped.
+*/
+func consumeSQSReceipts(batch events.SQSEvent) events.SQSEventResponse {
+	var response events.SQSEventResponse
+	for _, message := range batch.Records {
+		receiptID := uuid.NewSHA1(uuid.NameSpaceURL, []byte("sqs:"+message.MessageId)).String()
+		var userID string
+		if attribute, exists := message.MessageAttributes[sqsUserAttribute]; exists && attribute.StringValue != nil {
+			userID = *attribute.StringValue
+		}
+
+		var receipt Receipt
+		if err := json.Unmarshal([]byte(message.Body), &receipt); err != nil {
+			log.Printf("Dropping SQS message %s: %v", message.MessageId, err)
+			continue
+		}
+		record, _, err := scoreAndSave(processing{}, receiptID, receipt, userID, channelQueue)
+		switch {
+		case errors.Is(err, errSaveFailed), errors.Is(err, errPoolSaturated):
+			response.BatchItemFailures = append(
+				response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: message.MessageId},
+			)
+		case err != nil:
+			reason, _ := localizeError(defaultLanguage, err)
+			log.Printf("Dropping SQS message %s: %s", message.MessageId, reason)
+		default:
+			log.Printf("Scored receipt %s from SQS for %d points", record.ID, record.Points)
+		}
+	}
+	return response
+}
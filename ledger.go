@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+/*
+One change to a user's balance. Every change goes through the ledger, so a
+balance can always be explained by its entries.
+*/
+type ledgerEntry struct {
+	ID        string    `json:"id"`
+	At        time.Time `json:"at"`
+	UserID    string    `json:"userId"`
+	Kind      string    `json:"kind"`
+	Points    int       `json:"points"`
+	Balance   int       `json:"balance"`
+	ReceiptID string    `json:"receiptId,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	// where the points went or came from, e.g. the charity donated to
+	Counterparty string `json:"counterparty,omitempty"`
+}
+
+// Ledger entry kinds.
+const (
+	ledgerReceipt         = "receipt"
+	ledgerReceiptReplaced = "receipt.replaced"
+	ledgerReceiptDeleted  = "receipt.deleted"
+	ledgerReceiptRestored = "receipt.restored"
+	ledgerReceiptApproved = "receipt.approved"
+	ledgerAdjustment      = "adjustment"
+	ledgerDonation        = "donation"
+	ledgerTransferOut     = "transfer.out"
+	ledgerTransferIn      = "transfer.in"
+	// a balance carried over from before the ledger existed
+	ledgerOpening = "opening"
+	// a receipt's points leaving the shard it moved off of
+	ledgerReceiptMoved = "receipt.moved"
+	// points moved to the primary shard so a deduction can be made there
+	ledgerShardMove = "shard.move"
+)
+
+const auditPointsAdjusted = "points.adjusted"
+
+// A new ledger entry, before the store fills in the balance it results in.
+func newLedgerEntry(userID string, kind string, points int, receiptID string) ledgerEntry {
+	return ledgerEntry{
+		ID:        uuid.New().String(),
+		At:        wallClock.Now(),
+		UserID:    userID,
+		Kind:      kind,
+		Points:    points,
+		ReceiptID: receiptID,
+	}
+}
+
+// A manual grant (positive points) or deduction (negative points).
+type adjustmentRequest struct {
+	UserID    string `json:"userId"`
+	ReceiptID string `json:"receiptId"`
+	Points    int    `json:"points"`
+	Reason    string `json:"reason"`
+}
+
+/*
+Grants or deducts points for support goodwill credits and fraud clawbacks.
+The adjustment names a user, or a receipt whose user it applies to, and
+needs a reason; it's recorded in the ledger and the audit trail.
+*/
+func postAdjustment(context *gin.Context) {
+	var request adjustmentRequest
+	if err := context.BindJSON(&request); err != nil {
+		respondWithMessage(context, http.StatusBadRequest, "adjustment.bind_failed")
+		return
+	}
+	request.Reason = strings.TrimSpace(request.Reason)
+	if request.Reason == "" || request.Points == 0 {
+		respondWithMessage(context, http.StatusBadRequest, "adjustment.invalid")
+		return
+	}
+
+	if request.ReceiptID != "" {
+		record, err := receipts.GetReceipt(request.ReceiptID)
+		if errors.Is(err, errReceiptNotFound) {
+			respondWithMessage(context, http.StatusNotFound, "receipt.not_found")
+			return
+		}
+		if err != nil {
+			respondWithMessage(context, http.StatusInternalServerError, "points.lookup_failed")
+			return
+		}
+		if request.UserID != "" && request.UserID != record.UserID || record.UserID == "" {
+			respondWithMessage(context, http.StatusBadRequest, "adjustment.user_mismatch")
+			return
+		}
+		request.UserID = record.UserID
+	}
+	if request.UserID == "" {
+		respondWithMessage(context, http.StatusBadRequest, "adjustment.invalid")
+		return
+	}
+
+	entry := newLedgerEntry(request.UserID, ledgerAdjustment, request.Points, request.ReceiptID)
+	entry.Reason = request.Reason
+	entry, err := receipts.AdjustBalance(entry)
+	if updateConflict(err) {
+		respondWithConflict(context, err)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to adjust %s's balance: %v", request.UserID, err)
+		respondWithMessage(context, http.StatusInternalServerError, "adjustment.failed")
+		return
+	}
+	recordAudit(context, auditEntry{
+		Action:    auditPointsAdjusted,
+		ReceiptID: entry.ReceiptID,
+		UserID:    entry.UserID,
+		Points:    entry.Points,
+		Reason:    entry.Reason,
+	})
+
+	context.IndentedJSON(http.StatusCreated, entry)
+}
+
+// Lists a user's ledger entries, newest first.
+func getLedger(context *gin.Context) {
+	userID := context.Query("user")
+	if userID == "" {
+		respondWithMessage(context, http.StatusBadRequest, "ledger.user_required")
+		return
+	}
+	limit, err := strconv.Atoi(context.DefaultQuery("limit", strconv.Itoa(defaultAuditLimit)))
+	if err != nil || limit < 1 || limit > maxAuditLimit {
+		respondWithMessage(context, http.StatusBadRequest, "audit.limit_invalid", maxAuditLimit)
+		return
+	}
+
+	entries, err := receipts.Ledger(userID, limit)
+	if err != nil {
+		respondWithMessage(context, http.StatusInternalServerError, "ledger.lookup_failed")
+		return
+	}
+	balance, err := receipts.Balance(userID)
+	if err != nil {
+		respondWithMessage(context, http.StatusInternalServerError, "ledger.lookup_failed")
+		return
+	}
+	if entries == nil {
+		entries = []ledgerEntry{}
+	}
+	context.IndentedJSON(http.StatusOK, gin.H{"userId": userID, "balance": balance, "entries": entries})
+}
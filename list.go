@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Default and largest number of receipts one page of GET /receipts lists.
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+// Marks the cursor format, so it can change without misreading old cursors.
+const listCursorPrefix = "v1:"
+
+/*
+Cursors name the last receipt of a page. Receipts are listed in order of
+their ids, which never change, so a page carries on where the last one
+stopped however many receipts are added or deleted meanwhile: none that
+existed throughout are skipped or listed twice.
+*/
+func encodeListCursor(lastID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(listCursorPrefix + lastID))
+}
+
+// The receipt id the cursor continues after, reporting whether it's a cursor we made.
+func decodeListCursor(cursor string) (string, bool) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", false
+	}
+	return strings.CutPrefix(string(decoded), listCursorPrefix)
+}
+
+/*
+Lists receipts a page at a time, for exports and syncing. Each page's
+nextCursor is passed back as cursor for the next page, and is left out on
+the last one. ?count=true adds the total, which is exact for a user's
+receipts but may be an estimate for everyone's. Authenticated callers only
+see their own receipts.
+*/
+func listReceipts(context *gin.Context) {
+	limit, err := strconv.Atoi(context.DefaultQuery("limit", strconv.Itoa(defaultListLimit)))
+	if err != nil || limit < 1 || limit > maxListLimit {
+		respondWithMessage(context, http.StatusBadRequest, "list.limit_invalid", maxListLimit)
+		return
+	}
+	after := ""
+	if cursor := context.Query("cursor"); cursor != "" {
+		var valid bool
+		if after, valid = decodeListCursor(cursor); !valid {
+			respondWithMessage(context, http.StatusBadRequest, "list.cursor_invalid")
+			return
+		}
+	}
+	userID := ownerScope(context)
+
+	// one past the page tells whether there's another
+	records, err := receiptStore(context).ListReceipts(userID, after, limit+1)
+	if err != nil {
+		respondWithMessage(context, http.StatusInternalServerError, "list.failed")
+		return
+	}
+	response := gin.H{"limit": limit}
+	if len(records) > limit {
+		records = records[:limit]
+		response["nextCursor"] = encodeListCursor(records[limit-1].ID)
+	}
+
+	results := make([]gin.H, 0, len(records))
+	for _, record := range records {
+		results = append(results, gin.H{
+			"id":          record.ID,
+			"userId":      record.UserID,
+			"points":      record.Points,
+			"status":      record.Status,
+			"version":     record.Version,
+			"channel":     record.Channel,
+			"processedAt": record.ProcessedAt,
+			"receipt":     record.Receipt,
+			"links":       receiptLinks(record.ID),
+		})
+	}
+	response["receipts"] = results
+
+	if context.Query("count") == "true" {
+		total, exact, err := receiptStore(context).CountReceipts(userID)
+		if err != nil {
+			respondWithMessage(context, http.StatusInternalServerError, "list.failed")
+			return
+		}
+		response["total"] = total
+		response["totalExact"] = exact
+	}
+	respondCacheableJSON(context, response, time.Time{}, cacheRevalidate)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+/*
+Where a purchase was made, when the client knows. Every field is optional,
+but coordinates come as a pair.
+*/
+type StoreLocation struct {
+	StoreID   string   `json:"storeId,omitempty"`
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+	// two-letter postal code of a US state or territory, e.g. "TX"
+	State string `json:"state,omitempty"`
+}
+
+// Postal codes of the US states, DC and territories.
+var usStates = map[string]bool{
+	"AL": true, "AK": true, "AZ": true, "AR": true, "CA": true, "CO": true, "CT": true, "DE": true,
+	"FL": true, "GA": true, "HI": true, "ID": true, "IL": true, "IN": true, "IA": true, "KS": true,
+	"KY": true, "LA": true, "ME": true, "MD": true, "MA": true, "MI": true, "MN": true, "MS": true,
+	"MO": true, "MT": true, "NE": true, "NV": true, "NH": true, "NJ": true, "NM": true, "NY": true,
+	"NC": true, "ND": true, "OH": true, "OK": true, "OR": true, "PA": true, "RI": true, "SC": true,
+	"SD": true, "TN": true, "TX": true, "UT": true, "VT": true, "VA": true, "WA": true, "WV": true,
+	"WI": true, "WY": true, "DC": true, "AS": true, "GU": true, "MP": true, "PR": true, "VI": true,
+}
+
+// Checks the location's fields, returning a clientError for the first bad one.
+func (location StoreLocation) validate(invalid *validationError) {
+	switch {
+	case location.Latitude == nil && location.Longitude != nil:
+		invalid.add("storeLocation.latitude", "location.coordinates_incomplete")
+	case location.Latitude != nil && location.Longitude == nil:
+		invalid.add("storeLocation.longitude", "location.coordinates_incomplete")
+	case location.Latitude != nil && math.Abs(*location.Latitude) > 90:
+		invalid.add("storeLocation.latitude", "location.coordinates_invalid")
+	case location.Longitude != nil && math.Abs(*location.Longitude) > 180:
+		invalid.add("storeLocation.longitude", "location.coordinates_invalid")
+	}
+	if location.State != "" && !usStates[location.State] {
+		invalid.add("storeLocation.state", "location.state_invalid", location.State)
+	}
+}
+
+// The region a receipt's stats are counted under: its state, or "" when unknown.
+func receiptRegion(receipt Receipt) string {
+	if receipt.Location == nil {
+		return ""
+	}
+	return receipt.Location.State
+}
+
+/*
+Awards points to receipts purchased in any of the states, at any of the
+stores, or within RadiusKm of any of the points, e.g. a launch market.
+*/
+type locationRule struct {
+	Name     string    `json:"name"`
+	States   []string  `json:"states"`
+	StoreIDs []string  `json:"storeIds"`
+	Areas    []geoArea `json:"areas"`
+	Points   int       `json:"points"`
+	Flag     string    `json:"flag"`
+
+	states map[string]bool
+	stores map[string]bool
+}
+
+type geoArea struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	RadiusKm  float64 `json:"radiusKm"`
+}
+
+// Fills in the rule's lookups, checking its states and areas.
+func (bonus *locationRule) compile() error {
+	bonus.states = make(map[string]bool)
+	for _, state := range bonus.States {
+		state = strings.ToUpper(state)
+		if !usStates[state] {
+			return fmt.Errorf("location bonus %s has an unknown state %q", bonus.Name, state)
+		}
+		bonus.states[state] = true
+	}
+	bonus.stores = make(map[string]bool)
+	for _, store := range bonus.StoreIDs {
+		bonus.stores[store] = true
+	}
+	for _, area := range bonus.Areas {
+		if math.Abs(area.Latitude) > 90 || math.Abs(area.Longitude) > 180 || area.RadiusKm <= 0 {
+			return fmt.Errorf("location bonus %s needs areas with valid coordinates and a positive radius", bonus.Name)
+		}
+	}
+	if len(bonus.states) == 0 && len(bonus.stores) == 0 && len(bonus.Areas) == 0 {
+		return fmt.Errorf("location bonus %s needs states, storeIds or areas", bonus.Name)
+	}
+	return nil
+}
+
+func (bonus locationRule) rule() scoringRule {
+	return scoringRule{
+		Name: bonus.Name,
+		Flag: bonus.Flag,
+		Description: fmt.Sprintf(
+			"%d points if the purchase was made in one of %d states, %d stores or %d areas",
+			bonus.Points, len(bonus.states), len(bonus.stores), len(bonus.Areas),
+		),
+		score: func(receipt parsedReceipt) (centipoints, error) {
+			if bonus.matches(receipt.receipt.Location) {
+				return wholePoints(bonus.Points), nil
+			}
+			return 0, nil
+		},
+	}
+}
+
+func (bonus locationRule) matches(location *StoreLocation) bool {
+	if location == nil {
+		return false
+	}
+	if bonus.states[location.State] || bonus.stores[location.StoreID] {
+		return true
+	}
+	if location.Latitude == nil {
+		return false
+	}
+	for _, area := range bonus.Areas {
+		if distanceKm(*location.Latitude, *location.Longitude, area.Latitude, area.Longitude) <= area.RadiusKm {
+			return true
+		}
+	}
+	return false
+}
+
+// Great-circle distance between two points, by the haversine formula.
+func distanceKm(latitude1, longitude1, latitude2, longitude2 float64) float64 {
+	const earthRadiusKm = 6371
+	radians := math.Pi / 180
+	latitudeDelta := (latitude2 - latitude1) * radians
+	longitudeDelta := (longitude2 - longitude1) * radians
+	a := math.Sin(latitudeDelta/2)*math.Sin(latitudeDelta/2) +
+		math.Cos(latitude1*radians)*math.Cos(latitude2*radians)*math.Sin(longitudeDelta/2)*math.Sin(longitudeDelta/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
-	"math"
+	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
-	"unicode"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -15,6 +18,8 @@ import (
 type Item struct {
 	Description string `json:"shortDescription"`
 	Price       string `json:"price"`
+	// fields the schema doesn't know, kept in lenient mode
+	Extras map[string]json.RawMessage `json:"extras,omitempty"`
 }
 
 type Receipt struct {
@@ -23,143 +28,725 @@ type Receipt struct {
 	Time     string `json:"purchaseTime"`
 	Items    []Item `json:"items"`
 	Total    string `json:"total"`
+	// where the purchase was made, if the client knows
+	Location *StoreLocation `json:"storeLocation,omitempty"`
+	// labels grouping receipts, e.g. by campaign or source, see normalizeTags
+	Tags []string `json:"tags,omitempty"`
+	// fields the schema doesn't know, kept in lenient mode, see receiptSchema
+	Extras map[string]json.RawMessage `json:"extras,omitempty"`
 }
 
-// Global map to track all receipt point values
-var receiptPoints map[string]int
+// Global store of every processed receipt and its points
+var receipts Store
+
+// Global cache of points lookups, which downstream services repeat constantly
+var pointsCache *lruCache[string, cachedPoints]
+
+// A receipt's points as the lookup cache keeps them.
+type cachedPoints struct {
+	points     int
+	precise    centipoints
+	modifiedAt time.Time
+}
+
+// Global limit on how many receipts are scored and saved at once
+var scoringPool *workerPool
 
 /*
 Reads through a receipt object to determine its point value, saves the
-receipt points to the global map, then returns the unique id for that
-receipt's points.
+receipt and its points to the global store, then returns the unique id for
+that receipt's points.
 */
 func scanReceipt(context *gin.Context) {
-	var receipt Receipt
-
-	// read the JSON from the request
-	if err := context.BindJSON(&receipt); err != nil {
-		context.IndentedJSON(
-			http.StatusBadRequest,
-			gin.H{"message": "Failed to bind the request's JSON to type: Receipt."},
-		)
+	channel, err := submissionChannel(context, channelAPI)
+	if err != nil {
+		respondWithError(context, http.StatusBadRequest, err)
 		return
 	}
-
-	// parse the receipt's total
-	receiptTotal, receiptTotalError := strconv.ParseFloat(receipt.Total, 64)
-	if receiptTotalError != nil {
-		context.IndentedJSON(
-			http.StatusBadRequest,
-			gin.H{"message": "Failed to parse receipt total to float."},
-		)
+	record, processError := processReceipt(processingFor(context), boundReceipt(context), submittingUser(context), channel)
+	if processError != nil {
+		respondWithProcessError(context, processError)
 		return
 	}
 
-	// parse the receipt's date
-	receiptDate, receiptDateError := time.Parse("2006-01-02", receipt.Date)
-	if receiptDateError != nil {
-		context.IndentedJSON(
-			http.StatusBadRequest,
-			gin.H{"message": "Failed to parse receipt purchaseDate."},
-		)
+	response := gin.H{"id": record.ID}
+	// clients asking for metadata get everything they'd otherwise fetch next
+	if metadata, _ := strconv.ParseBool(context.Query("metadata")); metadata {
+		response = gin.H{
+			"id":            record.ID,
+			"points":        record.Points,
+			"precisePoints": record.precisePoints().precise(),
+			"processedAt":   record.ProcessedAt,
+			"rulesVersion":  record.RulesVersion,
+			"channel":       record.Channel,
+			"links":         receiptLinks(record.ID),
+		}
+	}
+	if record.Status != "" {
+		response["status"] = record.Status
+	}
+	if capped := record.capsApplied(); capped != nil {
+		response["capped"] = capped
+	}
+
+	context.IndentedJSON(http.StatusCreated, response)
+}
+
+/*
+Replaces a receipt with a corrected copy, e.g. after an OCR mistake. The
+correction is validated and rescored like a new receipt, the user's balance
+changes by the difference, and both versions go in the audit trail.
+*/
+func updateReceipt(context *gin.Context) {
+	receipt := boundReceipt(context)
+	previous, err := receiptStore(context).GetReceipt(context.Param("id"))
+	if err != nil && !errors.Is(err, errReceiptNotFound) {
+		respondWithMessage(context, http.StatusInternalServerError, "points.lookup_failed")
+		return
+	}
+	// other users' receipts look missing to authenticated callers
+	scope := ownerScope(context)
+	if err != nil || scope != "" && previous.UserID != scope {
+		respondWithMessage(context, http.StatusNotFound, "receipt.not_found")
+		return
+	}
+	// callers that read the receipt earlier can make sure nobody changed it since
+	if expected, given := ifMatchVersion(context.GetHeader("If-Match")); given && expected != previous.Version {
+		respondWithMessage(context, http.StatusConflict, "receipt.version_mismatch", previous.Version, expected)
 		return
 	}
 
-	// parse the receipt's time
-	receiptTime, receiptTimeError := time.Parse("15:04", receipt.Time)
-	if receiptTimeError != nil {
-		context.IndentedJSON(
-			http.StatusBadRequest,
-			gin.H{"message": "Failed to parse receipt purchaseTime."},
-		)
+	// still replaces nothing but the version just read, in case another update lands first,
+	// and stays attributed to the key that submitted it
+	target := processingFor(context)
+	target.apiKey = previous.APIKey
+	record, balance, err := scoreAndReplace(target, previous.ID, receipt, previous.UserID, previous.Channel, previous.Version)
+	if err != nil {
+		respondWithProcessError(context, err)
 		return
 	}
+	recordAudit(context, auditEntry{
+		Action:    auditReceiptUpdated,
+		ReceiptID: record.ID,
+		UserID:    record.UserID,
+		Before:    &previous,
+		After:     &record,
+		Points:    record.Points - previous.Points,
+	})
 
-	// Begin tallying points for the receipt
-	var totalPoints int = 0
+	response := gin.H{
+		"id":             record.ID,
+		"points":         record.Points,
+		"precisePoints":  record.precisePoints().precise(),
+		"previousPoints": previous.Points,
+		"version":        record.Version,
+		"links":          receiptLinks(record.ID),
+	}
+	if record.UserID != "" {
+		response["balance"] = balance
+	}
+	context.IndentedJSON(http.StatusOK, response)
+}
 
-	// 1 point for every alphanumeric character in the retailer name
-	var retailerAlphanumericChars []rune
-	for _, char := range receipt.Retailer {
-		if unicode.IsLetter(char) || unicode.IsDigit(char) {
-			retailerAlphanumericChars = append(retailerAlphanumericChars, char)
-		}
+/*
+Reads the receipt version an If-Match header names, e.g. "3" (with or
+without quotes), reporting whether there was one.
+*/
+func ifMatchVersion(ifMatch string) (int64, bool) {
+	tag := strings.Trim(strings.TrimPrefix(strings.TrimSpace(ifMatch), "W/"), `"`)
+	version, err := strconv.ParseInt(tag, 10, 64)
+	return version, err == nil
+}
+
+// Responds to a receipt that failed to process with the right status for why.
+func respondWithProcessError(context *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errSaveConflict):
+		respondWithConflict(context, err)
+	case errors.Is(err, errSaveFailed):
+		respondWithError(context, http.StatusInternalServerError, err)
+	case errors.Is(err, errPoolSaturated):
+		context.Header("Retry-After", "1")
+		respondWithError(context, http.StatusServiceUnavailable, err)
+	case errors.Is(err, errReceiptCapReached):
+		respondWithError(context, http.StatusTooManyRequests, err)
+	default:
+		respondWithError(context, http.StatusBadRequest, err)
 	}
-	totalPoints += len(retailerAlphanumericChars)
+}
 
-	// 50 points if the total is a round dollar amount with no cents
-	if math.Floor(receiptTotal) == receiptTotal {
-		totalPoints += 50
+// Links to the resources describing a processed receipt.
+func receiptLinks(id string) gin.H {
+	return gin.H{
+		"points":    gin.H{"href": "/receipts/" + id + "/points"},
+		"breakdown": gin.H{"href": "/receipts/" + id + "/breakdown"},
+		"image":     gin.H{"href": "/receipts/" + id + "/image"},
+		"render":    gin.H{"href": "/receipts/" + id + "/render"},
 	}
+}
 
-	// 25 points if the total is a multiple of 0.25
-	if math.Mod(receiptTotal, 0.25) == 0 {
-		totalPoints += 25
+var errSaveFailed = newClientError("receipt.save_failed")
+
+var errSaveConflict = newClientError("receipt.conflict")
+
+// Whether the error means another update won a race the request can retry.
+func updateConflict(err error) bool {
+	return errors.Is(err, errReceiptConflict) || errors.Is(err, errBalanceConflict) || errors.Is(err, errSaveConflict)
+}
+
+/*
+Responds 409 to a request that lost a race with another update; it can be
+retried shortly, after reading the receipt again when it named a version.
+*/
+func respondWithConflict(context *gin.Context, err error) {
+	context.Header("Retry-After", "1")
+	if errors.Is(err, errBalanceConflict) {
+		respondWithMessage(context, http.StatusConflict, "balance.conflict")
+		return
 	}
+	respondWithError(context, http.StatusConflict, errSaveConflict)
+}
 
-	// 5 points for every two items on the receipt
-	totalPoints += (5 * (len(receipt.Items) / 2))
+/*
+Scores a receipt, saves it for the submitting user (if any) along with
+the channel it came in through, and announces it to subscribers. Receipts
+processed in a sandbox are saved in its store, at its clock's time, and
+announced to nobody. Errors describe what's wrong with the receipt.
+*/
+func processReceipt(target processing, receipt Receipt, userID string, channel string) (storedReceipt, error) {
+	receiptID := uuid.New().String()
+	if target.sandbox != nil {
+		receiptID = target.sandbox.nextID()
+	}
+	record, _, err := scoreAndSave(target, receiptID, receipt, userID, channel)
+	return record, err
+}
+
+/*
+Does the work of processReceipt under the given id, returning the user's
+new balance too. Saving under an existing id replaces that receipt.
+*/
+func scoreAndSave(
+	target processing, receiptID string, receipt Receipt, userID string, channel string,
+) (storedReceipt, int, error) {
+	return scoreAndReplace(target, receiptID, receipt, userID, channel, 0)
+}
+
+/*
+Like scoreAndSave, but only replaces the receipt at the given version
+(0 for whichever is stored), failing with errSaveConflict otherwise.
+*/
+func scoreAndReplace(
+	target processing, receiptID string, receipt Receipt, userID string, channel string, version int64,
+) (storedReceipt, int, error) {
+	var record storedReceipt
+	var processError error
+	var balance int
+
+	store, now := target.store(), target.now(receipt)
+	sandboxed := target.sandbox != nil
+
+	rules, variant := rulesFor(userID, receiptID)
+	// looked up before taking a worker, so a slow directory doesn't hold one
+	merchant := merchants.enrich(receipt.Retailer)
 
-	/* If the trimmed length of the item description is a multiple of 3,
-	multiply the price by 0.2 and round up to the nearest integer.
-	The result is the number of points earned */
-	for _, item := range receipt.Items {
-		trimmedDescLength := len(strings.TrimSpace(item.Description))
-		if trimmedDescLength%3 == 0 {
-			priceFloat, err := strconv.ParseFloat(item.Price, 64)
-			if err != nil {
-				context.IndentedJSON(
-					http.StatusBadRequest,
-					gin.H{"message": "Failed to parse price to float for item: " + item.Description},
-				)
-				return
+	poolError := scoringPool.run(func() {
+		// parse the receipt's total, date and time
+		parsed, parseError := parseReceipt(receipt, now, activeRules().limits)
+		if parseError != nil {
+			processError = parseError
+			return
+		}
+		parsed.userID = userID
+		parsed.channel = channel
+		parsed.merchant = merchant
+		if !sandboxed {
+			parsed.verification = verifyPurchase(store, parsed, receiptID)
+		}
+		// a receipt refused or failing to save doesn't keep the transaction it claimed
+		defer func() {
+			if processError != nil && parsed.verification != nil {
+				if err := store.ReleaseTransaction(receiptID); err != nil {
+					log.Printf("Failed to release receipt %s's transaction: %v", receiptID, err)
+				}
 			}
-			totalPoints += int(math.Ceil(priceFloat * 0.2))
+		}()
+
+		// tally points for the receipt using every scoring rule
+		totalPoints, breakdown, scoreError := rules.score(parsed)
+		if scoreError != nil {
+			processError = scoreError
+			return
+		}
+
+		record = storedReceipt{
+			ID:           receiptID,
+			UserID:       userID,
+			Receipt:      parsed.receipt,
+			Points:       totalPoints,
+			Breakdown:    breakdown,
+			ProcessedAt:  now,
+			RulesVersion: rules.Version,
+			Variant:      variant,
+			Merchant:     merchant,
+			Channel:      channel,
+			APIKey:       target.apiKey,
+			Verification: parsed.verification,
+			Version:      version,
+		}
+		// suspicious receipts wait for review before their points are awarded
+		if reasons := reviewPolicy.check(parsed, totalPoints); len(reasons) > 0 {
+			record.Status = reviewPending
+			record.ReviewReasons = reasons
+		}
+		if pointsCaps.daily(userID) {
+			lock := capsLock(userID)
+			lock.Lock()
+			defer lock.Unlock()
+		}
+		if capError := pointsCaps.apply(store, &record); errors.Is(capError, errReceiptCapReached) {
+			processError = capError
+			return
+		} else if capError != nil {
+			log.Printf("Failed to count %s's recent receipts: %v", userID, capError)
+			processError = errSaveFailed
+			return
+		}
+		var saveError error
+		balance, saveError = store.SaveReceipt(record)
+		if updateConflict(saveError) {
+			processError = errSaveConflict
+			return
+		}
+		if saveError != nil {
+			log.Printf("Failed to save receipt %s: %v", record.ID, saveError)
+			processError = errSaveFailed
+			return
 		}
+		// one past the version replaced, taking no version to mean a new receipt
+		record.Version = max(version+1, 1)
+		if !sandboxed {
+			invalidatePoints(record.ID)
+			ruleMetrics.record(record.RulesVersion, record.Points, record.Breakdown)
+		}
+	})
+	if poolError != nil {
+		return storedReceipt{}, 0, poolError
+	}
+	if processError != nil {
+		return storedReceipt{}, 0, processError
 	}
 
-	// 6 points if the day in the purchase date is odd
-	if (receiptDate.Day() % 2) != 0 {
-		totalPoints += 6
+	if record.Status == "" && !sandboxed {
+		receiptEvents.publish(receiptEvent{
+			ID:       record.ID,
+			UserID:   userID,
+			Retailer: receipt.Retailer,
+			Points:   record.Points,
+			Balance:  balance,
+		})
+		notifyPointsAwardedFor(record, balance)
 	}
+	return record, balance, nil
+}
 
-	// 10 points if the time of purchase is after 2:00pm and before 4:00pm
-	if (receiptTime.Hour() == 14 && receiptTime.Minute() > 0) ||
-		(receiptTime.Hour() > 14) && (receiptTime.Hour() < 16) {
-		totalPoints += 10
+/*
+The user a submission belongs to: the token's subject when callers
+authenticate, otherwise the optional X-User-ID header.
+*/
+func submittingUser(context *gin.Context) string {
+	if subject := context.GetString("subject"); subject != "" {
+		return subject
 	}
+	return context.GetHeader("X-User-ID")
+}
 
-	uniqueID := uuid.New().String()
-	receiptPoints[uniqueID] = totalPoints
+/*
+Retrieve a receipt's point count using its unique id. Responses carry an
+ETag and Last-Modified, so clients that send them back in If-None-Match or
+If-Modified-Since get a 304 while the points are unchanged. Receipts held
+for review have no points yet, and say so with their status.
+*/
+func getPoints(context *gin.Context) {
+	inputId := context.Param("id")
+	// sandboxes' receipts reuse ids once they're wiped, so they aren't cached
+	sandboxed := sandboxOf(context) != nil
+	var points cachedPoints
+	var exists bool
+	if !sandboxed {
+		points, exists = pointsCache.get(inputId)
+	}
+	if !exists {
+		// a receipt saved after this read invalidates it, so the stale points aren't cached
+		generation := pointsCache.generation()
+		record, err := receiptStore(context).GetReceipt(inputId)
+		if err != nil && !errors.Is(err, errReceiptNotFound) {
+			respondWithMessage(context, http.StatusInternalServerError, "points.lookup_failed")
+			return
+		}
+		if err == nil && record.Status != "" {
+			respondCacheableJSON(
+				context, gin.H{"points": 0, "precisePoints": 0, "status": record.Status}, receiptModified(context, record),
+				cacheRevalidate,
+			)
+			return
+		}
+		exists = err == nil
+		if exists {
+			points = cachedPoints{
+				points: record.Points, precise: record.precisePoints(), modifiedAt: receiptModified(context, record),
+			}
+		}
+		if exists && !sandboxed {
+			pointsCache.putUnlessRemoved(inputId, points, generation)
+		}
+	}
 
-	context.IndentedJSON(
-		http.StatusCreated,
-		gin.H{"id": uniqueID},
+	if !exists {
+		respondWithMessage(context, http.StatusNotFound, "points.not_found")
+		return
+	}
+	respondCacheableJSON(
+		context,
+		gin.H{"points": points.points, "precisePoints": points.precise.precise()},
+		points.modifiedAt,
+		cacheRevalidate,
 	)
 }
 
-// Retrieve a receipt's point count using its unique id.
-func getPoints(context *gin.Context) {
-	inputId := context.Param("id")
-	points, exists := receiptPoints[inputId]
+/*
+Opens the configured store. Cluster mode refuses to start on the in-memory
+store, since replicas would each keep their own receipts.
+*/
+func openStore(config Config) (Store, error) {
+	switch config.StoreBackend {
+	case "memory":
+		if config.ClusterMode {
+			return nil, errors.New("CLUSTER_MODE needs a shared store, set STORE_BACKEND=postgres")
+		}
+		return newMemoryStore(), nil
+	case "postgres":
+		store, err := newPostgresStore(config.DatabaseURL, config.MigrateOnStartup)
+		if err != nil {
+			return nil, err
+		}
+		if config.ClusterMode {
+			store.relayEvents(receiptEvents)
+		}
+		return newGuardedStore(store, config.Resilience), nil
+	case "sharded":
+		return openShardedStore(config)
+	case "dual":
+		return openDualStore(config)
+	}
+	return nil, errors.New("unknown STORE_BACKEND: " + config.StoreBackend)
+}
 
-	if exists {
-		context.IndentedJSON(
-			http.StatusOK,
-			gin.H{"points": points},
-		)
-	} else {
-		context.IndentedJSON(
-			http.StatusNotFound,
-			gin.H{"message": "Points not found for that id."},
-		)
+// Retrieve how each scoring rule contributed to a receipt's points.
+func getBreakdown(context *gin.Context) {
+	record, err := receiptStore(context).GetReceipt(context.Param("id"))
+	if errors.Is(err, errReceiptNotFound) {
+		respondWithMessage(context, http.StatusNotFound, "points.not_found")
+		return
+	}
+	if err != nil {
+		respondWithMessage(context, http.StatusInternalServerError, "points.lookup_failed")
+		return
+	}
+
+	response := gin.H{
+		"id":            record.ID,
+		"points":        record.Points,
+		"precisePoints": record.precisePoints().precise(),
+		"rulesVersion":  record.RulesVersion,
+		"channel":       record.Channel,
+		"version":       record.Version,
+		"breakdown":     record.Breakdown,
+		"items":         itemTotals(record.Breakdown),
+		"links":         receiptLinks(record.ID),
+	}
+	if record.Merchant != nil {
+		response["merchant"] = record.Merchant
+	}
+	respondCacheableJSON(context, response, receiptModified(context, record), cacheReceipt)
+}
+
+/*
+Adds up what each line item earned across the item rules, most points
+first, so clients can highlight the products that earned the most. Items
+that earned nothing are left out.
+*/
+func itemTotals(breakdown []ruleResult) []itemPoints {
+	totals := make(map[int]*itemPoints)
+	precise := make(map[int]centipoints)
+	for _, result := range breakdown {
+		for _, item := range result.Items {
+			if totals[item.Index] == nil {
+				totals[item.Index] = &itemPoints{Index: item.Index, Description: item.Description}
+			}
+			precise[item.Index] += fractionalPoints(item.PrecisePoints)
+		}
+	}
+
+	rounding := activeRules().Rounding
+	items := make([]itemPoints, 0, len(totals))
+	for index, item := range totals {
+		item.Points = rounding.round(precise[index])
+		item.PrecisePoints = precise[index].precise()
+		items = append(items, *item)
 	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].PrecisePoints != items[j].PrecisePoints {
+			return items[i].PrecisePoints > items[j].PrecisePoints
+		}
+		return items[i].Index < items[j].Index
+	})
+	return items
 }
 
 func main() {
-	receiptPoints = make(map[string]int)
+	config := loadConfig()
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(config, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rebalance" {
+		if err := runRebalanceCommand(config, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "reprocess" {
+		if err := runReprocessCommand(config, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err := validateSchemaMode(config.ReceiptSchema); err != nil {
+		log.Fatal(err)
+	}
+	receiptSchema = config.ReceiptSchema
+	if config.PluginDir != "" {
+		plugins, err := loadPlugins(config.PluginDir, config.PluginTimeout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rulePlugins = plugins
+	}
+	rulesFile = config.RulesFile
+	_, err := loadRules(rulesFile, rulePlugins)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	walletAdapters, err = loadWalletAdapters(config.WalletAdaptersFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	receiptTemplate, err = loadRenderTemplate(config.RenderTemplateDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	featureFlags, err = newFlagProvider(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	receiptEvents = newEventBroker()
+	store, err := openStore(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	receipts = store
+	pointsCache = newLRUCache[string, cachedPoints](config.PointsCacheSize)
+	if err := startCacheInvalidation(config); err != nil {
+		log.Fatal(err)
+	}
+	scoringPool = newWorkerPool(config.WorkerConcurrency, config.WorkerQueueDepth)
+	reviewPolicy = config.Review
+	pointsCaps = config.Caps
+	merchants, err = newRetailerEnricher(config.Enrichment, config.Resilience)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.ReportInterval > 0 {
+		scheduleReports(config.ReportInterval)
+	}
+	scheduleTrashPurge(config.TrashRetention)
+	receiptBlobs, err = newBlobStore(config.Blobs, config.Resilience)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := startNotifications(config.Notifications, config.Resilience); err != nil {
+		log.Fatal(err)
+	}
+	if err := startNATSIngestion(config.NATS); err != nil {
+		log.Fatal(err)
+	}
+	if receiptJobs, err = openJobQueue(config); err != nil {
+		log.Fatal(err)
+	}
+	quotas, err := newQuotaMeter(config.Quotas, config.RedisURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if receiptJobs != nil {
+		startJobWorkers(receiptJobs, config.Jobs, quotas)
+	}
 	router := gin.Default()
-	router.POST("receipts/process", scanReceipt)
-	router.GET("/receipts/:id/points", getPoints)
-	router.Run("localhost:9090")
+	if len(config.CORS.AllowedOrigins) > 0 {
+		if err := config.CORS.validate(); err != nil {
+			log.Fatal(err)
+		}
+		router.Use(cors(config.CORS))
+	}
+	if quotas != nil {
+		router.Use(quotas.identify())
+		router.GET("/quota", quotas.getQuota)
+		for _, key := range quotas.keys {
+			transactionMatching = transactionMatching || key.Merchant != ""
+		}
+		router.POST("/transactions", requireMerchantKey, postTransaction)
+		router.GET("/transactions/:id", requireMerchantKey, getTransaction)
+	}
+	router.GET("/metrics", getMetrics)
+
+	// callers need a role for each endpoint once an OIDC issuer is configured
+	var verifier *oidcVerifier
+	authorize := func(role string) gin.HandlerFunc {
+		return func(context *gin.Context) { context.Next() }
+	}
+	receiptRoutes := router.Group("/receipts")
+	userRoutes := router.Group("/users")
+	sandboxRoutes := router.Group("/sandbox")
+	if config.OIDCIssuer != "" {
+		verifier, err = newOIDCVerifier(
+			config.OIDCIssuer, config.OIDCAudience, config.OIDCRolesClaim, config.OIDCRoleMap,
+		)
+		if err != nil {
+			log.Fatal(err)
+		}
+		receiptRoutes.Use(authenticate(verifier))
+		userRoutes.Use(authenticate(verifier))
+		sandboxRoutes.Use(authenticate(verifier))
+		authorize = requireRole
+	}
+	// after authentication, since callers only see their own namespaces
+	sandboxes, err := newSandboxRegistry(config.Sandbox)
+	if err != nil {
+		log.Fatal(err)
+	}
+	receiptRoutes.Use(sandboxes.enter())
+	userRoutes.Use(sandboxes.enter())
+	if sandboxes != nil {
+		sandboxRoutes.PUT("/:namespace/clock", authorize(roleSubmitter), sandboxes.putClock)
+		sandboxRoutes.DELETE("/:namespace", authorize(roleSubmitter), sandboxes.wipe)
+	}
+
+	// partners sign their submissions when a shared secret is configured
+	processHandlers := []gin.HandlerFunc{authorize(roleSubmitter)}
+	// batches are counted receipt by receipt, see processBatch
+	batchHandlers := []gin.HandlerFunc{authorize(roleSubmitter)}
+	var signatures *signatureCheck
+	if config.SignatureSecret != "" {
+		signatures = &signatureCheck{
+			secret:       config.SignatureSecret,
+			maxSkew:      config.SignatureMaxSkew,
+			replayWindow: config.Replay.Window,
+		}
+		if config.Replay.Window > 0 {
+			if signatures.nonces, err = openNonceCache(config); err != nil {
+				log.Fatal(err)
+			}
+		}
+		// no signed submission is larger than a receipt with its image
+		processHandlers = append(processHandlers, verifySignature(*signatures, config.Blobs.MaxSize+multipartOverhead))
+		// batches can be far larger, so they're held on disk instead
+		batchHandlers = append(batchHandlers, verifySpooledSignature(*signatures, config.MaxSignedBatch))
+	}
+	// after the signature check, so forged submissions don't use up a partner's quota
+	if quotas != nil {
+		processHandlers = append(processHandlers, quotas.consume())
+	}
+
+	receiptRoutes.POST("/process", append(processHandlers, acceptMultipart(config.Blobs.MaxSize), bindReceipt, scanReceipt)...)
+	receiptRoutes.POST("/qr", append(processHandlers, scanQRCode)...)
+	receiptRoutes.POST("/wallet", append(processHandlers, scanWalletPass)...)
+	receiptRoutes.POST("/batch", append(batchHandlers, requireFlag("batch-processing", true), processBatch(quotas))...)
+	receiptRoutes.GET("/batch/:id", authorize(roleReader), getBatchStatus)
+	receiptRoutes.GET("/:id/points", authorize(roleReader), getPoints)
+	receiptRoutes.GET("/:id/breakdown", authorize(roleReader), getBreakdown)
+	receiptRoutes.PUT("/:id", append(processHandlers, bindReceipt, updateReceipt)...)
+	receiptRoutes.PUT("/:id/image", authorize(roleSubmitter), putReceiptImage(config.Blobs.MaxSize))
+	receiptRoutes.GET("/:id/image", authorize(roleReader), getReceiptImage)
+	receiptRoutes.GET("/:id/render", authorize(roleReader), renderReceipt)
+	receiptRoutes.DELETE("/:id", authorize(roleSubmitter), deleteReceipt(config.TrashRetention))
+	receiptRoutes.POST("/:id/restore", authorize(roleSubmitter), restoreReceipt)
+	receiptRoutes.POST("/:id/tags", authorize(roleSubmitter), addReceiptTags)
+	receiptRoutes.DELETE("/:id/tags/:tag", authorize(roleSubmitter), removeReceiptTag)
+	receiptRoutes.GET("", authorize(roleReader), listReceipts)
+	receiptRoutes.GET("/search", authorize(roleReader), searchReceipts)
+	receiptRoutes.GET("/stream", authorize(roleReader), requireFlag("receipt-stream", true), streamReceipts)
+	receiptRoutes.GET("/ws", authorize(roleSubmitter), requireFlag("websocket", true), serveWebSocket(signatures, quotas, config.CORS.AllowedOrigins))
+
+	userRoutes.GET("/me", authorize(roleSubmitter), getProfile)
+	userRoutes.PUT("/me", authorize(roleSubmitter), putProfile)
+	userRoutes.POST("/:id/donate", authorize(roleSubmitter), requireSubject, postDonation(config.Donations))
+	userRoutes.POST("/:id/transfers", authorize(roleSubmitter), requireSubject, postTransfer(config.Transfers))
+
+	// the admin routes stay unreachable until there's a way to sign in to them
+	if config.AdminUsername != "" || verifier != nil {
+		adminRoutes := router.Group("/admin", requireAdmin(config.AdminUsername, config.AdminPassword, verifier))
+		adminRoutes.GET("", getAdminDashboard)
+		adminRoutes.GET("/api/overview", getAdminOverview)
+		adminRoutes.GET("/audit", getAuditTrail)
+		adminRoutes.GET("/ledger", getLedger)
+		adminRoutes.POST("/adjustments", postAdjustment)
+		adminRoutes.POST("/receipts/process", backdate, bindReceipt, postBackdatedReceipt)
+		adminRoutes.GET("/receipts/:id/diff", getReceiptDiff)
+		adminRoutes.GET("/donations", getDonationTotals(config.Donations.Charities))
+		adminRoutes.GET("/review", getReviewQueue)
+		adminRoutes.POST("/review/:id/approve", resolveReview(true))
+		adminRoutes.POST("/review/:id/reject", resolveReview(false))
+		adminRoutes.GET("/trash", getTrash)
+		adminRoutes.POST("/trash/:id/restore", restoreReceipt)
+		adminRoutes.POST("/bulk-deletes", postBulkDelete)
+		adminRoutes.GET("/bulk-deletes", getBulkDeletes)
+		adminRoutes.GET("/bulk-deletes/:id", getBulkDelete)
+		adminRoutes.GET("/jobs/dead", getDeadJobs)
+		adminRoutes.GET("/jobs/:id", getJob)
+		adminRoutes.POST("/jobs/:id/requeue", requeueJob)
+		adminRoutes.GET("/stats", getStats)
+		adminRoutes.GET("/experiments", getExperimentStats)
+		adminRoutes.GET("/rule-metrics", getRuleMetrics)
+		adminRoutes.POST("/rules/reload", postRulesReload)
+		adminRoutes.GET("/backup", getBackup)
+		if config.Analytics.SaltSecret != "" {
+			adminRoutes.GET("/exports/analytics", getAnalyticsExport(config.Analytics))
+		}
+		adminRoutes.POST("/restore", postRestore)
+		if dual, isDual := receipts.(*dualStore); isDual {
+			adminRoutes.GET("/migration", dual.getDrift)
+			adminRoutes.POST("/migration/backfill", dual.postBackfill)
+		}
+
+		reportRoutes := router.Group("/reports", requireAdmin(config.AdminUsername, config.AdminPassword, verifier))
+		reportRoutes.GET("/:period", getReports)
+		reportRoutes.POST("/:period", postReport)
+	}
+
+	if err := runServer(config, router); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Stops the middleware chain and responds with a message, like the handlers do.
+func abortWithMessage(context *gin.Context, status int, code string, args ...any) {
+	respondWithMessage(context, status, code, args...)
+	context.Abort()
 }
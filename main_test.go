@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+/*
+Points the globals handlers and jobs use at a fresh memory store, points
+cache, blob directory and scoring pool for the test, with the default
+rules, putting the previous ones back after it. Tests using it can't run
+in parallel.
+*/
+func useTestGlobals(t *testing.T) *memoryStore {
+	t.Helper()
+	previousReceipts, previousCache, previousBlobs := receipts, pointsCache, receiptBlobs
+	previousPool, previousEvents, previousCaps := scoringPool, receiptEvents, pointsCaps
+	t.Cleanup(func() {
+		receipts, pointsCache, receiptBlobs = previousReceipts, previousCache, previousBlobs
+		scoringPool, receiptEvents, pointsCaps = previousPool, previousEvents, previousCaps
+	})
+
+	store := newMemoryStore()
+	receipts = store
+	pointsCache = newLRUCache[string, cachedPoints](100)
+	receiptBlobs = diskBlobs{dir: t.TempDir()}
+	scoringPool = newWorkerPool(4, 1000)
+	receiptEvents = newEventBroker()
+	pointsCaps = CapsConfig{}
+	if currentRules.Load() == nil {
+		if _, err := loadRules("", nil); err != nil {
+			t.Fatalf("failed to load the default rules: %v", err)
+		}
+	}
+	return store
+}
+
+// The example receipt from the README, worth 28 points under the default rules.
+func targetReceipt() Receipt {
+	return Receipt{
+		Retailer: "Target",
+		Date:     "2022-01-01",
+		Time:     "13:01",
+		Items: []Item{
+			{Description: "Mountain Dew 12PK", Price: "6.49"},
+			{Description: "Emils Cheese Pizza", Price: "12.25"},
+			{Description: "Knorr Creamy Chicken", Price: "1.26"},
+			{Description: "Doritos Nacho Cheese", Price: "3.35"},
+			{Description: "   Klarbrunn 12-PK 12 FL OZ  ", Price: "12.00"},
+		},
+		Total: "35.35",
+	}
+}
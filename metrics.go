@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Numbers the breaker states are reported as.
+var breakerStateValues = map[string]int{"closed": 0, "half-open": 1, "open": 2}
+
+/*
+Serves metrics in the Prometheus text format: for each guarded dependency,
+its circuit breaker's state and how often it has failed, been retried and
+opened its breaker, and the rule metrics, see ruleMetricsRecorder.
+*/
+func getMetrics(context *gin.Context) {
+	guardsMutex.Lock()
+	registered := append([]*dependencyGuard{}, guards...)
+	guardsMutex.Unlock()
+
+	var metrics strings.Builder
+	writeMetric := func(name string, kind string, help string, value func(guard *dependencyGuard) int64) {
+		fmt.Fprintf(&metrics, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, guard := range registered {
+			fmt.Fprintf(&metrics, "%s{dependency=%q} %d\n", name, guard.name, value(guard))
+		}
+	}
+	writeMetric(
+		"dependency_breaker_state", "gauge", "Circuit breaker state: 0 closed, 1 half-open, 2 open.",
+		func(guard *dependencyGuard) int64 { return int64(breakerStateValues[guard.breaker.state()]) },
+	)
+	writeMetric(
+		"dependency_breaker_opened_total", "counter", "Times the circuit breaker has opened.",
+		func(guard *dependencyGuard) int64 { return guard.breaker.timesOpened() },
+	)
+	writeMetric(
+		"dependency_failures_total", "counter", "Calls that failed with a transient error.",
+		func(guard *dependencyGuard) int64 { return guard.failures.Load() },
+	)
+	writeMetric(
+		"dependency_retries_total", "counter", "Calls retried after a transient error.",
+		func(guard *dependencyGuard) int64 { return guard.retries.Load() },
+	)
+
+	ruleMetrics.writePrometheus(&metrics)
+
+	context.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(metrics.String()))
+}
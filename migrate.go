@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+Versioned schema changes for the SQL store, named like golang-migrate's:
+<version>_<description>.up.sql and a matching .down.sql that undoes it.
+*/
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Arbitrary key for the advisory lock that keeps replicas from migrating at the same time.
+const migrationLockKey = 727465636569707473
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// Reads the embedded migrations, ordered by version.
+func loadMigrations() ([]migration, error) {
+	paths, err := fs.Glob(migrationFiles, "migrations/*.up.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]migration, 0, len(paths))
+	for _, path := range paths {
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "migrations/"), ".up.sql")
+		versionText, _, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(versionText)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s has no version number", path)
+		}
+
+		up, err := migrationFiles.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		down, err := migrationFiles.ReadFile("migrations/" + name + ".down.sql")
+		if err != nil {
+			return nil, fmt.Errorf("migration %s has no down file", name)
+		}
+		migrations = append(migrations, migration{version: version, name: name, up: string(up), down: string(down)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	for index := 1; index < len(migrations); index++ {
+		if migrations[index].version == migrations[index-1].version {
+			return nil, fmt.Errorf("two migrations share version %d", migrations[index].version)
+		}
+	}
+	return migrations, nil
+}
+
+/*
+Applies or reverts migrations so the database ends up at the target
+version. A version of -1 means the latest migration. Each migration runs
+in a transaction together with the schema_migrations update, so a failed
+migration leaves the database at the previous version.
+*/
+func migrateTo(db *sql.DB, target int) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	if target < 0 && len(migrations) > 0 {
+		target = migrations[len(migrations)-1].version
+	}
+
+	// the advisory lock belongs to a connection, so hold one for the whole run
+	connection, err := db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+	if _, err := connection.ExecContext(context.Background(), `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		return err
+	}
+	defer connection.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+
+	current, err := migrationVersion(connection)
+	if err != nil {
+		return err
+	}
+
+	apply := func(version int, statements string) error {
+		transaction, err := connection.BeginTx(context.Background(), nil)
+		if err != nil {
+			return err
+		}
+		defer transaction.Rollback()
+
+		if _, err := transaction.Exec(statements); err != nil {
+			return err
+		}
+		if _, err := transaction.Exec(`DELETE FROM schema_migrations`); err != nil {
+			return err
+		}
+		if _, err := transaction.Exec(`INSERT INTO schema_migrations (version) VALUES ($1)`, version); err != nil {
+			return err
+		}
+		return transaction.Commit()
+	}
+
+	for _, step := range migrations {
+		if step.version > current && step.version <= target {
+			log.Printf("Applying migration %s", step.name)
+			if err := apply(step.version, step.up); err != nil {
+				return fmt.Errorf("migration %s failed: %w", step.name, err)
+			}
+		}
+	}
+	for index := len(migrations) - 1; index >= 0; index-- {
+		step := migrations[index]
+		if step.version <= current && step.version > target {
+			previous := 0
+			if index > 0 {
+				previous = migrations[index-1].version
+			}
+			log.Printf("Reverting migration %s", step.name)
+			if err := apply(previous, step.down); err != nil {
+				return fmt.Errorf("reverting migration %s failed: %w", step.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the recorded schema version, 0 when nothing has been applied yet.
+func migrationVersion(connection *sql.Conn) (int, error) {
+	_, err := connection.ExecContext(
+		context.Background(), `CREATE TABLE IF NOT EXISTS schema_migrations (version BIGINT NOT NULL)`,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	var version int
+	err = connection.QueryRowContext(
+		context.Background(), `SELECT version FROM schema_migrations LIMIT 1`,
+	).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return version, err
+}
+
+// Returns the version the embedded migrations bring the database to.
+func latestMigrationVersion() (int, error) {
+	migrations, err := loadMigrations()
+	if err != nil || len(migrations) == 0 {
+		return 0, err
+	}
+	return migrations[len(migrations)-1].version, nil
+}
+
+/*
+Runs the migrate subcommand:
+
+	main migrate up           apply every pending migration
+	main migrate down         revert every migration
+	main migrate goto <n>     migrate up or down to version n
+	main migrate version      print the current version
+*/
+func runMigrateCommand(config Config, arguments []string) error {
+	if config.StoreBackend != "postgres" {
+		return errors.New("migrations only apply to STORE_BACKEND=postgres")
+	}
+	db, err := sql.Open("pgx", config.DatabaseURL)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if len(arguments) == 0 {
+		return errors.New("usage: migrate up|down|goto <version>|version")
+	}
+	switch arguments[0] {
+	case "up":
+		return migrateTo(db, -1)
+	case "down":
+		return migrateTo(db, 0)
+	case "goto":
+		if len(arguments) < 2 {
+			return errors.New("usage: migrate goto <version>")
+		}
+		version, err := strconv.Atoi(arguments[1])
+		if err != nil || version < 0 {
+			return errors.New("the version must be a non-negative number")
+		}
+		return migrateTo(db, version)
+	case "version":
+		connection, err := db.Conn(context.Background())
+		if err != nil {
+			return err
+		}
+		defer connection.Close()
+		version, err := migrationVersion(connection)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "version %d\n", version)
+		return nil
+	}
+	return errors.New("unknown migrate command: " + arguments[0])
+}
@@ -0,0 +1,15 @@
+CREATE TABLE receipts (
+	sequence     BIGSERIAL UNIQUE,
+	id           TEXT PRIMARY KEY,
+	user_id      TEXT NOT NULL DEFAULT '',
+	receipt      JSONB NOT NULL,
+	points       INTEGER NOT NULL,
+	breakdown    JSONB NOT NULL,
+	processed_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE balances (
+	user_id TEXT PRIMARY KEY,
+	points  INTEGER NOT NULL,
+	version BIGINT NOT NULL
+);
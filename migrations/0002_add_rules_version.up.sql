@@ -0,0 +1 @@
+ALTER TABLE receipts ADD COLUMN rules_version TEXT NOT NULL DEFAULT '1';
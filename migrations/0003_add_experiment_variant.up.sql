@@ -0,0 +1 @@
+ALTER TABLE receipts ADD COLUMN variant TEXT NOT NULL DEFAULT '';
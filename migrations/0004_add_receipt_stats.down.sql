@@ -0,0 +1,3 @@
+DROP TABLE rule_stats;
+DROP TABLE retailer_stats;
+DROP TABLE receipt_stats;
@@ -0,0 +1,35 @@
+CREATE TABLE receipt_stats (
+	hour     TIMESTAMPTZ PRIMARY KEY,
+	receipts BIGINT NOT NULL,
+	points   BIGINT NOT NULL
+);
+
+CREATE TABLE retailer_stats (
+	hour     TIMESTAMPTZ NOT NULL,
+	retailer TEXT NOT NULL,
+	receipts BIGINT NOT NULL,
+	points   BIGINT NOT NULL,
+	PRIMARY KEY (hour, retailer)
+);
+
+CREATE TABLE rule_stats (
+	hour   TIMESTAMPTZ NOT NULL,
+	rule   TEXT NOT NULL,
+	hits   BIGINT NOT NULL,
+	points BIGINT NOT NULL,
+	PRIMARY KEY (hour, rule)
+);
+
+INSERT INTO receipt_stats (hour, receipts, points)
+SELECT date_trunc('hour', processed_at AT TIME ZONE 'UTC') AT TIME ZONE 'UTC', count(*), sum(points)
+FROM receipts GROUP BY 1;
+
+INSERT INTO retailer_stats (hour, retailer, receipts, points)
+SELECT date_trunc('hour', processed_at AT TIME ZONE 'UTC') AT TIME ZONE 'UTC', receipt->>'retailer', count(*), sum(points)
+FROM receipts GROUP BY 1, 2;
+
+INSERT INTO rule_stats (hour, rule, hits, points)
+SELECT date_trunc('hour', processed_at AT TIME ZONE 'UTC') AT TIME ZONE 'UTC', result->>'rule', count(*), sum((result->>'points')::int)
+FROM receipts, jsonb_array_elements(breakdown) AS result
+WHERE (result->>'points')::int <> 0
+GROUP BY 1, 2;
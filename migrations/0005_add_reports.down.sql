@@ -0,0 +1,2 @@
+DROP TABLE reports;
+DROP INDEX receipts_processed_at;
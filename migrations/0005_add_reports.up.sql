@@ -0,0 +1,13 @@
+CREATE INDEX receipts_processed_at ON receipts (processed_at);
+
+CREATE TABLE reports (
+	period       TEXT NOT NULL,
+	start_at     TIMESTAMPTZ NOT NULL,
+	end_at       TIMESTAMPTZ NOT NULL,
+	receipts     INTEGER NOT NULL,
+	points       BIGINT NOT NULL,
+	users        INTEGER NOT NULL,
+	retailers    JSONB NOT NULL,
+	generated_at TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (period, start_at)
+);
@@ -0,0 +1,2 @@
+DROP INDEX receipts_search;
+ALTER TABLE receipts DROP COLUMN search;
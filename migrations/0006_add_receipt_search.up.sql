@@ -0,0 +1,6 @@
+ALTER TABLE receipts ADD COLUMN search TSVECTOR GENERATED ALWAYS AS (
+	to_tsvector('simple', coalesce(receipt->>'retailer', '') || ' ' ||
+		jsonb_path_query_array(receipt, '$.items[*].shortDescription')::text)
+) STORED;
+
+CREATE INDEX receipts_search ON receipts USING GIN (search);
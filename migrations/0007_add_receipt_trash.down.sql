@@ -0,0 +1,2 @@
+DELETE FROM receipts WHERE deleted_at IS NOT NULL;
+ALTER TABLE receipts DROP COLUMN deleted_at;
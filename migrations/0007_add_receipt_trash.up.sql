@@ -0,0 +1,3 @@
+ALTER TABLE receipts ADD COLUMN deleted_at TIMESTAMPTZ;
+
+CREATE INDEX receipts_deleted_at ON receipts (deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,11 @@
+CREATE TABLE audit_log (
+	sequence   BIGSERIAL PRIMARY KEY,
+	id         TEXT NOT NULL UNIQUE,
+	at         TIMESTAMPTZ NOT NULL,
+	receipt_id TEXT NOT NULL DEFAULT '',
+	user_id    TEXT NOT NULL DEFAULT '',
+	entry      JSONB NOT NULL
+);
+
+CREATE INDEX audit_log_receipt_id ON audit_log (receipt_id, sequence);
+CREATE INDEX audit_log_user_id ON audit_log (user_id, sequence);
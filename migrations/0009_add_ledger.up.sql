@@ -0,0 +1,17 @@
+CREATE TABLE ledger (
+	sequence   BIGSERIAL PRIMARY KEY,
+	id         TEXT NOT NULL UNIQUE,
+	at         TIMESTAMPTZ NOT NULL,
+	user_id    TEXT NOT NULL,
+	kind       TEXT NOT NULL,
+	points     INTEGER NOT NULL,
+	balance    INTEGER NOT NULL,
+	receipt_id TEXT NOT NULL DEFAULT '',
+	reason     TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX ledger_user_id ON ledger (user_id, sequence);
+
+-- balances from before the ledger start with an opening entry
+INSERT INTO ledger (id, at, user_id, kind, points, balance)
+SELECT 'opening-' || user_id, now(), user_id, 'opening', points, points FROM balances;
@@ -0,0 +1,3 @@
+DROP INDEX receipts_pending_review;
+ALTER TABLE receipts DROP COLUMN review_reasons;
+ALTER TABLE receipts DROP COLUMN status;
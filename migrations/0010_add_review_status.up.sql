@@ -0,0 +1,4 @@
+ALTER TABLE receipts ADD COLUMN status TEXT NOT NULL DEFAULT '';
+ALTER TABLE receipts ADD COLUMN review_reasons JSONB NOT NULL DEFAULT 'null';
+
+CREATE INDEX receipts_pending_review ON receipts (sequence) WHERE status = 'pending_review';
@@ -0,0 +1,4 @@
+CREATE TABLE user_profiles (
+	user_id TEXT PRIMARY KEY,
+	profile JSONB NOT NULL
+);
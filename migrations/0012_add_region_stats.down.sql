@@ -0,0 +1 @@
+DROP TABLE region_stats;
@@ -0,0 +1,12 @@
+CREATE TABLE region_stats (
+	hour     TIMESTAMPTZ NOT NULL,
+	region   TEXT NOT NULL,
+	receipts BIGINT NOT NULL,
+	points   BIGINT NOT NULL,
+	PRIMARY KEY (hour, region)
+);
+
+INSERT INTO region_stats (hour, region, receipts, points)
+SELECT date_trunc('hour', processed_at AT TIME ZONE 'UTC') AT TIME ZONE 'UTC',
+	coalesce(receipt->'storeLocation'->>'state', ''), count(*), sum(points)
+FROM receipts WHERE deleted_at IS NULL AND status = '' GROUP BY 1, 2;
@@ -0,0 +1 @@
+ALTER TABLE receipts ADD COLUMN merchant JSONB NOT NULL DEFAULT 'null';
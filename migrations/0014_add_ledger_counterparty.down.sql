@@ -0,0 +1,2 @@
+DROP INDEX ledger_donations;
+ALTER TABLE ledger DROP COLUMN counterparty;
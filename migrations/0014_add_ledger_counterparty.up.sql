@@ -0,0 +1,3 @@
+ALTER TABLE ledger ADD COLUMN counterparty TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX ledger_donations ON ledger (counterparty) WHERE kind = 'donation';
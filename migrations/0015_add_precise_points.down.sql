@@ -0,0 +1,5 @@
+UPDATE receipts SET breakdown = (
+	SELECT COALESCE(jsonb_agg(result - 'precisePoints'), '[]')
+	FROM jsonb_array_elements(breakdown) AS result
+)
+WHERE jsonb_typeof(breakdown) = 'array';
@@ -0,0 +1,7 @@
+-- Breakdowns record each rule's exact points alongside its whole points;
+-- receipts scored before fractional points only had whole points.
+UPDATE receipts SET breakdown = (
+	SELECT COALESCE(jsonb_agg(result || jsonb_build_object('precisePoints', result->'points')), '[]')
+	FROM jsonb_array_elements(breakdown) AS result
+)
+WHERE jsonb_typeof(breakdown) = 'array';
@@ -0,0 +1 @@
+ALTER TABLE receipts ADD COLUMN version BIGINT NOT NULL DEFAULT 1;
@@ -0,0 +1 @@
+DROP INDEX receipts_tags;
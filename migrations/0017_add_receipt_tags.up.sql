@@ -0,0 +1 @@
+CREATE INDEX receipts_tags ON receipts USING GIN (coalesce(receipt->'tags', '[]'::jsonb) jsonb_path_ops);
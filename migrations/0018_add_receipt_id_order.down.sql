@@ -0,0 +1,2 @@
+DROP INDEX receipts_user_id_order;
+DROP INDEX receipts_id_order;
@@ -0,0 +1,2 @@
+CREATE INDEX receipts_id_order ON receipts (id COLLATE "C") WHERE deleted_at IS NULL;
+CREATE INDEX receipts_user_id_order ON receipts (user_id, id COLLATE "C") WHERE deleted_at IS NULL;
@@ -0,0 +1,2 @@
+DROP INDEX receipts_channel;
+ALTER TABLE receipts DROP COLUMN channel;
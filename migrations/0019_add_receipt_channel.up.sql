@@ -0,0 +1,2 @@
+ALTER TABLE receipts ADD COLUMN channel TEXT NOT NULL DEFAULT '';
+CREATE INDEX receipts_channel ON receipts (channel) WHERE deleted_at IS NULL;
@@ -0,0 +1 @@
+ALTER TABLE receipts ADD COLUMN api_key TEXT NOT NULL DEFAULT '';
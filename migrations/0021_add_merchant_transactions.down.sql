@@ -0,0 +1,3 @@
+ALTER TABLE receipts DROP COLUMN verification;
+
+DROP TABLE merchant_transactions;
@@ -0,0 +1,16 @@
+CREATE TABLE merchant_transactions (
+	merchant       TEXT NOT NULL,
+	transaction_id TEXT NOT NULL,
+	total          TEXT NOT NULL,
+	total_cents    BIGINT NOT NULL,
+	purchased_at   TIMESTAMPTZ NOT NULL,
+	store_id       TEXT NOT NULL DEFAULT '',
+	registered_at  TIMESTAMPTZ NOT NULL,
+	receipt_id     TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (merchant, transaction_id)
+);
+
+CREATE INDEX merchant_transactions_match ON merchant_transactions (merchant, total_cents, purchased_at);
+CREATE INDEX merchant_transactions_receipt ON merchant_transactions (receipt_id);
+
+ALTER TABLE receipts ADD COLUMN verification JSONB NOT NULL DEFAULT 'null';
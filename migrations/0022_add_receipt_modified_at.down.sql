@@ -0,0 +1 @@
+ALTER TABLE receipts DROP COLUMN modified_at;
@@ -0,0 +1,2 @@
+-- existing receipts haven't changed since the migration, as far as anyone can tell
+ALTER TABLE receipts ADD COLUMN modified_at TIMESTAMPTZ NOT NULL DEFAULT now();
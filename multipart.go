@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Room allowed beyond the attachment for the receipt JSON and the form's own framing.
+const multipartOverhead = 1 << 20
+
+/*
+Middleware accepting receipts submitted as multipart/form-data, for kiosks
+that can only make one upload call: a "receipt" part with the receipt JSON
+and an optional "attachment" part with the image or PDF it was scanned
+from. Other submissions pass through to the JSON handler.
+
+The two are saved together or not at all: the attachment is stored under
+the new receipt's id first, which nothing can look up until the receipt is
+saved, and removed again if the receipt fails.
+*/
+func acceptMultipart(maxSize int64) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if context.ContentType() != "multipart/form-data" {
+			context.Next()
+			return
+		}
+		context.Abort()
+		channel, err := submissionChannel(context, channelUpload)
+		if err != nil {
+			respondWithError(context, http.StatusBadRequest, err)
+			return
+		}
+
+		context.Request.Body = http.MaxBytesReader(context.Writer, context.Request.Body, maxSize+multipartOverhead)
+		reader, err := context.Request.MultipartReader()
+		if err != nil {
+			respondWithMessage(context, http.StatusBadRequest, "multipart.invalid")
+			return
+		}
+		receipt, attachment, err := readMultipartReceipt(reader, maxSize)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) || errors.Is(err, errAttachmentTooLarge) {
+			respondWithMessage(context, http.StatusRequestEntityTooLarge, "image.too_large", maxSize)
+			return
+		}
+		if err != nil {
+			respondWithError(context, http.StatusBadRequest, err)
+			return
+		}
+		if attachment != nil && !acceptedBlobType(attachment.ContentType) {
+			respondWithMessage(context, http.StatusUnsupportedMediaType, "image.unsupported_type", attachment.ContentType)
+			return
+		}
+
+		target := processingFor(context)
+		receiptID := uuid.New().String()
+		if target.sandbox != nil {
+			receiptID = target.sandbox.nextID()
+		}
+		if attachment != nil {
+			if err := receiptBlobs.put(receiptID, *attachment); err != nil {
+				log.Printf("Failed to store the attachment of receipt %s: %v", receiptID, err)
+				respondWithMessage(context, http.StatusInternalServerError, "image.save_failed")
+				return
+			}
+		}
+		record, _, err := scoreAndSave(target, receiptID, *receipt, submittingUser(context), channel)
+		if err != nil {
+			if attachment != nil {
+				if removeError := receiptBlobs.remove(receiptID); removeError != nil {
+					log.Printf("Failed to remove the attachment of unsaved receipt %s: %v", receiptID, removeError)
+				}
+			}
+			respondWithProcessError(context, err)
+			return
+		}
+
+		response := gin.H{
+			"id": record.ID, "points": record.Points, "channel": record.Channel, "links": receiptLinks(record.ID),
+		}
+		if attachment != nil {
+			response["attachment"] = gin.H{"contentType": attachment.ContentType, "size": len(attachment.Data)}
+		}
+		if record.Status != "" {
+			response["status"] = record.Status
+		}
+		if capped := record.capsApplied(); capped != nil {
+			response["capped"] = capped
+		}
+		context.IndentedJSON(http.StatusCreated, response)
+	}
+}
+
+var errAttachmentTooLarge = errors.New("attachment too large")
+
+/*
+Reads the form's receipt and attachment, which may come in either order.
+The attachment's type is sniffed from its contents rather than trusted.
+Errors other than size limits are clientErrors.
+*/
+func readMultipartReceipt(reader *multipart.Reader, maxSize int64) (*Receipt, *receiptBlob, error) {
+	var receipt *Receipt
+	var attachment *receiptBlob
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, wrapMultipartError(err)
+		}
+
+		switch part.FormName() {
+		case "receipt":
+			if receipt != nil {
+				return nil, nil, newClientError("multipart.duplicate_part", "receipt")
+			}
+			receipt = &Receipt{}
+			if err := decodeJSON(io.LimitReader(part, multipartOverhead), receipt, "receipt.bind_failed"); err != nil {
+				return nil, nil, wrapMultipartError(err)
+			}
+		case "attachment":
+			if attachment != nil {
+				return nil, nil, newClientError("multipart.duplicate_part", "attachment")
+			}
+			data, err := io.ReadAll(io.LimitReader(part, maxSize+1))
+			if err != nil {
+				return nil, nil, wrapMultipartError(err)
+			}
+			if int64(len(data)) > maxSize {
+				return nil, nil, errAttachmentTooLarge
+			}
+			if len(data) > 0 {
+				attachment = &receiptBlob{ContentType: http.DetectContentType(data), Data: data}
+			}
+		default:
+			return nil, nil, newClientError("multipart.unknown_part", strings.TrimSpace(part.FormName()))
+		}
+	}
+
+	if receipt == nil {
+		return nil, nil, newClientError("multipart.receipt_missing")
+	}
+	return receipt, attachment, nil
+}
+
+// Keeps body size errors and field problems recognizable, and describes anything else as an invalid form.
+func wrapMultipartError(err error) error {
+	var tooLarge *http.MaxBytesError
+	var invalid *validationError
+	if errors.As(err, &tooLarge) || errors.As(err, &invalid) {
+		return err
+	}
+	return newClientError("multipart.invalid")
+}
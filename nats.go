@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+/*
+Where receipts are consumed from and results published to over NATS
+JetStream. Ingestion is off unless URL is set.
+*/
+type NATSConfig struct {
+	URL string
+	// stream holding the submitted receipts, the subject they're published
+	// on, and the durable pull consumer this service reads them with
+	Stream   string
+	Subject  string
+	Consumer string
+	// subject results are published to; a stream must capture it, since
+	// results are only acknowledged once JetStream has stored them
+	ResultSubject string
+	// how many receipts are fetched at once
+	BatchSize int
+}
+
+// Header naming the user a receipt is submitted for.
+const natsUserHeader = "User-Id"
+
+// How long a failed receipt waits before JetStream redelivers it.
+const natsRedeliveryDelay = 5 * time.Second
+
+// The outcome of scoring one consumed receipt, as published to the result subject.
+type natsResult struct {
+	// stream sequence of the message the receipt arrived in
+	Sequence      uint64  `json:"sequence"`
+	ID            string  `json:"id,omitempty"`
+	Points        int     `json:"points"`
+	PrecisePoints float64 `json:"precisePoints"`
+	Status        string  `json:"status,omitempty"`
+	Error         string  `json:"error,omitempty"`
+	Code          string  `json:"code,omitempty"`
+}
+
+/*
+Connects to NATS and starts consuming receipts in the background. Delivery
+is at least once: a message is only acknowledged after its result is
+stored, and a receipt that arrives again keeps the id it got the first
+time, so rescoring it replaces the receipt rather than awarding its points
+twice. Receipts that fail for a reason on our side (e.g. the store being
+down) are redelivered; invalid receipts get an error result.
+*/
+func startNATSIngestion(config NATSConfig) error {
+	if config.URL == "" {
+		return nil
+	}
+	if config.Subject == "" || config.Consumer == "" || config.ResultSubject == "" {
+		return errors.New("NATS_URL needs NATS_SUBJECT, NATS_CONSUMER and NATS_RESULT_SUBJECT")
+	}
+
+	connection, err := nats.Connect(config.URL,
+		nats.Name("receipt-scanner"),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Printf("Disconnected from NATS: %v", err)
+		}),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	stream, err := connection.JetStream()
+	if err != nil {
+		return err
+	}
+	var options []nats.SubOpt
+	if config.Stream != "" {
+		options = append(options, nats.BindStream(config.Stream))
+	}
+	subscription, err := stream.PullSubscribe(config.Subject, config.Consumer, options...)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", config.Subject, err)
+	}
+
+	log.Printf("Consuming receipts from NATS subject %s", config.Subject)
+	go func() {
+		for {
+			messages, err := subscription.Fetch(max(config.BatchSize, 1), nats.MaxWait(30*time.Second))
+			if err != nil && !errors.Is(err, nats.ErrTimeout) {
+				log.Printf("Failed to fetch receipts from NATS: %v", err)
+				time.Sleep(natsRedeliveryDelay)
+				continue
+			}
+			for _, message := range messages {
+				consumeNATSReceipt(stream, config.ResultSubject, message)
+			}
+		}
+	}()
+	return nil
+}
+
+func consumeNATSReceipt(stream nats.JetStreamContext, resultSubject string, message *nats.Msg) {
+	metadata, err := message.Metadata()
+	if err != nil {
+		log.Printf("Dropping a NATS message without JetStream metadata: %v", err)
+		message.Term()
+		return
+	}
+	// the same message always becomes the same receipt
+	receiptID := uuid.NewSHA1(uuid.NameSpaceURL, []byte(fmt.Sprintf(
+		"nats:%s:%d", metadata.Stream, metadata.Sequence.Stream,
+	))).String()
+	result := natsResult{Sequence: metadata.Sequence.Stream}
+
+	var receipt Receipt
+	if err := json.Unmarshal(message.Data, &receipt); err != nil {
+		result.Error, result.Code = translate(defaultLanguage, "receipt.bind_failed"), "receipt.bind_failed"
+	} else {
+		record, _, err := scoreAndSave(processing{}, receiptID, receipt, message.Header.Get(natsUserHeader), channelQueue)
+		switch {
+		case errors.Is(err, errSaveFailed), errors.Is(err, errPoolSaturated):
+			message.NakWithDelay(natsRedeliveryDelay)
+			return
+		case err != nil:
+			result.Error, result.Code = localizeError(defaultLanguage, err)
+		default:
+			result.ID, result.Points, result.Status = record.ID, record.Points, record.Status
+			result.PrecisePoints = record.precisePoints().precise()
+		}
+	}
+
+	payload, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("Failed to encode the result of NATS message %d: %v", result.Sequence, err)
+		message.Term()
+		return
+	}
+	// the message id lets JetStream drop a result published twice
+	published := nats.NewMsg(resultSubject)
+	published.Header.Set(nats.MsgIdHdr, receiptID)
+	published.Data = payload
+	if _, err := stream.PublishMsg(published); err != nil {
+		log.Printf("Failed to publish the result of NATS message %d: %v", result.Sequence, err)
+		message.NakWithDelay(natsRedeliveryDelay)
+		return
+	}
+	if err := message.Ack(); err != nil {
+		log.Printf("Failed to acknowledge NATS message %d: %v", result.Sequence, err)
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of notification users can turn on and off in their preferences.
+const (
+	notifyPointsAwarded   = "points_awarded"
+	notifyPointsExpiring  = "points_expiring"
+	notifyRedemption      = "redemption_completed"
+	notifyReceiptRejected = "receipt_rejected"
+)
+
+/*
+Where notifications are sent from. Each channel is only available once its
+settings are configured.
+*/
+type NotificationConfig struct {
+	// SMTP server as host:port, with optional credentials and the sender address
+	SMTPAddress  string
+	SMTPUsername string
+	SMTPPassword string
+	SMTPFrom     string
+	// Google service account key file for Firebase Cloud Messaging
+	FCMCredentialsFile string
+	// URL notifications are posted to, and the secret signing them
+	WebhookURL    string
+	WebhookSecret string
+}
+
+// Something to tell a user. Args fill in the kind's message templates.
+type notification struct {
+	Kind      string `json:"kind"`
+	UserID    string `json:"userId"`
+	ReceiptID string `json:"receiptId,omitempty"`
+	Points    int    `json:"points,omitempty"`
+	Balance   int    `json:"balance,omitempty"`
+	Args      []any  `json:"-"`
+}
+
+// Delivers a notification over one channel, written as title and body.
+type notifier interface {
+	send(profile userProfile, message notification, title string, body string) error
+}
+
+// The channel names users can choose, with the notifier for each once configured.
+var notificationChannels = map[string]notifier{
+	"email":   nil,
+	"push":    nil,
+	"webhook": nil,
+}
+
+// Retries and circuit breakers for each configured channel, by channel name
+var notificationGuards = make(map[string]*dependencyGuard)
+
+// How many notifications may wait to be sent before new ones are dropped.
+const notificationQueueDepth = 1000
+
+var notificationQueue chan notification
+
+/*
+Sets up the configured notifiers and starts sending queued notifications in
+the background, so slow mail servers never hold up receipt processing.
+*/
+func startNotifications(config NotificationConfig, resilience ResilienceConfig) error {
+	if config.SMTPAddress != "" {
+		notificationChannels["email"] = smtpNotifier{config: config}
+	}
+	if config.FCMCredentialsFile != "" {
+		fcm, err := newFCMNotifier(config.FCMCredentialsFile)
+		if err != nil {
+			return err
+		}
+		notificationChannels["push"] = fcm
+	}
+	if config.WebhookURL != "" {
+		notificationChannels["webhook"] = webhookNotifier{url: config.WebhookURL, secret: config.WebhookSecret}
+	}
+
+	for channel, sender := range notificationChannels {
+		if sender != nil {
+			notificationGuards[channel] = newDependencyGuard("notifications."+channel, resilience, retryUnlessPermanent)
+		}
+	}
+
+	notificationQueue = make(chan notification, notificationQueueDepth)
+	go func() {
+		for message := range notificationQueue {
+			deliverNotification(message)
+		}
+	}()
+	return nil
+}
+
+// Queues a notification for the user, if notifications are running.
+func notifyUser(message notification) {
+	if notificationQueue == nil || message.UserID == "" {
+		return
+	}
+	select {
+	case notificationQueue <- message:
+	default:
+		log.Printf("Dropped a %s notification for %s, the queue is full", message.Kind, message.UserID)
+	}
+}
+
+// Tells a receipt's user about the points it earned.
+func notifyPointsAwardedFor(record storedReceipt, balance int) {
+	if record.Points == 0 {
+		return
+	}
+	notifyUser(notification{
+		Kind: notifyPointsAwarded, UserID: record.UserID, ReceiptID: record.ID,
+		Points: record.Points, Balance: balance,
+		Args: []any{record.Points, record.Receipt.Retailer, balance},
+	})
+}
+
+// Sends the notification over each channel the user chose, if they want this kind.
+func deliverNotification(message notification) {
+	profile, err := receipts.Profile(message.UserID)
+	if err != nil {
+		log.Printf("Failed to load the profile of %s for a notification: %v", message.UserID, err)
+		return
+	}
+	preferences := profile.Notifications
+	wanted := map[string]bool{
+		notifyPointsAwarded:   preferences.PointsAwarded,
+		notifyPointsExpiring:  preferences.PointsExpiring,
+		notifyRedemption:      preferences.Redemptions,
+		notifyReceiptRejected: preferences.ReceiptRejected,
+	}
+	if !wanted[message.Kind] {
+		return
+	}
+
+	language := profile.Language
+	if _, supported := catalogs[language]; !supported {
+		language = defaultLanguage
+	}
+	title := translate(language, "notification."+message.Kind+".title")
+	body := translate(language, "notification."+message.Kind+".body", message.Args...)
+	for _, channel := range preferences.Channels {
+		sender := notificationChannels[channel]
+		if sender == nil {
+			continue
+		}
+		err := notificationGuards[channel].do(context.Background(), func() error {
+			return sender.send(profile, message, title, body)
+		})
+		if err != nil {
+			log.Printf("Failed to send a %s notification to %s by %s: %v", message.Kind, message.UserID, channel, err)
+		}
+	}
+}
+
+// Sends email through an SMTP server.
+type smtpNotifier struct {
+	config NotificationConfig
+}
+
+func (notifier smtpNotifier) send(profile userProfile, message notification, title string, body string) error {
+	if profile.Email == "" {
+		return nil
+	}
+	host, _, _ := strings.Cut(notifier.config.SMTPAddress, ":")
+	var auth smtp.Auth
+	if notifier.config.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", notifier.config.SMTPUsername, notifier.config.SMTPPassword, host)
+	}
+
+	email := "From: " + notifier.config.SMTPFrom + "\r\n" +
+		"To: " + profile.Email + "\r\n" +
+		"Subject: " + title + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + body + "\r\n"
+	err := smtp.SendMail(notifier.config.SMTPAddress, auth, notifier.config.SMTPFrom, []string{profile.Email}, []byte(email))
+	// 5xx replies mean the server won't take the message however often it's sent
+	var reply *textproto.Error
+	if errors.As(err, &reply) && reply.Code >= 500 {
+		return permanentError{err}
+	}
+	return err
+}
+
+/*
+Posts the notification as JSON to a webhook, for integrations that reach
+users some other way. Bodies are signed like partner submissions when a
+secret is configured.
+*/
+type webhookNotifier struct {
+	url    string
+	secret string
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func (notifier webhookNotifier) send(profile userProfile, message notification, title string, body string) error {
+	payload, err := json.Marshal(struct {
+		notification
+		Title string `json:"title"`
+		Body  string `json:"body"`
+	}{message, title, body})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, notifier.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if notifier.secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		request.Header.Set(signatureTimestampHeader, timestamp)
+		request.Header.Set(signatureHeader, computeSignature(notifier.secret, timestamp, payload))
+	}
+	return postNotification(request)
+}
+
+func postNotification(request *http.Request) error {
+	response, err := webhookClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		err := fmt.Errorf("%s answered %s", request.URL.Host, response.Status)
+		if response.StatusCode < 500 && response.StatusCode != http.StatusTooManyRequests {
+			return permanentError{err}
+		}
+		return err
+	}
+	return nil
+}
+
+/*
+Sends push notifications with the Firebase Cloud Messaging HTTP v1 API,
+authenticating as a service account whose access tokens are refreshed
+shortly before they expire.
+*/
+type fcmNotifier struct {
+	account    fcmServiceAccount
+	privateKey *rsa.PrivateKey
+
+	mutex       sync.Mutex
+	accessToken string
+	expires     time.Time
+}
+
+// The fields of a Google service account key file that FCM needs.
+type fcmServiceAccount struct {
+	ProjectID   string `json:"project_id"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+func newFCMNotifier(credentialsFile string) (*fcmNotifier, error) {
+	contents, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	var account fcmServiceAccount
+	if err := json.Unmarshal(contents, &account); err != nil {
+		return nil, fmt.Errorf("failed to parse FCM credentials %s: %w", credentialsFile, err)
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, errors.New("the FCM credentials have no private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, isRSA := key.(*rsa.PrivateKey)
+	if !isRSA {
+		return nil, errors.New("the FCM credentials' private key isn't an RSA key")
+	}
+	if account.TokenURI == "" {
+		account.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	return &fcmNotifier{account: account, privateKey: privateKey}, nil
+}
+
+func (notifier *fcmNotifier) send(profile userProfile, message notification, title string, body string) error {
+	accessToken, err := notifier.token()
+	if err != nil {
+		return err
+	}
+	endpoint := "https://fcm.googleapis.com/v1/projects/" + url.PathEscape(notifier.account.ProjectID) + "/messages:send"
+
+	for _, deviceToken := range profile.PushTokens {
+		payload, err := json.Marshal(map[string]any{
+			"message": map[string]any{
+				"token":        deviceToken,
+				"notification": map[string]string{"title": title, "body": body},
+				"data":         map[string]string{"kind": message.Kind, "receiptId": message.ReceiptID},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		request, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Authorization", "Bearer "+accessToken)
+		if err := postNotification(request); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns a current access token, exchanging a signed JWT for a new one when needed.
+func (notifier *fcmNotifier) token() (string, error) {
+	notifier.mutex.Lock()
+	defer notifier.mutex.Unlock()
+	if time.Until(notifier.expires) > time.Minute {
+		return notifier.accessToken, nil
+	}
+
+	now := time.Now()
+	encode := func(value any) string {
+		contents, _ := json.Marshal(value)
+		return base64.RawURLEncoding.EncodeToString(contents)
+	}
+	unsigned := encode(map[string]string{"alg": "RS256", "typ": "JWT"}) + "." + encode(map[string]any{
+		"iss":   notifier.account.ClientEmail,
+		"scope": "https://www.googleapis.com/auth/firebase.messaging",
+		"aud":   notifier.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(nil, notifier.privateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	response, err := webhookClient.PostForm(notifier.account.TokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	var grant struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&grant); err != nil {
+		return "", err
+	}
+	if response.StatusCode != http.StatusOK || grant.AccessToken == "" {
+		return "", fmt.Errorf("the FCM token exchange answered %s", response.Status)
+	}
+
+	notifier.accessToken = grant.AccessToken
+	notifier.expires = now.Add(time.Duration(grant.ExpiresIn) * time.Second)
+	return notifier.accessToken, nil
+}
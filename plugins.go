@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+/*
+Scoring plugins are WebAssembly modules loaded from PLUGIN_DIR at startup.
+A plugin is a WASI reactor exporting:
+
+	allocate(size u32) u32        returns a buffer for the host to write into
+	score(pointer u32, size u32) u64
+
+score receives the receipt as JSON and returns the location of its JSON
+result, {"points": 5, "label": "why"}, packed as pointer<<32 | size.
+Plugins get no filesystem, network or environment access, a capped amount
+of memory and a deadline for every call. Each call runs in a fresh
+instance, so plugins can't keep state between receipts.
+*/
+type wasmPlugin struct {
+	name     string
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	timeout  time.Duration
+}
+
+type pluginResult struct {
+	Points int    `json:"points"`
+	Label  string `json:"label"`
+}
+
+// 64 KiB WebAssembly pages a plugin may use, 16 MiB in total.
+const pluginMemoryLimitPages = 256
+
+// Compiles every .wasm file in the directory.
+func loadPlugins(directory string, timeout time.Duration) ([]*wasmPlugin, error) {
+	paths, err := filepath.Glob(filepath.Join(directory, "*.wasm"))
+	if err != nil {
+		return nil, err
+	}
+
+	background := context.Background()
+	var plugins []*wasmPlugin
+	for _, path := range paths {
+		binary, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		// the runtime closes modules whose call context is done, enforcing the timeout
+		runtime := wazero.NewRuntimeWithConfig(background, wazero.NewRuntimeConfig().
+			WithMemoryLimitPages(pluginMemoryLimitPages).
+			WithCloseOnContextDone(true))
+		wasi_snapshot_preview1.MustInstantiate(background, runtime)
+
+		compiled, err := runtime.CompileModule(background, binary)
+		if err != nil {
+			runtime.Close(background)
+			return nil, fmt.Errorf("failed to compile plugin %s: %w", path, err)
+		}
+		exports := compiled.ExportedFunctions()
+		if exports["allocate"] == nil || exports["score"] == nil {
+			runtime.Close(background)
+			return nil, fmt.Errorf("plugin %s must export allocate and score", path)
+		}
+
+		plugins = append(plugins, &wasmPlugin{
+			name:     "plugin:" + strings.TrimSuffix(filepath.Base(path), ".wasm"),
+			runtime:  runtime,
+			compiled: compiled,
+			timeout:  timeout,
+		})
+	}
+	return plugins, nil
+}
+
+// Runs the plugin's score export against the receipt.
+func (plugin *wasmPlugin) score(receipt Receipt) (pluginResult, error) {
+	input, err := json.Marshal(receipt)
+	if err != nil {
+		return pluginResult{}, err
+	}
+
+	callContext, cancel := context.WithTimeout(context.Background(), plugin.timeout)
+	defer cancel()
+
+	module, err := plugin.runtime.InstantiateModule(
+		callContext, plugin.compiled,
+		wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize"),
+	)
+	if err != nil {
+		return pluginResult{}, err
+	}
+	defer module.Close(context.Background())
+
+	allocated, err := module.ExportedFunction("allocate").Call(callContext, uint64(len(input)))
+	if err != nil {
+		return pluginResult{}, err
+	}
+	pointer := uint32(allocated[0])
+	if !module.Memory().Write(pointer, input) {
+		return pluginResult{}, errors.New("allocate returned memory outside the plugin's bounds")
+	}
+
+	packed, err := module.ExportedFunction("score").Call(callContext, uint64(pointer), uint64(len(input)))
+	if err != nil {
+		return pluginResult{}, err
+	}
+	output, ok := readPluginMemory(module.Memory(), packed[0])
+	if !ok {
+		return pluginResult{}, errors.New("score returned memory outside the plugin's bounds")
+	}
+
+	var result pluginResult
+	if err := json.Unmarshal(output, &result); err != nil {
+		return pluginResult{}, fmt.Errorf("score returned invalid JSON: %w", err)
+	}
+	return result, nil
+}
+
+func readPluginMemory(memory api.Memory, packed uint64) ([]byte, bool) {
+	var location [8]byte
+	binary.BigEndian.PutUint64(location[:], packed)
+	pointer := binary.BigEndian.Uint32(location[:4])
+	size := binary.BigEndian.Uint32(location[4:])
+	return memory.Read(pointer, size)
+}
+
+/*
+Turns the plugin into a rule whose points and label appear in the
+breakdown. A plugin that fails awards no points rather than failing the
+receipt, since partners' code shouldn't be able to block scoring.
+*/
+func (plugin *wasmPlugin) rule() scoringRule {
+	return scoringRule{
+		Name:        plugin.name,
+		Description: "Points from the " + strings.TrimPrefix(plugin.name, "plugin:") + " WebAssembly plugin",
+		// plugins are given the whole receipt, tags and all
+		readsTags: true,
+		bonus: func(receipt parsedReceipt, subtotal centipoints) (centipoints, string) {
+			result, err := plugin.score(receipt.receipt)
+			if err != nil {
+				log.Printf("Plugin %s failed: %v", plugin.name, err)
+				return 0, ""
+			}
+			return wholePoints(result.Points), result.Label
+		},
+	}
+}
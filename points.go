@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+/*
+Hundredths of a point. Rules score in centipoints so fractional awards
+(e.g. a 1.5x multiplier) add up exactly; only the receipt's total is
+rounded to the whole points balances are kept in.
+*/
+type centipoints int64
+
+const centipointsPerPoint = 100
+
+func wholePoints(points int) centipoints {
+	return centipoints(points) * centipointsPerPoint
+}
+
+// Converts fractional points, e.g. from an expression, to the nearest centipoint.
+func fractionalPoints(points float64) centipoints {
+	return centipoints(math.Round(points * centipointsPerPoint))
+}
+
+// The points as a decimal, for responses.
+func (points centipoints) precise() float64 {
+	return float64(points) / centipointsPerPoint
+}
+
+// How a receipt's fractional points are rounded to whole points.
+type roundingMode string
+
+const (
+	// halves round away from zero, 12.5 to 13
+	roundHalfUp roundingMode = "half-up"
+	// halves round to the even neighbour, 12.5 to 12 and 13.5 to 14
+	roundHalfEven roundingMode = "half-even"
+	// fractions are dropped, 12.9 to 12
+	roundDown roundingMode = "down"
+	// any fraction rounds away from zero, 12.1 to 13
+	roundUp roundingMode = "up"
+)
+
+func (mode roundingMode) validate() error {
+	switch mode {
+	case roundHalfUp, roundHalfEven, roundDown, roundUp:
+		return nil
+	}
+	return fmt.Errorf("rounding must be %s, %s, %s or %s, not %q", roundHalfUp, roundHalfEven, roundDown, roundUp, mode)
+}
+
+func (mode roundingMode) round(points centipoints) int {
+	whole, fraction := points/centipointsPerPoint, points%centipointsPerPoint
+	away := centipoints(1)
+	if points < 0 {
+		away, fraction = -1, -fraction
+	}
+	switch {
+	case fraction == 0 || mode == roundDown:
+	case mode == roundUp,
+		mode == roundHalfUp && fraction >= centipointsPerPoint/2,
+		mode == roundHalfEven && (fraction > centipointsPerPoint/2 || fraction == centipointsPerPoint/2 && whole%2 != 0):
+		whole += away
+	}
+	return int(whole)
+}
+
+/*
+The receipt's points before rounding, from its breakdown. Breakdowns from
+before fractional points (e.g. in old backups) only have whole points.
+*/
+func (record storedReceipt) precisePoints() centipoints {
+	var total centipoints
+	for _, result := range record.Breakdown {
+		if result.PrecisePoints == 0 {
+			total += wholePoints(result.Points)
+		} else {
+			total += fractionalPoints(result.PrecisePoints)
+		}
+	}
+	return total
+}
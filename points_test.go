@@ -0,0 +1,71 @@
+package main
+
+import "testing"
+
+func TestRoundingModeRound(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   roundingMode
+		points centipoints
+		want   int
+	}{
+		{"half-up whole", roundHalfUp, 1200, 12},
+		{"half-up below half", roundHalfUp, 1249, 12},
+		{"half-up half", roundHalfUp, 1250, 13},
+		{"half-up negative half", roundHalfUp, -1250, -13},
+		{"half-even half to even", roundHalfEven, 1250, 12},
+		{"half-even half to odd", roundHalfEven, 1350, 14},
+		{"half-even above half", roundHalfEven, 1251, 13},
+		{"half-even negative half", roundHalfEven, -1350, -14},
+		{"down", roundDown, 1299, 12},
+		{"down negative", roundDown, -1299, -12},
+		{"up", roundUp, 1201, 13},
+		{"up whole", roundUp, 1200, 12},
+		{"up negative", roundUp, -1201, -13},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.mode.round(test.points); got != test.want {
+				t.Errorf("%s.round(%d) = %d, want %d", test.mode, test.points, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRoundingModeValidate(t *testing.T) {
+	tests := []struct {
+		mode    roundingMode
+		wantErr bool
+	}{
+		{roundHalfUp, false},
+		{roundHalfEven, false},
+		{roundDown, false},
+		{roundUp, false},
+		{"", true},
+		{"nearest", true},
+	}
+	for _, test := range tests {
+		t.Run(string(test.mode), func(t *testing.T) {
+			if err := test.mode.validate(); (err != nil) != test.wantErr {
+				t.Errorf("validate() = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestFractionalPoints(t *testing.T) {
+	tests := []struct {
+		points float64
+		want   centipoints
+	}{
+		{1.5, 150},
+		{0.125, 13},
+		{-2.25, -225},
+		{10, 1000},
+	}
+	for _, test := range tests {
+		if got := fractionalPoints(test.points); got != test.want {
+			t.Errorf("fractionalPoints(%v) = %d, want %d", test.points, got, test.want)
+		}
+	}
+}
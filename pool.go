@@ -0,0 +1,41 @@
+package main
+
+// Returned when the pool already has as much work running and queued as it allows.
+var errPoolSaturated = newClientError("server.busy")
+
+/*
+Bounds how much scoring work runs at once. Up to concurrency tasks run in
+their callers' goroutines while up to queueDepth more wait for a slot;
+anything beyond that is turned away immediately so bursts shed load
+instead of piling up against the store.
+*/
+type workerPool struct {
+	running chan struct{}
+	// holds a token for every running or waiting task
+	admitted chan struct{}
+}
+
+func newWorkerPool(concurrency int, queueDepth int) *workerPool {
+	concurrency = max(concurrency, 1)
+	queueDepth = max(queueDepth, 0)
+	return &workerPool{
+		running:  make(chan struct{}, concurrency),
+		admitted: make(chan struct{}, concurrency+queueDepth),
+	}
+}
+
+// Runs the task once a slot is free, or returns errPoolSaturated without running it.
+func (pool *workerPool) run(task func()) error {
+	select {
+	case pool.admitted <- struct{}{}:
+	default:
+		return errPoolSaturated
+	}
+	defer func() { <-pool.admitted }()
+
+	pool.running <- struct{}{}
+	defer func() { <-pool.running }()
+
+	task()
+	return nil
+}
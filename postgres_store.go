@@ -0,0 +1,1366 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// Channel receipt events are broadcast on between replicas.
+const receiptEventChannel = "receipt_events"
+
+// How many times a balance update is retried after losing a race with another replica.
+const balanceUpdateAttempts = 5
+
+var errBalanceConflict = errors.New("balance was updated concurrently")
+
+/*
+Keeps receipts and balances in PostgreSQL so any number of replicas can
+share them. Balances carry a version number and are only written when the
+version is unchanged since they were read, so concurrent updates from
+different replicas are retried rather than lost.
+*/
+type postgresStore struct {
+	db          *sql.DB
+	databaseURL string
+}
+
+/*
+Connects to postgres and, when migrate is set, applies any pending
+migrations. Otherwise the schema must already be up to date.
+*/
+func newPostgresStore(databaseURL string, migrate bool) (*postgresStore, error) {
+	db, err := sql.Open("pgx", databaseURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		return nil, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+
+	if migrate {
+		if err := migrateTo(db, -1); err != nil {
+			return nil, err
+		}
+	} else if err := checkSchemaVersion(db); err != nil {
+		return nil, err
+	}
+	return &postgresStore{db: db, databaseURL: databaseURL}, nil
+}
+
+// Fails unless every embedded migration has been applied.
+func checkSchemaVersion(db *sql.DB) error {
+	connection, err := db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	current, err := migrationVersion(connection)
+	if err != nil {
+		return err
+	}
+	latest, err := latestMigrationVersion()
+	if err != nil {
+		return err
+	}
+	if current != latest {
+		return fmt.Errorf("the database schema is at version %d but %d is needed, run: main migrate up", current, latest)
+	}
+	return nil
+}
+
+/*
+Routes the broker's events through postgres NOTIFY and delivers every
+notification to local subscribers, so streams on each replica see receipts
+processed by all of them.
+*/
+func (store *postgresStore) relayEvents(broker *eventBroker) {
+	broker.forward = func(event receiptEvent) error {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_, err = store.db.Exec(`SELECT pg_notify($1, $2)`, receiptEventChannel, string(payload))
+		return err
+	}
+
+	go func() {
+		for {
+			err := store.listenForEvents(broker)
+			log.Printf("Lost the receipt event listener, reconnecting: %v", err)
+			time.Sleep(time.Second)
+		}
+	}()
+}
+
+func (store *postgresStore) listenForEvents(broker *eventBroker) error {
+	background := context.Background()
+	connection, err := pgx.Connect(background, store.databaseURL)
+	if err != nil {
+		return err
+	}
+	defer connection.Close(background)
+
+	if _, err := connection.Exec(background, "LISTEN "+receiptEventChannel); err != nil {
+		return err
+	}
+	for {
+		notification, err := connection.WaitForNotification(background)
+		if err != nil {
+			return err
+		}
+		var event receiptEvent
+		if err := json.Unmarshal([]byte(notification.Payload), &event); err == nil {
+			broker.deliver(event)
+		}
+	}
+}
+
+func (store *postgresStore) SaveReceipt(record storedReceipt) (int, error) {
+	return retryBalanceConflicts(func() (int, error) {
+		return store.trySaveReceipt(record)
+	})
+}
+
+// Repeats an attempt that lost a race to update a balance, up to balanceUpdateAttempts times.
+func retryBalanceConflicts[T any](attempt func() (T, error)) (T, error) {
+	for count := 1; ; count++ {
+		result, err := attempt()
+		if !errors.Is(err, errBalanceConflict) || count == balanceUpdateAttempts {
+			return result, err
+		}
+	}
+}
+
+func (store *postgresStore) trySaveReceipt(record storedReceipt) (int, error) {
+	transaction, err := store.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer transaction.Rollback()
+
+	// take back the points from an earlier save of the same receipt
+	previous, err := scanStoredReceipt(transaction.QueryRow(
+		`SELECT `+receiptColumns+` FROM receipts WHERE id = $1 FOR UPDATE`, record.ID,
+	))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+	version, versionError := nextVersion(record, previous, err == nil)
+	if versionError != nil {
+		return 0, versionError
+	}
+	record.Version = version
+	record.ModifiedAt = wallClock.Now()
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case previous.counted():
+		if _, err := adjustBalance(
+			transaction, newLedgerEntry(previous.UserID, ledgerReceiptReplaced, -previous.Points, previous.ID),
+		); err != nil {
+			return 0, err
+		}
+		if err := adjustStats(transaction, previous, -1); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := upsertReceipt(transaction, record); err != nil {
+		return 0, err
+	}
+	if !record.counted() {
+		balance, err := readBalance(transaction, record.UserID)
+		if err != nil {
+			return 0, err
+		}
+		return balance, transaction.Commit()
+	}
+	if err := adjustStats(transaction, record, 1); err != nil {
+		return 0, err
+	}
+
+	balance, err := adjustBalance(transaction, receiptLedgerEntry(record, ledgerReceipt))
+	if err != nil {
+		return 0, err
+	}
+	return balance, transaction.Commit()
+}
+
+// Columns scanStoredReceipt expects, in order.
+const receiptColumns = `id, user_id, receipt, points, breakdown, processed_at, rules_version, variant, deleted_at,
+	status, review_reasons, merchant, version, channel, api_key, verification, modified_at`
+
+// A receipt's tags, as the expression migration 0017 indexes.
+const receiptTagsColumn = `coalesce(receipt->'tags', '[]'::jsonb)`
+
+// Condition selecting the receipts whose points count, see storedReceipt.counted.
+const countedReceipts = `deleted_at IS NULL AND status = ''`
+
+// Inserts the receipt, or replaces the stored copy of it.
+func upsertReceipt(transaction *sql.Tx, record storedReceipt) error {
+	receiptJSON, err := json.Marshal(record.Receipt)
+	if err != nil {
+		return err
+	}
+	breakdownJSON, err := json.Marshal(record.Breakdown)
+	if err != nil {
+		return err
+	}
+	reasonsJSON, err := json.Marshal(record.ReviewReasons)
+	if err != nil {
+		return err
+	}
+	merchantJSON, err := json.Marshal(record.Merchant)
+	if err != nil {
+		return err
+	}
+	verificationJSON, err := json.Marshal(record.Verification)
+	if err != nil {
+		return err
+	}
+	_, err = transaction.Exec(
+		`INSERT INTO receipts (`+receiptColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+		ON CONFLICT (id) DO UPDATE SET user_id = $2, receipt = $3, points = $4, breakdown = $5,
+			processed_at = $6, rules_version = $7, variant = $8, deleted_at = $9, status = $10,
+			review_reasons = $11, merchant = $12, version = $13, channel = $14, api_key = $15,
+			verification = $16, modified_at = $17`,
+		record.ID, record.UserID, receiptJSON, record.Points, breakdownJSON, record.ProcessedAt,
+		record.RulesVersion, record.Variant, record.DeletedAt, record.Status, reasonsJSON, merchantJSON,
+		record.Version, record.Channel, record.APIKey, verificationJSON, record.ModifiedAt,
+	)
+	return err
+}
+
+/*
+Applies a ledger entry to its user's balance if nobody else changed the
+balance since it was read, returning errBalanceConflict otherwise, and
+records the entry. Receipts without a user don't have a balance.
+*/
+func adjustBalance(transaction *sql.Tx, entry ledgerEntry) (int, error) {
+	if entry.UserID == "" {
+		return 0, nil
+	}
+
+	var balance int
+	var version int64
+	err := transaction.QueryRow(
+		`SELECT points, version FROM balances WHERE user_id = $1`, entry.UserID,
+	).Scan(&balance, &version)
+	var result sql.Result
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		result, err = transaction.Exec(
+			`INSERT INTO balances (user_id, points, version) VALUES ($1, $2, 1) ON CONFLICT DO NOTHING`,
+			entry.UserID, entry.Points,
+		)
+	case err == nil:
+		result, err = transaction.Exec(
+			`UPDATE balances SET points = $1, version = version + 1 WHERE user_id = $2 AND version = $3`,
+			balance+entry.Points, entry.UserID, version,
+		)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if changed, _ := result.RowsAffected(); changed == 0 {
+		return 0, errBalanceConflict
+	}
+
+	entry.Balance = balance + entry.Points
+	_, err = transaction.Exec(
+		`INSERT INTO ledger (id, at, user_id, kind, points, balance, receipt_id, reason, counterparty)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		entry.ID, entry.At, entry.UserID, entry.Kind, entry.Points, entry.Balance, entry.ReceiptID, entry.Reason,
+		entry.Counterparty,
+	)
+	return entry.Balance, err
+}
+
+// Adds the receipt to its hour's stats, or removes it when sign is -1.
+func adjustStats(transaction *sql.Tx, record storedReceipt, sign int) error {
+	hour := statsHour(record.ProcessedAt)
+	_, err := transaction.Exec(
+		`INSERT INTO receipt_stats (hour, receipts, points) VALUES ($1, $2, $3)
+		ON CONFLICT (hour) DO UPDATE SET receipts = receipt_stats.receipts + $2, points = receipt_stats.points + $3`,
+		hour, sign, sign*record.Points,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = transaction.Exec(
+		`INSERT INTO retailer_stats (hour, retailer, receipts, points) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (hour, retailer) DO UPDATE SET receipts = retailer_stats.receipts + $3,
+			points = retailer_stats.points + $4`,
+		hour, record.Receipt.Retailer, sign, sign*record.Points,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = transaction.Exec(
+		`INSERT INTO region_stats (hour, region, receipts, points) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (hour, region) DO UPDATE SET receipts = region_stats.receipts + $3,
+			points = region_stats.points + $4`,
+		hour, receiptRegion(record.Receipt), sign, sign*record.Points,
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, result := range record.Breakdown {
+		if result.Points == 0 {
+			continue
+		}
+		_, err := transaction.Exec(
+			`INSERT INTO rule_stats (hour, rule, hits, points) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (hour, rule) DO UPDATE SET hits = rule_stats.hits + $3, points = rule_stats.points + $4`,
+			hour, result.Rule, sign, sign*result.Points,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *postgresStore) GetReceipt(id string) (storedReceipt, error) {
+	row := store.db.QueryRow(
+		`SELECT `+receiptColumns+` FROM receipts WHERE id = $1 AND deleted_at IS NULL`, id,
+	)
+	record, err := scanStoredReceipt(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return storedReceipt{}, errReceiptNotFound
+	}
+	return record, err
+}
+
+func (store *postgresStore) DeleteReceipt(id string, owner string) (storedReceipt, error) {
+	return retryBalanceConflicts(func() (storedReceipt, error) {
+		return store.trySetDeleted(id, owner, true)
+	})
+}
+
+func (store *postgresStore) RestoreReceipt(id string, owner string) (storedReceipt, error) {
+	return retryBalanceConflicts(func() (storedReceipt, error) {
+		return store.trySetDeleted(id, owner, false)
+	})
+}
+
+// Moves a receipt into or out of the trash, along with its points and stats.
+func (store *postgresStore) trySetDeleted(id string, owner string, deleted bool) (storedReceipt, error) {
+	transaction, err := store.db.Begin()
+	if err != nil {
+		return storedReceipt{}, err
+	}
+	defer transaction.Rollback()
+
+	record, err := scanStoredReceipt(transaction.QueryRow(
+		`SELECT `+receiptColumns+` FROM receipts WHERE id = $1 FOR UPDATE`, id,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return storedReceipt{}, errReceiptNotFound
+	}
+	if err != nil {
+		return storedReceipt{}, err
+	}
+	// it's already where it's being moved to, or isn't the owner's
+	if (record.DeletedAt != nil) == deleted || owner != "" && record.UserID != owner {
+		return storedReceipt{}, errReceiptNotFound
+	}
+
+	sign, kind := 1, ledgerReceiptRestored
+	record.DeletedAt = nil
+	if deleted {
+		sign, kind = -1, ledgerReceiptDeleted
+		deletedAt := wallClock.Now()
+		record.DeletedAt = &deletedAt
+	}
+	record.Version++
+	record.ModifiedAt = wallClock.Now()
+	if _, err := transaction.Exec(
+		`UPDATE receipts SET deleted_at = $1, version = $2, modified_at = $3 WHERE id = $4`,
+		record.DeletedAt, record.Version, record.ModifiedAt, id,
+	); err != nil {
+		return storedReceipt{}, err
+	}
+	// receipts waiting for review or rejected never had their points counted
+	if record.Status != "" {
+		return record, transaction.Commit()
+	}
+	if _, err := adjustBalance(transaction, newLedgerEntry(record.UserID, kind, sign*record.Points, id)); err != nil {
+		return storedReceipt{}, err
+	}
+	if err := adjustStats(transaction, record, sign); err != nil {
+		return storedReceipt{}, err
+	}
+	return record, transaction.Commit()
+}
+
+func (store *postgresStore) ResolveReview(id string, approve bool) (storedReceipt, int, error) {
+	type resolution struct {
+		record  storedReceipt
+		balance int
+	}
+	resolved, err := retryBalanceConflicts(func() (resolution, error) {
+		transaction, err := store.db.Begin()
+		if err != nil {
+			return resolution{}, err
+		}
+		defer transaction.Rollback()
+
+		record, err := scanStoredReceipt(transaction.QueryRow(
+			`SELECT `+receiptColumns+` FROM receipts WHERE id = $1 AND deleted_at IS NULL AND status = $2 FOR UPDATE`,
+			id, reviewPending,
+		))
+		if errors.Is(err, sql.ErrNoRows) {
+			return resolution{}, errReceiptNotFound
+		}
+		if err != nil {
+			return resolution{}, err
+		}
+
+		record.Status = reviewRejected
+		if approve {
+			record.Status = ""
+		}
+		record.Version++
+		record.ModifiedAt = wallClock.Now()
+		if _, err := transaction.Exec(
+			`UPDATE receipts SET status = $1, version = $2, modified_at = $3 WHERE id = $4`,
+			record.Status, record.Version, record.ModifiedAt, id,
+		); err != nil {
+			return resolution{}, err
+		}
+		if !approve {
+			return resolution{record: record}, transaction.Commit()
+		}
+
+		if err := adjustStats(transaction, record, 1); err != nil {
+			return resolution{}, err
+		}
+		balance, err := adjustBalance(transaction, receiptLedgerEntry(record, ledgerReceiptApproved))
+		if err != nil {
+			return resolution{}, err
+		}
+		return resolution{record: record, balance: balance}, transaction.Commit()
+	})
+	return resolved.record, resolved.balance, err
+}
+
+func (store *postgresStore) PendingReview(limit int) ([]storedReceipt, error) {
+	rows, err := store.db.Query(
+		`SELECT `+receiptColumns+` FROM receipts WHERE deleted_at IS NULL AND status = $1
+		ORDER BY sequence LIMIT $2`, reviewPending, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []storedReceipt
+	for rows.Next() {
+		record, err := scanStoredReceipt(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+func (store *postgresStore) PendingReviewSince(userID string, since time.Time) ([]string, error) {
+	rows, err := store.db.Query(
+		`SELECT id FROM receipts WHERE user_id = $1 AND deleted_at IS NULL AND status = $2 AND processed_at >= $3`,
+		userID, reviewPending, since,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (store *postgresStore) TrashedReceipts(limit int) ([]storedReceipt, error) {
+	rows, err := store.db.Query(
+		`SELECT `+receiptColumns+` FROM receipts WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC LIMIT $1`,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []storedReceipt
+	for rows.Next() {
+		record, err := scanStoredReceipt(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+func (store *postgresStore) ListTrashedReceipts(after string, limit int) ([]storedReceipt, error) {
+	rows, err := store.db.Query(
+		`SELECT `+receiptColumns+` FROM receipts
+		WHERE id COLLATE "C" > $1 AND deleted_at IS NOT NULL
+		ORDER BY id COLLATE "C" LIMIT $2`, after, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make([]storedReceipt, 0, limit)
+	for rows.Next() {
+		record, err := scanStoredReceipt(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+func (store *postgresStore) PurgeTrash(before time.Time) (int, error) {
+	result, err := store.db.Exec(`DELETE FROM receipts WHERE deleted_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	purged, err := result.RowsAffected()
+	return int(purged), err
+}
+
+func (store *postgresStore) RemoveReceipt(id string) error {
+	_, err := retryBalanceConflicts(func() (struct{}, error) {
+		transaction, err := store.db.Begin()
+		if err != nil {
+			return struct{}{}, err
+		}
+		defer transaction.Rollback()
+
+		record, err := scanStoredReceipt(transaction.QueryRow(
+			`SELECT `+receiptColumns+` FROM receipts WHERE id = $1 FOR UPDATE`, id,
+		))
+		if errors.Is(err, sql.ErrNoRows) {
+			return struct{}{}, errReceiptNotFound
+		}
+		if err != nil {
+			return struct{}{}, err
+		}
+		if _, err := transaction.Exec(`DELETE FROM receipts WHERE id = $1`, id); err != nil {
+			return struct{}{}, err
+		}
+		if record.counted() {
+			if _, err := adjustBalance(
+				transaction, newLedgerEntry(record.UserID, ledgerReceiptMoved, -record.Points, id),
+			); err != nil {
+				return struct{}{}, err
+			}
+			if err := adjustStats(transaction, record, -1); err != nil {
+				return struct{}{}, err
+			}
+		}
+		return struct{}{}, transaction.Commit()
+	})
+	return err
+}
+
+func (store *postgresStore) RecentReceipts(limit int) ([]storedReceipt, error) {
+	rows, err := store.db.Query(
+		`SELECT `+receiptColumns+` FROM receipts WHERE deleted_at IS NULL ORDER BY sequence DESC LIMIT $1`, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make([]storedReceipt, 0, limit)
+	for rows.Next() {
+		record, err := scanStoredReceipt(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+func (store *postgresStore) ListReceipts(userID string, after string, limit int) ([]storedReceipt, error) {
+	// ids compare by byte, as migration 0018 indexes them, so shards merge in the same order
+	rows, err := store.db.Query(
+		`SELECT `+receiptColumns+` FROM receipts
+		WHERE id COLLATE "C" > $1 AND ($2 = '' OR user_id = $2) AND deleted_at IS NULL
+		ORDER BY id COLLATE "C" LIMIT $3`, after, userID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make([]storedReceipt, 0, limit)
+	for rows.Next() {
+		record, err := scanStoredReceipt(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+/*
+Counts everyone's receipts from the planner's estimate, which is cheap but
+includes the trash, and a user's exactly.
+*/
+func (store *postgresStore) CountReceipts(userID string) (int, bool, error) {
+	if userID == "" {
+		var estimate int
+		err := store.db.QueryRow(`SELECT reltuples::bigint FROM pg_class WHERE oid = 'receipts'::regclass`).Scan(&estimate)
+		// tables that were never analyzed have no estimate
+		if err != nil || estimate >= 0 {
+			return estimate, false, err
+		}
+	}
+	var count int
+	err := store.db.QueryRow(
+		`SELECT count(*) FROM receipts WHERE ($1 = '' OR user_id = $1) AND deleted_at IS NULL`, userID,
+	).Scan(&count)
+	return count, true, err
+}
+
+func (store *postgresStore) CountByPoints(lowerBounds []int) ([]int, error) {
+	counts := make([]int, len(lowerBounds))
+	for index, lower := range lowerBounds {
+		// the last bucket has no upper bound
+		upper := -1
+		if index+1 < len(lowerBounds) {
+			upper = lowerBounds[index+1]
+		}
+		err := store.db.QueryRow(
+			`SELECT count(*) FROM receipts WHERE `+countedReceipts+` AND points >= $1 AND ($2 < 0 OR points < $2)`,
+			lower, upper,
+		).Scan(&counts[index])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
+
+/*
+Matches the query's words against the receipts' search column, ranked by
+ts_rank_cd. The simple text search configuration doesn't stem words, like
+the in-memory index.
+*/
+func (store *postgresStore) Search(query string, tags []string, channel string, offset int, limit int) ([]searchHit, int, error) {
+	// receipts' tags are a JSON array, which contains the empty one too
+	tagsJSON, err := json.Marshal(append([]string{}, tags...))
+	if err != nil {
+		return nil, 0, err
+	}
+	rows, err := store.db.Query(
+		`SELECT `+receiptColumns+`, ts_rank_cd(search, query) AS rank, count(*) OVER ()
+		FROM receipts, plainto_tsquery('simple', $1) AS query
+		WHERE ($1 = '' OR search @@ query) AND `+receiptTagsColumn+` @> $4::jsonb AND ($5 = '' OR channel = $5)
+		AND deleted_at IS NULL
+		ORDER BY rank DESC, sequence DESC
+		LIMIT $2 OFFSET $3`, query, limit, offset, string(tagsJSON), channel,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var hits []searchHit
+	total := 0
+	for rows.Next() {
+		var hit searchHit
+		hit.Record, err = scanStoredReceipt(rows, &hit.Score, &total)
+		if err != nil {
+			return nil, 0, err
+		}
+		hits = append(hits, hit)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	// a page past the end has no rows to carry the total
+	if len(hits) == 0 && offset > 0 {
+		err = store.db.QueryRow(
+			`SELECT count(*) FROM receipts
+			WHERE ($1 = '' OR search @@ plainto_tsquery('simple', $1)) AND `+receiptTagsColumn+` @> $2::jsonb
+			AND ($3 = '' OR channel = $3) AND deleted_at IS NULL`,
+			query, string(tagsJSON), channel,
+		).Scan(&total)
+	}
+	return hits, total, err
+}
+
+func (store *postgresStore) RecordAudit(entry auditEntry) error {
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = store.db.Exec(
+		`INSERT INTO audit_log (id, at, receipt_id, user_id, entry) VALUES ($1, $2, $3, $4, $5)`,
+		entry.ID, entry.At, entry.ReceiptID, entry.UserID, entryJSON,
+	)
+	return err
+}
+
+func (store *postgresStore) AuditTrail(receiptID string, userID string, limit int) ([]auditEntry, error) {
+	rows, err := store.db.Query(
+		`SELECT entry FROM audit_log
+		WHERE ($1 = '' OR receipt_id = $1) AND ($2 = '' OR user_id = $2)
+		ORDER BY sequence DESC LIMIT $3`, receiptID, userID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []auditEntry
+	for rows.Next() {
+		var entryJSON []byte
+		if err := rows.Scan(&entryJSON); err != nil {
+			return nil, err
+		}
+		var entry auditEntry
+		if err := json.Unmarshal(entryJSON, &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (store *postgresStore) Profile(userID string) (userProfile, error) {
+	var profileJSON []byte
+	err := store.db.QueryRow(`SELECT profile FROM user_profiles WHERE user_id = $1`, userID).Scan(&profileJSON)
+	if errors.Is(err, sql.ErrNoRows) {
+		return defaultProfile(userID), nil
+	}
+	if err != nil {
+		return userProfile{}, err
+	}
+	var profile userProfile
+	return profile, json.Unmarshal(profileJSON, &profile)
+}
+
+func (store *postgresStore) SaveProfile(profile userProfile) error {
+	profileJSON, err := json.Marshal(profile)
+	if err != nil {
+		return err
+	}
+	_, err = store.db.Exec(
+		`INSERT INTO user_profiles (user_id, profile) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET profile = excluded.profile`,
+		profile.UserID, profileJSON,
+	)
+	return err
+}
+
+// Columns scanTransaction expects, in order.
+const transactionColumns = `merchant, transaction_id, total, total_cents, purchased_at, store_id, registered_at, receipt_id`
+
+func scanTransaction(row rowScanner) (merchantTransaction, error) {
+	var transaction merchantTransaction
+	err := row.Scan(
+		&transaction.Merchant, &transaction.TransactionID, &transaction.Total, &transaction.cents,
+		&transaction.PurchasedAt, &transaction.StoreID, &transaction.RegisteredAt, &transaction.ReceiptID,
+	)
+	transaction.PurchasedAt = transaction.PurchasedAt.UTC()
+	return transaction, err
+}
+
+func (store *postgresStore) RegisterTransaction(transaction merchantTransaction) error {
+	result, err := store.db.Exec(
+		`INSERT INTO merchant_transactions (`+transactionColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, '')
+		ON CONFLICT (merchant, transaction_id) DO NOTHING`,
+		transaction.Merchant, transaction.TransactionID, transaction.Total, transaction.cents,
+		transaction.PurchasedAt, transaction.StoreID, transaction.RegisteredAt,
+	)
+	if err != nil {
+		return err
+	}
+	inserted, err := result.RowsAffected()
+	if err == nil && inserted == 0 {
+		return errTransactionExists
+	}
+	return err
+}
+
+func (store *postgresStore) Transaction(merchant string, transactionID string) (merchantTransaction, error) {
+	transaction, err := scanTransaction(store.db.QueryRow(
+		`SELECT `+transactionColumns+` FROM merchant_transactions WHERE merchant = $1 AND transaction_id = $2`,
+		merchant, transactionID,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return merchantTransaction{}, errTransactionNotFound
+	}
+	return transaction, err
+}
+
+func (store *postgresStore) ClaimTransaction(match transactionMatch) (merchantTransaction, error) {
+	transaction, err := store.db.Begin()
+	if err != nil {
+		return merchantTransaction{}, err
+	}
+	defer transaction.Rollback()
+
+	if _, err := transaction.Exec(
+		`UPDATE merchant_transactions SET receipt_id = '' WHERE receipt_id = $1`, match.ReceiptID,
+	); err != nil {
+		return merchantTransaction{}, err
+	}
+	// locked, so two receipts can't claim the same transaction
+	rows, err := transaction.Query(
+		`SELECT `+transactionColumns+` FROM merchant_transactions
+		WHERE merchant = $1 AND total_cents = $2 AND purchased_at BETWEEN $3 AND $4 AND receipt_id = ''
+		FOR UPDATE`,
+		match.Merchant, match.Cents,
+		match.PurchasedAt.Add(-transactionTimeTolerance), match.PurchasedAt.Add(transactionTimeTolerance),
+	)
+	if err != nil {
+		return merchantTransaction{}, err
+	}
+	defer rows.Close()
+	var candidates []merchantTransaction
+	for rows.Next() {
+		candidate, err := scanTransaction(rows)
+		if err != nil {
+			return merchantTransaction{}, err
+		}
+		candidates = append(candidates, candidate)
+	}
+	if err := rows.Err(); err != nil {
+		return merchantTransaction{}, err
+	}
+
+	claimed, found := match.best(candidates)
+	if !found {
+		// the receipt's earlier claim stays released
+		if err := transaction.Commit(); err != nil {
+			return merchantTransaction{}, err
+		}
+		return merchantTransaction{}, errTransactionNotFound
+	}
+	if _, err := transaction.Exec(
+		`UPDATE merchant_transactions SET receipt_id = $3 WHERE merchant = $1 AND transaction_id = $2`,
+		claimed.Merchant, claimed.TransactionID, match.ReceiptID,
+	); err != nil {
+		return merchantTransaction{}, err
+	}
+	claimed.ReceiptID = match.ReceiptID
+	return claimed, transaction.Commit()
+}
+
+func (store *postgresStore) ReleaseTransaction(receiptID string) error {
+	_, err := store.db.Exec(`UPDATE merchant_transactions SET receipt_id = '' WHERE receipt_id = $1`, receiptID)
+	return err
+}
+
+func (store *postgresStore) Stats(since time.Time) (receiptStats, error) {
+	var stats receiptStats
+	err := store.db.QueryRow(
+		`SELECT coalesce(sum(receipts), 0), coalesce(sum(points), 0) FROM receipt_stats WHERE hour >= $1`, since,
+	).Scan(&stats.Receipts, &stats.TotalPoints)
+	if err != nil {
+		return receiptStats{}, err
+	}
+
+	rows, err := store.db.Query(
+		`SELECT retailer, sum(receipts), sum(points) FROM retailer_stats
+		WHERE hour >= $1 GROUP BY retailer HAVING sum(receipts) > 0`, since,
+	)
+	if err != nil {
+		return receiptStats{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var retailer retailerStats
+		if err := rows.Scan(&retailer.Retailer, &retailer.Receipts, &retailer.Points); err != nil {
+			return receiptStats{}, err
+		}
+		stats.Retailers = append(stats.Retailers, retailer)
+	}
+	if err := rows.Err(); err != nil {
+		return receiptStats{}, err
+	}
+
+	regionRows, err := store.db.Query(
+		`SELECT region, sum(receipts), sum(points) FROM region_stats
+		WHERE hour >= $1 GROUP BY region HAVING sum(receipts) > 0`, since,
+	)
+	if err != nil {
+		return receiptStats{}, err
+	}
+	defer regionRows.Close()
+	for regionRows.Next() {
+		var region regionStats
+		if err := regionRows.Scan(&region.Region, &region.Receipts, &region.Points); err != nil {
+			return receiptStats{}, err
+		}
+		stats.Regions = append(stats.Regions, region)
+	}
+	if err := regionRows.Err(); err != nil {
+		return receiptStats{}, err
+	}
+
+	ruleRows, err := store.db.Query(
+		`SELECT rule, sum(hits), sum(points) FROM rule_stats
+		WHERE hour >= $1 GROUP BY rule HAVING sum(hits) > 0`, since,
+	)
+	if err != nil {
+		return receiptStats{}, err
+	}
+	defer ruleRows.Close()
+	for ruleRows.Next() {
+		var rule ruleStats
+		if err := ruleRows.Scan(&rule.Rule, &rule.Hits, &rule.Points); err != nil {
+			return receiptStats{}, err
+		}
+		stats.Rules = append(stats.Rules, rule)
+	}
+	return stats, ruleRows.Err()
+}
+
+func (store *postgresStore) Rollup(start time.Time, end time.Time) (report, error) {
+	var rollup report
+	err := store.db.QueryRow(
+		`SELECT count(*), coalesce(sum(points), 0), count(DISTINCT NULLIF(user_id, ''))
+		FROM receipts WHERE processed_at >= $1 AND processed_at < $2 AND `+countedReceipts+``, start, end,
+	).Scan(&rollup.Receipts, &rollup.Points, &rollup.Users)
+	if err != nil {
+		return report{}, err
+	}
+
+	rows, err := store.db.Query(
+		`SELECT receipt->>'retailer', count(*), sum(points), count(DISTINCT NULLIF(user_id, ''))
+		FROM receipts WHERE processed_at >= $1 AND processed_at < $2 AND `+countedReceipts+`
+		GROUP BY 1 ORDER BY 1`, start, end,
+	)
+	if err != nil {
+		return report{}, err
+	}
+	defer rows.Close()
+
+	rollup.Retailers = []reportRetailer{}
+	for rows.Next() {
+		var retailer reportRetailer
+		if err := rows.Scan(&retailer.Retailer, &retailer.Receipts, &retailer.Points, &retailer.Users); err != nil {
+			return report{}, err
+		}
+		rollup.Retailers = append(rollup.Retailers, retailer)
+	}
+	return rollup, rows.Err()
+}
+
+func (store *postgresStore) SaveReport(saved report) error {
+	retailersJSON, err := json.Marshal(saved.Retailers)
+	if err != nil {
+		return err
+	}
+	_, err = store.db.Exec(
+		`INSERT INTO reports (period, start_at, end_at, receipts, points, users, retailers, generated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (period, start_at) DO UPDATE SET end_at = $3, receipts = $4, points = $5, users = $6,
+			retailers = $7, generated_at = $8`,
+		saved.Period, saved.Start, saved.End, saved.Receipts, saved.Points, saved.Users, retailersJSON,
+		saved.GeneratedAt,
+	)
+	return err
+}
+
+func (store *postgresStore) Reports(period string, from time.Time, to time.Time) ([]report, error) {
+	rows, err := store.db.Query(
+		`SELECT period, start_at, end_at, receipts, points, users, retailers, generated_at FROM reports
+		WHERE period = $1 AND start_at >= $2 AND start_at < $3 ORDER BY start_at`, period, from, to,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reports []report
+	for rows.Next() {
+		var saved report
+		var retailersJSON []byte
+		err := rows.Scan(
+			&saved.Period, &saved.Start, &saved.End, &saved.Receipts, &saved.Points, &saved.Users,
+			&retailersJSON, &saved.GeneratedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(retailersJSON, &saved.Retailers); err != nil {
+			return nil, err
+		}
+		reports = append(reports, saved)
+	}
+	return reports, rows.Err()
+}
+
+func (store *postgresStore) VariantStats() ([]variantStats, error) {
+	rows, err := store.db.Query(
+		`SELECT variant, count(*), count(DISTINCT NULLIF(user_id, '')), sum(points), avg(points)
+		FROM receipts WHERE ` + countedReceipts + ` GROUP BY variant ORDER BY variant`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []variantStats
+	for rows.Next() {
+		var stats variantStats
+		err := rows.Scan(&stats.Variant, &stats.Receipts, &stats.Users, &stats.TotalPoints, &stats.AveragePoints)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, stats)
+	}
+	return results, rows.Err()
+}
+
+func (store *postgresStore) Balance(userID string) (int, error) {
+	return readBalance(store.db, userID)
+}
+
+// Either the database or a transaction.
+type rowQuerier interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func readBalance(querier rowQuerier, userID string) (int, error) {
+	var balance int
+	err := querier.QueryRow(`SELECT points FROM balances WHERE user_id = $1`, userID).Scan(&balance)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return balance, err
+}
+
+func (store *postgresStore) ListBalances(after string, limit int) ([]userBalance, error) {
+	rows, err := store.db.Query(
+		`SELECT user_id, points FROM balances WHERE user_id COLLATE "C" > $1
+		ORDER BY user_id COLLATE "C" LIMIT $2`, after, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	balances := make([]userBalance, 0, limit)
+	for rows.Next() {
+		var balance userBalance
+		if err := rows.Scan(&balance.UserID, &balance.Points); err != nil {
+			return nil, err
+		}
+		balances = append(balances, balance)
+	}
+	return balances, rows.Err()
+}
+
+func (store *postgresStore) AdjustBalance(entry ledgerEntry) (ledgerEntry, error) {
+	return retryBalanceConflicts(func() (ledgerEntry, error) {
+		transaction, err := store.db.Begin()
+		if err != nil {
+			return ledgerEntry{}, err
+		}
+		defer transaction.Rollback()
+
+		entry.Balance, err = adjustBalance(transaction, entry)
+		if err != nil {
+			return ledgerEntry{}, err
+		}
+		return entry, transaction.Commit()
+	})
+}
+
+func (store *postgresStore) MovePoints(entries ...ledgerEntry) ([]ledgerEntry, error) {
+	return retryBalanceConflicts(func() ([]ledgerEntry, error) {
+		transaction, err := store.db.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer transaction.Rollback()
+
+		applied := make([]ledgerEntry, len(entries))
+		for index, entry := range entries {
+			entry.Balance, err = adjustBalance(transaction, entry)
+			if err != nil {
+				return nil, err
+			}
+			if entry.Points < 0 && entry.Balance < 0 {
+				return nil, errInsufficientPoints
+			}
+			applied[index] = entry
+		}
+		return applied, transaction.Commit()
+	})
+}
+
+func (store *postgresStore) DonationTotals() ([]charityTotal, error) {
+	rows, err := store.db.Query(
+		`SELECT counterparty, count(*), count(DISTINCT user_id), -sum(points) FROM ledger
+		WHERE kind = $1 GROUP BY counterparty ORDER BY counterparty`, ledgerDonation,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := []charityTotal{}
+	for rows.Next() {
+		var total charityTotal
+		if err := rows.Scan(&total.Charity, &total.Donations, &total.Donors, &total.Points); err != nil {
+			return nil, err
+		}
+		totals = append(totals, total)
+	}
+	return totals, rows.Err()
+}
+
+const ledgerColumns = `id, at, user_id, kind, points, balance, receipt_id, reason, counterparty`
+
+func (store *postgresStore) Ledger(userID string, limit int) ([]ledgerEntry, error) {
+	rows, err := store.db.Query(
+		`SELECT `+ledgerColumns+` FROM ledger WHERE user_id = $1 ORDER BY sequence DESC LIMIT $2`, userID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanLedgerEntries(rows)
+}
+
+func (store *postgresStore) LedgerSince(userID string, kind string, since time.Time) ([]ledgerEntry, error) {
+	rows, err := store.db.Query(
+		`SELECT `+ledgerColumns+` FROM ledger
+		WHERE user_id = $1 AND kind = $2 AND at >= $3 ORDER BY sequence`, userID, kind, since,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanLedgerEntries(rows)
+}
+
+func scanLedgerEntries(rows *sql.Rows) ([]ledgerEntry, error) {
+	defer rows.Close()
+
+	var entries []ledgerEntry
+	for rows.Next() {
+		var entry ledgerEntry
+		err := rows.Scan(
+			&entry.ID, &entry.At, &entry.UserID, &entry.Kind, &entry.Points, &entry.Balance,
+			&entry.ReceiptID, &entry.Reason, &entry.Counterparty,
+		)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (store *postgresStore) Export(visit func(entry snapshotEntry) error) error {
+	// a repeatable read transaction sees one snapshot across both queries
+	transaction, err := store.db.BeginTx(
+		context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true},
+	)
+	if err != nil {
+		return err
+	}
+	defer transaction.Rollback()
+
+	rows, err := transaction.Query(
+		`SELECT ` + receiptColumns + ` FROM receipts ORDER BY sequence`,
+	)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		record, err := scanStoredReceipt(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if err := visit(snapshotEntry{Receipt: &record}); err != nil {
+			rows.Close()
+			return err
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = transaction.Query(`SELECT user_id, points FROM balances ORDER BY user_id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var balance userBalance
+		if err := rows.Scan(&balance.UserID, &balance.Points); err != nil {
+			return err
+		}
+		if err := visit(snapshotEntry{Balance: &balance}); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (store *postgresStore) Import(next func() (snapshotEntry, error)) error {
+	transaction, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer transaction.Rollback()
+
+	if _, err := transaction.Exec(`TRUNCATE receipts, balances, receipt_stats, retailer_stats, region_stats, rule_stats, reports, ledger`); err != nil {
+		return err
+	}
+	for {
+		entry, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if entry.Receipt != nil {
+			if err := upsertReceipt(transaction, *entry.Receipt); err != nil {
+				return err
+			}
+			if !entry.Receipt.counted() {
+				continue
+			}
+			if err := adjustStats(transaction, *entry.Receipt, 1); err != nil {
+				return err
+			}
+		}
+		if balance := entry.Balance; balance != nil {
+			// the restored balance starts the user's ledger over
+			opening := newLedgerEntry(balance.UserID, ledgerOpening, balance.Points, "")
+			if _, err := adjustBalance(transaction, opening); err != nil {
+				return err
+			}
+		}
+	}
+	return transaction.Commit()
+}
+
+func (store *postgresStore) Merge(entries []snapshotEntry) error {
+	_, err := retryBalanceConflicts(func() (struct{}, error) {
+		transaction, err := store.db.Begin()
+		if err != nil {
+			return struct{}{}, err
+		}
+		defer transaction.Rollback()
+
+		for _, entry := range entries {
+			if record := entry.Receipt; record != nil {
+				previous, err := scanStoredReceipt(transaction.QueryRow(
+					`SELECT `+receiptColumns+` FROM receipts WHERE id = $1 FOR UPDATE`, record.ID,
+				))
+				if err != nil && !errors.Is(err, sql.ErrNoRows) {
+					return struct{}{}, err
+				}
+				if err == nil && previous.counted() {
+					if err := adjustStats(transaction, previous, -1); err != nil {
+						return struct{}{}, err
+					}
+				}
+				if err := upsertReceipt(transaction, *record); err != nil {
+					return struct{}{}, err
+				}
+				if record.counted() {
+					if err := adjustStats(transaction, *record, 1); err != nil {
+						return struct{}{}, err
+					}
+				}
+			}
+			if balance := entry.Balance; balance != nil {
+				points, err := readBalance(transaction, balance.UserID)
+				if err != nil {
+					return struct{}{}, err
+				}
+				if points == balance.Points {
+					continue
+				}
+				opening := newLedgerEntry(balance.UserID, ledgerOpening, balance.Points-points, "")
+				if _, err := adjustBalance(transaction, opening); err != nil {
+					return struct{}{}, err
+				}
+			}
+		}
+		return struct{}{}, transaction.Commit()
+	})
+	return err
+}
+
+// Either a single row or one row of a result set.
+type rowScanner interface {
+	Scan(destinations ...any) error
+}
+
+/*
+Scans the receiptColumns of a row, followed by any extra columns the query
+selected into extras.
+*/
+func scanStoredReceipt(row rowScanner, extras ...any) (storedReceipt, error) {
+	var record storedReceipt
+	var receiptJSON, breakdownJSON, reasonsJSON, merchantJSON, verificationJSON []byte
+	destinations := []any{
+		&record.ID, &record.UserID, &receiptJSON, &record.Points, &breakdownJSON, &record.ProcessedAt,
+		&record.RulesVersion, &record.Variant, &record.DeletedAt, &record.Status, &reasonsJSON, &merchantJSON,
+		&record.Version, &record.Channel, &record.APIKey, &verificationJSON, &record.ModifiedAt,
+	}
+	err := row.Scan(append(destinations, extras...)...)
+	if err != nil {
+		return storedReceipt{}, err
+	}
+	if err := json.Unmarshal(receiptJSON, &record.Receipt); err != nil {
+		return storedReceipt{}, err
+	}
+	if err := json.Unmarshal(breakdownJSON, &record.Breakdown); err != nil {
+		return storedReceipt{}, err
+	}
+	if err := json.Unmarshal(reasonsJSON, &record.ReviewReasons); err != nil {
+		return storedReceipt{}, err
+	}
+	if err := json.Unmarshal(merchantJSON, &record.Merchant); err != nil {
+		return storedReceipt{}, err
+	}
+	if err := json.Unmarshal(verificationJSON, &record.Verification); err != nil {
+		return storedReceipt{}, err
+	}
+	return record, nil
+}
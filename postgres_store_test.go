@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// Every table the store writes, emptied before each test against a real database.
+const testTables = `receipts, balances, receipt_stats, retailer_stats, rule_stats, reports, audit_log, ledger,
+	user_profiles, region_stats, merchant_transactions`
+
+/*
+Connects to the database at TEST_DATABASE_URL, migrating it and emptying
+its tables, or skips the test when that isn't set. Point it at a database
+kept for tests: whatever it has is lost.
+*/
+func newTestPostgresStore(t *testing.T) *postgresStore {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL isn't set")
+	}
+	store, err := newPostgresStore(url, true)
+	if err != nil {
+		t.Fatalf("newPostgresStore() failed: %v", err)
+	}
+	t.Cleanup(func() { store.db.Close() })
+	if _, err := store.db.Exec("TRUNCATE " + testTables); err != nil {
+		t.Fatalf("failed to empty the tables: %v", err)
+	}
+	return store
+}
+
+func TestPostgresStore(t *testing.T) {
+	checkStore(t, newTestPostgresStore(t))
+}
+
+// The memory store keeps to the same contract, so checkStore is checked without a database too.
+func TestMemoryStoreContract(t *testing.T) {
+	checkStore(t, newMemoryStore())
+}
+
+// Checks what every Store promises about receipts and balances, on an empty store.
+func checkStore(t *testing.T, store Store) {
+	// postgres keeps microseconds
+	processed := time.Now().UTC().Truncate(time.Millisecond)
+	save := func(record storedReceipt) int {
+		t.Helper()
+		record.ProcessedAt = processed
+		balance, err := store.SaveReceipt(record)
+		if err != nil {
+			t.Fatalf("SaveReceipt(%s) failed: %v", record.ID, err)
+		}
+		return balance
+	}
+	balance := func(userID string) int {
+		t.Helper()
+		points, err := store.Balance(userID)
+		if err != nil {
+			t.Fatalf("Balance(%s) failed: %v", userID, err)
+		}
+		return points
+	}
+
+	if got := save(storedReceipt{ID: "first", UserID: "alice", Points: 28}); got != 28 {
+		t.Errorf("SaveReceipt() = %d, want a balance of 28", got)
+	}
+	record, err := store.GetReceipt("first")
+	if err != nil {
+		t.Fatalf("GetReceipt() failed: %v", err)
+	}
+	if record.UserID != "alice" || record.Points != 28 || !record.ProcessedAt.Equal(processed) || record.ModifiedAt.IsZero() {
+		t.Errorf("GetReceipt() = %+v, want alice's 28 points processed at %s", record, processed)
+	}
+	// saving it again replaces its points rather than adding them
+	if got := save(storedReceipt{ID: "first", UserID: "alice", Points: 30}); got != 30 {
+		t.Errorf("resaving SaveReceipt() = %d, want a balance of 30", got)
+	}
+	if _, err := store.GetReceipt("missing"); !errors.Is(err, errReceiptNotFound) {
+		t.Errorf("GetReceipt() of a missing receipt = %v, want errReceiptNotFound", err)
+	}
+
+	// a held receipt's points wait for its review
+	save(storedReceipt{ID: "held", UserID: "alice", Points: 50, Status: reviewPending})
+	if got := balance("alice"); got != 30 {
+		t.Errorf("balance with a receipt held for review is %d, want 30", got)
+	}
+	if _, resolved, err := store.ResolveReview("held", true); err != nil || resolved != 80 {
+		t.Errorf("ResolveReview() = %d, %v, want a balance of 80", resolved, err)
+	}
+	if _, _, err := store.ResolveReview("held", true); !errors.Is(err, errReceiptNotFound) {
+		t.Errorf("resolving a review twice = %v, want errReceiptNotFound", err)
+	}
+
+	if _, err := store.DeleteReceipt("first", "bob"); !errors.Is(err, errReceiptNotFound) {
+		t.Errorf("bob's DeleteReceipt() of alice's receipt = %v, want errReceiptNotFound", err)
+	}
+	if _, err := store.DeleteReceipt("first", "alice"); err != nil {
+		t.Fatalf("DeleteReceipt() failed: %v", err)
+	}
+	if _, err := store.GetReceipt("first"); !errors.Is(err, errReceiptNotFound) {
+		t.Errorf("GetReceipt() of a trashed receipt = %v, want errReceiptNotFound", err)
+	}
+	if got := balance("alice"); got != 50 {
+		t.Errorf("balance after trashing a receipt is %d, want 50", got)
+	}
+	if trashed, _ := store.TrashedReceipts(10); len(trashed) != 1 || trashed[0].ID != "first" {
+		t.Errorf("TrashedReceipts() = %v, want the trashed receipt", trashed)
+	}
+	if _, err := store.RestoreReceipt("first", ""); err != nil {
+		t.Fatalf("RestoreReceipt() failed: %v", err)
+	}
+	if got := balance("alice"); got != 80 {
+		t.Errorf("balance after restoring a receipt is %d, want 80", got)
+	}
+
+	for index := 0; index < 5; index++ {
+		save(storedReceipt{ID: fmt.Sprintf("bob-%d", index), UserID: "bob", Points: 10})
+	}
+	page, err := store.ListReceipts("bob", "bob-1", 2)
+	if err != nil || len(page) != 2 || page[0].ID != "bob-2" || page[1].ID != "bob-3" {
+		t.Errorf("ListReceipts() after bob-1 = %v, %v, want bob-2 and bob-3", page, err)
+	}
+
+	if _, err := store.MovePoints(newLedgerEntry("bob", ledgerDonation, -60, "")); !errors.Is(err, errInsufficientPoints) {
+		t.Errorf("overspending MovePoints() = %v, want errInsufficientPoints", err)
+	}
+	transfer := []ledgerEntry{newLedgerEntry("bob", ledgerAdjustment, -20, ""), newLedgerEntry("carol", ledgerAdjustment, 20, "")}
+	if _, err := store.MovePoints(transfer...); err != nil {
+		t.Fatalf("MovePoints() failed: %v", err)
+	}
+	if bob, carol := balance("bob"), balance("carol"); bob != 30 || carol != 20 {
+		t.Errorf("after moving 20 points bob has %d and carol %d, want 30 and 20", bob, carol)
+	}
+	if entries, _ := store.Ledger("carol", 10); len(entries) != 1 || entries[0].Points != 20 || entries[0].Balance != 20 {
+		t.Errorf("carol's ledger is %+v, want the 20 points she got", entries)
+	}
+
+	balances, err := store.ListBalances("", 10)
+	if err != nil || len(balances) != 3 || balances[0].UserID != "alice" || balances[2].Points != 20 {
+		t.Errorf("ListBalances() = %+v, %v, want alice, bob and carol's", balances, err)
+	}
+	// merging a snapshot sets balances without counting the receipts' points again
+	merged := storedReceipt{ID: "merged", UserID: "alice", Points: 5, ProcessedAt: processed}
+	entries := []snapshotEntry{{Receipt: &merged}, {Balance: &userBalance{UserID: "alice", Points: 100}}}
+	for attempt := 0; attempt < 2; attempt++ {
+		if err := store.Merge(entries); err != nil {
+			t.Fatalf("Merge() failed: %v", err)
+		}
+	}
+	if got := balance("alice"); got != 100 {
+		t.Errorf("balance after merging is %d, want the snapshot's 100", got)
+	}
+	if _, err := store.GetReceipt("merged"); err != nil {
+		t.Errorf("GetReceipt() of a merged receipt failed: %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// What the service knows about a user, and how they want to hear from it.
+type userProfile struct {
+	UserID string `json:"userId"`
+	Email  string `json:"email,omitempty"`
+	// device registration tokens for push notifications
+	PushTokens []string `json:"pushTokens,omitempty"`
+	// language notifications are written in, e.g. "es"
+	Language      string                  `json:"language,omitempty"`
+	Notifications notificationPreferences `json:"notifications"`
+}
+
+/*
+Which notifications a user gets and where. Nothing is sent until the user
+picks at least one channel.
+*/
+type notificationPreferences struct {
+	// any of "email", "push" and "webhook"
+	Channels        []string `json:"channels"`
+	PointsAwarded   bool     `json:"pointsAwarded"`
+	PointsExpiring  bool     `json:"pointsExpiring"`
+	Redemptions     bool     `json:"redemptions"`
+	ReceiptRejected bool     `json:"receiptRejected"`
+}
+
+// The profile of a user who hasn't saved one.
+func defaultProfile(userID string) userProfile {
+	return userProfile{
+		UserID: userID,
+		Notifications: notificationPreferences{
+			Channels:        []string{},
+			PointsAwarded:   true,
+			PointsExpiring:  true,
+			Redemptions:     true,
+			ReceiptRejected: true,
+		},
+	}
+}
+
+// Returns the caller's profile.
+func getProfile(context *gin.Context) {
+	userID := submittingUser(context)
+	if userID == "" {
+		respondWithMessage(context, http.StatusBadRequest, "profile.user_required")
+		return
+	}
+	profile, err := receiptStore(context).Profile(userID)
+	if err != nil {
+		respondWithMessage(context, http.StatusInternalServerError, "profile.lookup_failed")
+		return
+	}
+	context.IndentedJSON(http.StatusOK, profile)
+}
+
+// Replaces the caller's profile, including their notification preferences.
+func putProfile(context *gin.Context) {
+	userID := submittingUser(context)
+	if userID == "" {
+		respondWithMessage(context, http.StatusBadRequest, "profile.user_required")
+		return
+	}
+	profile := defaultProfile(userID)
+	if err := context.BindJSON(&profile); err != nil {
+		respondWithMessage(context, http.StatusBadRequest, "profile.bind_failed")
+		return
+	}
+	profile.UserID = userID
+	profile.Email = strings.TrimSpace(profile.Email)
+	for _, channel := range profile.Notifications.Channels {
+		if _, known := notificationChannels[channel]; !known {
+			respondWithMessage(context, http.StatusBadRequest, "profile.channel_unknown", channel)
+			return
+		}
+	}
+
+	if err := receiptStore(context).SaveProfile(profile); err != nil {
+		log.Printf("Failed to save the profile of %s: %v", userID, err)
+		respondWithMessage(context, http.StatusInternalServerError, "profile.save_failed")
+		return
+	}
+	context.IndentedJSON(http.StatusOK, profile)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+A digital receipt read from the QR code a retailer printed on it. Payload is
+the decoded text of the code; the retailer and items can be filled in when
+the format doesn't carry them.
+*/
+type qrSubmission struct {
+	Payload  string `json:"payload"`
+	Retailer string `json:"retailer"`
+	Items    []Item `json:"items"`
+}
+
+/*
+Maps one digital-receipt format to a Receipt, returning false when the
+payload isn't in that format.
+*/
+type qrFormat struct {
+	Name  string
+	parse func(payload string) (Receipt, bool)
+}
+
+// The digital-receipt formats QR payloads are tried against, in order.
+var qrFormats = []qrFormat{
+	{Name: "receipt", parse: parseJSONReceiptCode},
+	{Name: "fns", parse: parseFNSCode},
+	{Name: "rksv", parse: parseRKSVCode},
+}
+
+/*
+Scores a receipt from a QR code. The format is detected from the payload and
+the response says which it was, along with the receipt it mapped to.
+*/
+func scanQRCode(context *gin.Context) {
+	if strings.HasPrefix(context.ContentType(), "image/") {
+		respondWithMessage(context, http.StatusUnsupportedMediaType, "qr.image_unsupported")
+		return
+	}
+	var submission qrSubmission
+	if err := decodeJSON(context.Request.Body, &submission, "qr.bind_failed"); err != nil {
+		respondWithError(context, http.StatusBadRequest, err)
+		return
+	}
+
+	receipt, format, recognized := decodeQRPayload(strings.TrimSpace(submission.Payload))
+	if !recognized {
+		respondWithMessage(context, http.StatusBadRequest, "qr.format_unknown")
+		return
+	}
+	if receipt.Retailer == "" {
+		receipt.Retailer = submission.Retailer
+	}
+	if len(receipt.Items) == 0 {
+		receipt.Items = submission.Items
+	}
+
+	record, processError := processReceipt(processingFor(context), receipt, submittingUser(context), channelQR)
+	if processError != nil {
+		respondWithProcessError(context, processError)
+		return
+	}
+	response := gin.H{
+		"id":      record.ID,
+		"format":  format,
+		"receipt": receipt,
+		"points":  record.Points,
+		"links":   receiptLinks(record.ID),
+	}
+	if record.Status != "" {
+		response["status"] = record.Status
+	}
+	if capped := record.capsApplied(); capped != nil {
+		response["capped"] = capped
+	}
+	context.IndentedJSON(http.StatusCreated, response)
+}
+
+// Maps a payload to a receipt with the first format that recognizes it.
+func decodeQRPayload(payload string) (Receipt, string, bool) {
+	for _, format := range qrFormats {
+		if receipt, recognized := format.parse(payload); recognized {
+			return receipt, format.Name, true
+		}
+	}
+	return Receipt{}, "", false
+}
+
+// Our own receipt JSON, which some retailers encode as is.
+func parseJSONReceiptCode(payload string) (Receipt, bool) {
+	var receipt Receipt
+	if !strings.HasPrefix(payload, "{") || json.Unmarshal([]byte(payload), &receipt) != nil {
+		return Receipt{}, false
+	}
+	return receipt, true
+}
+
+/*
+Russian fiscal receipts (54-FZ), a query string like
+t=20240102T1530&s=35.35&fn=...&i=...&fp=...&n=1 where t is the time of
+purchase and s the total. The code doesn't name the retailer.
+*/
+func parseFNSCode(payload string) (Receipt, bool) {
+	values, err := url.ParseQuery(payload)
+	if err != nil || !values.Has("t") || !values.Has("s") || !values.Has("fn") {
+		return Receipt{}, false
+	}
+	var purchased time.Time
+	for _, layout := range []string{"20060102T150405", "20060102T1504"} {
+		if purchased, err = time.Parse(layout, values.Get("t")); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return Receipt{}, false
+	}
+	return Receipt{
+		Date:  purchased.Format("2006-01-02"),
+		Time:  purchased.Format("15:04"),
+		Total: values.Get("s"),
+	}, true
+}
+
+/*
+Austrian cash register receipts (RKSV), underscore-separated fields starting
+with the algorithm, like _R1-AT1_<cash box>_<receipt number>_<date and
+time>_<amount at each of five VAT rates>_... The total is the sum of the five
+amounts, which use decimal commas. The cash box id stands in for the retailer.
+*/
+func parseRKSVCode(payload string) (Receipt, bool) {
+	fields := strings.Split(payload, "_")
+	if len(fields) < 10 || fields[0] != "" || !strings.HasPrefix(fields[1], "R1-") {
+		return Receipt{}, false
+	}
+	purchased, err := time.Parse("2006-01-02T15:04:05", fields[4])
+	if err != nil {
+		return Receipt{}, false
+	}
+	// whole cents, so the amounts add up exactly
+	cents := int64(0)
+	for _, amount := range fields[5:10] {
+		value, err := strconv.ParseFloat(strings.ReplaceAll(amount, ",", "."), 64)
+		if err != nil {
+			return Receipt{}, false
+		}
+		cents += int64(math.Round(value * 100))
+	}
+	return Receipt{
+		Retailer: fields[2],
+		Date:     purchased.Format("2006-01-02"),
+		Time:     purchased.Format("15:04"),
+		Total:    strconv.FormatFloat(float64(cents)/100, 'f', 2, 64),
+	}, true
+}
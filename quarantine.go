@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Review states of a flagged receipt, see storedReceipt.Status.
+const (
+	reviewPending  = "pending_review"
+	reviewRejected = "rejected"
+)
+
+const (
+	auditReceiptApproved = "receipt.approved"
+	auditReceiptRejected = "receipt.rejected"
+)
+
+// Number of receipts the review queue lists.
+const reviewQueueLimit = 100
+
+/*
+When a receipt looks suspicious enough to hold for review, rather than
+awarding its points straight away. Zero values turn a check off.
+*/
+type ReviewConfig struct {
+	// flag receipts scoring at least this many points
+	MinPoints int
+	// flag receipts whose total is more than this
+	MaxTotal float64
+	// flag receipts whose item prices don't add up to the total
+	CheckItemTotal bool
+}
+
+// Global policy for flagging receipts for review
+var reviewPolicy ReviewConfig
+
+// Reasons the receipt should be reviewed, if any.
+func (policy ReviewConfig) check(receipt parsedReceipt, points int) []string {
+	var reasons []string
+	if policy.MinPoints > 0 && points >= policy.MinPoints {
+		reasons = append(reasons, fmt.Sprintf("scored %d points, the review threshold is %d", points, policy.MinPoints))
+	}
+	if policy.MaxTotal > 0 && receipt.total > policy.MaxTotal {
+		reasons = append(reasons, fmt.Sprintf("total %.2f is over %.2f", receipt.total, policy.MaxTotal))
+	}
+	if policy.CheckItemTotal {
+		itemTotal := 0.0
+		for _, item := range receipt.receipt.Items {
+			price, err := strconv.ParseFloat(item.Price, 64)
+			if err != nil {
+				reasons = append(reasons, fmt.Sprintf("item price %q isn't a number", item.Price))
+				return reasons
+			}
+			itemTotal += price
+		}
+		if math.Abs(itemTotal-receipt.total) >= 0.005 {
+			reasons = append(reasons, fmt.Sprintf("items add up to %.2f, not the total %.2f", itemTotal, receipt.total))
+		}
+	}
+	return reasons
+}
+
+// Lists the receipts waiting for review, oldest first.
+func getReviewQueue(context *gin.Context) {
+	pending, err := receipts.PendingReview(reviewQueueLimit)
+	if err != nil {
+		respondWithMessage(context, http.StatusInternalServerError, "review.lookup_failed")
+		return
+	}
+	if pending == nil {
+		pending = []storedReceipt{}
+	}
+	context.IndentedJSON(http.StatusOK, gin.H{"pendingReceipts": pending})
+}
+
+/*
+Approves or rejects a receipt in the review queue. Approving credits the
+points it scored when it was submitted. Either way the submitting user's
+subscribers are told, and the decision goes in the audit trail with the
+optional reason.
+*/
+func resolveReview(approve bool) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		var request struct {
+			Reason string `json:"reason"`
+		}
+		if context.Request.ContentLength > 0 {
+			if err := context.BindJSON(&request); err != nil {
+				respondWithMessage(context, http.StatusBadRequest, "review.bind_failed")
+				return
+			}
+		}
+
+		record, balance, err := receipts.ResolveReview(context.Param("id"), approve)
+		if errors.Is(err, errReceiptNotFound) {
+			respondWithMessage(context, http.StatusNotFound, "review.not_pending")
+			return
+		}
+		if updateConflict(err) {
+			respondWithConflict(context, err)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to resolve the review of receipt %s: %v", context.Param("id"), err)
+			respondWithMessage(context, http.StatusInternalServerError, "receipt.save_failed")
+			return
+		}
+		invalidatePoints(record.ID)
+
+		action, outcome := auditReceiptRejected, "rejected"
+		if approve {
+			action, outcome = auditReceiptApproved, "approved"
+		}
+		recordAudit(context, auditEntry{
+			Action: action, ReceiptID: record.ID, UserID: record.UserID, Points: record.Points, Reason: request.Reason,
+		})
+		event := receiptEvent{
+			ID:       record.ID,
+			UserID:   record.UserID,
+			Retailer: record.Receipt.Retailer,
+			Review:   outcome,
+		}
+		if approve {
+			event.Points = record.Points
+			event.Balance = balance
+		}
+		receiptEvents.publish(event)
+		if approve {
+			notifyPointsAwardedFor(record, balance)
+		} else {
+			notifyUser(notification{
+				Kind: notifyReceiptRejected, UserID: record.UserID, ReceiptID: record.ID,
+				Args: []any{record.Receipt.Retailer},
+			})
+		}
+
+		response := gin.H{"id": record.ID, "review": outcome, "points": event.Points}
+		if approve && record.UserID != "" {
+			response["balance"] = balance
+		}
+		context.IndentedJSON(http.StatusOK, response)
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Header partners send their API key in.
+const apiKeyHeader = "X-API-Key"
+
+// Key the caller's API key is stored under in the gin context.
+const apiKeyContextKey = "apiKey"
+
+/*
+Quotas are enforced for the API keys listed in KeysFile, and off without
+one. Usage is counted in Counter: "memory", which each replica keeps for
+itself, or "redis" at REDIS_URL, which replicas share.
+*/
+type QuotaConfig struct {
+	KeysFile string
+	Counter  string
+}
+
+/*
+A partner's API key, and how many receipts it may submit each UTC day and
+calendar month; 0 is no limit. Keys naming a Merchant belong to a retailer,
+which registers its transactions with them.
+*/
+type apiKey struct {
+	Name         string `json:"name"`
+	Key          string `json:"key"`
+	DailyQuota   int    `json:"dailyQuota"`
+	MonthlyQuota int    `json:"monthlyQuota"`
+	Merchant     string `json:"merchant,omitempty"`
+}
+
+// One of an API key's quotas as of now.
+type quotaUsage struct {
+	Period    string    `json:"period"`
+	Limit     int       `json:"limit"`
+	Used      int       `json:"used"`
+	Remaining int       `json:"remaining"`
+	ResetsAt  time.Time `json:"resetsAt"`
+
+	// the counter holding the period's usage
+	counter string
+	// header names' suffix, e.g. X-Quota-Remaining-Day
+	header string
+}
+
+/*
+Counts API keys' usage per period. Counters expire once their period is
+over, so they don't need clearing out.
+*/
+type quotaCounter interface {
+	// Adds delta to the counter, returning its new value.
+	add(counter string, delta int, expiry time.Time) (int, error)
+}
+
+var errQuotaCheckFailed = newClientError("quota.check_failed")
+
+// Meters submissions made with the API keys it knows, by the keys' hashes.
+type quotaMeter struct {
+	keys    map[[sha256.Size]byte]apiKey
+	counter quotaCounter
+}
+
+// Reads the API keys file and opens the counter, or returns nil when quotas are off.
+func newQuotaMeter(config QuotaConfig, redisURL string) (*quotaMeter, error) {
+	if config.KeysFile == "" {
+		return nil, nil
+	}
+	contents, err := os.ReadFile(config.KeysFile)
+	if err != nil {
+		return nil, err
+	}
+	var keys []apiKey
+	if err := json.Unmarshal(contents, &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse API keys file %s: %w", config.KeysFile, err)
+	}
+
+	meter := &quotaMeter{keys: make(map[[sha256.Size]byte]apiKey)}
+	names := make(map[string]bool)
+	for index, key := range keys {
+		if key.Name == "" || names[key.Name] {
+			return nil, fmt.Errorf("API key %d needs a unique name", index)
+		}
+		names[key.Name] = true
+		if key.Key == "" || key.DailyQuota < 0 || key.MonthlyQuota < 0 {
+			return nil, fmt.Errorf("API key %s needs a key and quotas of 0 or more", key.Name)
+		}
+		meter.keys[sha256.Sum256([]byte(key.Key))] = key
+	}
+
+	switch config.Counter {
+	case "memory":
+		meter.counter = &memoryQuotaCounter{counts: make(map[string]expiringCount)}
+	case "redis":
+		client, err := openRedis(redisURL, "QUOTA_COUNTER=redis")
+		if err != nil {
+			return nil, err
+		}
+		meter.counter = redisQuotaCounter{client: client}
+	default:
+		return nil, errors.New("unknown QUOTA_COUNTER: " + config.Counter)
+	}
+	return meter, nil
+}
+
+// The key's quotas that have a limit, for the periods containing now.
+func (key apiKey) quotas(now time.Time) []quotaUsage {
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	var quotas []quotaUsage
+	if key.DailyQuota > 0 {
+		quotas = append(quotas, quotaUsage{
+			Period:   "day",
+			Limit:    key.DailyQuota,
+			ResetsAt: day.AddDate(0, 0, 1),
+			counter:  "quota:" + key.Name + ":day:" + day.Format("2006-01-02"),
+			header:   "Day",
+		})
+	}
+	if key.MonthlyQuota > 0 {
+		quotas = append(quotas, quotaUsage{
+			Period:   "month",
+			Limit:    key.MonthlyQuota,
+			ResetsAt: month.AddDate(0, 1, 0),
+			counter:  "quota:" + key.Name + ":month:" + month.Format("2006-01"),
+			header:   "Month",
+		})
+	}
+	return quotas
+}
+
+// Adds delta submissions to each of the key's quotas for the periods containing at, returning their usage.
+func (meter *quotaMeter) record(key apiKey, delta int, at time.Time) ([]quotaUsage, error) {
+	quotas := key.quotas(at)
+	for index := range quotas {
+		quota := &quotas[index]
+		used, err := meter.counter.add(quota.counter, delta, quota.ResetsAt)
+		if err != nil {
+			return nil, err
+		}
+		quota.Used = used
+		quota.Remaining = max(quota.Limit-used, 0)
+	}
+	return quotas, nil
+}
+
+// The API key the caller sent, if they sent one.
+func callerKey(context *gin.Context) (apiKey, bool) {
+	value, exists := context.Get(apiKeyContextKey)
+	if !exists {
+		return apiKey{}, false
+	}
+	return value.(apiKey), true
+}
+
+// The API key with the name, for receipts that were submitted with it earlier.
+func (meter *quotaMeter) named(name string) (apiKey, bool) {
+	if meter == nil {
+		return apiKey{}, false
+	}
+	for _, key := range meter.keys {
+		if key.Name == name {
+			return key, true
+		}
+	}
+	return apiKey{}, false
+}
+
+/*
+Counts a submission against each of the key's quotas. When that's more than
+one allows it's uncounted again and returned as exceeded, with the usage
+as it was before.
+*/
+func (meter *quotaMeter) charge(key apiKey, now time.Time) (quotas []quotaUsage, exceeded *quotaUsage, err error) {
+	if quotas, err = meter.record(key, 1, now); err != nil {
+		return nil, nil, err
+	}
+	for _, quota := range quotas {
+		if quota.Used <= quota.Limit {
+			continue
+		}
+		if uncounted, err := meter.record(key, -1, now); err == nil {
+			quotas = uncounted
+		}
+		return quotas, &quota, nil
+	}
+	return quotas, nil, nil
+}
+
+/*
+Uncounts a submission that failed, so partners aren't billed for it, from
+the periods it was charged to.
+*/
+func (meter *quotaMeter) refund(key apiKey, chargedAt time.Time) {
+	if _, err := meter.record(key, -1, chargedAt); err != nil {
+		log.Printf("Failed to uncount a failed submission from API key %s: %v", key.Name, err)
+	}
+}
+
+// The error a submission beyond the quota is refused with.
+func quotaExceededError(language string, quota quotaUsage) error {
+	return newClientError(
+		"quota.exceeded", translate(language, "quota.period."+quota.Period), quota.Limit,
+		quota.ResetsAt.Format(time.RFC3339),
+	)
+}
+
+/*
+Counts a receipt submitted outside the consume middleware, like one sent
+over a WebSocket or in a batch, against the caller's API key, returning a
+function that uncounts it again if the receipt fails. Callers without a
+key, or without quotas configured, aren't counted.
+*/
+func (meter *quotaMeter) chargeReceipt(context *gin.Context) (func(), error) {
+	key, exists := callerKey(context)
+	if meter == nil || !exists {
+		return func() {}, nil
+	}
+	return meter.chargeKey(key, requestLanguage(context))
+}
+
+/*
+Counts a receipt against the key's quotas, returning a function that
+uncounts it again. The errors are client errors in the language, for when
+a quota is used up or can't be checked.
+*/
+func (meter *quotaMeter) chargeKey(key apiKey, language string) (func(), error) {
+	now := wallClock.Now()
+	_, exceeded, err := meter.charge(key, now)
+	if err != nil {
+		log.Printf("Failed to count a submission against API key %s: %v", key.Name, err)
+		return nil, errQuotaCheckFailed
+	}
+	if exceeded != nil {
+		return nil, quotaExceededError(language, *exceeded)
+	}
+	return func() { meter.refund(key, now) }, nil
+}
+
+func setQuotaHeaders(context *gin.Context, quotas []quotaUsage) {
+	for _, quota := range quotas {
+		context.Header("X-Quota-Limit-"+quota.header, strconv.Itoa(quota.Limit))
+		context.Header("X-Quota-Remaining-"+quota.header, strconv.Itoa(quota.Remaining))
+		context.Header("X-Quota-Reset-"+quota.header, strconv.FormatInt(quota.ResetsAt.Unix(), 10))
+	}
+}
+
+/*
+Middleware recognizing the caller's API key, if they send one, and telling
+them how much of its quotas remain. Unknown keys are refused.
+*/
+func (meter *quotaMeter) identify() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		presented := context.GetHeader(apiKeyHeader)
+		if presented == "" {
+			context.Next()
+			return
+		}
+		key, known := meter.keys[sha256.Sum256([]byte(presented))]
+		if !known {
+			abortWithMessage(context, http.StatusUnauthorized, "quota.key_unknown")
+			return
+		}
+		context.Set(apiKeyContextKey, key)
+
+		quotas, err := meter.record(key, 0, wallClock.Now())
+		if err != nil {
+			log.Printf("Failed to read the quotas of API key %s: %v", key.Name, err)
+		} else {
+			setQuotaHeaders(context, quotas)
+		}
+		context.Next()
+	}
+}
+
+/*
+Middleware counting a submission against the caller's API key, refusing it
+with 429 once a quota is used up. Submissions that fail aren't counted, so
+partners are only billed for the receipts they got points for. Batches
+hold many receipts, so processBatch counts them one by one instead.
+*/
+func (meter *quotaMeter) consume() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		key, exists := callerKey(context)
+		if !exists {
+			context.Next()
+			return
+		}
+
+		now := wallClock.Now()
+		quotas, exceeded, err := meter.charge(key, now)
+		if err != nil {
+			log.Printf("Failed to count a submission against API key %s: %v", key.Name, err)
+			abortWithMessage(context, http.StatusServiceUnavailable, "quota.check_failed")
+			return
+		}
+		setQuotaHeaders(context, quotas)
+		if exceeded != nil {
+			context.Header("Retry-After", strconv.Itoa(int(time.Until(exceeded.ResetsAt).Seconds())+1))
+			respondWithError(context, http.StatusTooManyRequests, quotaExceededError(requestLanguage(context), *exceeded))
+			context.Abort()
+			return
+		}
+
+		context.Next()
+		if context.Writer.Status() >= http.StatusBadRequest {
+			meter.refund(key, now)
+		}
+	}
+}
+
+// Reports the caller's API key quotas.
+func (meter *quotaMeter) getQuota(context *gin.Context) {
+	key, exists := callerKey(context)
+	if !exists {
+		respondWithMessage(context, http.StatusUnauthorized, "quota.key_required")
+		return
+	}
+	quotas, err := meter.record(key, 0, wallClock.Now())
+	if err != nil {
+		log.Printf("Failed to read the quotas of API key %s: %v", key.Name, err)
+		respondWithMessage(context, http.StatusServiceUnavailable, "quota.check_failed")
+		return
+	}
+	if quotas == nil {
+		quotas = []quotaUsage{}
+	}
+	context.IndentedJSON(http.StatusOK, gin.H{"key": key.Name, "quotas": quotas})
+}
+
+type expiringCount struct {
+	value  int
+	expiry time.Time
+}
+
+type memoryQuotaCounter struct {
+	mutex  sync.Mutex
+	counts map[string]expiringCount
+	// when expired counters were last cleared out
+	swept time.Time
+}
+
+func (counter *memoryQuotaCounter) add(name string, delta int, expiry time.Time) (int, error) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(counter.swept) > time.Hour {
+		for key, count := range counter.counts {
+			if now.After(count.expiry) {
+				delete(counter.counts, key)
+			}
+		}
+		counter.swept = now
+	}
+
+	count := counter.counts[name]
+	count.value += delta
+	count.expiry = expiry
+	counter.counts[name] = count
+	return count.value, nil
+}
+
+type redisQuotaCounter struct {
+	client *redis.Client
+}
+
+func (counter redisQuotaCounter) add(name string, delta int, expiry time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	pipeline := counter.client.TxPipeline()
+	value := pipeline.IncrBy(ctx, name, int64(delta))
+	pipeline.ExpireAt(ctx, name, expiry)
+	if _, err := pipeline.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return int(value.Val()), nil
+}
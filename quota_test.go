@@ -0,0 +1,143 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestQuotaMeter() *quotaMeter {
+	return &quotaMeter{counter: &memoryQuotaCounter{counts: make(map[string]expiringCount)}}
+}
+
+func TestAPIKeyQuotas(t *testing.T) {
+	now := time.Date(2024, time.February, 29, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name        string
+		key         apiKey
+		wantPeriods []string
+		wantResets  []time.Time
+	}{
+		{"no limits", apiKey{Name: "acme"}, nil, nil},
+		{"daily", apiKey{Name: "acme", DailyQuota: 10}, []string{"day"}, []time.Time{
+			time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC),
+		}},
+		{"daily and monthly", apiKey{Name: "acme", DailyQuota: 10, MonthlyQuota: 100}, []string{"day", "month"}, []time.Time{
+			time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC),
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			quotas := test.key.quotas(now)
+			if len(quotas) != len(test.wantPeriods) {
+				t.Fatalf("quotas() has %d periods, want %d", len(quotas), len(test.wantPeriods))
+			}
+			for index, quota := range quotas {
+				if quota.Period != test.wantPeriods[index] || !quota.ResetsAt.Equal(test.wantResets[index]) {
+					t.Errorf("quota %d = %s resetting at %s, want %s resetting at %s",
+						index, quota.Period, quota.ResetsAt, test.wantPeriods[index], test.wantResets[index])
+				}
+			}
+		})
+	}
+}
+
+func TestQuotaMeterCharge(t *testing.T) {
+	now := time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name         string
+		key          apiKey
+		charges      int
+		wantExceeded string
+		wantUsed     []int
+	}{
+		{"under the limit", apiKey{Name: "acme", DailyQuota: 3}, 2, "", []int{2}},
+		{"up to the limit", apiKey{Name: "acme", DailyQuota: 3}, 3, "", []int{3}},
+		{"past the daily limit", apiKey{Name: "acme", DailyQuota: 3}, 4, "day", []int{3}},
+		{"past the monthly limit", apiKey{Name: "acme", DailyQuota: 5, MonthlyQuota: 2}, 3, "month", []int{2, 2}},
+		{"no limits", apiKey{Name: "acme"}, 5, "", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			meter := newTestQuotaMeter()
+			var quotas []quotaUsage
+			var exceeded *quotaUsage
+			for charge := 0; charge < test.charges; charge++ {
+				var err error
+				if quotas, exceeded, err = meter.charge(test.key, now); err != nil {
+					t.Fatalf("charge() failed: %v", err)
+				}
+			}
+			switch {
+			case test.wantExceeded == "" && exceeded != nil:
+				t.Errorf("charge() exceeded the %s quota, want it allowed", exceeded.Period)
+			case test.wantExceeded != "" && (exceeded == nil || exceeded.Period != test.wantExceeded):
+				t.Errorf("charge() exceeded %v, want the %s quota", exceeded, test.wantExceeded)
+			}
+			if len(quotas) != len(test.wantUsed) {
+				t.Fatalf("charge() reported %d quotas, want %d", len(quotas), len(test.wantUsed))
+			}
+			for index, quota := range quotas {
+				if quota.Used != test.wantUsed[index] || quota.Remaining != quota.Limit-test.wantUsed[index] {
+					t.Errorf("%s quota used %d with %d remaining, want %d used", quota.Period, quota.Used, quota.Remaining, test.wantUsed[index])
+				}
+			}
+		})
+	}
+}
+
+func TestQuotaMeterRefund(t *testing.T) {
+	key := apiKey{Name: "acme", DailyQuota: 1}
+	tests := []struct {
+		name      string
+		chargedAt time.Time
+		refundAt  time.Time
+		wantUsed  int
+	}{
+		// the refund comes out of the day the submission was charged to
+		{"same day", time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC), time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC), 0},
+		{"charged the day before", time.Date(2024, time.May, 1, 23, 59, 0, 0, time.UTC), time.Date(2024, time.May, 2, 0, 1, 0, 0, time.UTC), 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			meter := newTestQuotaMeter()
+			if _, exceeded, err := meter.charge(key, test.chargedAt); err != nil || exceeded != nil {
+				t.Fatalf("charge() = %v, %v, want it allowed", exceeded, err)
+			}
+			meter.refund(key, test.chargedAt)
+			quotas, err := meter.record(key, 0, test.chargedAt)
+			if err != nil {
+				t.Fatalf("record() failed: %v", err)
+			}
+			if quotas[0].Used != test.wantUsed {
+				t.Errorf("used %d after the refund, want %d", quotas[0].Used, test.wantUsed)
+			}
+			if _, exceeded, _ := meter.charge(key, test.chargedAt); exceeded != nil {
+				t.Errorf("charge() after the refund exceeded the quota, want it allowed")
+			}
+		})
+	}
+}
+
+func TestQuotaMeterNamed(t *testing.T) {
+	meter := newTestQuotaMeter()
+	meter.keys = map[[32]byte]apiKey{{1}: {Name: "acme", Key: "k1"}}
+	tests := []struct {
+		name      string
+		meter     *quotaMeter
+		key       string
+		wantFound bool
+	}{
+		{"known", meter, "acme", true},
+		{"unknown", meter, "globex", false},
+		{"quotas off", nil, "acme", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key, found := test.meter.named(test.key)
+			if found != test.wantFound || found && key.Name != test.key {
+				t.Errorf("named(%q) = %q, %v, want found %v", test.key, key.Name, found, test.wantFound)
+			}
+		})
+	}
+}
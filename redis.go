@@ -0,0 +1,23 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// How long a Redis command may take before whatever needed it gives up.
+const redisTimeout = 2 * time.Second
+
+// Connects to the Redis at REDIS_URL, which features needing shared state across replicas use.
+func openRedis(url string, neededBy string) (*redis.Client, error) {
+	if url == "" {
+		return nil, errors.New(neededBy + " needs REDIS_URL")
+	}
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return redis.NewClient(options), nil
+}
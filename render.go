@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed templates/*.html
+var templateFiles embed.FS
+
+// Template the receipt is rendered with, embedded unless its directory overrides it.
+const receiptTemplateName = "receipt.html"
+
+// Global template for rendered receipts, see loadRenderTemplate.
+var receiptTemplate *template.Template
+
+// What the receipt template is executed with.
+type receiptView struct {
+	Record    storedReceipt
+	Language  string
+	Generated time.Time
+}
+
+/*
+Parses the receipt template, taking receipt.html from dir when it has one
+so deployments can brand the rendered receipts without a rebuild.
+Templates can call message with a locale code for text in the caller's
+language.
+*/
+func loadRenderTemplate(dir string) (*template.Template, error) {
+	contents, err := templateFiles.ReadFile("templates/" + receiptTemplateName)
+	if err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		override, err := os.ReadFile(filepath.Join(dir, receiptTemplateName))
+		if err == nil {
+			contents = override
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	parsed, err := template.New(receiptTemplateName).
+		Funcs(template.FuncMap{"message": func(code string) string { return code }}).
+		Parse(string(contents))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the receipt template: %w", err)
+	}
+	return parsed, nil
+}
+
+/*
+Renders the receipt and its points breakdown as an HTML page, or as a PDF
+with ?format=pdf (or Accept: application/pdf), for attaching to disputes.
+*/
+func renderReceipt(context *gin.Context) {
+	record, found := receiptForBlob(context)
+	if !found {
+		return
+	}
+	view := receiptView{Record: record, Language: requestLanguage(context), Generated: wallClock.Now().UTC()}
+	context.Header("Content-Language", view.Language)
+
+	format := context.Query("format")
+	if format == "" && strings.Contains(context.GetHeader("Accept"), "application/pdf") {
+		format = "pdf"
+	}
+	switch format {
+	case "", "html":
+		page, err := executeReceiptTemplate(view)
+		if err != nil {
+			respondWithMessage(context, http.StatusInternalServerError, "render.failed")
+			return
+		}
+		context.Data(http.StatusOK, "text/html; charset=utf-8", page)
+	case "pdf":
+		context.Header("Content-Disposition", fmt.Sprintf(`inline; filename="receipt-%s.pdf"`, record.ID))
+		context.Data(http.StatusOK, "application/pdf", writePDF(receiptLines(view)))
+	default:
+		respondWithMessage(context, http.StatusBadRequest, "render.format_invalid", format)
+	}
+}
+
+func executeReceiptTemplate(view receiptView) ([]byte, error) {
+	page, err := receiptTemplate.Clone()
+	if err != nil {
+		return nil, err
+	}
+	page.Funcs(template.FuncMap{
+		"message": func(code string) string { return translate(view.Language, code) },
+	})
+	var rendered bytes.Buffer
+	if err := page.Execute(&rendered, view); err != nil {
+		return nil, err
+	}
+	return rendered.Bytes(), nil
+}
+
+// Lays the receipt out as lines of fixed-width text for the PDF.
+func receiptLines(view receiptView) []string {
+	record := view.Record
+	message := func(code string) string { return translate(view.Language, code) }
+	row := func(label string, value any) string {
+		return fmt.Sprintf("%-56.56s %15v", label, value)
+	}
+
+	lines := []string{record.Receipt.Retailer, record.Receipt.Date + " " + record.Receipt.Time}
+	if record.Merchant != nil {
+		lines = append(lines, record.Merchant.Name+" "+record.Merchant.Category)
+	}
+	lines = append(lines, message("render.receipt")+" "+record.ID)
+	if record.UserID != "" {
+		lines = append(lines, message("render.user")+" "+record.UserID)
+	}
+	if record.Status != "" {
+		lines = append(lines, record.Status)
+	}
+
+	lines = append(lines, "", row(message("render.item"), message("render.price")), strings.Repeat("-", 72))
+	for _, item := range record.Receipt.Items {
+		lines = append(lines, row(item.Description, item.Price))
+	}
+	lines = append(lines, row(message("render.total"), record.Receipt.Total))
+
+	lines = append(lines, "", row(message("render.rule"), message("render.points")), strings.Repeat("-", 72))
+	for _, result := range record.Breakdown {
+		label := result.Rule
+		if result.Detail != "" {
+			label += " (" + result.Detail + ")"
+		}
+		lines = append(lines, row(label, result.Points))
+	}
+	lines = append(lines, row(message("render.points_total"), record.Points), "",
+		message("render.rules_version")+" "+record.RulesVersion,
+		message("render.processed")+" "+record.ProcessedAt.UTC().Format("2006-01-02 15:04 MST"),
+		message("render.generated")+" "+view.Generated.Format("2006-01-02 15:04 MST"),
+	)
+	return lines
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+Signed submissions' nonces are remembered for Window, which should be at
+least twice SIGNATURE_MAX_SKEW so a replay can't outlast it; 0 turns the
+check off. NonceCache is "memory" or "redis" at REDIS_URL.
+*/
+type ReplayConfig struct {
+	Window     time.Duration
+	NonceCache string
+}
+
+/*
+Remembers the nonces of signed submissions for the replay window, so a
+captured submission can't be sent again while its timestamp is still
+accepted. A submission's nonce is its X-Signature-Nonce header, or its
+signature when it doesn't send one.
+*/
+type nonceCache interface {
+	// Records the nonce for ttl, reporting whether it was already recorded.
+	seen(nonce string, ttl time.Duration) (bool, error)
+}
+
+/*
+Opens the nonce cache SIGNATURE_NONCE_CACHE names: "memory", which only
+protects a single instance, or "redis" at REDIS_URL, which replicas share.
+*/
+func openNonceCache(config Config) (nonceCache, error) {
+	switch config.Replay.NonceCache {
+	case "memory":
+		if config.ClusterMode {
+			log.Print("Replicas don't share the memory nonce cache; set SIGNATURE_NONCE_CACHE=redis to catch " +
+				"submissions replayed to another replica")
+		}
+		return newMemoryNonceCache(), nil
+	case "redis":
+		client, err := openRedis(config.RedisURL, "SIGNATURE_NONCE_CACHE=redis")
+		if err != nil {
+			return nil, err
+		}
+		return redisNonceCache{client: client}, nil
+	}
+	return nil, errors.New("unknown SIGNATURE_NONCE_CACHE: " + config.Replay.NonceCache)
+}
+
+type memoryNonceCache struct {
+	mutex    sync.Mutex
+	expiries map[string]time.Time
+	// when expired nonces were last cleared out
+	swept time.Time
+}
+
+func newMemoryNonceCache() *memoryNonceCache {
+	return &memoryNonceCache{expiries: make(map[string]time.Time), swept: time.Now()}
+}
+
+func (cache *memoryNonceCache) seen(nonce string, ttl time.Duration) (bool, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(cache.swept) > time.Minute {
+		for key, expiry := range cache.expiries {
+			if now.After(expiry) {
+				delete(cache.expiries, key)
+			}
+		}
+		cache.swept = now
+	}
+
+	if expiry, exists := cache.expiries[nonce]; exists && now.Before(expiry) {
+		return true, nil
+	}
+	cache.expiries[nonce] = now.Add(ttl)
+	return false, nil
+}
+
+type redisNonceCache struct {
+	client *redis.Client
+}
+
+func (cache redisNonceCache) seen(nonce string, ttl time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	// only the first replica to record the nonce gets to set it
+	recorded, err := cache.client.SetNX(ctx, "signature-nonce:"+nonce, 1, ttl).Result()
+	if err != nil {
+		return false, err
+	}
+	return !recorded, nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/csv"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+A daily or weekly rollup of the receipts processed in [Start, End). Reports
+are generated on a schedule once their period is over and kept in the
+store, so reading them never touches the receipts.
+*/
+type report struct {
+	Period      string           `json:"period"`
+	Start       time.Time        `json:"start"`
+	End         time.Time        `json:"end"`
+	Receipts    int              `json:"receipts"`
+	Points      int              `json:"points"`
+	Users       int              `json:"users"`
+	Retailers   []reportRetailer `json:"retailers"`
+	GeneratedAt time.Time        `json:"generatedAt"`
+}
+
+type reportRetailer struct {
+	Retailer string `json:"retailer"`
+	Receipts int    `json:"receipts"`
+	Points   int    `json:"points"`
+	Users    int    `json:"users"`
+}
+
+// The report periods, by the name used in /reports routes.
+var reportPeriods = map[string]string{
+	"daily":  "day",
+	"weekly": "week",
+}
+
+// How far back the scheduler fills in reports that are missing.
+const reportBackfill = 35 * 24 * time.Hour
+
+// Start of the UTC day or week (starting Monday) containing moment.
+func periodStart(period string, moment time.Time) time.Time {
+	year, month, day := moment.UTC().Date()
+	start := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	if period == "week" {
+		// days since Monday
+		start = start.AddDate(0, 0, -((int(start.Weekday()) + 6) % 7))
+	}
+	return start
+}
+
+func periodEnd(period string, start time.Time) time.Time {
+	if period == "week" {
+		return start.AddDate(0, 0, 7)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// Totals the receipts processed in one period and saves the report.
+func generateReport(period string, start time.Time) (report, error) {
+	end := periodEnd(period, start)
+	rollup, err := receipts.Rollup(start, end)
+	if err != nil {
+		return report{}, err
+	}
+	rollup.Period = period
+	rollup.Start = start
+	rollup.End = end
+	rollup.GeneratedAt = wallClock.Now()
+	return rollup, receipts.SaveReport(rollup)
+}
+
+/*
+Generates the reports for finished periods in the backfill window that
+aren't in the store yet. Replicas may race to generate the same report,
+which just saves it twice.
+*/
+func generateMissingReports(now time.Time) error {
+	for _, period := range []string{"day", "week"} {
+		current := periodStart(period, now)
+		oldest := periodStart(period, now.Add(-reportBackfill))
+		existing, err := receipts.Reports(period, oldest, current)
+		if err != nil {
+			return err
+		}
+		generated := make(map[time.Time]bool)
+		for _, saved := range existing {
+			generated[saved.Start.UTC()] = true
+		}
+
+		for start := oldest; start.Before(current); start = periodEnd(period, start) {
+			if generated[start] {
+				continue
+			}
+			if _, err := generateReport(period, start); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Runs generateMissingReports now and then every interval.
+func scheduleReports(interval time.Duration) {
+	go func() {
+		for {
+			if err := generateMissingReports(wallClock.Now()); err != nil {
+				log.Printf("Failed to generate reports: %v", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+/*
+Lists the daily or weekly reports starting from one date to another, both
+included (like 2006-01-02, defaulting to the last 30 days), as JSON or, with format=csv, as
+a CSV download with a totals row and a row per retailer for each report.
+*/
+func getReports(context *gin.Context) {
+	period, known := reportPeriods[context.Param("period")]
+	if !known {
+		respondWithMessage(context, http.StatusNotFound, "report.period_unknown", context.Param("period"))
+		return
+	}
+
+	to, toValid := queryDate(context, "to", periodStart("day", wallClock.Now()))
+	from, fromValid := queryDate(context, "from", to.AddDate(0, 0, -30))
+	if !toValid || !fromValid {
+		return
+	}
+
+	reports, err := receipts.Reports(period, periodStart(period, from), to.AddDate(0, 0, 1))
+	if err != nil {
+		respondWithMessage(context, http.StatusInternalServerError, "report.lookup_failed")
+		return
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Start.Before(reports[j].Start) })
+
+	if context.Query("format") != "csv" {
+		context.IndentedJSON(http.StatusOK, gin.H{"period": period, "reports": reports})
+		return
+	}
+
+	filename := context.Param("period") + "-reports-" + from.Format("20060102") + "-" + to.Format("20060102") + ".csv"
+	context.Header("Content-Type", "text/csv; charset=utf-8")
+	context.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	context.Status(http.StatusOK)
+
+	writer := csv.NewWriter(context.Writer)
+	writer.Write([]string{"start", "end", "retailer", "receipts", "points", "users"})
+	for _, saved := range reports {
+		start := saved.Start.UTC().Format("2006-01-02")
+		end := saved.End.UTC().Format("2006-01-02")
+		// an empty retailer is the report's totals
+		writer.Write([]string{
+			start, end, "", strconv.Itoa(saved.Receipts), strconv.Itoa(saved.Points), strconv.Itoa(saved.Users),
+		})
+		for _, retailer := range saved.Retailers {
+			writer.Write([]string{
+				start, end, retailer.Retailer,
+				strconv.Itoa(retailer.Receipts), strconv.Itoa(retailer.Points), strconv.Itoa(retailer.Users),
+			})
+		}
+	}
+	writer.Flush()
+}
+
+/*
+Regenerates one report, e.g. after restoring a backup, for the period
+containing the date given as ?date=2006-01-02.
+*/
+func postReport(context *gin.Context) {
+	period, known := reportPeriods[context.Param("period")]
+	if !known {
+		respondWithMessage(context, http.StatusNotFound, "report.period_unknown", context.Param("period"))
+		return
+	}
+	date, err := time.Parse("2006-01-02", context.Query("date"))
+	if err != nil {
+		respondWithMessage(context, http.StatusBadRequest, "report.date_invalid", "date")
+		return
+	}
+
+	generated, err := generateReport(period, periodStart(period, date))
+	if err != nil {
+		log.Printf("Failed to generate %s report for %s: %v", period, context.Query("date"), err)
+		respondWithMessage(context, http.StatusInternalServerError, "report.generate_failed")
+		return
+	}
+	context.IndentedJSON(http.StatusCreated, generated)
+}
+
+// Reads a date query parameter, responding with an error when it's malformed.
+func queryDate(context *gin.Context, name string, fallback time.Time) (time.Time, bool) {
+	value := context.Query(name)
+	if value == "" {
+		return fallback, true
+	}
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		respondWithMessage(context, http.StatusBadRequest, "report.date_invalid", name)
+		return time.Time{}, false
+	}
+	return date, true
+}
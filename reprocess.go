@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Receipts the reprocess command reads from the store at a time.
+const reprocessPageSize = 500
+
+// Columns of the CSV the reprocess command writes, one row per receipt.
+var reprocessColumns = []string{
+	"id", "user_id", "status", "processed_at", "rules_version_before", "points_before",
+	"rules_version_after", "points_after", "delta", "rule_deltas", "error",
+}
+
+/*
+Rescores every stored receipt with the rules file given, to model a rule
+change offline: `reprocess <rules-file> [<output.csv>]` writes each
+receipt's points before and after, the difference and what each changed
+rule contributed, to the file or standard output. Receipts are scored as of
+when they were last processed, with their stored merchant, channel and
+merchant verification, and nothing is saved, so live balances are
+untouched. The per-receipt cap applies like it does live; the daily caps
+depend on the order receipts come in, so they don't.
+*/
+func runReprocessCommand(config Config, arguments []string) error {
+	if len(arguments) == 0 {
+		return errors.New("usage: reprocess <rules-file> [<output.csv>]")
+	}
+	if config.StoreBackend == "memory" {
+		return errors.New("reprocessing needs a persistent store; the memory store starts empty")
+	}
+	rulesConfig, err := loadRulesConfig(arguments[0])
+	if err != nil {
+		return err
+	}
+	var plugins []*wasmPlugin
+	if config.PluginDir != "" {
+		if plugins, err = loadPlugins(config.PluginDir, config.PluginTimeout); err != nil {
+			return err
+		}
+	}
+	useExpressionMemoryBudget(rulesConfig.ExpressionMemoryBudget)
+	rules := newRuleSet(rulesConfig, plugins)
+	// rules behind a flag apply to the users they would live
+	if featureFlags, err = newFlagProvider(config); err != nil {
+		return err
+	}
+	store, err := openStore(config)
+	if err != nil {
+		return err
+	}
+
+	output := io.Writer(os.Stdout)
+	if len(arguments) > 1 {
+		file, err := os.Create(arguments[1])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		output = file
+	}
+	writer := csv.NewWriter(output)
+	if err := writer.Write(reprocessColumns); err != nil {
+		return err
+	}
+
+	caps := CapsConfig{ReceiptPoints: config.Caps.ReceiptPoints}
+	count, changed, delta := 0, 0, 0
+	after := ""
+	for {
+		page, err := store.ListReceipts("", after, reprocessPageSize)
+		if err != nil {
+			return err
+		}
+		if len(page) == 0 {
+			break
+		}
+		after = page[len(page)-1].ID
+
+		for _, record := range page {
+			rescored, scoreError := rescore(rules, caps, record)
+			row := []string{
+				record.ID, record.UserID, record.Status, record.ProcessedAt.Format(time.RFC3339),
+				record.RulesVersion, strconv.Itoa(record.Points), rules.Version,
+			}
+			if scoreError != nil {
+				reason, _ := localizeError(defaultLanguage, scoreError)
+				row = append(row, "", "", "", reason)
+			} else {
+				row = append(
+					row, strconv.Itoa(rescored.Points), strconv.Itoa(rescored.Points-record.Points),
+					ruleDeltaSummary(diffRules(record.Breakdown, rescored.Breakdown)), "",
+				)
+				if rescored.Points != record.Points {
+					changed++
+					delta += rescored.Points - record.Points
+				}
+			}
+			if err := writer.Write(row); err != nil {
+				return err
+			}
+			count++
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	log.Printf("Rescored %d receipts with rules version %s: %d changed, %+d points in all", count, rules.Version, changed, delta)
+	return nil
+}
+
+/*
+The receipt scored with the rules as of when it was last processed, without
+saving it. Its purchase is checked against the rules' own limits, which
+needn't be the live ones.
+*/
+func rescore(rules ruleSet, caps CapsConfig, record storedReceipt) (storedReceipt, error) {
+	parsed, err := parseReceipt(record.Receipt, record.ProcessedAt, rules.limits)
+	if err != nil {
+		return storedReceipt{}, err
+	}
+	parsed.userID = record.UserID
+	parsed.channel = record.Channel
+	parsed.merchant = record.Merchant
+	// for the verified-purchase bonus; the transaction was claimed when it was matched
+	parsed.verification = record.Verification
+
+	points, breakdown, err := rules.score(parsed)
+	if err != nil {
+		return storedReceipt{}, err
+	}
+	rescored := record
+	rescored.Points, rescored.Breakdown, rescored.RulesVersion = points, breakdown, rules.Version
+	// with the daily caps off, applying them never reads the store
+	if err := caps.apply(nil, &rescored); err != nil {
+		return storedReceipt{}, err
+	}
+	return rescored, nil
+}
+
+// The rules whose points changed, like "round-total:+50;odd-day:-6".
+func ruleDeltaSummary(deltas []ruleDelta) string {
+	var changes []string
+	for _, delta := range deltas {
+		if delta.Delta != 0 {
+			changes = append(changes, fmt.Sprintf("%s:%+g", delta.Rule, delta.Delta))
+		}
+	}
+	return strings.Join(changes, ";")
+}
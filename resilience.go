@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+How calls to the store and outbound integrations are retried and when they
+stop being tried at all, so a flaky dependency slows requests down a little
+instead of failing them, and a dead one fails them fast.
+*/
+type ResilienceConfig struct {
+	// attempts per call, including the first
+	Attempts int
+	// wait before the first retry, doubling for each one after up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// consecutive failures that open a dependency's circuit breaker, and for how long
+	BreakerFailures int
+	BreakerCooldown time.Duration
+}
+
+/*
+Guards calls to one dependency with retries and a circuit breaker. Only
+errors retryable reports true for are retried, and only those count towards
+opening the breaker: a receipt that doesn't exist says nothing about the
+database's health.
+*/
+type dependencyGuard struct {
+	name      string
+	config    ResilienceConfig
+	breaker   *circuitBreaker
+	retryable func(err error) bool
+
+	retries  atomic.Int64
+	failures atomic.Int64
+}
+
+// Guards registered for metrics, in the order they were created
+var (
+	guardsMutex sync.Mutex
+	guards      []*dependencyGuard
+)
+
+func newDependencyGuard(name string, config ResilienceConfig, retryable func(err error) bool) *dependencyGuard {
+	guard := &dependencyGuard{
+		name:      name,
+		config:    config,
+		breaker:   newCircuitBreaker(config.BreakerFailures, config.BreakerCooldown),
+		retryable: retryable,
+	}
+	guardsMutex.Lock()
+	defer guardsMutex.Unlock()
+	guards = append(guards, guard)
+	return guard
+}
+
+/*
+Calls call until it succeeds, fails with an error that isn't retryable, runs
+out of attempts, or ctx is done. Waits back off exponentially with jitter,
+so replicas don't retry in lockstep.
+*/
+func (guard *dependencyGuard) do(ctx context.Context, call func() error) error {
+	backoff := guard.config.Backoff
+	for attempt := 1; ; attempt++ {
+		if !guard.breaker.allow() {
+			return errCircuitOpen
+		}
+		if attempt > 1 {
+			guard.retries.Add(1)
+		}
+		err := call()
+		transient := err != nil && guard.retryable(err)
+		guard.breaker.record(transient)
+		if transient {
+			guard.failures.Add(1)
+		}
+		if !transient || attempt >= guard.config.Attempts {
+			return err
+		}
+
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, guard.config.MaxBackoff)
+	}
+}
+
+// Runs call through the guard, returning its result.
+func guarded[T any](guard *dependencyGuard, call func() (T, error)) (T, error) {
+	var result T
+	err := guard.do(context.Background(), func() error {
+		var err error
+		result, err = call()
+		return err
+	})
+	return result, err
+}
+
+// An error retrying can't fix, like a request the dependency rejected.
+type permanentError struct {
+	err error
+}
+
+func (err permanentError) Error() string { return err.err.Error() }
+func (err permanentError) Unwrap() error { return err.err }
+
+// Retries anything but permanent errors and the caller giving up.
+func retryUnlessPermanent(err error) bool {
+	var permanent permanentError
+	return !errors.As(err, &permanent) && !errors.Is(err, context.Canceled)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+/*
+How the retailer-name rule counts a retailer's characters. Names are put in
+composed (NFC) form first, so "Müller" counts the same whether its ü was
+typed as one character or as u and a combining diaeresis.
+*/
+type countingMode string
+
+const (
+	// every letter and digit in any script, so "無印良品" is 4
+	countUnicode countingMode = "unicode"
+	// only A-Z, a-z and 0-9, so "Müller" is 5 and "無印良品" 0
+	countASCII countingMode = "ascii"
+	// letters and digits together with the marks and joiners that follow
+	// them, so a letter a font draws as one character counts once
+	countGraphemes countingMode = "graphemes"
+)
+
+func (mode countingMode) validate() error {
+	switch mode {
+	case countUnicode, countASCII, countGraphemes:
+		return nil
+	}
+	return fmt.Errorf("retailerCounting must be %s, %s or %s, not %q", countUnicode, countASCII, countGraphemes, mode)
+}
+
+// The number of the name's characters that count toward the retailer-name rule.
+func (mode countingMode) count(name string) int {
+	count := 0
+	// whether the rune before was counted, for graphemes to extend
+	extending := false
+	for _, char := range norm.NFC.String(name) {
+		switch mode {
+		case countASCII:
+			if char < unicode.MaxASCII && (unicode.IsLetter(char) || unicode.IsDigit(char)) {
+				count++
+			}
+		case countGraphemes:
+			if extending && extendsGrapheme(char) {
+				continue
+			}
+			extending = unicode.IsLetter(char) || unicode.IsDigit(char)
+			if extending {
+				count++
+			}
+		default:
+			if unicode.IsLetter(char) || unicode.IsDigit(char) {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+/*
+Whether the rune continues the grapheme before it rather than starting one:
+combining marks, joiners, variation selectors, and the vowel and final
+jamo of Hangul syllables NFC has no precomposed form for.
+*/
+func extendsGrapheme(char rune) bool {
+	return unicode.Is(unicode.M, char) || unicode.Is(unicode.Variation_Selector, char) ||
+		char == '\u200d' || // zero width joiner
+		char >= '\u1160' && char <= '\u11ff' || char >= '\ud7b0' && char <= '\ud7ff'
+}
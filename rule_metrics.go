@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Upper bounds, in points, of the buckets the points rules award are counted in.
+var ruleMetricBuckets = []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000}
+
+// How many awards fell in each of ruleMetricBuckets, and past the last one.
+type pointsHistogram struct {
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+func newPointsHistogram() *pointsHistogram {
+	return &pointsHistogram{counts: make([]int64, len(ruleMetricBuckets)+1)}
+}
+
+func (histogram *pointsHistogram) observe(points float64) {
+	bucket := sort.SearchFloat64s(ruleMetricBuckets, points)
+	histogram.counts[bucket]++
+	histogram.sum += points
+	histogram.count++
+}
+
+// One bucket of a histogram, counting the awards up to and including its bound.
+type ruleMetricBucket struct {
+	UpTo  string `json:"upTo"`
+	Count int64  `json:"count"`
+}
+
+// The buckets with cumulative counts, as Prometheus has them; the last is "+Inf".
+func (histogram *pointsHistogram) cumulative() []ruleMetricBucket {
+	buckets := make([]ruleMetricBucket, len(histogram.counts))
+	var total int64
+	for index, count := range histogram.counts {
+		total += count
+		bound := "+Inf"
+		if index < len(ruleMetricBuckets) {
+			bound = strconv.FormatFloat(ruleMetricBuckets[index], 'f', -1, 64)
+		}
+		buckets[index] = ruleMetricBucket{UpTo: bound, Count: total}
+	}
+	return buckets
+}
+
+func (histogram *pointsHistogram) mean() float64 {
+	if histogram.count == 0 {
+		return 0
+	}
+	return math.Round(histogram.sum/float64(histogram.count)*100) / 100
+}
+
+// How one rule has scored the receipts it was run on.
+type ruleMetric struct {
+	evaluations int64
+	// receipts it awarded (or took) any points
+	hits    int64
+	awarded *pointsHistogram
+}
+
+// What the receipts scored with one rules version earned, overall and by rule.
+type versionMetrics struct {
+	totals *pointsHistogram
+	rules  map[string]*ruleMetric
+	// rule names in the order receipts' breakdowns first listed them
+	order []string
+}
+
+/*
+Counts, for each rules version, how often each rule fires and the points
+it awards, so the rewards team can see which rules drive scores. The counts
+are this instance's since it started; replicas each report their own.
+*/
+type ruleMetricsRecorder struct {
+	mutex    sync.Mutex
+	versions map[string]*versionMetrics
+}
+
+// Global record of the receipts this instance has scored
+var ruleMetrics = &ruleMetricsRecorder{versions: make(map[string]*versionMetrics)}
+
+// Counts a receipt scored with the rules version.
+func (recorder *ruleMetricsRecorder) record(rulesVersion string, points int, breakdown []ruleResult) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	version := recorder.versions[rulesVersion]
+	if version == nil {
+		version = &versionMetrics{totals: newPointsHistogram(), rules: make(map[string]*ruleMetric)}
+		recorder.versions[rulesVersion] = version
+	}
+	version.totals.observe(float64(points))
+	for _, result := range breakdown {
+		rule := version.rules[result.Rule]
+		if rule == nil {
+			rule = &ruleMetric{awarded: newPointsHistogram()}
+			version.rules[result.Rule] = rule
+			version.order = append(version.order, result.Rule)
+		}
+		rule.evaluations++
+		if result.PrecisePoints != 0 {
+			rule.hits++
+			rule.awarded.observe(result.PrecisePoints)
+		}
+	}
+}
+
+type ruleMetricsReport struct {
+	RulesVersion string             `json:"rulesVersion"`
+	Receipts     int64              `json:"receipts"`
+	TotalPoints  float64            `json:"totalPoints"`
+	MeanPoints   float64            `json:"meanPoints"`
+	Points       []ruleMetricBucket `json:"points"`
+	Rules        []ruleMetricReport `json:"rules"`
+}
+
+type ruleMetricReport struct {
+	Rule        string  `json:"rule"`
+	Evaluations int64   `json:"evaluations"`
+	Hits        int64   `json:"hits"`
+	HitRate     float64 `json:"hitRate"`
+	// the points the rule awarded in all, on average per hit, and by bucket
+	PointsAwarded float64            `json:"pointsAwarded"`
+	MeanPoints    float64            `json:"meanPoints"`
+	Points        []ruleMetricBucket `json:"points"`
+	// the share of all points it awarded, to compare rules by
+	ShareOfPoints float64 `json:"shareOfPoints"`
+}
+
+// The metrics by rules version, in version order.
+func (recorder *ruleMetricsRecorder) report() []ruleMetricsReport {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	reports := make([]ruleMetricsReport, 0, len(recorder.versions))
+	for name, version := range recorder.versions {
+		report := ruleMetricsReport{
+			RulesVersion: name,
+			Receipts:     version.totals.count,
+			TotalPoints:  version.totals.sum,
+			MeanPoints:   version.totals.mean(),
+			Points:       version.totals.cumulative(),
+			Rules:        make([]ruleMetricReport, 0, len(version.order)),
+		}
+		for _, ruleName := range version.order {
+			rule := version.rules[ruleName]
+			ruleReport := ruleMetricReport{
+				Rule:          ruleName,
+				Evaluations:   rule.evaluations,
+				Hits:          rule.hits,
+				HitRate:       math.Round(float64(rule.hits)/float64(rule.evaluations)*1000) / 1000,
+				PointsAwarded: math.Round(rule.awarded.sum*100) / 100,
+				MeanPoints:    rule.awarded.mean(),
+				Points:        rule.awarded.cumulative(),
+			}
+			if version.totals.sum != 0 {
+				ruleReport.ShareOfPoints = math.Round(rule.awarded.sum/version.totals.sum*1000) / 1000
+			}
+			report.Rules = append(report.Rules, ruleReport)
+		}
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].RulesVersion < reports[j].RulesVersion })
+	return reports
+}
+
+// Reports how often each rule fired and what it awarded, by rules version.
+func getRuleMetrics(context *gin.Context) {
+	context.IndentedJSON(http.StatusOK, gin.H{"versions": ruleMetrics.report()})
+}
+
+// Adds the rule metrics to a Prometheus text format exposition.
+func (recorder *ruleMetricsRecorder) writePrometheus(metrics *strings.Builder) {
+	reports := recorder.report()
+	writeHistogram := func(name string, labels string, buckets []ruleMetricBucket, sum float64, count int64) {
+		for _, bucket := range buckets {
+			fmt.Fprintf(metrics, "%s_bucket{%s,le=%q} %d\n", name, labels, bucket.UpTo, bucket.Count)
+		}
+		fmt.Fprintf(metrics, "%s_sum{%s} %g\n%s_count{%s} %d\n", name, labels, sum, name, labels, count)
+	}
+
+	fmt.Fprint(metrics, "# HELP receipt_points Points receipts were awarded.\n# TYPE receipt_points histogram\n")
+	for _, report := range reports {
+		labels := fmt.Sprintf("rules_version=%q", report.RulesVersion)
+		writeHistogram("receipt_points", labels, report.Points, report.TotalPoints, report.Receipts)
+	}
+	fmt.Fprint(metrics, "# HELP rule_evaluations_total Receipts each rule was run on.\n# TYPE rule_evaluations_total counter\n")
+	for _, report := range reports {
+		for _, rule := range report.Rules {
+			fmt.Fprintf(metrics, "rule_evaluations_total{rules_version=%q,rule=%q} %d\n", report.RulesVersion, rule.Rule, rule.Evaluations)
+		}
+	}
+	fmt.Fprint(metrics, "# HELP rule_hits_total Receipts each rule awarded points.\n# TYPE rule_hits_total counter\n")
+	for _, report := range reports {
+		for _, rule := range report.Rules {
+			fmt.Fprintf(metrics, "rule_hits_total{rules_version=%q,rule=%q} %d\n", report.RulesVersion, rule.Rule, rule.Hits)
+		}
+	}
+	fmt.Fprint(metrics, "# HELP rule_points Points each rule awarded when it fired.\n# TYPE rule_points histogram\n")
+	for _, report := range reports {
+		for _, rule := range report.Rules {
+			labels := fmt.Sprintf("rules_version=%q,rule=%q", report.RulesVersion, rule.Rule)
+			writeHistogram("rule_points", labels, rule.Points, rule.PointsAwarded, rule.Hits)
+		}
+	}
+}
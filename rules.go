@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A receipt whose total, date and time have been parsed for scoring.
+type parsedReceipt struct {
+	receipt      Receipt
+	total        float64
+	purchaseDate time.Time
+	purchaseTime time.Time
+	// when it's processed, which rules ask rather than the system clock
+	processedAt time.Time
+	// who submitted it, for rules behind a feature flag
+	userID string
+	// how it was submitted, see receiptChannels
+	channel string
+	// the retailer's merchant, when enrichment found it
+	merchant *merchantInfo
+	// the transaction its retailer registered for it, if any
+	verification *merchantVerification
+	// its items with the descriptions item rules see, see descriptionNormalization
+	items []Item
+}
+
+/*
+A single way a receipt can earn points. Most rules score the receipt on its
+own; item rules score each line item, so the breakdown can say what each
+item earned, and bonus rules see the points the other rules awarded (e.g.
+to double them) and can say what triggered them.
+*/
+type scoringRule struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// feature flag the rule only applies behind, if any
+	Flag      string `json:"flag,omitempty"`
+	score     func(receipt parsedReceipt) (centipoints, error)
+	itemScore func(receipt parsedReceipt, item Item) (centipoints, error)
+	bonus     func(receipt parsedReceipt, subtotal centipoints) (centipoints, string)
+	// whether the points can depend on the receipt's tags, so retagging scores it again
+	readsTags bool
+}
+
+// The points one rule awarded to a receipt.
+type ruleResult struct {
+	Rule string `json:"rule"`
+	// the points rounded to whole points, and exactly
+	Points        int     `json:"points"`
+	PrecisePoints float64 `json:"precisePoints"`
+	// what triggered the rule, e.g. the holiday that applied
+	Detail string `json:"detail,omitempty"`
+	// the items that earned an item rule's points
+	Items []itemPoints `json:"items,omitempty"`
+}
+
+// The points one line item earned from a rule, by its position on the receipt.
+type itemPoints struct {
+	Index         int     `json:"index"`
+	Description   string  `json:"shortDescription"`
+	Points        int     `json:"points"`
+	PrecisePoints float64 `json:"precisePoints"`
+}
+
+// The scoring rules receipts are scored with, and the version identifying them.
+type ruleSet struct {
+	Version  string        `json:"version"`
+	Rounding roundingMode  `json:"rounding"`
+	Rules    []scoringRule `json:"rules"`
+
+	// the purchase dates receipts are accepted with
+	limits purchaseLimits
+	// what item descriptions go through before they're scored
+	normalization descriptionNormalization
+}
+
+/*
+The rule set every receipt is scored with and the experiment running on
+it, which POST /admin/rules/reload swaps together while receipts are being
+scored.
+*/
+type loadedRules struct {
+	rules      ruleSet
+	experiment *experiment
+	// the expression memory budget, which every rule set of the load shares
+	memoryBudget uint
+}
+
+var currentRules atomic.Pointer[loadedRules]
+
+// The rules and experiment in use, from the same load; empty until the rules are loaded.
+func rulesInUse() loadedRules {
+	if loaded := currentRules.Load(); loaded != nil {
+		return *loaded
+	}
+	return loadedRules{}
+}
+
+// Global rule set every receipt is scored with
+func activeRules() ruleSet {
+	return rulesInUse().rules
+}
+
+// Name of the rule scoring the retailer's name, which the rules config can tune.
+const retailerRuleName = "retailer-name"
+
+// Awards a point for every character of the retailer's name that counts in the mode.
+func retailerNameRule(mode countingMode) scoringRule {
+	description := "1 point for every alphanumeric character in the retailer name"
+	if mode != countUnicode {
+		description += fmt.Sprintf(", counting %s characters", mode)
+	}
+	return scoringRule{
+		Name:        retailerRuleName,
+		Description: description,
+		score: func(receipt parsedReceipt) (centipoints, error) {
+			return wholePoints(mode.count(receipt.receipt.Retailer)), nil
+		},
+	}
+}
+
+// Rules every rule set has, some of them tuned by the rules config.
+func baseRules(config RulesConfig) []scoringRule {
+	return []scoringRule{
+		retailerNameRule(config.RetailerCounting),
+		{
+			Name:        "round-total",
+			Description: "50 points if the total is a round dollar amount with no cents",
+			score: func(receipt parsedReceipt) (centipoints, error) {
+				if math.Floor(receipt.total) == receipt.total {
+					return wholePoints(50), nil
+				}
+				return 0, nil
+			},
+		},
+		{
+			Name:        "quarter-total",
+			Description: "25 points if the total is a multiple of 0.25",
+			score: func(receipt parsedReceipt) (centipoints, error) {
+				if math.Mod(receipt.total, 0.25) == 0 {
+					return wholePoints(25), nil
+				}
+				return 0, nil
+			},
+		},
+		{
+			Name:        "item-pairs",
+			Description: "5 points for every two items on the receipt",
+			score: func(receipt parsedReceipt) (centipoints, error) {
+				return wholePoints(5 * (len(receipt.receipt.Items) / 2)), nil
+			},
+		},
+		config.DescriptionLength.rule(),
+		{
+			Name:        "odd-day",
+			Description: "6 points if the day in the purchase date is odd",
+			score: func(receipt parsedReceipt) (centipoints, error) {
+				if (receipt.purchaseDate.Day() % 2) != 0 {
+					return wholePoints(6), nil
+				}
+				return 0, nil
+			},
+		},
+	}
+}
+
+/*
+Builds the rule set from configuration: the base rules followed by the
+configured rules and then any plugins.
+*/
+func newRuleSet(config RulesConfig, plugins []*wasmPlugin) ruleSet {
+	rules := baseRules(config)
+	for _, window := range config.TimeWindows {
+		rules = append(rules, window.rule())
+	}
+	for _, bonus := range config.DayOfWeekBonuses {
+		rules = append(rules, bonus.rule())
+	}
+	for _, bonus := range config.LocationBonuses {
+		rules = append(rules, bonus.rule())
+	}
+	for _, expression := range config.Expressions {
+		rules = append(rules, expression.rule(config.expressionTimeout))
+	}
+	if len(config.Holidays) > 0 {
+		rules = append(rules, holidayRule(config.Holidays))
+	}
+	if config.MerchantVerified != nil {
+		rules = append(rules, config.MerchantVerified.rule())
+	}
+	for _, adjustment := range config.ChannelRules {
+		rules = append(rules, adjustment.rule())
+	}
+	for _, plugin := range plugins {
+		rules = append(rules, plugin.rule())
+	}
+	return ruleSet{
+		Version:       config.Version,
+		Rounding:      config.Rounding,
+		Rules:         rules,
+		limits:        config.PurchaseLimits,
+		normalization: config.DescriptionNormalization,
+	}
+}
+
+/*
+Parses the receipt's total, purchase date and purchase time, checking
+the purchase against now and the limits. Errors are clientErrors, suitable
+for returning to the client.
+*/
+func parseReceipt(receipt Receipt, now time.Time, limits purchaseLimits) (parsedReceipt, error) {
+	if receipt.Location != nil {
+		// states are looked up as given in stats, so keep them in one case
+		location := *receipt.Location
+		location.State = strings.ToUpper(strings.TrimSpace(location.State))
+		receipt.Location = &location
+	}
+	if err := validateReceipt(receipt, now, limits); err != nil {
+		return parsedReceipt{}, err
+	}
+	receipt.Tags = normalizeTags(receipt.Tags)
+
+	total, _ := strconv.ParseFloat(receipt.Total, 64)
+	purchaseDate, _ := time.Parse("2006-01-02", receipt.Date)
+	purchaseTime, _ := time.Parse("15:04", receipt.Time)
+	return parsedReceipt{
+		receipt:      receipt,
+		total:        total,
+		purchaseDate: purchaseDate,
+		purchaseTime: purchaseTime,
+		processedAt:  now,
+	}, nil
+}
+
+/*
+Runs every scoring rule against the receipt, returning the total and each
+rule's share. Bonus rules run last, on the total of the other rules. Rules
+whose flag is off for the submitter are left out of the breakdown. Points
+add up in centipoints, and the total is rounded to whole points by the
+rule set's rounding mode; each rule's share is rounded the same way, so
+the shares' whole points needn't add up to the total's. Item descriptions
+are normalized first.
+*/
+func (rules ruleSet) score(receipt parsedReceipt) (int, []ruleResult, error) {
+	receipt.items = rules.normalization.items(receipt.receipt.Items)
+	var totalPoints centipoints
+	breakdown := make([]ruleResult, 0, len(rules.Rules))
+	for _, rule := range rules.Rules {
+		switch {
+		case !rule.flagEnabled(receipt):
+		case rule.score != nil:
+			points, err := rule.score(receipt)
+			if err != nil {
+				return 0, nil, err
+			}
+			totalPoints += points
+			breakdown = append(breakdown, rules.result(rule.Name, points, ""))
+		case rule.itemScore != nil:
+			result, points, err := rules.scoreItems(rule, receipt)
+			if err != nil {
+				return 0, nil, err
+			}
+			totalPoints += points
+			breakdown = append(breakdown, result)
+		}
+	}
+
+	subtotal := totalPoints
+	for _, rule := range rules.Rules {
+		if rule.bonus == nil || !rule.flagEnabled(receipt) {
+			continue
+		}
+		points, detail := rule.bonus(receipt, subtotal)
+		totalPoints += points
+		breakdown = append(breakdown, rules.result(rule.Name, points, detail))
+	}
+	return rules.Rounding.round(totalPoints), breakdown, nil
+}
+
+// Whether any of the rules can award points by tag.
+func (rules ruleSet) readsTags() bool {
+	for _, rule := range rules.Rules {
+		if rule.readsTags {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Runs an item rule on each line item, with its normalized description,
+attributing its points to the items that earned them as the receipt lists them.
+*/
+func (rules ruleSet) scoreItems(rule scoringRule, receipt parsedReceipt) (ruleResult, centipoints, error) {
+	var total centipoints
+	var items []itemPoints
+	for index, item := range receipt.receipt.Items {
+		points, err := rule.itemScore(receipt, receipt.items[index])
+		if err != nil {
+			return ruleResult{}, 0, err
+		}
+		if points != 0 {
+			total += points
+			items = append(items, itemPoints{
+				Index:         index,
+				Description:   item.Description,
+				Points:        rules.Rounding.round(points),
+				PrecisePoints: points.precise(),
+			})
+		}
+	}
+	result := rules.result(rule.Name, total, "")
+	result.Items = items
+	return result, total, nil
+}
+
+func (rules ruleSet) result(name string, points centipoints, detail string) ruleResult {
+	return ruleResult{Rule: name, Points: rules.Rounding.round(points), PrecisePoints: points.precise(), Detail: detail}
+}
+
+func (rule scoringRule) flagEnabled(receipt parsedReceipt) bool {
+	return rule.Flag == "" || featureFlags.enabled(rule.Flag, receipt.userID, false)
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+The configurable part of the rules engine, read from the JSON file named by
+RULES_FILE. Without a file the defaults reproduce the original rules.
+*/
+type RulesConfig struct {
+	// Stored with every receipt's points; change it whenever the rules change.
+	Version          string           `json:"version"`
+	TimeWindows      []timeWindowRule `json:"timeWindows"`
+	DayOfWeekBonuses []dayOfWeekRule  `json:"dayOfWeekBonuses"`
+	LocationBonuses  []locationRule   `json:"locationBonuses"`
+	Holidays         []holidayEntry   `json:"holidays"`
+	Expressions      []expressionRule `json:"expressions"`
+	ChannelRules     []channelRule    `json:"channelRules"`
+	// Awards receipts their retailer registered, see merchantVerifiedRule.
+	MerchantVerified *merchantVerifiedRule `json:"merchantVerified"`
+	// Sandbox limits for each expression run, e.g. "50ms", and how much
+	// memory (in expr's allocation units) one run may use.
+	ExpressionTimeout      string `json:"expressionTimeout"`
+	ExpressionMemoryBudget uint   `json:"expressionMemoryBudget"`
+	// How receipts' fractional points round to whole points: "half-up"
+	// (the default), "half-even", "down" or "up".
+	Rounding roundingMode `json:"rounding"`
+	// Which of the retailer's characters earn points: "unicode" letters and
+	// digits (the default), "ascii" ones only, or "graphemes".
+	RetailerCounting countingMode `json:"retailerCounting"`
+	// Which purchase dates receipts may have, see purchaseLimits.
+	PurchaseLimits purchaseLimits `json:"purchaseLimits"`
+	// Tunes the item-description-length rule, see descriptionLengthRule.
+	DescriptionLength descriptionLengthRule `json:"descriptionLength"`
+	// What item descriptions go through before item rules see them.
+	DescriptionNormalization descriptionNormalization `json:"descriptionNormalization"`
+	// Scores some receipts with variant rules, see experimentConfig.
+	Experiment *experimentConfig `json:"experiment"`
+
+	expressionTimeout time.Duration
+}
+
+// Awards points to receipts purchased on any of the days, e.g. "saturday".
+type dayOfWeekRule struct {
+	Name   string   `json:"name"`
+	Days   []string `json:"days"`
+	Points int      `json:"points"`
+	Flag   string   `json:"flag"`
+
+	weekdays map[time.Weekday]bool
+}
+
+/*
+A day in the holiday calendar. Date is either "2006-01-02" for a single
+day or "01-02" for a day that recurs every year. Receipts purchased on a
+holiday earn Points more, and have the other rules' points multiplied by
+Multiplier when it's set (2 doubles them).
+*/
+type holidayEntry struct {
+	Date       string  `json:"date"`
+	Name       string  `json:"name"`
+	Points     int     `json:"points"`
+	Multiplier float64 `json:"multiplier"`
+}
+
+/*
+Awards points to receipts purchased strictly after Start and strictly
+before End, both "15:04" times. A window whose end is before its start
+wraps past midnight.
+*/
+type timeWindowRule struct {
+	Name   string `json:"name"`
+	Start  string `json:"start"`
+	End    string `json:"end"`
+	Points int    `json:"points"`
+	Flag   string `json:"flag"`
+
+	start time.Time
+	end   time.Time
+}
+
+/*
+How far from now a receipt's purchase may be. Purchases up to
+FutureTolerance (default "14h", for time zones ahead of UTC) in the future
+are accepted, as are ones at most MaxAgeDays old; 0 allows any age.
+*/
+type purchaseLimits struct {
+	FutureTolerance string `json:"futureTolerance"`
+	MaxAgeDays      int    `json:"maxAgeDays"`
+
+	futureTolerance time.Duration
+}
+
+/*
+Awards items whose normalized description is a multiple of Modulus (default 3)
+long their price times Multiplier (default 0.2), rounded to a whole point
+by Rounding: "ceil" (the default), "round" (halves away from zero) or
+"floor". Prices and the multiplier are multiplied as exact decimals, so
+e.g. 15.00 * 0.2 is 3 rather than a float just over it that rounds up to 4.
+*/
+type descriptionLengthRule struct {
+	Modulus    int         `json:"modulus"`
+	Multiplier json.Number `json:"multiplier"`
+	Rounding   string      `json:"rounding"`
+
+	multiplier *big.Rat
+}
+
+// Purchases are compared to now in UTC, which is at most this far behind local time.
+const defaultFutureTolerance = 14 * time.Hour
+
+// Name of the rule applying the holiday calendar.
+const holidayRuleName = "holiday"
+
+func defaultRulesConfig() RulesConfig {
+	return RulesConfig{
+		Version: "1",
+		TimeWindows: []timeWindowRule{
+			{Name: "afternoon-purchase", Start: "14:00", End: "16:00", Points: 10},
+		},
+	}
+}
+
+// Reads and validates the rules file, or returns the defaults when path is empty.
+func loadRulesConfig(path string) (RulesConfig, error) {
+	config := defaultRulesConfig()
+	if path != "" {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return RulesConfig{}, err
+		}
+		config = RulesConfig{}
+		if err := json.Unmarshal(contents, &config); err != nil {
+			return RulesConfig{}, fmt.Errorf("failed to parse rules file %s: %w", path, err)
+		}
+	}
+
+	if err := config.validate(); err != nil {
+		return RulesConfig{}, err
+	}
+	return config, nil
+}
+
+/*
+Checks the configuration, filling in parsed values and defaults. Rule names
+must be unique so breakdowns and metrics can tell rules apart.
+*/
+func (config *RulesConfig) validate() error {
+	if config.Version == "" {
+		return errors.New("the rules config needs a version")
+	}
+	if config.Rounding == "" {
+		config.Rounding = roundHalfUp
+	}
+	if err := config.Rounding.validate(); err != nil {
+		return err
+	}
+	if config.RetailerCounting == "" {
+		config.RetailerCounting = countUnicode
+	}
+	if err := config.RetailerCounting.validate(); err != nil {
+		return err
+	}
+	if err := config.PurchaseLimits.validate(); err != nil {
+		return err
+	}
+	if err := config.DescriptionLength.validate(); err != nil {
+		return err
+	}
+	if config.DescriptionNormalization == nil {
+		config.DescriptionNormalization = descriptionNormalization{normalizeTrim}
+	}
+	if err := config.DescriptionNormalization.validate(); err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for _, rule := range baseRules(*config) {
+		names[rule.Name] = true
+	}
+	for index := range config.TimeWindows {
+		window := &config.TimeWindows[index]
+		if window.Name == "" || names[window.Name] {
+			return fmt.Errorf("time window %d needs a unique name", index)
+		}
+		names[window.Name] = true
+
+		var startError, endError error
+		window.start, startError = time.Parse("15:04", window.Start)
+		window.end, endError = time.Parse("15:04", window.End)
+		if startError != nil || endError != nil {
+			return fmt.Errorf("time window %s needs start and end times like 14:00", window.Name)
+		}
+	}
+
+	for index := range config.DayOfWeekBonuses {
+		bonus := &config.DayOfWeekBonuses[index]
+		if bonus.Name == "" || names[bonus.Name] {
+			return fmt.Errorf("day of week bonus %d needs a unique name", index)
+		}
+		names[bonus.Name] = true
+
+		bonus.weekdays = make(map[time.Weekday]bool)
+		for _, day := range bonus.Days {
+			weekday, known := weekdaysByName[strings.ToLower(day)]
+			if !known {
+				return fmt.Errorf("day of week bonus %s has an unknown day %q", bonus.Name, day)
+			}
+			bonus.weekdays[weekday] = true
+		}
+	}
+
+	for index := range config.LocationBonuses {
+		bonus := &config.LocationBonuses[index]
+		if bonus.Name == "" || names[bonus.Name] {
+			return fmt.Errorf("location bonus %d needs a unique name", index)
+		}
+		names[bonus.Name] = true
+		if err := bonus.compile(); err != nil {
+			return err
+		}
+	}
+
+	for index := range config.Expressions {
+		rule := &config.Expressions[index]
+		if rule.Name == "" || names[rule.Name] {
+			return fmt.Errorf("expression rule %d needs a unique name", index)
+		}
+		names[rule.Name] = true
+		if err := rule.compile(); err != nil {
+			return err
+		}
+	}
+	for index, rule := range config.ChannelRules {
+		if rule.Name == "" || names[rule.Name] {
+			return fmt.Errorf("channel rule %d needs a unique name", index)
+		}
+		names[rule.Name] = true
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+	if bonus := config.MerchantVerified; bonus != nil {
+		if bonus.Name == "" {
+			bonus.Name = defaultMerchantVerifiedName
+		}
+		if names[bonus.Name] {
+			return fmt.Errorf("the merchant verified bonus needs a unique name, %s is taken", bonus.Name)
+		}
+		names[bonus.Name] = true
+	}
+	config.expressionTimeout = defaultExpressionTimeout
+	if config.ExpressionTimeout != "" {
+		timeout, err := time.ParseDuration(config.ExpressionTimeout)
+		if err != nil || timeout <= 0 {
+			return errors.New("expressionTimeout must be a duration like 50ms")
+		}
+		config.expressionTimeout = timeout
+	}
+	if config.ExpressionMemoryBudget == 0 {
+		config.ExpressionMemoryBudget = defaultExpressionMemoryBudget
+	}
+
+	if config.Experiment != nil {
+		if err := config.Experiment.validate(); err != nil {
+			return err
+		}
+		// expr has one memory budget for every run, see useExpressionMemoryBudget
+		for _, variant := range config.Experiment.Variants {
+			if variant.Rules.ExpressionMemoryBudget != config.ExpressionMemoryBudget {
+				return fmt.Errorf("experiment variant %s needs the main rules' expressionMemoryBudget of %d",
+					variant.Name, config.ExpressionMemoryBudget)
+			}
+		}
+	}
+
+	if len(config.Holidays) > 0 && names[holidayRuleName] {
+		return fmt.Errorf("the name %s is reserved for the holiday calendar", holidayRuleName)
+	}
+	for _, holiday := range config.Holidays {
+		_, fullDateError := time.Parse("2006-01-02", holiday.Date)
+		_, recurringError := time.Parse("01-02", holiday.Date)
+		if fullDateError != nil && recurringError != nil {
+			return fmt.Errorf("holiday %s needs a date like 2024-07-04 or 07-04", holiday.Name)
+		}
+		if holiday.Multiplier < 0 {
+			return fmt.Errorf("holiday %s has a negative multiplier", holiday.Name)
+		}
+	}
+	return nil
+}
+
+func (limits *purchaseLimits) validate() error {
+	limits.futureTolerance = defaultFutureTolerance
+	if limits.FutureTolerance != "" {
+		tolerance, err := time.ParseDuration(limits.FutureTolerance)
+		if err != nil || tolerance < 0 {
+			return errors.New("purchaseLimits.futureTolerance must be a duration like 14h")
+		}
+		limits.futureTolerance = tolerance
+	}
+	if limits.MaxAgeDays < 0 {
+		return errors.New("purchaseLimits.maxAgeDays must be 0 or more")
+	}
+	return nil
+}
+
+func (rule *descriptionLengthRule) validate() error {
+	if rule.Modulus == 0 {
+		rule.Modulus = 3
+	}
+	if rule.Modulus < 0 {
+		return errors.New("descriptionLength.modulus must be more than 0")
+	}
+	if rule.Multiplier == "" {
+		rule.Multiplier = "0.2"
+	}
+	multiplier, valid := new(big.Rat).SetString(rule.Multiplier.String())
+	if !valid {
+		return fmt.Errorf("descriptionLength.multiplier must be a decimal, not %s", rule.Multiplier)
+	}
+	rule.multiplier = multiplier
+	if rule.Rounding == "" {
+		rule.Rounding = "ceil"
+	}
+	if rule.Rounding != "ceil" && rule.Rounding != "round" && rule.Rounding != "floor" {
+		return fmt.Errorf("descriptionLength.rounding must be ceil, round or floor, not %q", rule.Rounding)
+	}
+	return nil
+}
+
+var weekdaysByName = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+func (window timeWindowRule) rule() scoringRule {
+	return scoringRule{
+		Name: window.Name,
+		Flag: window.Flag,
+		Description: fmt.Sprintf(
+			"%d points if the time of purchase is after %s and before %s", window.Points, window.Start, window.End,
+		),
+		score: func(receipt parsedReceipt) (centipoints, error) {
+			if window.contains(receipt.purchaseTime) {
+				return wholePoints(window.Points), nil
+			}
+			return 0, nil
+		},
+	}
+}
+
+func (window timeWindowRule) contains(purchaseTime time.Time) bool {
+	if window.start.Before(window.end) {
+		return purchaseTime.After(window.start) && purchaseTime.Before(window.end)
+	}
+	// the window wraps past midnight
+	return purchaseTime.After(window.start) || purchaseTime.Before(window.end)
+}
+
+func (bonus dayOfWeekRule) rule() scoringRule {
+	return scoringRule{
+		Name: bonus.Name,
+		Flag: bonus.Flag,
+		Description: fmt.Sprintf(
+			"%d points if the purchase date is a %s", bonus.Points, strings.Join(bonus.Days, " or "),
+		),
+		score: func(receipt parsedReceipt) (centipoints, error) {
+			if bonus.weekdays[receipt.purchaseDate.Weekday()] {
+				return wholePoints(bonus.Points), nil
+			}
+			return 0, nil
+		},
+	}
+}
+
+func (rule descriptionLengthRule) rule() scoringRule {
+	var rounded string
+	switch rule.Rounding {
+	case "ceil":
+		rounded = "rounded up"
+	case "round":
+		rounded = "rounded to the nearest point"
+	case "floor":
+		rounded = "rounded down"
+	}
+	return scoringRule{
+		Name: "item-description-length",
+		Description: fmt.Sprintf(
+			"If the normalized length of an item description is a multiple of %d, the item's price multiplied by %s and %s",
+			rule.Modulus, rule.Multiplier, rounded,
+		),
+		itemScore: func(receipt parsedReceipt, item Item) (centipoints, error) {
+			if len(item.Description)%rule.Modulus != 0 {
+				return 0, nil
+			}
+			price, valid := new(big.Rat).SetString(item.Price)
+			if !valid {
+				return 0, newClientError("item.price_invalid", item.Description)
+			}
+			// each item's share is rounded to a whole point, as the rule says
+			return wholePoints(roundRat(price.Mul(price, rule.multiplier), rule.Rounding)), nil
+		},
+	}
+}
+
+// Rounds the exact value to a whole number, by "ceil", "round" or "floor".
+func roundRat(value *big.Rat, rounding string) int {
+	numerator, denominator := new(big.Int).Set(value.Num()), value.Denom()
+	switch rounding {
+	case "ceil":
+		// the floor of the negation, negated
+		return -int(new(big.Int).Div(numerator.Neg(numerator), denominator).Int64())
+	case "round":
+		// the floor of the magnitude plus a half, with the value's sign
+		half := new(big.Rat).Add(new(big.Rat).Abs(value), big.NewRat(1, 2))
+		whole := int(new(big.Int).Div(half.Num(), half.Denom()).Int64())
+		return value.Sign() * whole
+	}
+	return int(new(big.Int).Div(numerator, denominator).Int64())
+}
+
+/*
+Applies the holiday calendar. A specific date takes precedence over a
+recurring entry for the same day, and the breakdown names the holiday.
+*/
+func holidayRule(holidays []holidayEntry) scoringRule {
+	calendar := make(map[string]holidayEntry)
+	for _, holiday := range holidays {
+		if _, exists := calendar[holiday.Date]; !exists {
+			calendar[holiday.Date] = holiday
+		}
+	}
+
+	return scoringRule{
+		Name:        holidayRuleName,
+		Description: fmt.Sprintf("Bonus points for purchases on any of %d holidays", len(calendar)),
+		bonus: func(receipt parsedReceipt, subtotal centipoints) (centipoints, string) {
+			holiday, exists := calendar[receipt.purchaseDate.Format("2006-01-02")]
+			if !exists {
+				holiday, exists = calendar[receipt.purchaseDate.Format("01-02")]
+			}
+			if !exists {
+				return 0, ""
+			}
+
+			points := wholePoints(holiday.Points)
+			if holiday.Multiplier > 0 {
+				points += centipoints(math.Round(float64(subtotal) * (holiday.Multiplier - 1)))
+			}
+			return points, holiday.Name
+		},
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Audit action for an operator reloading the rules file.
+const auditRulesReloaded = "rules.reloaded"
+
+/*
+The rules file and the plugins loaded at startup, which reloading the rules
+reuses: plugins only change with a restart.
+*/
+var (
+	rulesFile   string
+	rulePlugins []*wasmPlugin
+)
+
+/*
+Loads the rules file and swaps the rules and experiment receipts are scored
+with for its own, returning the new rule set. Receipts being scored keep
+the rules they started with. The first load sets the expression memory
+budget, which later ones can't change.
+*/
+func loadRules(path string, plugins []*wasmPlugin) (ruleSet, error) {
+	config, err := loadRulesConfig(path)
+	if err != nil {
+		return ruleSet{}, err
+	}
+	previous := currentRules.Load()
+	if previous == nil {
+		useExpressionMemoryBudget(config.ExpressionMemoryBudget)
+	} else if config.ExpressionMemoryBudget != previous.memoryBudget {
+		return ruleSet{}, fmt.Errorf("expressionMemoryBudget only changes with a restart, and is %d", previous.memoryBudget)
+	}
+	loaded := &loadedRules{rules: newRuleSet(config, plugins), memoryBudget: config.ExpressionMemoryBudget}
+	if config.Experiment != nil {
+		loaded.experiment = newExperiment(config.Experiment, plugins)
+	}
+	currentRules.Store(loaded)
+	return loaded.rules, nil
+}
+
+// Rereads RULES_FILE, for when another replica reloaded its rules.
+func reloadRules() {
+	previous := activeRules().Version
+	rules, err := loadRules(rulesFile, rulePlugins)
+	if err != nil {
+		log.Printf("Failed to reload the rules file: %v", err)
+		return
+	}
+	log.Printf("Reloaded the rules file: version %s, was %s", rules.Version, previous)
+}
+
+/*
+Rereads RULES_FILE so a rule change applies without a restart, and tells
+the other replicas to reload theirs. A file that doesn't load leaves the
+current rules in place.
+*/
+func postRulesReload(context *gin.Context) {
+	previous := activeRules().Version
+	rules, err := loadRules(rulesFile, rulePlugins)
+	if err != nil {
+		respondWithMessage(context, http.StatusUnprocessableEntity, "rules.reload_failed", err.Error())
+		return
+	}
+	broadcastInvalidation(invalidation{Rules: true})
+	recordAudit(context, auditEntry{
+		Action: auditRulesReloaded,
+		Reason: "version " + previous + " to " + rules.Version,
+	})
+	context.IndentedJSON(http.StatusOK, gin.H{"rulesVersion": rules.Version, "previousVersion": previous})
+}
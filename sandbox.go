@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Header naming the sandbox namespace a request runs in.
+const sandboxHeader = "X-Sandbox"
+
+// Key the request's sandbox is stored under in the gin context, see sandboxOf.
+const sandboxContextKey = "sandbox"
+
+// Modes SANDBOX_MODE can be in.
+const (
+	sandboxOff = "off"
+	// requests naming a namespace in X-Sandbox run in it, others in production
+	sandboxByHeader = "header"
+	// every request runs in a sandbox, "default" unless X-Sandbox names another,
+	// for deployments that only partners' integration tests use
+	sandboxAlways = "always"
+)
+
+// Namespace requests run in under sandboxAlways when they don't name one.
+const defaultSandboxNamespace = "default"
+
+/*
+Sandboxes let partners run integration tests without touching production
+data. Time is the RFC 3339 time a new namespace's clock is frozen at, and
+MaxNamespaces bounds how many namespaces an instance holds at once.
+*/
+type SandboxConfig struct {
+	Mode          string
+	Time          string
+	MaxNamespaces int
+}
+
+/*
+An isolated namespace receipts are processed in: its own store, so
+receipts, balances and audit entries never reach production's, a clock
+that only moves when it's set, and receipt ids from a sequence, so a test
+run from a wiped namespace sees the same ids every time. Processing in a
+sandbox doesn't notify anyone or publish events.
+*/
+type sandbox struct {
+	name  string
+	store Store
+
+	mutex    sync.Mutex
+	now      time.Time
+	sequence int
+}
+
+// The time the sandbox's receipts are processed at, as its Clock.
+func (box *sandbox) Now() time.Time {
+	box.mutex.Lock()
+	defer box.mutex.Unlock()
+	return box.now
+}
+
+// The next receipt id in the sandbox's sequence.
+func (box *sandbox) nextID() string {
+	box.mutex.Lock()
+	defer box.mutex.Unlock()
+	box.sequence++
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte(fmt.Sprintf("sandbox:%s:%d", box.name, box.sequence))).String()
+}
+
+// The namespaces this instance holds, each kept for the caller that made it.
+type sandboxRegistry struct {
+	config SandboxConfig
+	start  time.Time
+
+	mutex sync.Mutex
+	boxes map[string]*sandbox
+}
+
+// Opens the sandbox registry, or returns nil when sandboxes are off.
+func newSandboxRegistry(config SandboxConfig) (*sandboxRegistry, error) {
+	switch config.Mode {
+	case sandboxOff:
+		return nil, nil
+	case sandboxByHeader, sandboxAlways:
+	default:
+		return nil, fmt.Errorf("SANDBOX_MODE must be %s, %s or %s, not %q", sandboxOff, sandboxByHeader, sandboxAlways, config.Mode)
+	}
+	start, err := time.Parse(time.RFC3339, config.Time)
+	if err != nil {
+		return nil, fmt.Errorf("SANDBOX_TIME must be a time like 2024-01-01T12:00:00Z: %w", err)
+	}
+	return &sandboxRegistry{config: config, start: start.UTC(), boxes: make(map[string]*sandbox)}, nil
+}
+
+/*
+Where a namespace is kept: callers only see their own namespaces, by their
+token's subject or their API key, so partners can't wipe each other's.
+*/
+func sandboxKey(context *gin.Context, namespace string) string {
+	owner := context.GetString("subject")
+	if value, exists := context.Get(apiKeyContextKey); exists && owner == "" {
+		owner = value.(apiKey).Name
+	}
+	return owner + "/" + namespace
+}
+
+// The namespace the request names, checked like a tag, and whether it named one.
+func requestedNamespace(namespace string) (string, bool, error) {
+	namespace = normalizeTag(namespace)
+	if namespace == "" {
+		return "", false, nil
+	}
+	if !validTag(namespace) {
+		return "", true, newClientError("sandbox.namespace_invalid", namespace, maxTagLength)
+	}
+	return namespace, true, nil
+}
+
+/*
+Middleware running the request in the sandbox namespace X-Sandbox names,
+which is made on first use. Without sandboxes, requests naming one are
+refused, so tests pointed at production by mistake don't write to it.
+*/
+func (registry *sandboxRegistry) enter() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		namespace, named, err := requestedNamespace(context.GetHeader(sandboxHeader))
+		if err != nil {
+			respondWithError(context, http.StatusBadRequest, err)
+			context.Abort()
+			return
+		}
+		if registry == nil {
+			if named {
+				abortWithMessage(context, http.StatusBadRequest, "sandbox.disabled")
+				return
+			}
+			context.Next()
+			return
+		}
+		if !named && registry.config.Mode == sandboxAlways {
+			namespace, named = defaultSandboxNamespace, true
+		}
+		if !named {
+			context.Next()
+			return
+		}
+
+		box, err := registry.open(sandboxKey(context, namespace))
+		if err != nil {
+			respondWithError(context, http.StatusServiceUnavailable, err)
+			context.Abort()
+			return
+		}
+		context.Header(sandboxHeader, namespace)
+		context.Set(sandboxContextKey, box)
+		context.Next()
+	}
+}
+
+// The namespace under the key, made when it's new.
+func (registry *sandboxRegistry) open(key string) (*sandbox, error) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if box, exists := registry.boxes[key]; exists {
+		return box, nil
+	}
+	if len(registry.boxes) >= registry.config.MaxNamespaces {
+		return nil, newClientError("sandbox.too_many", registry.config.MaxNamespaces)
+	}
+	box := &sandbox{name: key, store: newMemoryStore(), now: registry.start}
+	registry.boxes[key] = box
+	return box, nil
+}
+
+// The sandbox the request runs in, or nil in production.
+func sandboxOf(context *gin.Context) *sandbox {
+	if box, exists := context.Get(sandboxContextKey); exists {
+		return box.(*sandbox)
+	}
+	return nil
+}
+
+// The store the request reads and writes: its sandbox's, or production's.
+func receiptStore(context *gin.Context) Store {
+	return processingFor(context).store()
+}
+
+// The namespace named in the path, for the caller.
+func (registry *sandboxRegistry) lookup(context *gin.Context) (*sandbox, string, bool) {
+	namespace, _, err := requestedNamespace(context.Param("namespace"))
+	if err != nil {
+		respondWithError(context, http.StatusBadRequest, err)
+		return nil, "", false
+	}
+	key := sandboxKey(context, namespace)
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	return registry.boxes[key], key, true
+}
+
+/*
+Sets the time a namespace's receipts are processed at from a body like
+{"now": "2024-03-01T12:00:00Z"}, making the namespace if it's new.
+*/
+func (registry *sandboxRegistry) putClock(context *gin.Context) {
+	var request struct {
+		Now time.Time `json:"now"`
+	}
+	if err := decodeJSON(context.Request.Body, &request, "sandbox.clock_invalid"); err != nil || request.Now.IsZero() {
+		respondWithMessage(context, http.StatusBadRequest, "sandbox.clock_invalid")
+		return
+	}
+	_, key, valid := registry.lookup(context)
+	if !valid {
+		return
+	}
+	box, err := registry.open(key)
+	if err != nil {
+		respondWithError(context, http.StatusServiceUnavailable, err)
+		return
+	}
+	box.mutex.Lock()
+	box.now = request.Now.UTC()
+	box.mutex.Unlock()
+	context.IndentedJSON(http.StatusOK, gin.H{"namespace": context.Param("namespace"), "now": box.Now()})
+}
+
+/*
+Wipes a namespace: its receipts, their images, balances and audit entries
+go, and its clock and id sequence start over.
+*/
+func (registry *sandboxRegistry) wipe(context *gin.Context) {
+	box, key, valid := registry.lookup(context)
+	if !valid {
+		return
+	}
+	wiped := 0
+	if box != nil {
+		registry.mutex.Lock()
+		delete(registry.boxes, key)
+		registry.mutex.Unlock()
+
+		err := box.store.Export(func(entry snapshotEntry) error {
+			if entry.Receipt != nil {
+				wiped++
+				// images are kept with production's, by the receipt's id
+				return receiptBlobs.remove(entry.Receipt.ID)
+			}
+			return nil
+		})
+		if err != nil {
+			respondWithMessage(context, http.StatusInternalServerError, "sandbox.wipe_failed")
+			return
+		}
+	}
+	context.IndentedJSON(http.StatusOK, gin.H{"namespace": context.Param("namespace"), "receiptsWiped": wiped})
+}
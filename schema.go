@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+/*
+How receipts' JSON is checked, set from RECEIPT_SCHEMA. Lenient receipts
+keep fields the schema doesn't know in their extras, so partners' own data
+comes back with the receipt. Strict receipts may not have any, and must
+also have the metadata that's otherwise optional: the retailer, every
+item's description and the store location.
+*/
+const (
+	schemaLenient = "lenient"
+	schemaStrict  = "strict"
+)
+
+// Global schema mode receipts are decoded and validated under.
+var receiptSchema = schemaLenient
+
+func validateSchemaMode(mode string) error {
+	if mode != schemaLenient && mode != schemaStrict {
+		return errors.New("RECEIPT_SCHEMA must be lenient or strict, not " + mode)
+	}
+	return nil
+}
+
+// The JSON names of the struct's fields, in lower case since decoding ignores case.
+func jsonFieldNames(structType reflect.Type) map[string]bool {
+	names := make(map[string]bool)
+	for index := 0; index < structType.NumField(); index++ {
+		name, _, _ := strings.Cut(structType.Field(index).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names[strings.ToLower(name)] = true
+		}
+	}
+	return names
+}
+
+var (
+	receiptFields = jsonFieldNames(reflect.TypeOf(Receipt{}))
+	itemFields    = jsonFieldNames(reflect.TypeOf(Item{}))
+)
+
+/*
+Decodes a receipt, sorting the receipt's and its items' unknown fields into
+their extras, or refusing them in strict mode with each one's path.
+*/
+func (receipt *Receipt) UnmarshalJSON(data []byte) error {
+	// the same fields without this method, so decoding them doesn't recurse
+	type plainReceipt Receipt
+	var plain plainReceipt
+	if err := json.Unmarshal(data, &plain); err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	var items struct {
+		Items []map[string]json.RawMessage `json:"items"`
+	}
+	// decoding the receipt checked these are objects
+	json.Unmarshal(data, &fields)
+	json.Unmarshal(data, &items)
+
+	invalid := &validationError{}
+	plain.Extras = sortExtras(fields, receiptFields, plain.Extras, "", invalid)
+	for index, item := range items.Items {
+		if index < len(plain.Items) {
+			path := fmt.Sprintf("items[%d].", index)
+			plain.Items[index].Extras = sortExtras(item, itemFields, plain.Items[index].Extras, path, invalid)
+		}
+	}
+	if err := invalid.orNil(); err != nil {
+		return err
+	}
+	*receipt = Receipt(plain)
+	return nil
+}
+
+// Adds the unknown fields to the extras, or reports them when the schema is strict.
+func sortExtras(
+	fields map[string]json.RawMessage, known map[string]bool, extras map[string]json.RawMessage, path string,
+	invalid *validationError,
+) map[string]json.RawMessage {
+	for name, value := range fields {
+		if known[strings.ToLower(name)] {
+			continue
+		}
+		if receiptSchema == schemaStrict {
+			invalid.add(path+name, "receipt.field_unknown", path+name)
+			continue
+		}
+		if extras == nil {
+			extras = make(map[string]json.RawMessage)
+		}
+		extras[name] = value
+	}
+	return extras
+}
+
+// In strict mode, adds the optional metadata the receipt is missing to invalid.
+func requireMetadata(receipt Receipt, invalid *validationError) {
+	if receiptSchema != schemaStrict {
+		return
+	}
+	if strings.TrimSpace(receipt.Retailer) == "" {
+		invalid.add("retailer", "receipt.field_required", "retailer")
+	}
+	if len(receipt.Items) == 0 {
+		invalid.add("items", "receipt.field_required", "items")
+	}
+	for index, item := range receipt.Items {
+		if strings.TrimSpace(item.Description) == "" {
+			field := fmt.Sprintf("items[%d].shortDescription", index)
+			invalid.add(field, "receipt.field_required", field)
+		}
+	}
+	if receipt.Location == nil {
+		invalid.add("storeLocation", "receipt.field_required", "storeLocation")
+	}
+}
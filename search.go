@@ -0,0 +1,168 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A receipt matching a search, and how well it matches.
+type searchHit struct {
+	Record storedReceipt
+	Score  float64
+}
+
+// Most results one page of a search returns.
+const maxSearchLimit = 100
+
+// Splits text into the lower case words search indexes and matches on.
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(char rune) bool {
+		return !unicode.IsLetter(char) && !unicode.IsDigit(char)
+	})
+}
+
+// The text of a receipt that's searchable: its retailer and item descriptions.
+func searchableText(receipt Receipt) string {
+	parts := []string{receipt.Retailer}
+	for _, item := range receipt.Items {
+		parts = append(parts, item.Description)
+	}
+	return strings.Join(parts, " ")
+}
+
+/*
+An inverted index from words to the receipts containing them, with how
+many times each receipt uses the word. Callers synchronize access.
+*/
+type searchIndex struct {
+	postings map[string]map[string]int
+	// insertion order of receipts, for ordering equally ranked results
+	sequence map[string]int
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: make(map[string]map[string]int),
+		sequence: make(map[string]int),
+	}
+}
+
+func (index *searchIndex) add(record storedReceipt) {
+	if _, exists := index.sequence[record.ID]; !exists {
+		index.sequence[record.ID] = len(index.sequence)
+	}
+	for _, term := range searchTerms(searchableText(record.Receipt)) {
+		if index.postings[term] == nil {
+			index.postings[term] = make(map[string]int)
+		}
+		index.postings[term][record.ID]++
+	}
+}
+
+func (index *searchIndex) remove(record storedReceipt) {
+	for _, term := range searchTerms(searchableText(record.Receipt)) {
+		delete(index.postings[term], record.ID)
+		if len(index.postings[term]) == 0 {
+			delete(index.postings, term)
+		}
+	}
+}
+
+/*
+Returns the ids of receipts containing every term, best match first. Each
+term scores its count in the receipt weighted by how rare the term is
+(tf-idf); ties go to the most recent receipt.
+*/
+func (index *searchIndex) search(terms []string) []searchHit {
+	if len(terms) == 0 {
+		return nil
+	}
+	scores := make(map[string]float64)
+	for position, term := range terms {
+		postings := index.postings[term]
+		weight := math.Log(float64(len(index.sequence))/float64(len(postings)+1)) + 1
+		next := make(map[string]float64)
+		for id, count := range postings {
+			if _, matched := scores[id]; matched || position == 0 {
+				next[id] = scores[id] + float64(count)*weight
+			}
+		}
+		scores = next
+	}
+
+	hits := make([]searchHit, 0, len(scores))
+	for id, score := range scores {
+		hits = append(hits, searchHit{Record: storedReceipt{ID: id}, Score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return index.sequence[hits[i].Record.ID] > index.sequence[hits[j].Record.ID]
+	})
+	return hits
+}
+
+/*
+Searches item descriptions and retailer names for receipts containing all
+of the words in q, ranked by relevance and paged with limit and offset.
+Receipts can be narrowed to those with every tag given as a tag parameter,
+e.g. ?q=gatorade&tag=campaign:spring, and to the channel they came in
+through, e.g. &channel=manual, or listed by tag or channel alone.
+*/
+func searchReceipts(context *gin.Context) {
+	query := strings.TrimSpace(context.Query("q"))
+	tags := append([]string{}, normalizeTags(context.QueryArray("tag"))...)
+	channel := strings.ToLower(strings.TrimSpace(context.Query("channel")))
+	if channel != "" && !slices.Contains(receiptChannels, channel) {
+		respondWithMessage(context, http.StatusBadRequest, "search.channel_invalid", channel, strings.Join(receiptChannels, ", "))
+		return
+	}
+	if query == "" && len(tags) == 0 && channel == "" {
+		respondWithMessage(context, http.StatusBadRequest, "search.query_required")
+		return
+	}
+	limit, limitError := strconv.Atoi(context.DefaultQuery("limit", "20"))
+	offset, offsetError := strconv.Atoi(context.DefaultQuery("offset", "0"))
+	if limitError != nil || offsetError != nil || limit < 1 || limit > maxSearchLimit || offset < 0 {
+		respondWithMessage(context, http.StatusBadRequest, "search.page_invalid", maxSearchLimit)
+		return
+	}
+
+	hits, total, err := receiptStore(context).Search(query, tags, channel, offset, limit)
+	if err != nil {
+		respondWithMessage(context, http.StatusInternalServerError, "search.failed")
+		return
+	}
+
+	results := make([]gin.H, 0, len(hits))
+	for _, hit := range hits {
+		results = append(results, gin.H{
+			"id":          hit.Record.ID,
+			"score":       hit.Score,
+			"userId":      hit.Record.UserID,
+			"points":      hit.Record.Points,
+			"channel":     hit.Record.Channel,
+			"processedAt": hit.Record.ProcessedAt,
+			"receipt":     hit.Record.Receipt,
+			"links":       receiptLinks(hit.Record.ID),
+		})
+	}
+	respondCacheableJSON(
+		context,
+		gin.H{
+			"query": query, "tags": tags, "channel": channel,
+			"total": total, "offset": offset, "limit": limit, "results": results,
+		},
+		time.Time{},
+		cacheRevalidate,
+	)
+}
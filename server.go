@@ -0,0 +1,82 @@
+//go:build !lambda
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+/*
+Starts serving the router. Plain HTTP is used unless a certificate is
+configured, either as cert/key files or through autocert, in which case an
+optional second listener redirects HTTP traffic to HTTPS.
+*/
+func runServer(config Config, handler http.Handler) error {
+	server := &http.Server{Addr: config.Address, Handler: handler}
+
+	redirectHandler := redirectToHTTPS(config.Address)
+
+	switch {
+	case len(config.AutocertDomains) > 0:
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(config.AutocertDomains...),
+			Cache:      autocert.DirCache(config.AutocertCacheDir),
+			Email:      config.AutocertEmail,
+		}
+		server.TLSConfig = manager.TLSConfig()
+		// the redirect listener also answers the ACME http-01 challenges
+		redirectHandler = manager.HTTPHandler(redirectHandler)
+	case config.TLSCertFile != "" || config.TLSKeyFile != "":
+		if config.TLSCertFile == "" || config.TLSKeyFile == "" {
+			return errors.New("both TLS_CERT_FILE and TLS_KEY_FILE must be set")
+		}
+		certificate, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	default:
+		log.Printf("Listening for HTTP on %s", config.Address)
+		return server.ListenAndServe()
+	}
+
+	if config.HTTPRedirectAddress != "" {
+		go func() {
+			log.Printf("Redirecting HTTP on %s to HTTPS", config.HTTPRedirectAddress)
+			err := http.ListenAndServe(config.HTTPRedirectAddress, redirectHandler)
+			if err != nil {
+				log.Printf("HTTP redirect listener stopped: %v", err)
+			}
+		}()
+	}
+
+	log.Printf("Listening for HTTPS on %s", config.Address)
+	// certificates are already in the TLS config, so no files are passed here
+	return server.ListenAndServeTLS("", "")
+}
+
+/*
+Returns a handler that permanently redirects to the same host and path over
+HTTPS, keeping the HTTPS listener's port when it isn't the default one.
+*/
+func redirectToHTTPS(httpsAddress string) http.Handler {
+	_, httpsPort, _ := net.SplitHostPort(httpsAddress)
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		host := request.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		target := "https://" + host + request.URL.RequestURI()
+		http.Redirect(writer, request, target, http.StatusMovedPermanently)
+	})
+}
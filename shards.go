@@ -0,0 +1,975 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Points each shard gets on the hash ring; more spread receipts more evenly.
+const ringReplicas = 128
+
+/*
+A consistent hash ring placing keys on shards by name, so adding or
+removing a shard only moves the keys that hash near its points.
+*/
+type hashRing struct {
+	hashes []uint64
+	owners []int
+}
+
+func newHashRing(names []string) *hashRing {
+	type point struct {
+		hash  uint64
+		owner int
+	}
+	var points []point
+	for owner, name := range names {
+		for replica := 0; replica < ringReplicas; replica++ {
+			points = append(points, point{hash: ringHash(fmt.Sprintf("%s#%d", name, replica)), owner: owner})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+
+	ring := &hashRing{}
+	for _, point := range points {
+		ring.hashes = append(ring.hashes, point.hash)
+		ring.owners = append(ring.owners, point.owner)
+	}
+	return ring
+}
+
+// Returns the index of the shard owning the key.
+func (ring *hashRing) owner(key string) int {
+	hash := ringHash(key)
+	index := sort.Search(len(ring.hashes), func(i int) bool { return ring.hashes[i] >= hash })
+	if index == len(ring.hashes) {
+		index = 0
+	}
+	return ring.owners[index]
+}
+
+func ringHash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+type storeShard struct {
+	name string
+	Store
+}
+
+/*
+Spreads receipts across several stores by receipt id, for deployments too
+big for one database. Each receipt's points are credited on its shard along
+with the receipt, so a user's balance is the sum of their balances on every
+shard. Everything that isn't a receipt (profiles, the audit trail, reports,
+adjustments, donations and transfers) lives on the first shard, the
+primary, so adding shards never strands it; points are moved to the primary
+before a deduction that its share of the balance can't cover.
+
+Retired shards are read from until rebalance has moved their receipts to
+the shards now owning them. Until then, receipts that haven't moved yet are
+found on the shard the previous ring placed them on, so a lookup tries at
+most two shards.
+*/
+type shardedStore struct {
+	// the ring's shards, the primary first
+	shards  []storeShard
+	retired []storeShard
+	ring    *hashRing
+	// the ring before the shards changed and its shards' names, nil once rebalanced
+	previous      *hashRing
+	previousNames []string
+}
+
+/*
+Opens the shards listed in STORE_SHARDS (and STORE_RETIRED_SHARDS) as
+name=url pairs, where the url is a Postgres connection string or "memory".
+A shard's name places it on the ring, so it must never change. The previous
+ring is STORE_PREVIOUS_SHARDS, or with only retired shards, every shard.
+*/
+func openShardedStore(config Config) (*shardedStore, error) {
+	open := func(pairs []string) ([]storeShard, error) {
+		var shards []storeShard
+		for _, pair := range pairs {
+			name, url, found := strings.Cut(pair, "=")
+			name, url = strings.TrimSpace(name), strings.TrimSpace(url)
+			if !found || name == "" || url == "" {
+				return nil, fmt.Errorf("store shards are name=url pairs, not %q", pair)
+			}
+			store, err := openNamedStore(name, url, config, config.ClusterMode)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open store shard %s: %w", name, err)
+			}
+			shards = append(shards, storeShard{name: name, Store: store})
+		}
+		return shards, nil
+	}
+
+	shards, err := open(config.StoreShards)
+	if err != nil {
+		return nil, err
+	}
+	if len(shards) == 0 {
+		return nil, errors.New("STORE_BACKEND=sharded needs STORE_SHARDS")
+	}
+	retired, err := open(config.RetiredShards)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(shards))
+	for index, shard := range shards {
+		names[index] = shard.name
+	}
+	store := &shardedStore{shards: shards, retired: retired, ring: newHashRing(names)}
+
+	previous := config.PreviousShards
+	if len(previous) == 0 && len(retired) > 0 {
+		for _, shard := range store.all() {
+			previous = append(previous, shard.name)
+		}
+	}
+	for _, name := range previous {
+		if _, found := store.named(name); !found {
+			return nil, fmt.Errorf("STORE_PREVIOUS_SHARDS names shard %s, which isn't in STORE_SHARDS or STORE_RETIRED_SHARDS", name)
+		}
+	}
+	if len(previous) > 0 {
+		store.previous, store.previousNames = newHashRing(previous), previous
+	}
+	return store, nil
+}
+
+/*
+Opens one of several stores by url, "memory" or a PostgreSQL url, naming
+its circuit breaker after it. Only stores that relay receipt events pass
+on other replicas' events in cluster mode.
+*/
+func openNamedStore(name string, url string, config Config, relay bool) (Store, error) {
+	if url == "memory" {
+		if config.ClusterMode {
+			return nil, errors.New("CLUSTER_MODE needs shared stores, not memory ones")
+		}
+		return newMemoryStore(), nil
+	}
+	store, err := newPostgresStore(url, config.MigrateOnStartup)
+	if err != nil {
+		return nil, err
+	}
+	if relay {
+		store.relayEvents(receiptEvents)
+	}
+	guard := newDependencyGuard("store:"+name, config.Resilience, transientStoreError)
+	return guardedStore{Store: store, guard: guard}, nil
+}
+
+func (store *shardedStore) primary() storeShard {
+	return store.shards[0]
+}
+
+func (store *shardedStore) owner(receiptID string) storeShard {
+	return store.shards[store.ring.owner(receiptID)]
+}
+
+// The shard with the name, retired or not.
+func (store *shardedStore) named(name string) (storeShard, bool) {
+	for _, shard := range store.all() {
+		if shard.name == name {
+			return shard, true
+		}
+	}
+	return storeShard{}, false
+}
+
+/*
+The shard the previous ring placed the receipt on, if the shards changed
+since and it isn't the shard owning the receipt now.
+*/
+func (store *shardedStore) previousOwner(receiptID string) (storeShard, bool) {
+	if store.previous == nil {
+		return storeShard{}, false
+	}
+	name := store.previousNames[store.previous.owner(receiptID)]
+	if name == store.owner(receiptID).name {
+		return storeShard{}, false
+	}
+	return store.named(name)
+}
+
+// Every shard holding data, retired ones included.
+func (store *shardedStore) all() []storeShard {
+	return append(append([]storeShard{}, store.shards...), store.retired...)
+}
+
+/*
+Runs the call on the receipt's shard, then on the shard it was on before
+the shards changed while the first answers errReceiptNotFound, in case the
+receipt hasn't moved yet.
+*/
+func onReceiptShard[T any](store *shardedStore, id string, call func(shard storeShard) (T, error)) (T, error) {
+	result, err := call(store.owner(id))
+	if !errors.Is(err, errReceiptNotFound) {
+		return result, err
+	}
+	if previous, found := store.previousOwner(id); found {
+		return call(previous)
+	}
+	return result, err
+}
+
+func (store *shardedStore) SaveReceipt(record storedReceipt) (int, error) {
+	// a receipt that hasn't moved yet is replaced where it is, so its points aren't counted twice
+	target := store.owner(record.ID)
+	if previous, found := store.previousOwner(record.ID); found {
+		_, err := previous.GetReceipt(record.ID)
+		if err == nil {
+			target = previous
+		} else if !errors.Is(err, errReceiptNotFound) {
+			return 0, err
+		}
+	}
+
+	if _, err := target.SaveReceipt(record); err != nil {
+		return 0, err
+	}
+	if record.UserID == "" {
+		return 0, nil
+	}
+	return store.Balance(record.UserID)
+}
+
+func (store *shardedStore) GetReceipt(id string) (storedReceipt, error) {
+	return onReceiptShard(store, id, func(shard storeShard) (storedReceipt, error) { return shard.GetReceipt(id) })
+}
+
+func (store *shardedStore) DeleteReceipt(id string, owner string) (storedReceipt, error) {
+	return onReceiptShard(store, id, func(shard storeShard) (storedReceipt, error) {
+		return shard.DeleteReceipt(id, owner)
+	})
+}
+
+func (store *shardedStore) RestoreReceipt(id string, owner string) (storedReceipt, error) {
+	return onReceiptShard(store, id, func(shard storeShard) (storedReceipt, error) {
+		return shard.RestoreReceipt(id, owner)
+	})
+}
+
+func (store *shardedStore) ResolveReview(id string, approve bool) (storedReceipt, int, error) {
+	record, err := onReceiptShard(store, id, func(shard storeShard) (storedReceipt, error) {
+		record, _, err := shard.ResolveReview(id, approve)
+		return record, err
+	})
+	if err != nil || record.UserID == "" {
+		return record, 0, err
+	}
+	balance, err := store.Balance(record.UserID)
+	return record, balance, err
+}
+
+func (store *shardedStore) RemoveReceipt(id string) error {
+	_, err := onReceiptShard(store, id, func(shard storeShard) (struct{}, error) {
+		return struct{}{}, shard.RemoveReceipt(id)
+	})
+	return err
+}
+
+// Collects the call's results from every shard.
+func fromEveryShard[T any](store *shardedStore, call func(shard storeShard) ([]T, error)) ([]T, error) {
+	var results []T
+	for _, shard := range store.all() {
+		shardResults, err := call(shard)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, shardResults...)
+	}
+	return results, nil
+}
+
+func (store *shardedStore) PendingReview(limit int) ([]storedReceipt, error) {
+	records, err := fromEveryShard(store, func(shard storeShard) ([]storedReceipt, error) {
+		return shard.PendingReview(limit)
+	})
+	sort.SliceStable(records, func(i, j int) bool { return records[i].ProcessedAt.Before(records[j].ProcessedAt) })
+	return records[:min(limit, len(records))], err
+}
+
+func (store *shardedStore) PendingReviewSince(userID string, since time.Time) ([]string, error) {
+	ids, err := fromEveryShard(store, func(shard storeShard) ([]string, error) {
+		return shard.PendingReviewSince(userID, since)
+	})
+	// a receipt being rebalanced is briefly on both shards
+	slices.Sort(ids)
+	return slices.Compact(ids), err
+}
+
+func (store *shardedStore) TrashedReceipts(limit int) ([]storedReceipt, error) {
+	records, err := fromEveryShard(store, func(shard storeShard) ([]storedReceipt, error) {
+		return shard.TrashedReceipts(limit)
+	})
+	sort.SliceStable(records, func(i, j int) bool { return records[i].DeletedAt.After(*records[j].DeletedAt) })
+	return records[:min(limit, len(records))], err
+}
+
+func (store *shardedStore) ListTrashedReceipts(after string, limit int) ([]storedReceipt, error) {
+	records, err := fromEveryShard(store, func(shard storeShard) ([]storedReceipt, error) {
+		return shard.ListTrashedReceipts(after, limit)
+	})
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+	// a receipt being rebalanced is briefly on both shards
+	records = slices.CompactFunc(records, func(a storedReceipt, b storedReceipt) bool { return a.ID == b.ID })
+	return records[:min(limit, len(records))], err
+}
+
+func (store *shardedStore) PurgeTrash(before time.Time) (int, error) {
+	purged := 0
+	for _, shard := range store.all() {
+		count, err := shard.PurgeTrash(before)
+		purged += count
+		if err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+func (store *shardedStore) RecentReceipts(limit int) ([]storedReceipt, error) {
+	records, err := fromEveryShard(store, func(shard storeShard) ([]storedReceipt, error) {
+		return shard.RecentReceipts(limit)
+	})
+	sort.SliceStable(records, func(i, j int) bool { return records[i].ProcessedAt.After(records[j].ProcessedAt) })
+	return records[:min(limit, len(records))], err
+}
+
+func (store *shardedStore) ListReceipts(userID string, after string, limit int) ([]storedReceipt, error) {
+	records, err := fromEveryShard(store, func(shard storeShard) ([]storedReceipt, error) {
+		return shard.ListReceipts(userID, after, limit)
+	})
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+	// a receipt being rebalanced is briefly on both shards
+	records = slices.CompactFunc(records, func(a storedReceipt, b storedReceipt) bool { return a.ID == b.ID })
+	return records[:min(limit, len(records))], err
+}
+
+func (store *shardedStore) CountReceipts(userID string) (int, bool, error) {
+	total, exact := 0, true
+	for _, shard := range store.all() {
+		count, shardExact, err := shard.CountReceipts(userID)
+		if err != nil {
+			return 0, false, err
+		}
+		total += count
+		exact = exact && shardExact
+	}
+	return total, exact, nil
+}
+
+func (store *shardedStore) CountByPoints(lowerBounds []int) ([]int, error) {
+	counts := make([]int, len(lowerBounds))
+	for _, shard := range store.all() {
+		shardCounts, err := shard.CountByPoints(lowerBounds)
+		if err != nil {
+			return nil, err
+		}
+		for index, count := range shardCounts {
+			counts[index] += count
+		}
+	}
+	return counts, nil
+}
+
+func (store *shardedStore) Balance(userID string) (int, error) {
+	balance := 0
+	for _, shard := range store.all() {
+		points, err := shard.Balance(userID)
+		if err != nil {
+			return 0, err
+		}
+		balance += points
+	}
+	return balance, nil
+}
+
+// Adds up each user's share on every shard.
+func (store *shardedStore) ListBalances(after string, limit int) ([]userBalance, error) {
+	shares, err := fromEveryShard(store, func(shard storeShard) ([]userBalance, error) {
+		return shard.ListBalances(after, limit)
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(shares, func(i, j int) bool { return shares[i].UserID < shares[j].UserID })
+	var balances []userBalance
+	for _, share := range shares {
+		if last := len(balances) - 1; last >= 0 && balances[last].UserID == share.UserID {
+			balances[last].Points += share.Points
+			continue
+		}
+		balances = append(balances, share)
+	}
+	return balances[:min(limit, len(balances))], nil
+}
+
+// Replaces the shard-local balances in applied entries with the users' whole balances.
+func (store *shardedStore) withBalances(entries []ledgerEntry) ([]ledgerEntry, error) {
+	balances := make(map[string]int)
+	for index, entry := range entries {
+		if _, known := balances[entry.UserID]; !known && entry.UserID != "" {
+			balance, err := store.Balance(entry.UserID)
+			if err != nil {
+				return nil, err
+			}
+			balances[entry.UserID] = balance
+		}
+		entries[index].Balance = balances[entry.UserID]
+	}
+	return entries, nil
+}
+
+func (store *shardedStore) AdjustBalance(entry ledgerEntry) (ledgerEntry, error) {
+	applied, err := store.primary().AdjustBalance(entry)
+	if err != nil {
+		return ledgerEntry{}, err
+	}
+	balances, err := store.withBalances([]ledgerEntry{applied})
+	if err != nil {
+		return ledgerEntry{}, err
+	}
+	return balances[0], nil
+}
+
+func (store *shardedStore) MovePoints(entries ...ledgerEntry) ([]ledgerEntry, error) {
+	changes := make(map[string]int)
+	for _, entry := range entries {
+		changes[entry.UserID] += entry.Points
+	}
+	gathered := false
+	for userID, change := range changes {
+		if change < 0 {
+			moved, err := store.gatherPoints(userID, -change)
+			if err != nil {
+				return nil, err
+			}
+			gathered = gathered || moved
+		}
+	}
+	if gathered {
+		// the entries follow the moves they needed in the ledger
+		entries = append([]ledgerEntry{}, entries...)
+		for index := range entries {
+			entries[index].At = wallClock.Now()
+		}
+	}
+
+	applied, err := store.primary().MovePoints(entries...)
+	if err != nil {
+		return nil, err
+	}
+	return store.withBalances(applied)
+}
+
+/*
+Makes sure the primary holds at least the given points of the user's
+balance, moving points there from the other shards as needed. Each move
+takes the points off one shard before crediting the primary (and puts them
+back if that fails), so a failure part way leaves points where they were
+rather than counting them twice.
+*/
+func (store *shardedStore) gatherPoints(userID string, points int) (bool, error) {
+	primary := store.primary()
+	held, err := primary.Balance(userID)
+	if err != nil || held >= points {
+		return false, err
+	}
+	missing := points - held
+
+	for _, shard := range store.all()[1:] {
+		available, err := shard.Balance(userID)
+		if err != nil {
+			return true, err
+		}
+		if available <= 0 {
+			continue
+		}
+		moved := min(available, missing)
+
+		taken := newLedgerEntry(userID, ledgerShardMove, -moved, "")
+		taken.Counterparty = primary.name
+		if _, err := shard.MovePoints(taken); errors.Is(err, errInsufficientPoints) {
+			continue
+		} else if err != nil {
+			return true, err
+		}
+		given := newLedgerEntry(userID, ledgerShardMove, moved, "")
+		given.Counterparty = shard.name
+		if _, err := primary.AdjustBalance(given); err != nil {
+			returned := newLedgerEntry(userID, ledgerShardMove, moved, "")
+			returned.Counterparty = primary.name
+			if _, returnError := shard.AdjustBalance(returned); returnError != nil {
+				log.Printf("Failed to return %d points of %s to shard %s: %v", moved, userID, shard.name, returnError)
+			}
+			return true, err
+		}
+
+		missing -= moved
+		if missing == 0 {
+			return true, nil
+		}
+	}
+	return true, errInsufficientPoints
+}
+
+/*
+Merges the user's newest entries from every shard. The balance after each
+entry is worked back from the user's whole balance, since each shard only
+knows its own share.
+*/
+func (store *shardedStore) Ledger(userID string, limit int) ([]ledgerEntry, error) {
+	entries, err := fromEveryShard(store, func(shard storeShard) ([]ledgerEntry, error) {
+		return shard.Ledger(userID, limit)
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].At.After(entries[j].At) })
+	entries = entries[:min(limit, len(entries))]
+
+	balance, err := store.Balance(userID)
+	if err != nil {
+		return nil, err
+	}
+	for index := range entries {
+		entries[index].Balance = balance
+		balance -= entries[index].Points
+	}
+	return entries, nil
+}
+
+func (store *shardedStore) LedgerSince(userID string, kind string, since time.Time) ([]ledgerEntry, error) {
+	entries, err := fromEveryShard(store, func(shard storeShard) ([]ledgerEntry, error) {
+		return shard.LedgerSince(userID, kind, since)
+	})
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].At.Before(entries[j].At) })
+	return entries, err
+}
+
+func (store *shardedStore) DonationTotals() ([]charityTotal, error) {
+	return store.primary().DonationTotals()
+}
+
+func (store *shardedStore) RecordAudit(entry auditEntry) error {
+	return store.primary().RecordAudit(entry)
+}
+
+func (store *shardedStore) AuditTrail(receiptID string, userID string, limit int) ([]auditEntry, error) {
+	return store.primary().AuditTrail(receiptID, userID, limit)
+}
+
+func (store *shardedStore) Profile(userID string) (userProfile, error) {
+	return store.primary().Profile(userID)
+}
+
+func (store *shardedStore) SaveProfile(profile userProfile) error {
+	return store.primary().SaveProfile(profile)
+}
+
+func (store *shardedStore) RegisterTransaction(transaction merchantTransaction) error {
+	return store.primary().RegisterTransaction(transaction)
+}
+
+func (store *shardedStore) Transaction(merchant string, transactionID string) (merchantTransaction, error) {
+	return store.primary().Transaction(merchant, transactionID)
+}
+
+func (store *shardedStore) ClaimTransaction(match transactionMatch) (merchantTransaction, error) {
+	return store.primary().ClaimTransaction(match)
+}
+
+func (store *shardedStore) ReleaseTransaction(receiptID string) error {
+	return store.primary().ReleaseTransaction(receiptID)
+}
+
+func (store *shardedStore) Search(query string, tags []string, channel string, offset int, limit int) ([]searchHit, int, error) {
+	var hits []searchHit
+	total := 0
+	for _, shard := range store.all() {
+		shardHits, shardTotal, err := shard.Search(query, tags, channel, 0, offset+limit)
+		if err != nil {
+			return nil, 0, err
+		}
+		hits = append(hits, shardHits...)
+		total += shardTotal
+	}
+	sort.SliceStable(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Record.ProcessedAt.After(hits[j].Record.ProcessedAt)
+	})
+	offset = min(offset, len(hits))
+	return hits[offset:min(offset+limit, len(hits))], total, nil
+}
+
+func (store *shardedStore) Stats(since time.Time) (receiptStats, error) {
+	var stats receiptStats
+	retailers := make(map[string]*retailerStats)
+	regions := make(map[string]*regionStats)
+	rules := make(map[string]*ruleStats)
+	for _, shard := range store.all() {
+		shardStats, err := shard.Stats(since)
+		if err != nil {
+			return receiptStats{}, err
+		}
+		stats.Receipts += shardStats.Receipts
+		stats.TotalPoints += shardStats.TotalPoints
+		for _, retailer := range shardStats.Retailers {
+			if retailers[retailer.Retailer] == nil {
+				retailers[retailer.Retailer] = &retailerStats{Retailer: retailer.Retailer}
+			}
+			retailers[retailer.Retailer].Receipts += retailer.Receipts
+			retailers[retailer.Retailer].Points += retailer.Points
+		}
+		for _, region := range shardStats.Regions {
+			if regions[region.Region] == nil {
+				regions[region.Region] = &regionStats{Region: region.Region}
+			}
+			regions[region.Region].Receipts += region.Receipts
+			regions[region.Region].Points += region.Points
+		}
+		for _, rule := range shardStats.Rules {
+			if rules[rule.Rule] == nil {
+				rules[rule.Rule] = &ruleStats{Rule: rule.Rule}
+			}
+			rules[rule.Rule].Hits += rule.Hits
+			rules[rule.Rule].Points += rule.Points
+		}
+	}
+
+	for _, retailer := range retailers {
+		stats.Retailers = append(stats.Retailers, *retailer)
+	}
+	for _, region := range regions {
+		stats.Regions = append(stats.Regions, *region)
+	}
+	for _, rule := range rules {
+		stats.Rules = append(stats.Rules, *rule)
+	}
+	return stats, nil
+}
+
+/*
+Totals the period across shards. A user with receipts on several shards is
+counted once on each, so Users is an upper bound.
+*/
+func (store *shardedStore) Rollup(start time.Time, end time.Time) (report, error) {
+	var rollup report
+	retailers := make(map[string]*reportRetailer)
+	for _, shard := range store.all() {
+		shardRollup, err := shard.Rollup(start, end)
+		if err != nil {
+			return report{}, err
+		}
+		rollup.Receipts += shardRollup.Receipts
+		rollup.Points += shardRollup.Points
+		rollup.Users += shardRollup.Users
+		for _, retailer := range shardRollup.Retailers {
+			if retailers[retailer.Retailer] == nil {
+				retailers[retailer.Retailer] = &reportRetailer{Retailer: retailer.Retailer}
+			}
+			retailers[retailer.Retailer].Receipts += retailer.Receipts
+			retailers[retailer.Retailer].Points += retailer.Points
+			retailers[retailer.Retailer].Users += retailer.Users
+		}
+	}
+
+	rollup.Retailers = make([]reportRetailer, 0, len(retailers))
+	for _, retailer := range retailers {
+		rollup.Retailers = append(rollup.Retailers, *retailer)
+	}
+	sort.Slice(rollup.Retailers, func(i, j int) bool {
+		return rollup.Retailers[i].Retailer < rollup.Retailers[j].Retailer
+	})
+	return rollup, nil
+}
+
+func (store *shardedStore) SaveReport(saved report) error {
+	return store.primary().SaveReport(saved)
+}
+
+func (store *shardedStore) Reports(period string, from time.Time, to time.Time) ([]report, error) {
+	return store.primary().Reports(period, from, to)
+}
+
+// Like Rollup, counts a user once on each shard they have receipts on.
+func (store *shardedStore) VariantStats() ([]variantStats, error) {
+	byVariant := make(map[string]*variantStats)
+	var order []string
+	for _, shard := range store.all() {
+		shardStats, err := shard.VariantStats()
+		if err != nil {
+			return nil, err
+		}
+		for _, stats := range shardStats {
+			if byVariant[stats.Variant] == nil {
+				byVariant[stats.Variant] = &variantStats{Variant: stats.Variant}
+				order = append(order, stats.Variant)
+			}
+			byVariant[stats.Variant].Receipts += stats.Receipts
+			byVariant[stats.Variant].Users += stats.Users
+			byVariant[stats.Variant].TotalPoints += stats.TotalPoints
+		}
+	}
+
+	results := make([]variantStats, 0, len(order))
+	for _, variant := range order {
+		stats := byVariant[variant]
+		stats.AveragePoints = float64(stats.TotalPoints) / float64(stats.Receipts)
+		results = append(results, *stats)
+	}
+	return results, nil
+}
+
+/*
+Visits every shard's receipts, then each user's whole balance. Each shard
+is exported as of its own point in time rather than all of them at once.
+*/
+func (store *shardedStore) Export(visit func(entry snapshotEntry) error) error {
+	balances := make(map[string]int)
+	for _, shard := range store.all() {
+		err := shard.Export(func(entry snapshotEntry) error {
+			if entry.Balance != nil {
+				balances[entry.Balance.UserID] += entry.Balance.Points
+				return nil
+			}
+			return visit(entry)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	users := make([]string, 0, len(balances))
+	for userID := range balances {
+		users = append(users, userID)
+	}
+	sort.Strings(users)
+	for _, userID := range users {
+		if err := visit(snapshotEntry{Balance: &userBalance{UserID: userID, Points: balances[userID]}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Replaces every shard's contents, sending each receipt to the shard owning
+it and the balances to the primary; retired shards are emptied. The shards
+import side by side and only finish once the snapshot has been read to the
+end, so a bad snapshot leaves them all untouched, but one failing to save
+doesn't undo the others.
+*/
+func (store *shardedStore) Import(next func() (snapshotEntry, error)) error {
+	type delivery struct {
+		entry snapshotEntry
+		err   error
+	}
+	shards := store.all()
+	feeds := make([]chan delivery, len(shards))
+	finished := make([]chan error, len(shards))
+	for index, shard := range shards {
+		feeds[index] = make(chan delivery, 64)
+		finished[index] = make(chan error, 1)
+		go func(shard storeShard, feed chan delivery, done chan error) {
+			done <- shard.Import(func() (snapshotEntry, error) {
+				delivered, open := <-feed
+				if !open {
+					return snapshotEntry{}, io.EOF
+				}
+				return delivered.entry, delivered.err
+			})
+		}(shard, feeds[index], finished[index])
+	}
+
+	// a shard that gave up stops reading, so deliveries to it are dropped
+	failed := make([]error, len(shards))
+	deliver := func(index int, delivered delivery) {
+		if failed[index] != nil {
+			return
+		}
+		select {
+		case feeds[index] <- delivered:
+		case err := <-finished[index]:
+			failed[index] = fmt.Errorf("shard %s: %w", shards[index].name, err)
+		}
+	}
+	owners := make(map[string]int, len(store.shards))
+	for index, shard := range store.shards {
+		owners[shard.name] = index
+	}
+
+	for {
+		entry, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			for index := range shards {
+				deliver(index, delivery{err: err})
+			}
+			break
+		}
+		index := 0
+		if entry.Receipt != nil {
+			index = owners[store.owner(entry.Receipt.ID).name]
+		}
+		deliver(index, delivery{entry: entry})
+	}
+
+	var errs []error
+	for index := range shards {
+		close(feeds[index])
+		if failed[index] == nil {
+			if err := <-finished[index]; err != nil {
+				failed[index] = fmt.Errorf("shard %s: %w", shards[index].name, err)
+			}
+		}
+		errs = append(errs, failed[index])
+	}
+	return errors.Join(errs...)
+}
+
+/*
+Sends each receipt to the shard owning it, and makes up the difference
+between a user's whole balance and the one merged on the primary.
+*/
+func (store *shardedStore) Merge(entries []snapshotEntry) error {
+	owned := make(map[string][]snapshotEntry)
+	var balances []userBalance
+	for _, entry := range entries {
+		if entry.Receipt != nil {
+			owner := store.owner(entry.Receipt.ID).name
+			owned[owner] = append(owned[owner], snapshotEntry{Receipt: entry.Receipt})
+		}
+		if entry.Balance != nil {
+			balances = append(balances, *entry.Balance)
+		}
+	}
+	for _, shard := range store.shards {
+		if len(owned[shard.name]) == 0 {
+			continue
+		}
+		if err := shard.Merge(owned[shard.name]); err != nil {
+			return fmt.Errorf("shard %s: %w", shard.name, err)
+		}
+	}
+
+	primary := store.primary()
+	for _, balance := range balances {
+		whole, err := store.Balance(balance.UserID)
+		if err != nil {
+			return err
+		}
+		share, err := primary.Balance(balance.UserID)
+		if err != nil {
+			return err
+		}
+		share += balance.Points - whole
+		if err := primary.Merge([]snapshotEntry{{Balance: &userBalance{UserID: balance.UserID, Points: share}}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Runs the rebalance subcommand, which moves every receipt that isn't on the
+shard owning it there, e.g. after adding a shard or retiring one:
+
+	main rebalance            move misplaced receipts
+	main rebalance -dry-run   only count them
+
+Each receipt is saved on its new shard before it's removed from its old
+one, so running it again after an interruption picks up where it left off.
+The service can keep running meanwhile.
+*/
+func runRebalanceCommand(config Config, arguments []string) error {
+	if config.StoreBackend != "sharded" {
+		return errors.New("rebalancing only applies to STORE_BACKEND=sharded")
+	}
+	for _, pair := range append(append([]string{}, config.StoreShards...), config.RetiredShards...) {
+		if _, url, _ := strings.Cut(pair, "="); strings.TrimSpace(url) == "memory" {
+			return errors.New("rebalancing needs Postgres shards; memory shards don't outlive the process")
+		}
+	}
+	dryRun := len(arguments) > 0 && strings.TrimLeft(arguments[0], "-") == "dry-run"
+	store, err := openShardedStore(config)
+	if err != nil {
+		return err
+	}
+	_, err = store.rebalance(dryRun)
+	return err
+}
+
+// Moves (or with dryRun only counts) the receipts that aren't on the shard owning them, returning how many.
+func (store *shardedStore) rebalance(dryRun bool) (int, error) {
+	total := 0
+	for _, shard := range store.all() {
+		moved := make(map[string]int)
+		err := shard.Export(func(entry snapshotEntry) error {
+			if entry.Receipt == nil {
+				return nil
+			}
+			target := store.owner(entry.Receipt.ID)
+			if target.name == shard.name {
+				return nil
+			}
+			moved[target.name]++
+			total++
+			if dryRun {
+				return nil
+			}
+			return moveReceipt(*entry.Receipt, shard, target)
+		})
+		if err != nil {
+			return total, fmt.Errorf("rebalancing shard %s failed: %w", shard.name, err)
+		}
+		for target, count := range moved {
+			log.Printf("%d receipts from shard %s belong on shard %s", count, shard.name, target)
+		}
+	}
+	return total, nil
+}
+
+/*
+Moves a receipt and its points between shards. A copy the target already
+has that's newer (rescored since the shards changed) wins over the old one.
+*/
+func moveReceipt(record storedReceipt, from storeShard, to storeShard) error {
+	existing, err := to.GetReceipt(record.ID)
+	if err != nil && !errors.Is(err, errReceiptNotFound) {
+		return err
+	}
+	if err != nil || !existing.ProcessedAt.After(record.ProcessedAt) {
+		if err == nil {
+			// replaces the older copy unless it changes meanwhile
+			record.Version = existing.Version
+		}
+		if _, err := to.SaveReceipt(record); err != nil {
+			return err
+		}
+	}
+	err = from.RemoveReceipt(record.ID)
+	if errors.Is(err, errReceiptNotFound) {
+		return nil
+	}
+	return err
+}
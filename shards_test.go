@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// Memory shards by name, on a ring of them all, remembering the previous ring's names if any.
+func newTestShardedStore(shards []storeShard, previous ...string) *shardedStore {
+	names := make([]string, len(shards))
+	for index, shard := range shards {
+		names[index] = shard.name
+	}
+	store := &shardedStore{shards: shards, ring: newHashRing(names)}
+	if len(previous) > 0 {
+		store.previous, store.previousNames = newHashRing(previous), previous
+	}
+	return store
+}
+
+func memoryShards(names ...string) []storeShard {
+	shards := make([]storeShard, len(names))
+	for index, name := range names {
+		shards[index] = storeShard{name: name, Store: newMemoryStore()}
+	}
+	return shards
+}
+
+// Adding a shard only takes keys over to it, about its share of them.
+func TestHashRingAddingAShard(t *testing.T) {
+	before := newHashRing([]string{"a", "b", "c"})
+	after := newHashRing([]string{"a", "b", "c", "d"})
+	const keys = 10000
+	moved := 0
+	for index := 0; index < keys; index++ {
+		key := fmt.Sprintf("receipt-%d", index)
+		was, now := before.owner(key), after.owner(key)
+		if was == now {
+			continue
+		}
+		if now != 3 {
+			t.Fatalf("%s moved from shard %d to %d, want only moves to the new shard", key, was, now)
+		}
+		moved++
+	}
+	if moved < keys/8 || moved > keys/2 {
+		t.Errorf("%d of %d keys moved to the new shard, want about a quarter", moved, keys)
+	}
+}
+
+// A user's balance is their shares on every shard, and spending it draws on them all.
+func TestShardedStoreBalances(t *testing.T) {
+	store := newTestShardedStore(memoryShards("primary", "second", "third"))
+	for index := 0; index < 30; index++ {
+		record := storedReceipt{ID: fmt.Sprintf("receipt-%d", index), UserID: "alice", Points: 10}
+		if _, err := store.SaveReceipt(record); err != nil {
+			t.Fatalf("SaveReceipt() failed: %v", err)
+		}
+	}
+	spread := 0
+	for _, shard := range store.shards {
+		if share, _ := shard.Balance("alice"); share > 0 {
+			spread++
+		}
+	}
+	if spread < 2 {
+		t.Fatalf("alice's receipts all landed on one shard, want them spread")
+	}
+	if balance, _ := store.Balance("alice"); balance != 300 {
+		t.Fatalf("Balance() = %d, want 300", balance)
+	}
+
+	// more than the primary's share, so points move there first
+	applied, err := store.MovePoints(newLedgerEntry("alice", ledgerDonation, -250, ""))
+	if err != nil {
+		t.Fatalf("MovePoints() failed: %v", err)
+	}
+	if applied[0].Balance != 50 {
+		t.Errorf("MovePoints() left a balance of %d, want 50", applied[0].Balance)
+	}
+	// it follows the moves it needed
+	entries, _ := store.Ledger("alice", 1)
+	if len(entries) != 1 || entries[0].Kind != ledgerDonation || entries[0].Balance != 50 {
+		t.Errorf("newest ledger entry is %+v, want the donation leaving 50", entries)
+	}
+	if _, err := store.MovePoints(newLedgerEntry("alice", ledgerDonation, -60, "")); !errors.Is(err, errInsufficientPoints) {
+		t.Errorf("overspending MovePoints() = %v, want errInsufficientPoints", err)
+	}
+	if balance, _ := store.Balance("alice"); balance != 50 {
+		t.Errorf("Balance() = %d after spending, want 50", balance)
+	}
+}
+
+// After a shard is added, receipts are found where they were until rebalancing moves them.
+func TestShardedStoreRebalance(t *testing.T) {
+	shards := memoryShards("primary", "second", "third")
+	before := newTestShardedStore(shards[:2])
+	const count = 60
+	for index := 0; index < count; index++ {
+		record := storedReceipt{ID: fmt.Sprintf("receipt-%d", index), UserID: "alice", Points: 5}
+		if _, err := before.SaveReceipt(record); err != nil {
+			t.Fatalf("SaveReceipt() failed: %v", err)
+		}
+	}
+	if _, err := before.DeleteReceipt("receipt-0", ""); err != nil {
+		t.Fatalf("DeleteReceipt() failed: %v", err)
+	}
+
+	store := newTestShardedStore(shards, "primary", "second")
+	for index := 1; index < count; index++ {
+		if _, err := store.GetReceipt(fmt.Sprintf("receipt-%d", index)); err != nil {
+			t.Fatalf("GetReceipt(receipt-%d) before rebalancing failed: %v", index, err)
+		}
+	}
+	misplaced, err := store.rebalance(true)
+	if err != nil || misplaced == 0 {
+		t.Fatalf("dry run rebalance() = %d, %v, want some receipts to move", misplaced, err)
+	}
+
+	moved, err := store.rebalance(false)
+	if err != nil || moved != misplaced {
+		t.Fatalf("rebalance() = %d, %v, want the dry run's %d", moved, err, misplaced)
+	}
+	for index := 1; index < count; index++ {
+		id := fmt.Sprintf("receipt-%d", index)
+		for _, shard := range store.shards {
+			_, err := shard.GetReceipt(id)
+			if onShard, owns := err == nil, shard.name == store.owner(id).name; onShard != owns {
+				t.Errorf("%s is on shard %s: %v, want it only on %s", id, shard.name, onShard, store.owner(id).name)
+			}
+		}
+	}
+	// the trash moves too
+	for _, shard := range store.shards {
+		trashed, _ := shard.TrashedReceipts(10)
+		if onShard, owns := len(trashed) == 1, shard.name == store.owner("receipt-0").name; onShard != owns {
+			t.Errorf("shard %s has %d trashed receipts, want receipt-0 only on %s", shard.name, len(trashed), store.owner("receipt-0").name)
+		}
+	}
+	if balance, _ := store.Balance("alice"); balance != (count-1)*5 {
+		t.Errorf("Balance() = %d after rebalancing, want %d", balance, (count-1)*5)
+	}
+	if again, err := store.rebalance(false); err != nil || again != 0 {
+		t.Errorf("second rebalance() = %d, %v, want nothing left to move", again, err)
+	}
+}
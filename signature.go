@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	signatureHeader          = "X-Signature"
+	signatureTimestampHeader = "X-Signature-Timestamp"
+	signatureNonceHeader     = "X-Signature-Nonce"
+)
+
+/*
+Computes the hex encoded HMAC-SHA256 a partner is expected to send for a
+request body. The timestamp is signed along with the body so a captured
+signature can't be reused with a fresh timestamp.
+*/
+func computeSignature(secret string, timestamp string, body []byte) string {
+	mac := newSignatureMAC(secret, timestamp)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// An HMAC that has been given the timestamp, ready for the body to be written to it.
+func newSignatureMAC(secret string, timestamp string) hash.Hash {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	return mac
+}
+
+/*
+What a submission's signature covers besides its body: the method and path,
+so a signature captured for one endpoint can't be replayed against another,
+then the timestamp and the nonce when one is sent.
+*/
+func signedPrefix(method string, path string, timestamp string, nonce string) string {
+	signed := method + "\n" + path + "\n" + timestamp
+	if nonce != "" {
+		signed += "." + nonce
+	}
+	return signed
+}
+
+/*
+What signed submissions are checked against: the shared secret, how far a
+timestamp may be from the server's clock, and, with a nonce cache, how long
+a submission is remembered to refuse it being sent again.
+*/
+type signatureCheck struct {
+	secret       string
+	maxSkew      time.Duration
+	nonces       nonceCache
+	replayWindow time.Duration
+}
+
+// The code to refuse a signature timestamp with, or "" when it's recent enough.
+func (check signatureCheck) timestampError(timestamp string) string {
+	unixSeconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "signature.timestamp_invalid"
+	}
+	skew := time.Since(time.Unix(unixSeconds, 0))
+	if skew > check.maxSkew || skew < -check.maxSkew {
+		return "signature.expired"
+	}
+	return ""
+}
+
+/*
+Checks that the signature was made with the secret for the method, path,
+timestamp, nonce and body, then that it wasn't received before. It returns
+the status and code to refuse the submission with, or 0 and "".
+*/
+func (check signatureCheck) verify(
+	method string, path string, signature string, timestamp string, nonce string, body []byte,
+) (int, string) {
+	return check.accept(computeSignature(check.secret, signedPrefix(method, path, timestamp, nonce), body), signature, nonce)
+}
+
+// Like verify, for a signature expected to be the given one.
+func (check signatureCheck) accept(expected string, signature string, nonce string) (int, string) {
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return http.StatusUnauthorized, "signature.mismatch"
+	}
+	if nonce == "" {
+		nonce = signature
+	}
+
+	// checked once the signature is known to be genuine, so nobody else can use up a nonce
+	if check.nonces != nil {
+		replayed, err := check.nonces.seen(nonce, check.replayWindow)
+		if err != nil {
+			log.Printf("Failed to check signature nonce: %v", err)
+			return http.StatusServiceUnavailable, "signature.replay_check_failed"
+		}
+		if replayed {
+			return http.StatusConflict, "signature.replayed"
+		}
+	}
+	return 0, ""
+}
+
+/*
+The submission's signature headers, or false once it's been aborted for
+missing them or for a timestamp further than the check's skew from the
+server's clock.
+*/
+func (check signatureCheck) headers(context *gin.Context) (signature string, timestamp string, nonce string, ok bool) {
+	signature = context.GetHeader(signatureHeader)
+	timestamp = context.GetHeader(signatureTimestampHeader)
+	nonce = context.GetHeader(signatureNonceHeader)
+	if signature == "" || timestamp == "" {
+		abortWithMessage(context, http.StatusUnauthorized, "signature.missing")
+		return "", "", "", false
+	}
+	// check the timestamp before doing any hashing of the body
+	if code := check.timestampError(timestamp); code != "" {
+		abortWithMessage(context, http.StatusUnauthorized, code)
+		return "", "", "", false
+	}
+	return signature, timestamp, nonce, true
+}
+
+// Aborts the submission if its body couldn't be read, reporting whether it was.
+func abortUnreadBody(context *gin.Context, err error, maxBody int64) bool {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		abortWithMessage(context, http.StatusRequestEntityTooLarge, "request.body_too_large", maxBody)
+	case err != nil:
+		abortWithMessage(context, http.StatusBadRequest, "request.body_unreadable")
+	default:
+		return false
+	}
+	return true
+}
+
+/*
+Middleware that rejects submissions whose signature doesn't match the body,
+or whose timestamp is too far off, or that were sent before; a nonce, when
+sent, is signed along with the timestamp. The body is read whole to check
+it, so bodies over maxBody are refused with 413.
+*/
+func verifySignature(check signatureCheck, maxBody int64) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		signature, timestamp, nonce, ok := check.headers(context)
+		if !ok {
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(context.Writer, context.Request.Body, maxBody))
+		if abortUnreadBody(context, err, maxBody) {
+			return
+		}
+		// put the body back so the handler can still bind it
+		context.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		status, code := check.verify(
+			context.Request.Method, context.Request.URL.Path, signature, timestamp, nonce, body,
+		)
+		if status != 0 {
+			abortWithMessage(context, status, code)
+			return
+		}
+
+		context.Next()
+	}
+}
+
+/*
+Like verifySignature, for batches too large to hold in memory. The body is
+hashed as it's written to a temporary file, which the handler then streams
+from. Nothing in it is processed before the whole body has been checked,
+since a forged one would otherwise be part way scored when the signature
+turns out wrong.
+*/
+func verifySpooledSignature(check signatureCheck, maxBody int64) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		signature, timestamp, nonce, ok := check.headers(context)
+		if !ok {
+			return
+		}
+		spool, err := os.CreateTemp("", "signed-body-*")
+		if err != nil {
+			log.Printf("Failed to create a file for a signed body: %v", err)
+			abortWithMessage(context, http.StatusInternalServerError, "request.spool_failed")
+			return
+		}
+		defer func() {
+			spool.Close()
+			os.Remove(spool.Name())
+		}()
+
+		mac := newSignatureMAC(
+			check.secret, signedPrefix(context.Request.Method, context.Request.URL.Path, timestamp, nonce),
+		)
+		body := http.MaxBytesReader(context.Writer, context.Request.Body, maxBody)
+		_, err = io.Copy(spool, io.TeeReader(body, mac))
+		// the file failing to take it isn't the client's fault
+		var fileError *fs.PathError
+		if errors.As(err, &fileError) {
+			log.Printf("Failed to write a signed body to %s: %v", spool.Name(), err)
+			abortWithMessage(context, http.StatusInternalServerError, "request.spool_failed")
+			return
+		}
+		if abortUnreadBody(context, err, maxBody) {
+			return
+		}
+		if status, code := check.accept(hex.EncodeToString(mac.Sum(nil)), signature, nonce); status != 0 {
+			abortWithMessage(context, status, code)
+			return
+		}
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			log.Printf("Failed to rewind the file holding a signed body: %v", err)
+			abortWithMessage(context, http.StatusInternalServerError, "request.spool_failed")
+			return
+		}
+		context.Request.Body = io.NopCloser(spool)
+
+		context.Next()
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSignedPrefix(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		timestamp string
+		nonce     string
+		want      string
+	}{
+		{"without a nonce", "POST", "/receipts/process", "1700000000", "", "POST\n/receipts/process\n1700000000"},
+		{"with a nonce", "POST", "/receipts/process", "1700000000", "n1", "POST\n/receipts/process\n1700000000.n1"},
+		{"websocket submission", socketSignedMethod, "/receipts/ws", "1700000000", "", "SUBMIT\n/receipts/ws\n1700000000"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := signedPrefix(test.method, test.path, test.timestamp, test.nonce); got != test.want {
+				t.Errorf("signedPrefix() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSignatureTimestampError(t *testing.T) {
+	check := signatureCheck{secret: "secret", maxSkew: 5 * time.Minute}
+	unix := func(offset time.Duration) string { return strconv.FormatInt(time.Now().Add(offset).Unix(), 10) }
+	tests := []struct {
+		name      string
+		timestamp string
+		want      string
+	}{
+		{"now", unix(0), ""},
+		{"within the skew", unix(-4 * time.Minute), ""},
+		{"too old", unix(-10 * time.Minute), "signature.expired"},
+		{"too far ahead", unix(10 * time.Minute), "signature.expired"},
+		{"not a number", "yesterday", "signature.timestamp_invalid"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := check.timestampError(test.timestamp); got != test.want {
+				t.Errorf("timestampError(%q) = %q, want %q", test.timestamp, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSignatureVerify(t *testing.T) {
+	body := []byte(`{"retailer":"Target"}`)
+	sign := func(method string, path string, nonce string) string {
+		return computeSignature("secret", signedPrefix(method, path, "1700000000", nonce), body)
+	}
+	tests := []struct {
+		name       string
+		signature  string
+		method     string
+		path       string
+		nonce      string
+		body       []byte
+		wantStatus int
+		wantCode   string
+	}{
+		{"genuine", sign("POST", "/receipts/process", ""), "POST", "/receipts/process", "", body, 0, ""},
+		{"genuine with a nonce", sign("POST", "/receipts/process", "n1"), "POST", "/receipts/process", "n1", body, 0, ""},
+		{"other body", sign("POST", "/receipts/process", ""), "POST", "/receipts/process", "", []byte(`{}`), http.StatusUnauthorized, "signature.mismatch"},
+		{"other path", sign("POST", "/receipts/process", ""), "POST", "/receipts/batch", "", body, http.StatusUnauthorized, "signature.mismatch"},
+		{"other method", sign("POST", "/receipts/process", ""), "PUT", "/receipts/process", "", body, http.StatusUnauthorized, "signature.mismatch"},
+		{"other nonce", sign("POST", "/receipts/process", "n1"), "POST", "/receipts/process", "n2", body, http.StatusUnauthorized, "signature.mismatch"},
+		{"other secret", computeSignature("other", signedPrefix("POST", "/receipts/process", "1700000000", ""), body), "POST", "/receipts/process", "", body, http.StatusUnauthorized, "signature.mismatch"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			check := signatureCheck{secret: "secret", maxSkew: time.Minute}
+			status, code := check.verify(test.method, test.path, test.signature, "1700000000", test.nonce, test.body)
+			if status != test.wantStatus || code != test.wantCode {
+				t.Errorf("verify() = %d %q, want %d %q", status, code, test.wantStatus, test.wantCode)
+			}
+		})
+	}
+}
+
+func TestSignatureVerifyRefusesReplays(t *testing.T) {
+	body := []byte(`{"retailer":"Target"}`)
+	tests := []struct {
+		name  string
+		nonce string
+	}{
+		{"by nonce", "n1"},
+		{"by signature without a nonce", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			check := signatureCheck{secret: "secret", maxSkew: time.Minute, nonces: newMemoryNonceCache(), replayWindow: time.Minute}
+			signature := computeSignature("secret", signedPrefix("POST", "/receipts/process", "1700000000", test.nonce), body)
+			if status, code := check.verify("POST", "/receipts/process", signature, "1700000000", test.nonce, body); status != 0 {
+				t.Fatalf("first verify() = %d %q, want it accepted", status, code)
+			}
+			status, code := check.verify("POST", "/receipts/process", signature, "1700000000", test.nonce, body)
+			if status != http.StatusConflict || code != "signature.replayed" {
+				t.Errorf("second verify() = %d %q, want %d %q", status, code, http.StatusConflict, "signature.replayed")
+			}
+		})
+	}
+}
+
+// Signs a request for the middleware the way a partner would.
+func signedRequest(secret string, path string, body []byte) *http.Request {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	request.Header.Set(signatureTimestampHeader, timestamp)
+	request.Header.Set(signatureHeader, computeSignature(secret, signedPrefix(http.MethodPost, path, timestamp, ""), body))
+	return request
+}
+
+func TestSignatureMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	batch := bytes.Repeat([]byte(`{"retailer":"Target","total":"1.00"}`+"\n"), 1000)
+	check := signatureCheck{secret: "secret", maxSkew: time.Minute}
+	middlewares := map[string]func(maxBody int64) gin.HandlerFunc{
+		"buffered": func(maxBody int64) gin.HandlerFunc { return verifySignature(check, maxBody) },
+		"spooled":  func(maxBody int64) gin.HandlerFunc { return verifySpooledSignature(check, maxBody) },
+	}
+	for name, middleware := range middlewares {
+		t.Run(name, func(t *testing.T) {
+			var received []byte
+			router := gin.New()
+			router.POST("/receipts/batch", middleware(int64(len(batch))), func(context *gin.Context) {
+				received, _ = io.ReadAll(context.Request.Body)
+				context.Status(http.StatusOK)
+			})
+			serve := func(request *http.Request) int {
+				received = nil
+				recorder := httptest.NewRecorder()
+				router.ServeHTTP(recorder, request)
+				return recorder.Code
+			}
+
+			if status := serve(signedRequest("secret", "/receipts/batch", batch)); status != http.StatusOK || !bytes.Equal(received, batch) {
+				t.Errorf("genuine batch got %d with %d of %d bytes passed on, want 200 with all of them", status, len(received), len(batch))
+			}
+
+			forged := signedRequest("secret", "/receipts/batch", batch)
+			forged.Body = io.NopCloser(bytes.NewReader(append(bytes.Clone(batch[:len(batch)-1]), ' ')))
+			if status := serve(forged); status != http.StatusUnauthorized || received != nil {
+				t.Errorf("tampered batch got %d and reached the handler %v, want 401 before it", status, received != nil)
+			}
+
+			larger := append(bytes.Clone(batch), '\n')
+			if status := serve(signedRequest("secret", "/receipts/batch", larger)); status != http.StatusRequestEntityTooLarge {
+				t.Errorf("oversized batch got %d, want 413", status)
+			}
+
+			unsigned := httptest.NewRequest(http.MethodPost, "/receipts/batch", bytes.NewReader(batch))
+			if status := serve(unsigned); status != http.StatusUnauthorized || received != nil {
+				t.Errorf("unsigned batch got %d, want 401", status)
+			}
+		})
+	}
+}
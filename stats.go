@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Totals for the receipts processed since some time. Stores keep these in
+hourly buckets that are updated as receipts are saved, so a query only
+adds up buckets instead of reading every receipt.
+*/
+type receiptStats struct {
+	Receipts    int
+	TotalPoints int
+	Retailers   []retailerStats
+	Regions     []regionStats
+	Rules       []ruleStats
+}
+
+type retailerStats struct {
+	Retailer string `json:"retailer"`
+	Receipts int    `json:"receipts"`
+	Points   int    `json:"points"`
+}
+
+// Receipts purchased in a state, or without a known state when Region is "".
+type regionStats struct {
+	Region   string `json:"region"`
+	Receipts int    `json:"receipts"`
+	Points   int    `json:"points"`
+}
+
+// How often a rule awarded points, and how many.
+type ruleStats struct {
+	Rule    string  `json:"rule"`
+	Hits    int     `json:"hits"`
+	HitRate float64 `json:"hitRate"`
+	Points  int     `json:"points"`
+}
+
+// One hour's bucket of receipt stats.
+type hourlyStats struct {
+	receipts  int
+	points    int
+	retailers map[string]*retailerStats
+	regions   map[string]*regionStats
+	rules     map[string]*ruleStats
+}
+
+// Windows GET /admin/stats can report on; "all" has no start.
+var statsWindows = map[string]time.Duration{
+	"1h":  time.Hour,
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+	"30d": 30 * 24 * time.Hour,
+	"all": 0,
+}
+
+// Number of retailers listed when the request doesn't say.
+const defaultTopRetailers = 10
+
+// The hour bucket a receipt's stats are kept in.
+func statsHour(processedAt time.Time) time.Time {
+	return processedAt.UTC().Truncate(time.Hour)
+}
+
+/*
+Adds a receipt to the bucket, or takes it back out when sign is -1.
+Hits count the rules that awarded a receipt any points.
+*/
+func (bucket *hourlyStats) add(record storedReceipt, sign int) {
+	bucket.receipts += sign
+	bucket.points += sign * record.Points
+
+	retailer, exists := bucket.retailers[record.Receipt.Retailer]
+	if !exists {
+		retailer = &retailerStats{Retailer: record.Receipt.Retailer}
+		bucket.retailers[record.Receipt.Retailer] = retailer
+	}
+	retailer.Receipts += sign
+	retailer.Points += sign * record.Points
+
+	region, exists := bucket.regions[receiptRegion(record.Receipt)]
+	if !exists {
+		region = &regionStats{Region: receiptRegion(record.Receipt)}
+		bucket.regions[region.Region] = region
+	}
+	region.Receipts += sign
+	region.Points += sign * record.Points
+
+	for _, result := range record.Breakdown {
+		if result.Points == 0 {
+			continue
+		}
+		rule, exists := bucket.rules[result.Rule]
+		if !exists {
+			rule = &ruleStats{Rule: result.Rule}
+			bucket.rules[result.Rule] = rule
+		}
+		rule.Hits += sign
+		rule.Points += sign * result.Points
+	}
+}
+
+func newHourlyStats() *hourlyStats {
+	return &hourlyStats{
+		retailers: make(map[string]*retailerStats),
+		regions:   make(map[string]*regionStats),
+		rules:     make(map[string]*ruleStats),
+	}
+}
+
+/*
+Reports receipt counts, points, top retailers, regions and per-rule hit rates over a
+window (1h, 24h, 7d, 30d or all, default 24h). Windows start on the hour.
+*/
+func getStats(context *gin.Context) {
+	window := context.DefaultQuery("window", "24h")
+	length, known := statsWindows[window]
+	if !known {
+		respondWithMessage(context, http.StatusBadRequest, "stats.window_invalid", window)
+		return
+	}
+	top, err := strconv.Atoi(context.DefaultQuery("top", strconv.Itoa(defaultTopRetailers)))
+	if err != nil || top < 1 {
+		respondWithMessage(context, http.StatusBadRequest, "stats.top_invalid")
+		return
+	}
+
+	var since time.Time
+	if length > 0 {
+		since = statsHour(wallClock.Now().Add(-length))
+	}
+	stats, err := receipts.Stats(since)
+	if err != nil {
+		respondWithMessage(context, http.StatusInternalServerError, "stats.failed")
+		return
+	}
+
+	averagePoints := 0.0
+	if stats.Receipts > 0 {
+		averagePoints = float64(stats.TotalPoints) / float64(stats.Receipts)
+	}
+
+	sort.Slice(stats.Retailers, func(i, j int) bool {
+		if stats.Retailers[i].Receipts != stats.Retailers[j].Receipts {
+			return stats.Retailers[i].Receipts > stats.Retailers[j].Receipts
+		}
+		return stats.Retailers[i].Retailer < stats.Retailers[j].Retailer
+	})
+	if len(stats.Retailers) > top {
+		stats.Retailers = stats.Retailers[:top]
+	}
+
+	sort.Slice(stats.Regions, func(i, j int) bool {
+		if stats.Regions[i].Receipts != stats.Regions[j].Receipts {
+			return stats.Regions[i].Receipts > stats.Regions[j].Receipts
+		}
+		return stats.Regions[i].Region < stats.Regions[j].Region
+	})
+
+	sort.Slice(stats.Rules, func(i, j int) bool { return stats.Rules[i].Rule < stats.Rules[j].Rule })
+	for index := range stats.Rules {
+		if stats.Receipts > 0 {
+			stats.Rules[index].HitRate = float64(stats.Rules[index].Hits) / float64(stats.Receipts)
+		}
+	}
+
+	response := gin.H{
+		"window":        window,
+		"receipts":      stats.Receipts,
+		"totalPoints":   stats.TotalPoints,
+		"averagePoints": averagePoints,
+		"topRetailers":  stats.Retailers,
+		"regions":       stats.Regions,
+		"rules":         stats.Rules,
+	}
+	if !since.IsZero() {
+		response["since"] = since
+	}
+	context.IndentedJSON(http.StatusOK, response)
+}
@@ -0,0 +1,1024 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A processed receipt along with how it was scored.
+type storedReceipt struct {
+	ID          string       `json:"id"`
+	UserID      string       `json:"userId,omitempty"`
+	Receipt     Receipt      `json:"receipt"`
+	Points      int          `json:"points"`
+	Breakdown   []ruleResult `json:"breakdown"`
+	ProcessedAt time.Time    `json:"processedAt"`
+	// version of the scoring rules the points were computed with
+	RulesVersion string `json:"rulesVersion"`
+	// experiment variant whose rules scored the receipt, empty for the main rules
+	Variant string `json:"variant,omitempty"`
+	// when the receipt was moved to the trash; trashed receipts are left
+	// out of lookups, balances and stats until they're restored
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+	// reviewPending while the receipt waits in the review queue, or
+	// reviewRejected; its points are only awarded once it's approved
+	Status string `json:"status,omitempty"`
+	// why the receipt was flagged for review
+	ReviewReasons []string `json:"reviewReasons,omitempty"`
+	// the retailer's merchant, when enrichment found it
+	Merchant *merchantInfo `json:"merchant,omitempty"`
+	// how the receipt was submitted, see receiptChannels; empty for
+	// receipts saved before channels were recorded
+	Channel string `json:"channel,omitempty"`
+	// name of the partner API key that submitted the receipt, if any
+	APIKey string `json:"apiKey,omitempty"`
+	// the transaction its retailer registered, when one matched
+	Verification *merchantVerification `json:"verification,omitempty"`
+	// bumped by every change to the receipt; a record saved with a version
+	// only replaces the stored copy at that version, see nextVersion
+	Version int64 `json:"version"`
+	// when the store last changed the receipt, along with Version; zero for
+	// receipts saved before it was kept
+	ModifiedAt time.Time `json:"modifiedAt"`
+}
+
+// Whether the receipt's points count towards balances and stats.
+func (record storedReceipt) counted() bool {
+	return record.DeletedAt == nil && record.Status == ""
+}
+
+/*
+Everything the service remembers lives behind a Store, so replicas sharing
+a Store need no state of their own.
+*/
+type Store interface {
+	// Saves the receipt and credits its points to the receipt's user,
+	// returning the user's new balance. Saving a receipt again replaces
+	// its earlier points.
+	SaveReceipt(record storedReceipt) (int, error)
+	// Returns the receipt, or errReceiptNotFound.
+	GetReceipt(id string) (storedReceipt, error)
+	// Moves a receipt to the trash, taking its points back from its user.
+	// Returns errReceiptNotFound if it doesn't exist, is already trashed or
+	// belongs to someone other than owner (when owner isn't empty).
+	DeleteReceipt(id string, owner string) (storedReceipt, error)
+	// Takes a receipt back out of the trash, crediting its points again.
+	// Returns errReceiptNotFound if it isn't in the trash or isn't owner's.
+	RestoreReceipt(id string, owner string) (storedReceipt, error)
+	// Approves a receipt waiting for review, crediting its points and
+	// returning the user's new balance, or rejects it. Returns
+	// errReceiptNotFound if it isn't waiting for review.
+	ResolveReview(id string, approve bool) (storedReceipt, int, error)
+	// Returns up to limit receipts waiting for review, oldest first.
+	PendingReview(limit int) ([]storedReceipt, error)
+	// Returns the ids of the user's receipts waiting for review that were
+	// processed since the given time.
+	PendingReviewSince(userID string, since time.Time) ([]string, error)
+	// Returns up to limit trashed receipts, most recently deleted first.
+	TrashedReceipts(limit int) ([]storedReceipt, error)
+	// Returns up to limit trashed receipts with ids after the given one, in
+	// byte order of their ids.
+	ListTrashedReceipts(after string, limit int) ([]storedReceipt, error)
+	// Permanently removes receipts trashed before the given time, returning how many.
+	PurgeTrash(before time.Time) (int, error)
+	// Permanently removes a receipt, trashed or not, taking back its points
+	// if they counted, when it moves to another shard. Returns
+	// errReceiptNotFound if it doesn't exist.
+	RemoveReceipt(id string) error
+	// Returns up to limit receipts, most recently processed first.
+	RecentReceipts(limit int) ([]storedReceipt, error)
+	// Returns up to limit of the user's receipts (everyone's when userID is
+	// empty) with ids after the given one, in byte order of their ids.
+	// Trashed receipts are left out.
+	ListReceipts(userID string, after string, limit int) ([]storedReceipt, error)
+	// Counts the receipts ListReceipts would list, reporting whether the
+	// count is exact or an estimate.
+	CountReceipts(userID string) (int, bool, error)
+	// Counts receipts into buckets whose lower bounds are given in ascending order.
+	CountByPoints(lowerBounds []int) ([]int, error)
+	// Returns the points a user has earned across all their receipts.
+	Balance(userID string) (int, error)
+	// Returns up to limit balances of users with ids after the given one, in
+	// byte order of their ids.
+	ListBalances(after string, limit int) ([]userBalance, error)
+	// Applies a manual change to a user's balance, returning the ledger
+	// entry with the resulting balance.
+	AdjustBalance(entry ledgerEntry) (ledgerEntry, error)
+	// Applies the entries together, returning them with their resulting
+	// balances, or applies none and returns errInsufficientPoints if any
+	// deduction would leave a balance below zero.
+	MovePoints(entries ...ledgerEntry) ([]ledgerEntry, error)
+	// Returns up to limit of the user's ledger entries, newest first.
+	Ledger(userID string, limit int) ([]ledgerEntry, error)
+	// Returns the user's ledger entries of the kind made since the given time, oldest first.
+	LedgerSince(userID string, kind string, since time.Time) ([]ledgerEntry, error)
+	// Totals the points donated to each charity.
+	DonationTotals() ([]charityTotal, error)
+	// Appends an entry to the audit trail.
+	RecordAudit(entry auditEntry) error
+	// Returns up to limit audit entries, newest first, for the receipt and
+	// user when they're given.
+	AuditTrail(receiptID string, userID string, limit int) ([]auditEntry, error)
+	// Returns the user's profile, or the default profile if they haven't saved one.
+	Profile(userID string) (userProfile, error)
+	// Saves the user's profile, replacing any earlier one.
+	SaveProfile(profile userProfile) error
+	// Saves a transaction a merchant registered, or returns
+	// errTransactionExists if the merchant registered its id already.
+	RegisterTransaction(transaction merchantTransaction) error
+	// Returns one of the merchant's registered transactions.
+	Transaction(merchant string, transactionID string) (merchantTransaction, error)
+	// Releases any transaction the receipt claimed, then claims the one
+	// it verifies, see transactionMatch.best, or returns errTransactionNotFound.
+	ClaimTransaction(match transactionMatch) (merchantTransaction, error)
+	// Releases any transaction the receipt claimed, for other receipts to verify.
+	ReleaseTransaction(receiptID string) error
+	// Returns a page of the receipts matching a full text query and
+	// having all the tags, best match first, and how many match in all.
+	// Without a query every receipt with the tags matches, newest first.
+	Search(query string, tags []string, channel string, offset int, limit int) ([]searchHit, int, error)
+	// Totals the receipts processed since the given hour, or ever when it's zero.
+	Stats(since time.Time) (receiptStats, error)
+	// Totals the receipts processed in [start, end) into a report.
+	Rollup(start time.Time, end time.Time) (report, error)
+	// Saves a report, replacing any earlier one for the same period.
+	SaveReport(saved report) error
+	// Returns the period's reports starting in [from, to).
+	Reports(period string, from time.Time, to time.Time) ([]report, error)
+	// Summarizes receipts by the experiment variant that scored them.
+	VariantStats() ([]variantStats, error)
+	// Visits every receipt, then every balance, as of a single point in time.
+	Export(visit func(entry snapshotEntry) error) error
+	// Replaces everything in the store with the entries returned by next,
+	// which returns io.EOF after the last one.
+	Import(next func() (snapshotEntry, error)) error
+	// Writes the entries over what the store holds, keeping the rest: each
+	// receipt replaces the one with its id without changing any balance,
+	// and each balance is set by an opening ledger entry for the difference.
+	Merge(entries []snapshotEntry) error
+}
+
+// One receipt or one balance from a store snapshot.
+type snapshotEntry struct {
+	Receipt *storedReceipt `json:"receipt,omitempty"`
+	Balance *userBalance   `json:"balance,omitempty"`
+}
+
+type userBalance struct {
+	UserID string `json:"userId"`
+	Points int    `json:"points"`
+}
+
+var errReceiptNotFound = errors.New("receipt not found")
+
+var errInsufficientPoints = errors.New("insufficient points")
+
+var errReceiptConflict = errors.New("receipt was changed by another update")
+
+/*
+The version a receipt is saved as. A record carrying the version it was
+read at loses to any update saved since, with errReceiptConflict, while one
+without a version replaces whatever is stored. A receipt the store doesn't
+have yet keeps its version, so moving receipts between stores doesn't
+reset them.
+*/
+func nextVersion(record storedReceipt, previous storedReceipt, exists bool) (int64, error) {
+	if !exists {
+		return max(record.Version, 1), nil
+	}
+	if record.Version != 0 && record.Version != previous.Version {
+		return 0, errReceiptConflict
+	}
+	return previous.Version + 1, nil
+}
+
+// Keeps processed receipts in memory, safe for use by concurrent requests.
+type memoryStore struct {
+	mutex    sync.RWMutex
+	receipts map[string]storedReceipt
+	// receipt ids in the order they were processed
+	order []string
+	// points earned by each user across all their receipts
+	balances map[string]int
+	// receipt stats for each hour, see receiptStats
+	stats map[time.Time]*hourlyStats
+	// generated reports by period and start time
+	reports map[string]report
+	// words in receipts' retailers and item descriptions
+	index *searchIndex
+	// audit entries, oldest first
+	audit []auditEntry
+	// every balance change, oldest first
+	ledger []ledgerEntry
+	// profiles users have saved
+	profiles map[string]userProfile
+	// registered transactions by merchant and transaction id
+	transactions map[string]merchantTransaction
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		receipts: make(map[string]storedReceipt),
+		balances: make(map[string]int),
+		stats:    make(map[time.Time]*hourlyStats),
+		reports:  make(map[string]report),
+		index:    newSearchIndex(),
+		profiles: make(map[string]userProfile),
+
+		transactions: make(map[string]merchantTransaction),
+	}
+}
+
+func (store *memoryStore) SaveReceipt(record storedReceipt) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	previous, exists := store.receipts[record.ID]
+	version, err := nextVersion(record, previous, exists)
+	if err != nil {
+		return 0, err
+	}
+	record.Version = version
+	record.ModifiedAt = wallClock.Now()
+	if !exists {
+		store.order = append(store.order, record.ID)
+	} else if previous.DeletedAt == nil {
+		if previous.counted() {
+			store.credit(newLedgerEntry(previous.UserID, ledgerReceiptReplaced, -previous.Points, previous.ID))
+			store.countStats(previous, -1)
+		}
+		store.index.remove(previous)
+	}
+	store.receipts[record.ID] = record
+	store.index.add(record)
+
+	if !record.counted() {
+		return store.balances[record.UserID], nil
+	}
+	store.countStats(record, 1)
+	return store.credit(receiptLedgerEntry(record, ledgerReceipt)).Balance, nil
+}
+
+/*
+Applies a ledger entry to its user's balance and records it. Receipts
+without a user don't have a balance to change.
+*/
+func (store *memoryStore) credit(entry ledgerEntry) ledgerEntry {
+	if entry.UserID == "" {
+		return entry
+	}
+	store.balances[entry.UserID] += entry.Points
+	entry.Balance = store.balances[entry.UserID]
+	store.ledger = append(store.ledger, entry)
+	return entry
+}
+
+func (store *memoryStore) GetReceipt(id string) (storedReceipt, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	record, exists := store.receipts[id]
+	if !exists || record.DeletedAt != nil {
+		return storedReceipt{}, errReceiptNotFound
+	}
+	return record, nil
+}
+
+func (store *memoryStore) DeleteReceipt(id string, owner string) (storedReceipt, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	record, exists := store.receipts[id]
+	if !exists || record.DeletedAt != nil || owner != "" && record.UserID != owner {
+		return storedReceipt{}, errReceiptNotFound
+	}
+	deletedAt := wallClock.Now()
+	record.DeletedAt = &deletedAt
+	record.Version++
+	record.ModifiedAt = deletedAt
+	store.receipts[id] = record
+
+	if record.Status == "" {
+		store.credit(newLedgerEntry(record.UserID, ledgerReceiptDeleted, -record.Points, record.ID))
+		store.countStats(record, -1)
+	}
+	store.index.remove(record)
+	return record, nil
+}
+
+func (store *memoryStore) RestoreReceipt(id string, owner string) (storedReceipt, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	record, exists := store.receipts[id]
+	if !exists || record.DeletedAt == nil || owner != "" && record.UserID != owner {
+		return storedReceipt{}, errReceiptNotFound
+	}
+	record.DeletedAt = nil
+	record.Version++
+	record.ModifiedAt = wallClock.Now()
+	store.receipts[id] = record
+
+	if record.counted() {
+		store.credit(newLedgerEntry(record.UserID, ledgerReceiptRestored, record.Points, record.ID))
+		store.countStats(record, 1)
+	}
+	store.index.add(record)
+	return record, nil
+}
+
+func (store *memoryStore) ResolveReview(id string, approve bool) (storedReceipt, int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	record, exists := store.receipts[id]
+	if !exists || record.DeletedAt != nil || record.Status != reviewPending {
+		return storedReceipt{}, 0, errReceiptNotFound
+	}
+	record.Version++
+	record.ModifiedAt = wallClock.Now()
+	if !approve {
+		record.Status = reviewRejected
+		store.receipts[id] = record
+		return record, store.balances[record.UserID], nil
+	}
+
+	record.Status = ""
+	store.receipts[id] = record
+	store.countStats(record, 1)
+	entry := store.credit(receiptLedgerEntry(record, ledgerReceiptApproved))
+	return record, entry.Balance, nil
+}
+
+func (store *memoryStore) PendingReview(limit int) ([]storedReceipt, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var records []storedReceipt
+	for _, id := range store.order {
+		if len(records) == limit {
+			break
+		}
+		if record := store.receipts[id]; record.DeletedAt == nil && record.Status == reviewPending {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+func (store *memoryStore) PendingReviewSince(userID string, since time.Time) ([]string, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var ids []string
+	for _, id := range store.order {
+		record := store.receipts[id]
+		if record.UserID == userID && record.DeletedAt == nil && record.Status == reviewPending &&
+			!record.ProcessedAt.Before(since) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (store *memoryStore) TrashedReceipts(limit int) ([]storedReceipt, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var records []storedReceipt
+	for _, record := range store.receipts {
+		if record.DeletedAt != nil {
+			records = append(records, record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].DeletedAt.After(*records[j].DeletedAt) })
+	if len(records) > limit {
+		records = records[:limit]
+	}
+	return records, nil
+}
+
+func (store *memoryStore) ListTrashedReceipts(after string, limit int) ([]storedReceipt, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var records []storedReceipt
+	for id, record := range store.receipts {
+		if id > after && record.DeletedAt != nil {
+			records = append(records, record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+	return records[:min(limit, len(records))], nil
+}
+
+func (store *memoryStore) PurgeTrash(before time.Time) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	purged := 0
+	remaining := store.order[:0]
+	for _, id := range store.order {
+		record := store.receipts[id]
+		if record.DeletedAt != nil && record.DeletedAt.Before(before) {
+			delete(store.receipts, id)
+			delete(store.index.sequence, id)
+			purged++
+			continue
+		}
+		remaining = append(remaining, id)
+	}
+	store.order = remaining
+	return purged, nil
+}
+
+func (store *memoryStore) RemoveReceipt(id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	record, exists := store.receipts[id]
+	if !exists {
+		return errReceiptNotFound
+	}
+	if record.counted() {
+		store.credit(newLedgerEntry(record.UserID, ledgerReceiptMoved, -record.Points, record.ID))
+		store.countStats(record, -1)
+	}
+	if record.DeletedAt == nil {
+		store.index.remove(record)
+	}
+	delete(store.receipts, id)
+	delete(store.index.sequence, id)
+	store.order = slices.DeleteFunc(store.order, func(ordered string) bool { return ordered == id })
+	return nil
+}
+
+func (store *memoryStore) RecentReceipts(limit int) ([]storedReceipt, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	records := make([]storedReceipt, 0, limit)
+	for index := len(store.order) - 1; index >= 0 && len(records) < limit; index-- {
+		if record := store.receipts[store.order[index]]; record.DeletedAt == nil {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+func (store *memoryStore) ListReceipts(userID string, after string, limit int) ([]storedReceipt, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var records []storedReceipt
+	for id, record := range store.receipts {
+		if id > after && record.DeletedAt == nil && (userID == "" || record.UserID == userID) {
+			records = append(records, record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+	return records[:min(limit, len(records))], nil
+}
+
+func (store *memoryStore) CountReceipts(userID string) (int, bool, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	count := 0
+	for _, record := range store.receipts {
+		if record.DeletedAt == nil && (userID == "" || record.UserID == userID) {
+			count++
+		}
+	}
+	return count, true, nil
+}
+
+func (store *memoryStore) CountByPoints(lowerBounds []int) ([]int, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	counts := make([]int, len(lowerBounds))
+	for _, record := range store.receipts {
+		if !record.counted() {
+			continue
+		}
+		for index := len(lowerBounds) - 1; index >= 0; index-- {
+			if record.Points >= lowerBounds[index] {
+				counts[index]++
+				break
+			}
+		}
+	}
+	return counts, nil
+}
+
+func (store *memoryStore) Balance(userID string) (int, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return store.balances[userID], nil
+}
+
+func (store *memoryStore) ListBalances(after string, limit int) ([]userBalance, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var balances []userBalance
+	for userID, points := range store.balances {
+		if userID > after {
+			balances = append(balances, userBalance{UserID: userID, Points: points})
+		}
+	}
+	sort.Slice(balances, func(i, j int) bool { return balances[i].UserID < balances[j].UserID })
+	return balances[:min(limit, len(balances))], nil
+}
+
+func (store *memoryStore) AdjustBalance(entry ledgerEntry) (ledgerEntry, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.credit(entry), nil
+}
+
+func (store *memoryStore) MovePoints(entries ...ledgerEntry) ([]ledgerEntry, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	balances := make(map[string]int)
+	for _, entry := range entries {
+		if _, seen := balances[entry.UserID]; !seen {
+			balances[entry.UserID] = store.balances[entry.UserID]
+		}
+		balances[entry.UserID] += entry.Points
+		if entry.Points < 0 && balances[entry.UserID] < 0 {
+			return nil, errInsufficientPoints
+		}
+	}
+
+	applied := make([]ledgerEntry, len(entries))
+	for index, entry := range entries {
+		applied[index] = store.credit(entry)
+	}
+	return applied, nil
+}
+
+func (store *memoryStore) LedgerSince(userID string, kind string, since time.Time) ([]ledgerEntry, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var entries []ledgerEntry
+	for _, entry := range store.ledger {
+		if entry.UserID == userID && entry.Kind == kind && !entry.At.Before(since) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (store *memoryStore) DonationTotals() ([]charityTotal, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	totals := make(map[string]*charityTotal)
+	donors := make(map[string]map[string]bool)
+	var charities []string
+	for _, entry := range store.ledger {
+		if entry.Kind != ledgerDonation {
+			continue
+		}
+		total, exists := totals[entry.Counterparty]
+		if !exists {
+			total = &charityTotal{Charity: entry.Counterparty}
+			totals[entry.Counterparty] = total
+			donors[entry.Counterparty] = make(map[string]bool)
+			charities = append(charities, entry.Counterparty)
+		}
+		total.Donations++
+		total.Points -= entry.Points
+		donors[entry.Counterparty][entry.UserID] = true
+	}
+
+	sort.Strings(charities)
+	result := make([]charityTotal, 0, len(charities))
+	for _, charity := range charities {
+		totals[charity].Donors = len(donors[charity])
+		result = append(result, *totals[charity])
+	}
+	return result, nil
+}
+
+func (store *memoryStore) Ledger(userID string, limit int) ([]ledgerEntry, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var entries []ledgerEntry
+	for index := len(store.ledger) - 1; index >= 0 && len(entries) < limit; index-- {
+		if store.ledger[index].UserID == userID {
+			entries = append(entries, store.ledger[index])
+		}
+	}
+	return entries, nil
+}
+
+func (store *memoryStore) Export(visit func(entry snapshotEntry) error) error {
+	// copy under the lock so a slow reader doesn't hold up writers
+	store.mutex.RLock()
+	records := make([]storedReceipt, 0, len(store.order))
+	for _, id := range store.order {
+		records = append(records, store.receipts[id])
+	}
+	balances := make([]userBalance, 0, len(store.balances))
+	for userID, points := range store.balances {
+		balances = append(balances, userBalance{UserID: userID, Points: points})
+	}
+	store.mutex.RUnlock()
+
+	for index := range records {
+		if err := visit(snapshotEntry{Receipt: &records[index]}); err != nil {
+			return err
+		}
+	}
+	for index := range balances {
+		if err := visit(snapshotEntry{Balance: &balances[index]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *memoryStore) Import(next func() (snapshotEntry, error)) error {
+	// build the replacement first so a bad snapshot leaves the store untouched
+	restored := newMemoryStore()
+	for {
+		entry, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if entry.Receipt != nil {
+			if _, exists := restored.receipts[entry.Receipt.ID]; !exists {
+				restored.order = append(restored.order, entry.Receipt.ID)
+			}
+			restored.receipts[entry.Receipt.ID] = *entry.Receipt
+		}
+		if entry.Balance != nil {
+			// the restored balance starts the user's ledger over
+			restored.credit(newLedgerEntry(entry.Balance.UserID, ledgerOpening, entry.Balance.Points, ""))
+		}
+	}
+
+	for _, id := range restored.order {
+		record := restored.receipts[id]
+		if record.counted() {
+			restored.countStats(record, 1)
+		}
+		if record.DeletedAt == nil {
+			restored.index.add(record)
+		}
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.receipts = restored.receipts
+	store.order = restored.order
+	store.balances = restored.balances
+	store.ledger = restored.ledger
+	store.stats = restored.stats
+	store.index = restored.index
+	// reports of the replaced receipts no longer apply
+	store.reports = restored.reports
+	return nil
+}
+
+func (store *memoryStore) Merge(entries []snapshotEntry) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for _, entry := range entries {
+		if record := entry.Receipt; record != nil {
+			previous, exists := store.receipts[record.ID]
+			switch {
+			case !exists:
+				store.order = append(store.order, record.ID)
+			case previous.DeletedAt == nil:
+				if previous.counted() {
+					store.countStats(previous, -1)
+				}
+				store.index.remove(previous)
+			}
+			store.receipts[record.ID] = *record
+			if record.counted() {
+				store.countStats(*record, 1)
+			}
+			if record.DeletedAt == nil {
+				store.index.add(*record)
+			}
+		}
+		if balance := entry.Balance; balance != nil {
+			if difference := balance.Points - store.balances[balance.UserID]; difference != 0 {
+				store.credit(newLedgerEntry(balance.UserID, ledgerOpening, difference, ""))
+			}
+		}
+	}
+	return nil
+}
+
+// Adds the receipt to its hour's stats, or removes it when sign is -1.
+func (store *memoryStore) countStats(record storedReceipt, sign int) {
+	hour := statsHour(record.ProcessedAt)
+	bucket, exists := store.stats[hour]
+	if !exists {
+		bucket = newHourlyStats()
+		store.stats[hour] = bucket
+	}
+	bucket.add(record, sign)
+}
+
+func (store *memoryStore) Stats(since time.Time) (receiptStats, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	total := newHourlyStats()
+	for hour, bucket := range store.stats {
+		if hour.Before(since) {
+			continue
+		}
+		total.receipts += bucket.receipts
+		total.points += bucket.points
+		for name, retailer := range bucket.retailers {
+			if _, exists := total.retailers[name]; !exists {
+				total.retailers[name] = &retailerStats{Retailer: name}
+			}
+			total.retailers[name].Receipts += retailer.Receipts
+			total.retailers[name].Points += retailer.Points
+		}
+		for name, region := range bucket.regions {
+			if _, exists := total.regions[name]; !exists {
+				total.regions[name] = &regionStats{Region: name}
+			}
+			total.regions[name].Receipts += region.Receipts
+			total.regions[name].Points += region.Points
+		}
+		for name, rule := range bucket.rules {
+			if _, exists := total.rules[name]; !exists {
+				total.rules[name] = &ruleStats{Rule: name}
+			}
+			total.rules[name].Hits += rule.Hits
+			total.rules[name].Points += rule.Points
+		}
+	}
+
+	stats := receiptStats{Receipts: total.receipts, TotalPoints: total.points}
+	for _, retailer := range total.retailers {
+		if retailer.Receipts > 0 {
+			stats.Retailers = append(stats.Retailers, *retailer)
+		}
+	}
+	for _, region := range total.regions {
+		if region.Receipts > 0 {
+			stats.Regions = append(stats.Regions, *region)
+		}
+	}
+	for _, rule := range total.rules {
+		if rule.Hits > 0 {
+			stats.Rules = append(stats.Rules, *rule)
+		}
+	}
+	return stats, nil
+}
+
+func (store *memoryStore) VariantStats() ([]variantStats, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	byVariant := make(map[string]*variantStats)
+	users := make(map[string]map[string]bool)
+	var order []string
+	for _, id := range store.order {
+		record := store.receipts[id]
+		if !record.counted() {
+			continue
+		}
+		stats, exists := byVariant[record.Variant]
+		if !exists {
+			stats = &variantStats{Variant: record.Variant}
+			byVariant[record.Variant] = stats
+			users[record.Variant] = make(map[string]bool)
+			order = append(order, record.Variant)
+		}
+		stats.Receipts++
+		stats.TotalPoints += record.Points
+		if record.UserID != "" {
+			users[record.Variant][record.UserID] = true
+		}
+	}
+
+	results := make([]variantStats, 0, len(order))
+	for _, variant := range order {
+		stats := byVariant[variant]
+		stats.Users = len(users[variant])
+		stats.AveragePoints = float64(stats.TotalPoints) / float64(stats.Receipts)
+		results = append(results, *stats)
+	}
+	return results, nil
+}
+
+func (store *memoryStore) Rollup(start time.Time, end time.Time) (report, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var rollup report
+	users := make(map[string]bool)
+	retailers := make(map[string]*reportRetailer)
+	retailerUsers := make(map[string]map[string]bool)
+	for _, record := range store.receipts {
+		if !record.counted() || record.ProcessedAt.Before(start) || !record.ProcessedAt.Before(end) {
+			continue
+		}
+		rollup.Receipts++
+		rollup.Points += record.Points
+
+		name := record.Receipt.Retailer
+		retailer, exists := retailers[name]
+		if !exists {
+			retailer = &reportRetailer{Retailer: name}
+			retailers[name] = retailer
+			retailerUsers[name] = make(map[string]bool)
+		}
+		retailer.Receipts++
+		retailer.Points += record.Points
+		if record.UserID != "" {
+			users[record.UserID] = true
+			retailerUsers[name][record.UserID] = true
+		}
+	}
+
+	rollup.Users = len(users)
+	rollup.Retailers = make([]reportRetailer, 0, len(retailers))
+	for name, retailer := range retailers {
+		retailer.Users = len(retailerUsers[name])
+		rollup.Retailers = append(rollup.Retailers, *retailer)
+	}
+	sort.Slice(rollup.Retailers, func(i, j int) bool {
+		return rollup.Retailers[i].Retailer < rollup.Retailers[j].Retailer
+	})
+	return rollup, nil
+}
+
+func (store *memoryStore) SaveReport(saved report) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.reports[saved.Period+"/"+saved.Start.UTC().Format(time.RFC3339)] = saved
+	return nil
+}
+
+func (store *memoryStore) Reports(period string, from time.Time, to time.Time) ([]report, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var reports []report
+	for _, saved := range store.reports {
+		if saved.Period == period && !saved.Start.Before(from) && saved.Start.Before(to) {
+			reports = append(reports, saved)
+		}
+	}
+	return reports, nil
+}
+
+func (store *memoryStore) Search(query string, tags []string, channel string, offset int, limit int) ([]searchHit, int, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var hits []searchHit
+	if query != "" {
+		hits = store.index.search(searchTerms(query))
+	} else {
+		for index := len(store.order) - 1; index >= 0; index-- {
+			if record := store.receipts[store.order[index]]; record.DeletedAt == nil {
+				hits = append(hits, searchHit{Record: storedReceipt{ID: record.ID}})
+			}
+		}
+	}
+	hits = slices.DeleteFunc(hits, func(hit searchHit) bool {
+		record := store.receipts[hit.Record.ID]
+		return !hasTags(record.Receipt, tags) || channel != "" && record.Channel != channel
+	})
+	total := len(hits)
+	if offset > total {
+		offset = total
+	}
+	hits = hits[offset:min(offset+limit, total)]
+	for index := range hits {
+		hits[index].Record = store.receipts[hits[index].Record.ID]
+	}
+	return hits, total, nil
+}
+
+func (store *memoryStore) RecordAudit(entry auditEntry) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.audit = append(store.audit, entry)
+	return nil
+}
+
+func (store *memoryStore) AuditTrail(receiptID string, userID string, limit int) ([]auditEntry, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var entries []auditEntry
+	for index := len(store.audit) - 1; index >= 0 && len(entries) < limit; index-- {
+		entry := store.audit[index]
+		if (receiptID == "" || entry.ReceiptID == receiptID) && (userID == "" || entry.UserID == userID) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (store *memoryStore) Profile(userID string) (userProfile, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	if profile, exists := store.profiles[userID]; exists {
+		return profile, nil
+	}
+	return defaultProfile(userID), nil
+}
+
+func (store *memoryStore) SaveProfile(profile userProfile) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.profiles[profile.UserID] = profile
+	return nil
+}
+
+func transactionKey(merchant string, transactionID string) string {
+	return merchant + "\x00" + transactionID
+}
+
+func (store *memoryStore) RegisterTransaction(transaction merchantTransaction) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	key := transactionKey(transaction.Merchant, transaction.TransactionID)
+	if _, exists := store.transactions[key]; exists {
+		return errTransactionExists
+	}
+	store.transactions[key] = transaction
+	return nil
+}
+
+func (store *memoryStore) Transaction(merchant string, transactionID string) (merchantTransaction, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	transaction, exists := store.transactions[transactionKey(merchant, transactionID)]
+	if !exists {
+		return merchantTransaction{}, errTransactionNotFound
+	}
+	return transaction, nil
+}
+
+func (store *memoryStore) ClaimTransaction(match transactionMatch) (merchantTransaction, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.releaseTransaction(match.ReceiptID)
+	candidates := make([]merchantTransaction, 0)
+	for _, transaction := range store.transactions {
+		candidates = append(candidates, transaction)
+	}
+	transaction, found := match.best(candidates)
+	if !found {
+		return merchantTransaction{}, errTransactionNotFound
+	}
+	transaction.ReceiptID = match.ReceiptID
+	store.transactions[transactionKey(transaction.Merchant, transaction.TransactionID)] = transaction
+	return transaction, nil
+}
+
+func (store *memoryStore) ReleaseTransaction(receiptID string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.releaseTransaction(receiptID)
+	return nil
+}
+
+func (store *memoryStore) releaseTransaction(receiptID string) {
+	for key, transaction := range store.transactions {
+		if transaction.ReceiptID == receiptID {
+			transaction.ReceiptID = ""
+			store.transactions[key] = transaction
+		}
+	}
+}
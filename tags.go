@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Limits on receipts' tags, so they stay labels rather than a place for data.
+const (
+	maxTags      = 20
+	maxTagLength = 40
+)
+
+// A tag as it's stored and matched: trimmed and in lower case.
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// The tags normalized, without duplicates, in the order they were first given.
+func normalizeTags(tags []string) []string {
+	var normalized []string
+	for _, tag := range tags {
+		if tag = normalizeTag(tag); !slices.Contains(normalized, tag) {
+			normalized = append(normalized, tag)
+		}
+	}
+	return normalized
+}
+
+/*
+Adds the tags that aren't allowed to invalid. Tags are up to maxTagLength
+letters, digits, dashes, underscores and colons, starting with a letter or
+digit, e.g. "campaign:spring-2024".
+*/
+func validateTags(tags []string, invalid *validationError) {
+	if len(tags) > maxTags {
+		invalid.add("tags", "receipt.tags_too_many", maxTags)
+	}
+	for index, tag := range tags {
+		if !validTag(normalizeTag(tag)) {
+			invalid.add(fmt.Sprintf("tags[%d]", index), "receipt.tag_invalid", tag, maxTagLength)
+		}
+	}
+}
+
+func validTag(tag string) bool {
+	if tag == "" || utf8.RuneCountInString(tag) > maxTagLength {
+		return false
+	}
+	for position, char := range tag {
+		alphanumeric := unicode.IsLetter(char) || unicode.IsDigit(char)
+		if !alphanumeric && (position == 0 || !strings.ContainsRune("-_:", char)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether the receipt has every one of the tags.
+func hasTags(receipt Receipt, tags []string) bool {
+	for _, tag := range tags {
+		if !slices.Contains(receipt.Tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Tags a processed receipt with the tags in the request body, e.g.
+{"tags": ["campaign:spring"]}, keeping the ones it has.
+*/
+func addReceiptTags(context *gin.Context) {
+	var request struct {
+		Tags []string `json:"tags"`
+	}
+	if err := decodeJSON(context.Request.Body, &request, "tags.bind_failed"); err != nil {
+		respondWithError(context, http.StatusBadRequest, err)
+		return
+	}
+	invalid := &validationError{}
+	if len(request.Tags) == 0 {
+		invalid.add("tags", "tags.required")
+	}
+	validateTags(request.Tags, invalid)
+	if err := invalid.orNil(); err != nil {
+		respondWithError(context, http.StatusBadRequest, err)
+		return
+	}
+	retagReceipt(context, func(tags []string) []string { return append(tags, request.Tags...) })
+}
+
+// Takes a tag off a processed receipt.
+func removeReceiptTag(context *gin.Context) {
+	removed := normalizeTag(context.Param("tag"))
+	retagReceipt(context, func(tags []string) []string {
+		return slices.DeleteFunc(tags, func(tag string) bool { return tag == removed })
+	})
+}
+
+/*
+Changes the tags of the receipt the request names, keeping its points: a
+receipt is only scored again when its rules can award points by tag, and
+then as of when it was processed, with the rules it was scored with. When
+those rules aren't loaded anymore, only the tags change. Like updates,
+it's refused with 409 when the receipt changes meanwhile or doesn't have
+the version in If-Match.
+*/
+func retagReceipt(context *gin.Context, change func(tags []string) []string) {
+	store := receiptStore(context)
+	previous, err := store.GetReceipt(context.Param("id"))
+	if err != nil && !errors.Is(err, errReceiptNotFound) {
+		respondWithMessage(context, http.StatusInternalServerError, "points.lookup_failed")
+		return
+	}
+	// other users' receipts look missing to authenticated callers
+	scope := ownerScope(context)
+	if err != nil || scope != "" && previous.UserID != scope {
+		respondWithMessage(context, http.StatusNotFound, "receipt.not_found")
+		return
+	}
+	if expected, given := ifMatchVersion(context.GetHeader("If-Match")); given && expected != previous.Version {
+		respondWithMessage(context, http.StatusConflict, "receipt.version_mismatch", previous.Version, expected)
+		return
+	}
+
+	record := previous
+	record.Receipt.Tags = normalizeTags(change(slices.Clone(previous.Receipt.Tags)))
+	invalid := &validationError{}
+	validateTags(record.Receipt.Tags, invalid)
+	if err := invalid.orNil(); err != nil {
+		respondWithError(context, http.StatusBadRequest, err)
+		return
+	}
+
+	rules, variant := rulesFor(previous.UserID, previous.ID)
+	if rules.readsTags() && rules.Version == previous.RulesVersion && variant == previous.Variant {
+		var scoreError error
+		err := scoringPool.run(func() {
+			record, scoreError = rescore(rules, CapsConfig{ReceiptPoints: pointsCaps.ReceiptPoints}, record)
+		})
+		if err == nil {
+			err = scoreError
+		}
+		if err != nil {
+			respondWithProcessError(context, err)
+			return
+		}
+	}
+
+	balance, err := store.SaveReceipt(record)
+	if updateConflict(err) {
+		respondWithProcessError(context, errSaveConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to save receipt %s's tags: %v", record.ID, err)
+		respondWithProcessError(context, errSaveFailed)
+		return
+	}
+	record.Version = previous.Version + 1
+	if sandboxOf(context) == nil {
+		invalidatePoints(record.ID)
+		if record.Points != previous.Points && record.Status == "" {
+			receiptEvents.publish(receiptEvent{
+				ID:       record.ID,
+				UserID:   record.UserID,
+				Retailer: record.Receipt.Retailer,
+				Points:   record.Points,
+				Balance:  balance,
+			})
+			notifyPointsAwardedFor(record, balance)
+		}
+	}
+	recordAudit(context, auditEntry{
+		Action:    auditReceiptTagged,
+		ReceiptID: record.ID,
+		UserID:    record.UserID,
+		Before:    &previous,
+		After:     &record,
+		Points:    record.Points - previous.Points,
+	})
+
+	tags := record.Receipt.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	context.IndentedJSON(http.StatusOK, gin.H{
+		"id":             record.ID,
+		"tags":           tags,
+		"points":         record.Points,
+		"previousPoints": previous.Points,
+		"version":        record.Version,
+		"links":          receiptLinks(record.ID),
+	})
+}
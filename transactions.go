@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+A purchase a retailer registered from its point of sale, so a receipt a
+user submits for it later can be verified. Merchant is the merchantKey of
+the API key's merchant, and ReceiptID the receipt verified against it.
+*/
+type merchantTransaction struct {
+	Merchant      string    `json:"merchant"`
+	TransactionID string    `json:"transactionId"`
+	Total         string    `json:"total"`
+	PurchasedAt   time.Time `json:"purchasedAt"`
+	StoreID       string    `json:"storeId,omitempty"`
+	RegisteredAt  time.Time `json:"registeredAt"`
+	ReceiptID     string    `json:"receiptId,omitempty"`
+
+	// the total in cents, which receipts are matched on
+	cents int64
+}
+
+/*
+What a receipt claims about its purchase, to find the transaction it
+verifies. Receipts that are saved again keep their claim while they still
+match.
+*/
+type transactionMatch struct {
+	Merchant    string
+	ReceiptID   string
+	Cents       int64
+	PurchasedAt time.Time
+	StoreID     string
+}
+
+// How far a receipt's purchase time may be from the registered one, for tills and printers whose clocks differ.
+const transactionTimeTolerance = 10 * time.Minute
+
+// Name of the merchant-verified rule unless the rules config names it.
+const defaultMerchantVerifiedName = "merchant-verified"
+
+// Longest transaction id a retailer can register.
+const maxTransactionIDLength = 100
+
+// Stored with a receipt verified against a registered transaction.
+type merchantVerification struct {
+	Merchant      string    `json:"merchant"`
+	TransactionID string    `json:"transactionId"`
+	VerifiedAt    time.Time `json:"verifiedAt"`
+}
+
+var errTransactionNotFound = errors.New("transaction not found")
+
+var errTransactionExists = errors.New("transaction already registered")
+
+// Whether receipts are matched against registered transactions, which only happens once a merchant's API key exists
+var transactionMatching bool
+
+var totalPattern = regexp.MustCompile(`^\d+\.\d{2}$`)
+
+// The receipt total in cents, e.g. 3535 for "35.35".
+func totalCents(total string) (int64, bool) {
+	if !totalPattern.MatchString(total) {
+		return 0, false
+	}
+	cents, err := strconv.ParseInt(strings.Replace(total, ".", "", 1), 10, 64)
+	return cents, err == nil
+}
+
+/*
+Picks the transaction the receipt verifies from candidates of its merchant:
+same total, purchased within transactionTimeTolerance, at the same store
+when the transaction names one, and not verifying another receipt. The
+closest in time wins.
+*/
+func (match transactionMatch) best(candidates []merchantTransaction) (merchantTransaction, bool) {
+	var best merchantTransaction
+	bestGap := time.Duration(-1)
+	for _, candidate := range candidates {
+		gap := candidate.PurchasedAt.Sub(match.PurchasedAt).Abs()
+		switch {
+		case candidate.Merchant != match.Merchant, candidate.cents != match.Cents, gap > transactionTimeTolerance:
+		case candidate.StoreID != "" && !strings.EqualFold(candidate.StoreID, match.StoreID):
+		case candidate.ReceiptID != "" && candidate.ReceiptID != match.ReceiptID:
+		case bestGap < 0 || gap < bestGap:
+			best, bestGap = candidate, gap
+		}
+	}
+	return best, bestGap >= 0
+}
+
+// The match a parsed receipt makes, by its merchant's canonical id when enrichment found one, otherwise its retailer.
+func matchFor(receipt parsedReceipt, receiptID string) transactionMatch {
+	merchant := receipt.receipt.Retailer
+	if receipt.merchant != nil && receipt.merchant.CanonicalID != "" {
+		merchant = receipt.merchant.CanonicalID
+	}
+	match := transactionMatch{
+		Merchant:  merchantKey(merchant),
+		ReceiptID: receiptID,
+		Cents:     int64(math.Round(receipt.total * 100)),
+		PurchasedAt: time.Date(
+			receipt.purchaseDate.Year(), receipt.purchaseDate.Month(), receipt.purchaseDate.Day(),
+			receipt.purchaseTime.Hour(), receipt.purchaseTime.Minute(), 0, 0, time.UTC,
+		),
+	}
+	if receipt.receipt.Location != nil {
+		match.StoreID = receipt.receipt.Location.StoreID
+	}
+	return match
+}
+
+/*
+Claims the registered transaction the receipt verifies, if any, for the
+merchant-verified rule. A store failure only costs the receipt its
+verification, so it's logged rather than failing the receipt.
+*/
+func verifyPurchase(store Store, receipt parsedReceipt, receiptID string) *merchantVerification {
+	if !transactionMatching {
+		return nil
+	}
+	transaction, err := store.ClaimTransaction(matchFor(receipt, receiptID))
+	if errors.Is(err, errTransactionNotFound) {
+		return nil
+	}
+	if err != nil {
+		log.Printf("Failed to match receipt %s to a registered transaction: %v", receiptID, err)
+		return nil
+	}
+	return &merchantVerification{
+		Merchant:      transaction.Merchant,
+		TransactionID: transaction.TransactionID,
+		VerifiedAt:    wallClock.Now(),
+	}
+}
+
+/*
+Middleware letting through callers whose API key registers transactions
+for a merchant, and refusing everyone else.
+*/
+func requireMerchantKey(context *gin.Context) {
+	if value, exists := context.Get(apiKeyContextKey); exists && value.(apiKey).Merchant != "" {
+		context.Next()
+		return
+	}
+	abortWithMessage(context, http.StatusForbidden, "transaction.merchant_key_required")
+}
+
+// The merchant the caller's API key registers transactions for.
+func callerMerchant(context *gin.Context) string {
+	return merchantKey(context.MustGet(apiKeyContextKey).(apiKey).Merchant)
+}
+
+/*
+Registers a transaction from the merchant's point of sale, like
+{"transactionId": "pos-1234", "total": "35.35", "purchaseDate": "2022-01-01",
+"purchaseTime": "13:01", "storeId": "T-0042"}, with the purchase's local date
+and time as they're printed on the receipt. Registering an id again is
+refused with 409.
+*/
+func postTransaction(context *gin.Context) {
+	var request struct {
+		TransactionID string `json:"transactionId"`
+		Total         string `json:"total"`
+		Date          string `json:"purchaseDate"`
+		Time          string `json:"purchaseTime"`
+		StoreID       string `json:"storeId"`
+	}
+	if err := decodeJSON(context.Request.Body, &request, "transaction.bind_failed"); err != nil {
+		respondWithError(context, http.StatusBadRequest, err)
+		return
+	}
+
+	invalid := &validationError{}
+	request.TransactionID = strings.TrimSpace(request.TransactionID)
+	if request.TransactionID == "" || len(request.TransactionID) > maxTransactionIDLength {
+		invalid.add("transactionId", "transaction.id_invalid", maxTransactionIDLength)
+	}
+	cents, validTotal := totalCents(request.Total)
+	if !validTotal {
+		invalid.add("total", "transaction.total_invalid")
+	}
+	purchasedAt, err := time.Parse("2006-01-02 15:04", request.Date+" "+request.Time)
+	if err != nil {
+		invalid.add("purchaseDate", "transaction.purchased_invalid")
+	}
+	if err := invalid.orNil(); err != nil {
+		respondWithError(context, http.StatusBadRequest, err)
+		return
+	}
+
+	transaction := merchantTransaction{
+		Merchant:      callerMerchant(context),
+		TransactionID: request.TransactionID,
+		Total:         request.Total,
+		PurchasedAt:   purchasedAt,
+		StoreID:       strings.TrimSpace(request.StoreID),
+		RegisteredAt:  wallClock.Now(),
+		cents:         cents,
+	}
+	err = receipts.RegisterTransaction(transaction)
+	if errors.Is(err, errTransactionExists) {
+		respondWithMessage(context, http.StatusConflict, "transaction.exists", transaction.TransactionID)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to register transaction %s for %s: %v", transaction.TransactionID, transaction.Merchant, err)
+		respondWithMessage(context, http.StatusInternalServerError, "transaction.register_failed")
+		return
+	}
+	context.Header("Location", "/transactions/"+transaction.TransactionID)
+	context.IndentedJSON(http.StatusCreated, transaction)
+}
+
+// Shows one of the merchant's transactions, with the receipt verified against it once there is one.
+func getTransaction(context *gin.Context) {
+	transaction, err := receipts.Transaction(callerMerchant(context), context.Param("id"))
+	if errors.Is(err, errTransactionNotFound) {
+		respondWithMessage(context, http.StatusNotFound, "transaction.not_found")
+		return
+	}
+	if err != nil {
+		respondWithMessage(context, http.StatusInternalServerError, "transaction.lookup_failed")
+		return
+	}
+	context.IndentedJSON(http.StatusOK, transaction)
+}
+
+/*
+Awards Points to receipts verified against a transaction their retailer
+registered, which can't have been made up or altered.
+*/
+type merchantVerifiedRule struct {
+	Name   string `json:"name"`
+	Points int    `json:"points"`
+	Flag   string `json:"flag"`
+}
+
+func (bonus merchantVerifiedRule) rule() scoringRule {
+	return scoringRule{
+		Name:        bonus.Name,
+		Flag:        bonus.Flag,
+		Description: strconv.Itoa(bonus.Points) + " points for receipts their retailer verified",
+		bonus: func(receipt parsedReceipt, subtotal centipoints) (centipoints, string) {
+			if receipt.verification == nil {
+				return 0, ""
+			}
+			return wholePoints(bonus.Points), receipt.verification.TransactionID
+		},
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Limits on moving points between users, which exist for households sharing
+points and shouldn't become a way to pool points from many accounts.
+Zero turns a limit off.
+*/
+type TransferConfig struct {
+	// most points one transfer can move
+	MaxPoints int
+	// most points a user can send in any 24 hours
+	DailyLimit int
+	// most different users a user can send to in any 30 days
+	MaxRecipients int
+}
+
+// Windows the transfer limits are counted over.
+const (
+	transferDailyWindow     = 24 * time.Hour
+	transferRecipientWindow = 30 * 24 * time.Hour
+)
+
+const auditPointsTransferred = "points.transferred"
+
+/*
+Serializes transfers so each one's limit checks see the transfers before
+it. This only covers one replica; with several a user could briefly exceed
+the daily limit by sending through each at once.
+*/
+var transferMutex sync.Mutex
+
+/*
+Moves points from the user to another, e.g. within a household. Only the
+user themselves, as their token names them, can send their points, and the
+move is recorded as a pair of ledger entries naming each other, applied
+together or not at all.
+*/
+func postTransfer(config TransferConfig) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		sender := context.Param("id")
+		if context.GetString("subject") != sender {
+			respondWithMessage(context, http.StatusForbidden, "transfer.forbidden")
+			return
+		}
+		var request struct {
+			To     string `json:"to"`
+			Points int    `json:"points"`
+			Note   string `json:"note"`
+		}
+		if err := context.BindJSON(&request); err != nil {
+			respondWithMessage(context, http.StatusBadRequest, "transfer.bind_failed")
+			return
+		}
+		request.To = strings.TrimSpace(request.To)
+		if request.To == "" || request.To == sender {
+			respondWithMessage(context, http.StatusBadRequest, "transfer.recipient_invalid")
+			return
+		}
+		if request.Points < 1 || config.MaxPoints > 0 && request.Points > config.MaxPoints {
+			respondWithMessage(context, http.StatusBadRequest, "transfer.points_invalid", config.MaxPoints)
+			return
+		}
+
+		transferMutex.Lock()
+		defer transferMutex.Unlock()
+		if code, args, err := checkTransferLimits(receiptStore(context), config, sender, request.To, request.Points); err != nil {
+			respondWithMessage(context, http.StatusInternalServerError, "transfer.failed")
+			return
+		} else if code != "" {
+			respondWithMessage(context, http.StatusTooManyRequests, code, args...)
+			return
+		}
+
+		sent := newLedgerEntry(sender, ledgerTransferOut, -request.Points, "")
+		sent.Counterparty, sent.Reason = request.To, strings.TrimSpace(request.Note)
+		received := newLedgerEntry(request.To, ledgerTransferIn, request.Points, "")
+		received.Counterparty, received.Reason = sender, sent.Reason
+		applied, err := receiptStore(context).MovePoints(sent, received)
+		if errors.Is(err, errInsufficientPoints) {
+			respondWithMessage(context, http.StatusConflict, "transfer.insufficient_points")
+			return
+		}
+		if updateConflict(err) {
+			respondWithConflict(context, err)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to transfer points from %s to %s: %v", sender, request.To, err)
+			respondWithMessage(context, http.StatusInternalServerError, "transfer.failed")
+			return
+		}
+		recordAudit(context, auditEntry{
+			Action: auditPointsTransferred, UserID: sender, Points: -request.Points, Reason: "to " + request.To,
+		})
+
+		context.IndentedJSON(http.StatusCreated, gin.H{
+			"id":      applied[0].ID,
+			"from":    sender,
+			"to":      request.To,
+			"points":  request.Points,
+			"balance": applied[0].Balance,
+		})
+	}
+}
+
+/*
+Checks the transfer against the sender's recent transfers in the store,
+returning the message code (and its arguments) of the limit it would
+break, if any.
+*/
+func checkTransferLimits(
+	store Store, config TransferConfig, sender string, recipient string, points int,
+) (string, []any, error) {
+	now := wallClock.Now()
+	if config.DailyLimit > 0 {
+		recent, err := store.LedgerSince(sender, ledgerTransferOut, now.Add(-transferDailyWindow))
+		if err != nil {
+			return "", nil, err
+		}
+		sentToday := 0
+		for _, entry := range recent {
+			sentToday -= entry.Points
+		}
+		if sentToday+points > config.DailyLimit {
+			return "transfer.daily_limit", []any{config.DailyLimit}, nil
+		}
+	}
+
+	if config.MaxRecipients > 0 {
+		recent, err := store.LedgerSince(sender, ledgerTransferOut, now.Add(-transferRecipientWindow))
+		if err != nil {
+			return "", nil, err
+		}
+		recipients := map[string]bool{recipient: true}
+		for _, entry := range recent {
+			recipients[entry.Counterparty] = true
+		}
+		if len(recipients) > config.MaxRecipients {
+			return "transfer.recipient_limit", []any{config.MaxRecipients}, nil
+		}
+	}
+	return "", nil, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A router sending transfers as the caller a token would name, or nobody when subject is empty.
+func transferRouter(config TransferConfig, subject string) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/users/:id/transfers", func(context *gin.Context) {
+		if subject != "" {
+			context.Set("subject", subject)
+		}
+	}, requireSubject, postTransfer(config))
+	return router
+}
+
+func transfer(router *gin.Engine, from string, body string) int {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/users/"+from+"/transfers", strings.NewReader(body))
+	request.Header.Set("X-User-ID", from)
+	router.ServeHTTP(recorder, request)
+	return recorder.Code
+}
+
+func TestTransferNeedsTheSendersToken(t *testing.T) {
+	useTestGlobals(t)
+	receipts.SaveReceipt(storedReceipt{ID: "r1", UserID: "alice", Points: 100})
+
+	// X-User-ID alone doesn't show who's asking
+	if status := transfer(transferRouter(TransferConfig{}, ""), "alice", `{"to": "mallory", "points": 50}`); status != http.StatusUnauthorized {
+		t.Errorf("transfer without a token got %d, want 401", status)
+	}
+	if status := transfer(transferRouter(TransferConfig{}, "mallory"), "alice", `{"to": "mallory", "points": 50}`); status != http.StatusForbidden {
+		t.Errorf("transfer from someone else's account got %d, want 403", status)
+	}
+	if balance, _ := receipts.Balance("alice"); balance != 100 {
+		t.Errorf("alice has %d points after refused transfers, want 100", balance)
+	}
+}
+
+func TestTransferMovesPoints(t *testing.T) {
+	useTestGlobals(t)
+	receipts.SaveReceipt(storedReceipt{ID: "r1", UserID: "alice", Points: 100})
+	router := transferRouter(TransferConfig{}, "alice")
+
+	if status := transfer(router, "alice", `{"to": "bob", "points": 30, "note": "groceries"}`); status != http.StatusCreated {
+		t.Fatalf("transfer got %d, want 201", status)
+	}
+	for user, want := range map[string]int{"alice": 70, "bob": 30} {
+		if balance, _ := receipts.Balance(user); balance != want {
+			t.Errorf("%s has %d points, want %d", user, balance, want)
+		}
+	}
+	sent, _ := receipts.LedgerSince("alice", ledgerTransferOut, wallClock.Now().Add(-transferDailyWindow))
+	if len(sent) != 1 || sent[0].Counterparty != "bob" || sent[0].Reason != "groceries" {
+		t.Errorf("alice's transfer.out entries are %+v, want one to bob for groceries", sent)
+	}
+
+	if status := transfer(router, "alice", `{"to": "bob", "points": 71}`); status != http.StatusConflict {
+		t.Errorf("transfer beyond the balance got %d, want 409", status)
+	}
+	if balance, _ := receipts.Balance("alice"); balance != 70 {
+		t.Errorf("alice has %d points after an overdrawn transfer, want 70", balance)
+	}
+}
+
+func TestTransferLimits(t *testing.T) {
+	useTestGlobals(t)
+	receipts.SaveReceipt(storedReceipt{ID: "r1", UserID: "alice", Points: 1000})
+	router := transferRouter(TransferConfig{MaxPoints: 100, DailyLimit: 150, MaxRecipients: 2}, "alice")
+
+	steps := []struct {
+		body string
+		want int
+	}{
+		{`{"to": "alice", "points": 10}`, http.StatusBadRequest},
+		{`{"to": "bob", "points": 0}`, http.StatusBadRequest},
+		{`{"to": "bob", "points": 101}`, http.StatusBadRequest},
+		{`{"to": "bob", "points": 100}`, http.StatusCreated},
+		{`{"to": "carol", "points": 40}`, http.StatusCreated},
+		// a third recipient in 30 days
+		{`{"to": "dave", "points": 5}`, http.StatusTooManyRequests},
+		// 140 sent today already
+		{`{"to": "bob", "points": 20}`, http.StatusTooManyRequests},
+		{`{"to": "bob", "points": 10}`, http.StatusCreated},
+	}
+	for _, step := range steps {
+		if status := transfer(router, "alice", step.body); status != step.want {
+			t.Errorf("transfer %s got %d, want %d", step.body, status, step.want)
+		}
+	}
+	if balance, _ := receipts.Balance("alice"); balance != 850 {
+		t.Errorf("alice has %d points, want 850", balance)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Number of trashed receipts the admin trash view lists.
+const trashListLimit = 100
+
+// How often receipts past the trash retention are purged.
+const trashPurgeInterval = time.Hour
+
+/*
+Moves a receipt to the trash. It stays restorable until the retention
+window passes, after which it's purged for good.
+*/
+func deleteReceipt(retention time.Duration) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		record, err := receiptStore(context).DeleteReceipt(context.Param("id"), ownerScope(context))
+		if !trashMoveSucceeded(context, err) {
+			return
+		}
+		recordAudit(context, auditEntry{
+			Action: auditReceiptDeleted, ReceiptID: record.ID, UserID: record.UserID, Points: -record.Points,
+		})
+
+		context.IndentedJSON(
+			http.StatusOK,
+			gin.H{"id": record.ID, "deletedAt": record.DeletedAt, "restorableUntil": record.DeletedAt.Add(retention)},
+		)
+	}
+}
+
+// Takes a receipt back out of the trash.
+func restoreReceipt(context *gin.Context) {
+	record, err := receiptStore(context).RestoreReceipt(context.Param("id"), ownerScope(context))
+	if !trashMoveSucceeded(context, err) {
+		return
+	}
+	recordAudit(context, auditEntry{
+		Action: auditReceiptRestored, ReceiptID: record.ID, UserID: record.UserID, Points: record.Points,
+	})
+
+	context.IndentedJSON(
+		http.StatusOK,
+		gin.H{"id": record.ID, "points": record.Points, "links": receiptLinks(record.ID)},
+	)
+}
+
+/*
+The user whose receipts an authenticated caller may change, or "" for any
+receipt. Admins, and callers when authentication is off, may change any
+receipt, like processing.
+*/
+func ownerScope(context *gin.Context) string {
+	for _, role := range context.GetStringSlice(rolesContextKey) {
+		if role == roleAdmin {
+			return ""
+		}
+	}
+	return context.GetString("subject")
+}
+
+// Responds to a failed delete or restore, returning whether it succeeded.
+func trashMoveSucceeded(context *gin.Context, err error) bool {
+	if errors.Is(err, errReceiptNotFound) {
+		respondWithMessage(context, http.StatusNotFound, "receipt.not_found")
+		return false
+	}
+	if updateConflict(err) {
+		respondWithConflict(context, err)
+		return false
+	}
+	if err != nil {
+		log.Printf("Failed to move receipt %s: %v", context.Param("id"), err)
+		respondWithMessage(context, http.StatusInternalServerError, "receipt.save_failed")
+		return false
+	}
+	invalidatePoints(context.Param("id"))
+	return true
+}
+
+// Lists the receipts in the trash, most recently deleted first.
+func getTrash(context *gin.Context) {
+	trashed, err := receipts.TrashedReceipts(trashListLimit)
+	if err != nil {
+		respondWithMessage(context, http.StatusInternalServerError, "trash.lookup_failed")
+		return
+	}
+	if trashed == nil {
+		trashed = []storedReceipt{}
+	}
+	context.IndentedJSON(http.StatusOK, gin.H{"trashedReceipts": trashed})
+}
+
+// Permanently removes trashed receipts once they're older than retention.
+func scheduleTrashPurge(retention time.Duration) {
+	go func() {
+		for {
+			purged, err := receipts.PurgeTrash(wallClock.Now().Add(-retention))
+			if err != nil {
+				log.Printf("Failed to purge the trash: %v", err)
+			} else if purged > 0 {
+				log.Printf("Purged %d receipts from the trash", purged)
+			}
+			time.Sleep(trashPurgeInterval)
+		}
+	}()
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Key the request's receipt is stored under in the gin context, see bindReceipt.
+const receiptContextKey = "receipt"
+
+/*
+A problem with one field of a request, named by its JSON path, e.g.
+items[3].price, or "" when it's with the request as a whole.
+*/
+type fieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+
+	args []any
+}
+
+/*
+Everything wrong with a request's fields, so clients can point at all of it
+at once. It unwraps to the first problem as a clientError, so responses
+keep that problem's code and message alongside the full list.
+*/
+type validationError struct {
+	fields []fieldError
+}
+
+func (err *validationError) add(field string, code string, args ...any) {
+	err.fields = append(err.fields, fieldError{Field: field, Code: code, args: args})
+}
+
+// The problems found, or nil when there are none.
+func (err *validationError) orNil() error {
+	if len(err.fields) == 0 {
+		return nil
+	}
+	return err
+}
+
+func (err *validationError) Error() string {
+	return err.Unwrap().Error()
+}
+
+func (err *validationError) Unwrap() error {
+	return newClientError(err.fields[0].Code, err.fields[0].args...)
+}
+
+// The problems with their messages in the language.
+func (err *validationError) localize(language string) []fieldError {
+	fields := make([]fieldError, len(err.fields))
+	for index, field := range err.fields {
+		field.Message = translate(language, field.Code, field.args...)
+		fields[index] = field
+	}
+	return fields
+}
+
+// The error's field problems in the language, if it's a validationError.
+func localizeFieldErrors(language string, err error) []fieldError {
+	var invalid *validationError
+	if errors.As(err, &invalid) {
+		return invalid.localize(language)
+	}
+	return nil
+}
+
+/*
+Decodes JSON into target. A value of the wrong type is reported at its
+field, and anything else that isn't the JSON expected as the code.
+*/
+func decodeJSON(reader io.Reader, target any, code string) error {
+	err := json.NewDecoder(reader).Decode(target)
+	if err == nil {
+		return nil
+	}
+	// receipts' own decoding reports their unknown fields in strict mode
+	var invalid *validationError
+	if errors.As(err, &invalid) {
+		return err
+	}
+	invalid = &validationError{}
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &typeError) && typeError.Field != "" {
+		field := jsonPath(typeError.Field)
+		invalid.add(field, "request.field_type_invalid", field, jsonType(typeError.Type), typeError.Value)
+	} else {
+		invalid.add("", code)
+	}
+	return invalid
+}
+
+// Writes the decoder's field path, e.g. items.3.price, as items[3].price.
+func jsonPath(decoderPath string) string {
+	var path strings.Builder
+	for index, segment := range strings.Split(decoderPath, ".") {
+		if _, err := strconv.Atoi(segment); err == nil {
+			path.WriteString("[" + segment + "]")
+			continue
+		}
+		if index > 0 {
+			path.WriteString(".")
+		}
+		path.WriteString(segment)
+	}
+	return path.String()
+}
+
+// What JSON calls values of the Go type.
+func jsonType(goType reflect.Type) string {
+	switch goType.Kind() {
+	case reflect.Pointer:
+		return jsonType(goType.Elem())
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Struct, reflect.Map:
+		return "object"
+	}
+	return "number"
+}
+
+/*
+Checks every field of a receipt that scoring relies on, collecting all the
+problems rather than stopping at the first. Purchases are checked against
+now and the limits of the rules scoring the receipt, see purchaseLimits.
+*/
+func validateReceipt(receipt Receipt, now time.Time, limits purchaseLimits) error {
+	invalid := &validationError{}
+	if _, err := strconv.ParseFloat(receipt.Total, 64); err != nil {
+		invalid.add("total", "receipt.total_invalid")
+	}
+	date, dateError := time.Parse("2006-01-02", receipt.Date)
+	if outOfRange(dateError) {
+		invalid.add("purchaseDate", "receipt.date_impossible", receipt.Date)
+	} else if dateError != nil {
+		invalid.add("purchaseDate", "receipt.date_invalid")
+	}
+	clock, timeError := time.Parse("15:04", receipt.Time)
+	if outOfRange(timeError) {
+		invalid.add("purchaseTime", "receipt.time_impossible", receipt.Time)
+	} else if timeError != nil {
+		invalid.add("purchaseTime", "receipt.time_invalid")
+	}
+	if dateError == nil && timeError == nil {
+		limits.check(date, clock, now, invalid)
+	}
+	for index, item := range receipt.Items {
+		if _, err := strconv.ParseFloat(item.Price, 64); err != nil {
+			invalid.add(fmt.Sprintf("items[%d].price", index), "item.price_invalid", item.Description)
+		}
+	}
+	if receipt.Location != nil {
+		receipt.Location.validate(invalid)
+	}
+	validateTags(receipt.Tags, invalid)
+	requireMetadata(receipt, invalid)
+	return invalid.orNil()
+}
+
+/*
+Whether parsing failed on a date or time that's written right but isn't on
+the calendar or clock, e.g. 2023-02-30 or 24:00.
+*/
+func outOfRange(err error) bool {
+	var parseError *time.ParseError
+	return errors.As(err, &parseError) && strings.HasSuffix(parseError.Message, " out of range")
+}
+
+/*
+Adds a purchase outside the limits to invalid. The receipt's date and time
+are its local time, so they're compared to now in UTC give or take the
+future tolerance.
+*/
+func (limits purchaseLimits) check(date time.Time, clock time.Time, now time.Time, invalid *validationError) {
+	purchase := date.Add(time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute)
+	if purchase.After(now.UTC().Add(limits.futureTolerance)) {
+		invalid.add("purchaseDate", "receipt.date_future", date.Format("2006-01-02"))
+	}
+	if limits.MaxAgeDays > 0 && date.Before(now.UTC().AddDate(0, 0, -limits.MaxAgeDays-1)) {
+		invalid.add("purchaseDate", "receipt.date_too_old", limits.MaxAgeDays)
+	}
+}
+
+/*
+Middleware reading the request's receipt and checking all of it before the
+handler runs, which takes the receipt from boundReceipt. Problems are
+refused with 400, each listed by its JSON path.
+*/
+func bindReceipt(context *gin.Context) {
+	var receipt Receipt
+	err := decodeJSON(context.Request.Body, &receipt, "receipt.bind_failed")
+	if err == nil {
+		_, err = parseReceipt(receipt, processingFor(context).now(receipt), activeRules().limits)
+	}
+	if err != nil {
+		respondWithError(context, http.StatusBadRequest, err)
+		context.Abort()
+		return
+	}
+	context.Set(receiptContextKey, receipt)
+	context.Next()
+}
+
+// The receipt bindReceipt read from the request.
+func boundReceipt(context *gin.Context) Receipt {
+	return context.MustGet(receiptContextKey).(Receipt)
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Wallet pass formats POST /receipts/wallet accepts.
+const (
+	// an Apple Wallet .pkpass bundle, or the pass.json inside one
+	walletApple = "pkpass"
+	// a Google Wallet pass object
+	walletGoogle = "google"
+)
+
+// Largest wallet pass accepted; passes carry their images, but nothing like a scan.
+const maxWalletPassSize = 5 << 20
+
+/*
+The parts of an Apple or Google wallet pass that say what was bought.
+Issuer is the Apple pass type identifier or the Google issuer id; Fields
+has every field's value by its key, from all of a pass's field groups or
+text modules.
+*/
+type walletPass struct {
+	Format       string
+	Issuer       string
+	Organization string
+	// when the pass is relevant, which for a receipt is when the purchase was made
+	RelevantDate string
+	Fields       map[string]string
+}
+
+/*
+Maps one issuer's passes to receipts. Passes keep the purchase in fields
+whose keys each issuer picks, so Fields names them, each defaulting to the
+key in defaultWalletFields. Retailer stands in when the pass doesn't name
+it in a field.
+
+Passes' signatures aren't checked, so anyone can write a pass naming any
+issuer; only the issuers an adapter lists are accepted, rather than every
+pass anyone makes up.
+*/
+type walletAdapter struct {
+	Name     string       `json:"name"`
+	Issuers  []string     `json:"issuers"`
+	Retailer string       `json:"retailer"`
+	Fields   walletFields `json:"fields"`
+}
+
+/*
+Keys of the pass fields holding the purchase. Date is "2006-01-02" or a
+date and time like relevantDate's; without one the pass's relevantDate is
+the time of purchase. Items is a JSON array of items or a line per item
+ending in its price, like "Emils Cheese Pizza 12.25".
+*/
+type walletFields struct {
+	Retailer string `json:"retailer"`
+	Total    string `json:"total"`
+	Date     string `json:"date"`
+	Time     string `json:"time"`
+	Items    string `json:"items"`
+}
+
+var defaultWalletFields = walletFields{
+	Retailer: "retailer",
+	Total:    "total",
+	Date:     "purchaseDate",
+	Time:     "purchaseTime",
+	Items:    "items",
+}
+
+// Adapters passes are matched to by issuer
+var walletAdapters []walletAdapter
+
+/*
+Reads the issuers' adapters from a JSON file of walletAdapters, like
+[{"name": "target", "issuers": ["pass.com.target.receipt"], "retailer":
+"Target", "fields": {"total": "amount"}}]. Without a file no issuer's
+passes are accepted.
+*/
+func loadWalletAdapters(path string) ([]walletAdapter, error) {
+	if path == "" {
+		return nil, nil
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var adapters []walletAdapter
+	if err := json.Unmarshal(contents, &adapters); err != nil {
+		return nil, fmt.Errorf("failed to parse wallet adapters file %s: %w", path, err)
+	}
+	names := make(map[string]bool)
+	for index := range adapters {
+		adapter := &adapters[index]
+		if adapter.Name == "" || names[adapter.Name] {
+			return nil, fmt.Errorf("wallet adapter %d needs a unique name", index)
+		}
+		names[adapter.Name] = true
+		if len(adapter.Issuers) == 0 {
+			return nil, fmt.Errorf("wallet adapter %s needs the issuers it maps", adapter.Name)
+		}
+		adapter.Fields = adapter.Fields.withDefaults()
+	}
+	return adapters, nil
+}
+
+func (fields walletFields) withDefaults() walletFields {
+	if fields.Retailer == "" {
+		fields.Retailer = defaultWalletFields.Retailer
+	}
+	if fields.Total == "" {
+		fields.Total = defaultWalletFields.Total
+	}
+	if fields.Date == "" {
+		fields.Date = defaultWalletFields.Date
+	}
+	if fields.Time == "" {
+		fields.Time = defaultWalletFields.Time
+	}
+	if fields.Items == "" {
+		fields.Items = defaultWalletFields.Items
+	}
+	return fields
+}
+
+/*
+Scores a receipt forwarded from a digital wallet: a .pkpass bundle sent as
+application/vnd.apple.pkpass, or JSON with an Apple pass.json or a Google
+Wallet pass object. The pass is mapped to a receipt by its issuer's adapter,
+and the response says which, along with the receipt it mapped to. Passes
+of issuers without an adapter are refused.
+*/
+func scanWalletPass(context *gin.Context) {
+	body, err := io.ReadAll(http.MaxBytesReader(context.Writer, context.Request.Body, maxWalletPassSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		respondWithMessage(context, http.StatusRequestEntityTooLarge, "wallet.too_large", maxWalletPassSize)
+		return
+	}
+	if err != nil {
+		respondWithMessage(context, http.StatusBadRequest, "wallet.bind_failed")
+		return
+	}
+
+	var pass walletPass
+	switch contentType := context.ContentType(); contentType {
+	case "application/vnd.apple.pkpass", "application/zip":
+		pass, err = readPKPass(body)
+	case "application/json", "":
+		pass, err = readWalletJSON(body)
+	default:
+		respondWithMessage(context, http.StatusUnsupportedMediaType, "wallet.unsupported_type", contentType)
+		return
+	}
+	if err != nil {
+		respondWithError(context, http.StatusBadRequest, err)
+		return
+	}
+
+	adapter, known := adapterFor(pass)
+	if !known {
+		respondWithMessage(context, http.StatusUnprocessableEntity, "wallet.issuer_unknown", pass.Issuer)
+		return
+	}
+	receipt, err := adapter.receipt(pass)
+	if err != nil {
+		respondWithError(context, http.StatusBadRequest, err)
+		return
+	}
+
+	record, processError := processReceipt(processingFor(context), receipt, submittingUser(context), channelWallet)
+	if processError != nil {
+		respondWithProcessError(context, processError)
+		return
+	}
+	response := gin.H{
+		"id":      record.ID,
+		"format":  pass.Format,
+		"adapter": adapter.Name,
+		"receipt": receipt,
+		"points":  record.Points,
+		"links":   receiptLinks(record.ID),
+	}
+	if record.Status != "" {
+		response["status"] = record.Status
+	}
+	if capped := record.capsApplied(); capped != nil {
+		response["capped"] = capped
+	}
+	context.IndentedJSON(http.StatusCreated, response)
+}
+
+// The adapter for the pass's issuer, if it has one.
+func adapterFor(pass walletPass) (walletAdapter, bool) {
+	for _, adapter := range walletAdapters {
+		for _, issuer := range adapter.Issuers {
+			if issuer == pass.Issuer {
+				return adapter, true
+			}
+		}
+	}
+	return walletAdapter{}, false
+}
+
+// The pass.json inside a .pkpass bundle, which is a zip archive.
+func readPKPass(bundle []byte) (walletPass, error) {
+	archive, err := zip.NewReader(bytes.NewReader(bundle), int64(len(bundle)))
+	if err != nil {
+		return walletPass{}, newClientError("wallet.pkpass_invalid")
+	}
+	file, err := archive.Open("pass.json")
+	if err != nil {
+		return walletPass{}, newClientError("wallet.pkpass_invalid")
+	}
+	defer file.Close()
+	contents, err := io.ReadAll(io.LimitReader(file, maxWalletPassSize))
+	if err != nil {
+		return walletPass{}, newClientError("wallet.pkpass_invalid")
+	}
+	pass, recognized := parseApplePass(contents)
+	if !recognized {
+		return walletPass{}, newClientError("wallet.pkpass_invalid")
+	}
+	return pass, nil
+}
+
+// An Apple pass.json or a Google Wallet pass object, told apart by their identifying fields.
+func readWalletJSON(contents []byte) (walletPass, error) {
+	if !json.Valid(contents) {
+		return walletPass{}, newClientError("wallet.bind_failed")
+	}
+	if pass, recognized := parseApplePass(contents); recognized {
+		return pass, nil
+	}
+	if pass, recognized := parseGooglePass(contents); recognized {
+		return pass, nil
+	}
+	return walletPass{}, newClientError("wallet.format_unknown")
+}
+
+// A field of an Apple pass; values are strings, numbers or dates.
+type applePassField struct {
+	Key   string `json:"key"`
+	Value any    `json:"value"`
+}
+
+type applePassFields struct {
+	HeaderFields    []applePassField `json:"headerFields"`
+	PrimaryFields   []applePassField `json:"primaryFields"`
+	SecondaryFields []applePassField `json:"secondaryFields"`
+	AuxiliaryFields []applePassField `json:"auxiliaryFields"`
+	BackFields      []applePassField `json:"backFields"`
+}
+
+/*
+An Apple pass.json, whose fields are grouped under the key of its style.
+Receipts are usually store cards or generic passes, but any style is read.
+*/
+func parseApplePass(contents []byte) (walletPass, bool) {
+	var pass struct {
+		PassTypeIdentifier string `json:"passTypeIdentifier"`
+		OrganizationName   string `json:"organizationName"`
+		RelevantDate       string `json:"relevantDate"`
+
+		BoardingPass *applePassFields `json:"boardingPass"`
+		Coupon       *applePassFields `json:"coupon"`
+		EventTicket  *applePassFields `json:"eventTicket"`
+		Generic      *applePassFields `json:"generic"`
+		StoreCard    *applePassFields `json:"storeCard"`
+	}
+	if json.Unmarshal(contents, &pass) != nil || pass.PassTypeIdentifier == "" {
+		return walletPass{}, false
+	}
+	parsed := walletPass{
+		Format:       walletApple,
+		Issuer:       pass.PassTypeIdentifier,
+		Organization: pass.OrganizationName,
+		RelevantDate: pass.RelevantDate,
+		Fields:       make(map[string]string),
+	}
+	for _, style := range []*applePassFields{pass.BoardingPass, pass.Coupon, pass.EventTicket, pass.Generic, pass.StoreCard} {
+		if style == nil {
+			continue
+		}
+		for _, group := range [][]applePassField{
+			style.HeaderFields, style.PrimaryFields, style.SecondaryFields, style.AuxiliaryFields, style.BackFields,
+		} {
+			for _, field := range group {
+				parsed.Fields[field.Key] = walletFieldValue(field.Value)
+			}
+		}
+	}
+	return parsed, true
+}
+
+// A localized string of a Google Wallet pass, of which the default value is read.
+type googleLocalizedString struct {
+	DefaultValue struct {
+		Value string `json:"value"`
+	} `json:"defaultValue"`
+}
+
+/*
+A Google Wallet pass object. Its class id is "<issuer id>.<class>", and its
+text modules are its fields, by id. The card title, or the issuer name
+older pass types carry, names the organization.
+*/
+func parseGooglePass(contents []byte) (walletPass, bool) {
+	var pass struct {
+		ClassID         string                `json:"classId"`
+		IssuerName      string                `json:"issuerName"`
+		CardTitle       googleLocalizedString `json:"cardTitle"`
+		TextModulesData []struct {
+			ID   string `json:"id"`
+			Body string `json:"body"`
+		} `json:"textModulesData"`
+		ValidTimeInterval struct {
+			Start struct {
+				Date string `json:"date"`
+			} `json:"start"`
+		} `json:"validTimeInterval"`
+	}
+	if json.Unmarshal(contents, &pass) != nil || pass.ClassID == "" {
+		return walletPass{}, false
+	}
+	issuer, _, _ := strings.Cut(pass.ClassID, ".")
+	parsed := walletPass{
+		Format:       walletGoogle,
+		Issuer:       issuer,
+		Organization: pass.CardTitle.DefaultValue.Value,
+		RelevantDate: pass.ValidTimeInterval.Start.Date,
+		Fields:       make(map[string]string),
+	}
+	if parsed.Organization == "" {
+		parsed.Organization = pass.IssuerName
+	}
+	for _, module := range pass.TextModulesData {
+		parsed.Fields[module.ID] = module.Body
+	}
+	return parsed, true
+}
+
+// A field's value as text, with numbers like totals in full.
+func walletFieldValue(value any) string {
+	switch value := value.(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+/*
+The receipt the pass records. Totals lose any currency symbol and get two
+decimals; what the receipt still lacks is left to its validation.
+*/
+func (adapter walletAdapter) receipt(pass walletPass) (Receipt, error) {
+	receipt := Receipt{
+		Retailer: pass.Fields[adapter.Fields.Retailer],
+		Total:    walletAmount(pass.Fields[adapter.Fields.Total]),
+		Date:     pass.Fields[adapter.Fields.Date],
+		Time:     pass.Fields[adapter.Fields.Time],
+	}
+	if receipt.Retailer == "" {
+		receipt.Retailer = adapter.Retailer
+	}
+	if receipt.Retailer == "" {
+		receipt.Retailer = pass.Organization
+	}
+
+	// a date with its time, like relevantDate, stands for both
+	if purchased, parsed := walletTime(receipt.Date); parsed {
+		receipt.Date, receipt.Time = purchased.Format("2006-01-02"), purchased.Format("15:04")
+	} else if purchased, parsed := walletTime(pass.RelevantDate); parsed && receipt.Date == "" {
+		receipt.Date = purchased.Format("2006-01-02")
+		if receipt.Time == "" {
+			receipt.Time = purchased.Format("15:04")
+		}
+	}
+
+	items, err := walletItems(pass.Fields[adapter.Fields.Items])
+	if err != nil {
+		return Receipt{}, err
+	}
+	receipt.Items = items
+	return receipt, nil
+}
+
+/*
+A time of purchase as passes write it, in the local time it's written in,
+which is the time the receipt would print. Apple's relevantDate may leave
+out the seconds.
+*/
+func walletTime(value string) (time.Time, bool) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04Z07:00", "2006-01-02T15:04:05", "2006-01-02T15:04"} {
+		if purchased, err := time.Parse(layout, value); err == nil {
+			return purchased, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// An amount like "$35.35" or "35.3 USD" as a receipt total, "35.35".
+func walletAmount(value string) string {
+	amount := strings.Trim(strings.TrimSpace(value), "$€£¥ ")
+	amount, _, _ = strings.Cut(amount, " ")
+	parsed, err := strconv.ParseFloat(amount, 64)
+	if err != nil {
+		return value
+	}
+	return strconv.FormatFloat(parsed, 'f', 2, 64)
+}
+
+/*
+The items on a pass: a JSON array of items, or a line per item whose last
+word is its price, like "Emils Cheese Pizza $12.25". Blank lines are skipped.
+*/
+func walletItems(value string) ([]Item, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(value, "[") {
+		var items []Item
+		if err := json.Unmarshal([]byte(value), &items); err != nil {
+			return nil, newClientError("wallet.items_invalid", value)
+		}
+		return items, nil
+	}
+	var items []Item
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		separator := strings.LastIndexAny(line, " \t")
+		if separator < 0 {
+			return nil, newClientError("wallet.items_invalid", line)
+		}
+		items = append(items, Item{
+			Description: strings.TrimSpace(line[:separator]),
+			Price:       walletAmount(line[separator+1:]),
+		})
+	}
+	return items, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestScanWalletPassIssuers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useTestGlobals(t)
+	previous := walletAdapters
+	t.Cleanup(func() { walletAdapters = previous })
+	walletAdapters = []walletAdapter{
+		{Name: "target", Issuers: []string{"pass.com.target.receipt", "3388000000022222222"}, Retailer: "Target", Fields: defaultWalletFields},
+	}
+	router := gin.New()
+	router.POST("/receipts/wallet", scanWalletPass)
+
+	items := `Mountain Dew 12PK 6.49\nEmils Cheese Pizza 12.25`
+	applePass := func(issuer string) string {
+		return `{"passTypeIdentifier": "` + issuer + `", "storeCard": {"primaryFields": [
+			{"key": "total", "value": "$18.74"}, {"key": "purchaseDate", "value": "2022-01-01"},
+			{"key": "purchaseTime", "value": "13:01"}, {"key": "items", "value": "` + items + `"}]}}`
+	}
+	googlePass := func(classID string) string {
+		return `{"classId": "` + classID + `", "textModulesData": [
+			{"id": "total", "body": "18.74"}, {"id": "purchaseDate", "body": "2022-01-01"},
+			{"id": "purchaseTime", "body": "13:01"}, {"id": "items", "body": "` + items + `"}]}`
+	}
+	tests := []struct {
+		name        string
+		pass        string
+		wantStatus  int
+		wantAdapter string
+	}{
+		{"apple pass of a known issuer", applePass("pass.com.target.receipt"), http.StatusCreated, "target"},
+		{"google pass of a known issuer", googlePass("3388000000022222222.receipt"), http.StatusCreated, "target"},
+		{"apple pass of another issuer", applePass("pass.com.example.forged"), http.StatusUnprocessableEntity, ""},
+		{"google pass of another issuer", googlePass("1234.receipt"), http.StatusUnprocessableEntity, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/receipts/wallet", strings.NewReader(test.pass))
+			request.Header.Set("Content-Type", "application/json")
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+			if recorder.Code != test.wantStatus {
+				t.Fatalf("got %d: %s, want %d", recorder.Code, recorder.Body, test.wantStatus)
+			}
+			var response struct {
+				Adapter string `json:"adapter"`
+			}
+			json.Unmarshal(recorder.Body.Bytes(), &response)
+			if response.Adapter != test.wantAdapter {
+				t.Errorf("mapped by adapter %q, want %q", response.Adapter, test.wantAdapter)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+/*
+A message from a WebSocket client. "submit" scores the attached receipt and
+answers with its points; "subscribe" starts pushing point updates for a
+user; "unsubscribe" stops them. With a signature secret configured, submits
+carry their own signature over the receipt as sent.
+*/
+type socketRequest struct {
+	Type      string          `json:"type"`
+	RequestID string          `json:"requestId,omitempty"`
+	Receipt   json.RawMessage `json:"receipt,omitempty"`
+	UserID    string          `json:"userId,omitempty"`
+	Signature string          `json:"signature,omitempty"`
+	Timestamp string          `json:"timestamp,omitempty"`
+	Nonce     string          `json:"nonce,omitempty"`
+}
+
+// What a submit message's signature is made for, in place of a request's method.
+const socketSignedMethod = "SUBMIT"
+
+type socketResponse struct {
+	Type      string `json:"type"`
+	RequestID string `json:"requestId,omitempty"`
+	ID        string `json:"id,omitempty"`
+	UserID    string `json:"userId,omitempty"`
+	Points    int    `json:"points,omitempty"`
+	Balance   int    `json:"balance,omitempty"`
+	Status    string `json:"status,omitempty"`
+	Review    string `json:"review,omitempty"`
+	Message   string `json:"message,omitempty"`
+	Code      string `json:"code,omitempty"`
+}
+
+/*
+Lets interactive clients submit receipts and subscribe to a user's point
+updates over a single connection instead of polling. Authenticated callers
+act as, and can only subscribe to, their own user. Each receipt submitted
+is checked like one POSTed to /receipts/process: its signature, when
+signatures is set, and the caller's API key quotas. Browsers only open
+sockets from this site or the origins CORS allows, see socketOriginAllowed.
+*/
+func serveWebSocket(signatures *signatureCheck, quotas *quotaMeter, allowedOrigins []string) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		caller := submittingUser(context)
+		authenticated := context.GetString("subject") != ""
+		language := requestLanguage(context)
+
+		handshake := func(config *websocket.Config, request *http.Request) error {
+			if !socketOriginAllowed(allowedOrigins, request) {
+				return errSocketOrigin
+			}
+			return nil
+		}
+		server := websocket.Server{Handshake: handshake, Handler: func(connection *websocket.Conn) {
+			defer connection.Close()
+
+			var sendMutex sync.Mutex
+			send := func(response socketResponse) {
+				sendMutex.Lock()
+				defer sendMutex.Unlock()
+				websocket.JSON.Send(connection, response)
+			}
+			sendError := func(requestID string, code string, args ...any) {
+				send(socketResponse{
+					Type:      "error",
+					RequestID: requestID,
+					Message:   translate(language, code, args...),
+					Code:      code,
+				})
+			}
+			sendFailure := func(requestID string, err error) {
+				message, code := localizeError(language, err)
+				send(socketResponse{Type: "error", RequestID: requestID, Message: message, Code: code})
+			}
+
+			var subscription chan receiptEvent
+			stopSubscription := func() {
+				if subscription != nil {
+					receiptEvents.unsubscribe(subscription)
+					close(subscription)
+					subscription = nil
+				}
+			}
+			defer stopSubscription()
+
+			for {
+				var request socketRequest
+				if err := websocket.JSON.Receive(connection, &request); err != nil {
+					return
+				}
+
+				switch request.Type {
+				case "submit":
+					if signatures != nil {
+						if request.Signature == "" || request.Timestamp == "" {
+							sendError(request.RequestID, "signature.missing")
+							continue
+						}
+						if code := signatures.timestampError(request.Timestamp); code != "" {
+							sendError(request.RequestID, code)
+							continue
+						}
+						status, code := signatures.verify(
+							socketSignedMethod, context.Request.URL.Path,
+							request.Signature, request.Timestamp, request.Nonce, request.Receipt,
+						)
+						if status != 0 {
+							sendError(request.RequestID, code)
+							continue
+						}
+					}
+					var receipt Receipt
+					if err := json.Unmarshal(request.Receipt, &receipt); err != nil {
+						var invalid *validationError
+						if !errors.As(err, &invalid) {
+							err = newClientError("receipt.bind_failed")
+						}
+						sendFailure(request.RequestID, err)
+						continue
+					}
+
+					refund, err := quotas.chargeReceipt(context)
+					if err != nil {
+						sendFailure(request.RequestID, err)
+						continue
+					}
+					record, err := processReceipt(processingFor(context), receipt, caller, channelAPI)
+					if err != nil {
+						refund()
+						sendFailure(request.RequestID, err)
+						continue
+					}
+					send(socketResponse{
+						Type:      "points",
+						RequestID: request.RequestID,
+						ID:        record.ID,
+						UserID:    record.UserID,
+						Points:    record.Points,
+						Status:    record.Status,
+					})
+
+				case "subscribe":
+					userID := request.UserID
+					if authenticated || userID == "" {
+						userID = caller
+					}
+					if userID == "" {
+						sendError(request.RequestID, "websocket.user_required")
+						continue
+					}
+					balance, err := receiptStore(context).Balance(userID)
+					if err != nil {
+						sendError(request.RequestID, "websocket.balance_failed")
+						continue
+					}
+					stopSubscription()
+					subscription = receiptEvents.subscribe()
+					go forwardUserEvents(subscription, userID, send)
+					send(socketResponse{
+						Type:      "subscribed",
+						RequestID: request.RequestID,
+						UserID:    userID,
+						Balance:   balance,
+					})
+
+				case "unsubscribe":
+					stopSubscription()
+					send(socketResponse{Type: "unsubscribed", RequestID: request.RequestID})
+
+				default:
+					sendError(request.RequestID, "websocket.unknown_type", request.Type)
+				}
+			}
+		}}
+		server.ServeHTTP(context.Writer, context.Request)
+	}
+}
+
+var errSocketOrigin = errors.New("origin isn't allowed to open sockets")
+
+/*
+Whether a socket may be opened from the page at the request's Origin: one
+on this host, or one the CORS origins allow. Browsers send cookies with
+sockets to any site, and don't check CORS for them, so otherwise any page
+could open one as its visitor. Clients other than browsers send no Origin.
+*/
+func socketOriginAllowed(allowedOrigins []string, request *http.Request) bool {
+	origin := request.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	parsed, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(parsed.Host, request.Host) || originAllowed(allowedOrigins, origin)
+}
+
+// Sends the user's receipt events to the client until the subscription is closed.
+func forwardUserEvents(events chan receiptEvent, userID string, send func(socketResponse)) {
+	for event := range events {
+		if event.UserID != userID {
+			continue
+		}
+		send(socketResponse{
+			Type:    "update",
+			ID:      event.ID,
+			UserID:  event.UserID,
+			Points:  event.Points,
+			Balance: event.Balance,
+			Review:  event.Review,
+		})
+	}
+}
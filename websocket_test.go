@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+func TestWebSocketOrigins(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useTestGlobals(t)
+	router := gin.New()
+	router.GET("/receipts/ws", serveWebSocket(nil, nil, []string{"https://app.example.com"}))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	socketURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/receipts/ws"
+
+	tests := []struct {
+		name      string
+		origin    string
+		wantOpens bool
+	}{
+		{"the API's own host", server.URL, true},
+		{"an allowed origin", "https://app.example.com", true},
+		{"another site", "https://evil.example.com", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			connection, err := websocket.Dial(socketURL, "", test.origin)
+			if opened := err == nil; opened != test.wantOpens {
+				t.Fatalf("Dial() from %s = %v, want open %v", test.origin, err, test.wantOpens)
+			}
+			if err != nil {
+				return
+			}
+			defer connection.Close()
+			if err := websocket.JSON.Send(connection, socketRequest{Type: "unsubscribe"}); err != nil {
+				t.Fatalf("Send() failed: %v", err)
+			}
+			var response socketResponse
+			if err := websocket.JSON.Receive(connection, &response); err != nil || response.Type != "unsubscribed" {
+				t.Errorf("Receive() = %+v, %v, want unsubscribed", response, err)
+			}
+		})
+	}
+}